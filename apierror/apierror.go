@@ -0,0 +1,291 @@
+// Package apierror defines the errors that the handlers of the registry's
+// APIs return, and writes the corresponding responses in the same format as
+// the public Terraform Registry, so that clients can report them
+// consistently.
+//
+// Each error has a Kind, which decides its status code, whether and at what
+// level it is logged, and the label under which it is counted.
+package apierror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// Kind classifies an error. Its string value is the label under which
+// responses for errors of that kind are counted.
+type Kind string
+
+const (
+	// KindNotFound is for requests about modules, providers or versions
+	// that don't exist.
+	KindNotFound Kind = "not_found"
+
+	// KindGone is for requests about modules that have been deleted or
+	// versions that have been yanked.
+	KindGone Kind = "gone"
+
+	// KindBadRequest is for requests that are malformed in any way other
+	// than those covered by KindInvalidVersion.
+	KindBadRequest Kind = "bad_request"
+
+	// KindInvalidVersion is for requests containing something that should
+	// be a version number or constraint but isn't.
+	KindInvalidVersion Kind = "invalid_version"
+
+	// KindConflict is for requests that would change something in a way
+	// that conflicts with its current state, such as publishing a version
+	// that already exists.
+	KindConflict Kind = "conflict"
+
+	// KindUnauthorized is for requests that aren't allowed by the configured
+	// authentication.
+	KindUnauthorized Kind = "unauthorized"
+
+	// KindForbidden is for requests from clients that the listener they
+	// came to doesn't serve.
+	KindForbidden Kind = "forbidden"
+
+	// KindTooManyRequests is for requests from clients that have exceeded
+	// the configured rate limit.
+	KindTooManyRequests Kind = "too_many_requests"
+
+	// KindNotImplemented is for requests that the configuration of the
+	// server doesn't allow it to handle, such as comparing the versions of a
+	// module whose source has no history.
+	KindNotImplemented Kind = "not_implemented"
+
+	// KindBackendUnavailable is for failures of the git repositories,
+	// directories, buckets or plugins that the server depends on, which may
+	// well be temporary.
+	KindBackendUnavailable Kind = "backend_unavailable"
+
+	// KindInternal is for failures of the server itself.
+	KindInternal Kind = "internal"
+)
+
+var kinds = map[Kind]struct {
+	status int
+	level  logging.Level
+}{
+	KindNotFound:           {http.StatusNotFound, logging.Info},
+	KindGone:               {http.StatusGone, logging.Info},
+	KindBadRequest:         {http.StatusBadRequest, logging.Info},
+	KindInvalidVersion:     {http.StatusBadRequest, logging.Info},
+	KindConflict:           {http.StatusConflict, logging.Info},
+	KindUnauthorized:       {http.StatusUnauthorized, logging.Info},
+	KindForbidden:          {http.StatusForbidden, logging.Info},
+	KindTooManyRequests:    {http.StatusTooManyRequests, logging.Info},
+	KindNotImplemented:     {http.StatusNotImplemented, logging.Warn},
+	KindBackendUnavailable: {http.StatusServiceUnavailable, logging.Error},
+	KindInternal:           {http.StatusInternalServerError, logging.Error},
+}
+
+// Status returns the HTTP status code of responses for errors of the
+// receiving kind.
+func (k Kind) Status() int {
+	if info, ok := kinds[k]; ok {
+		return info.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is an error that a handler can return to produce an error response.
+type Error struct {
+	Kind Kind
+
+	// Message is the message included in the response body. If it is empty,
+	// the standard text for the status code is used instead.
+	Message string
+
+	// Detail describes what failed for the log, and Cause is the underlying
+	// error, if any. Neither is ever sent to the client, and an error
+	// without a Detail isn't logged at all, since it represents an ordinary
+	// response rather than something an operator might want to know about.
+	Detail string
+	Cause  error
+}
+
+// New returns an error of the given kind, logged with a detail formatted
+// from the given format and arguments, followed by the given cause if it
+// isn't nil.
+func New(kind Kind, cause error, format string, args ...interface{}) *Error {
+	return &Error{
+		Kind:   kind,
+		Detail: fmt.Sprintf(format, args...),
+		Cause:  cause,
+	}
+}
+
+// NotFound returns an error for a request about something that doesn't
+// exist.
+func NotFound() *Error {
+	return &Error{Kind: KindNotFound}
+}
+
+// Gone returns an error for a request about something that has been
+// withdrawn.
+func Gone() *Error {
+	return &Error{Kind: KindGone}
+}
+
+// BadRequest returns an error for a malformed request, with the given
+// message for the client.
+func BadRequest(message string) *Error {
+	return &Error{Kind: KindBadRequest, Message: message}
+}
+
+// InvalidVersion returns an error for a request with an invalid version, or
+// version constraint, with the given message for the client.
+func InvalidVersion(message string) *Error {
+	return &Error{Kind: KindInvalidVersion, Message: message}
+}
+
+// Conflict returns an error for a request that conflicts with the current
+// state of what it would change, with the given message for the client.
+func Conflict(message string) *Error {
+	return &Error{Kind: KindConflict, Message: message}
+}
+
+// Unauthorized returns an error for a request that isn't allowed.
+func Unauthorized() *Error {
+	return &Error{Kind: KindUnauthorized}
+}
+
+// Forbidden returns an error for a request from a client that isn't
+// allowed to make any.
+func Forbidden() *Error {
+	return &Error{Kind: KindForbidden}
+}
+
+// TooManyRequests returns an error for a request from a client that has
+// made too many recently.
+func TooManyRequests() *Error {
+	return &Error{Kind: KindTooManyRequests}
+}
+
+// NotImplemented returns an error for a request that the server can't
+// handle, with the given message for the client.
+func NotImplemented(message string) *Error {
+	return &Error{Kind: KindNotImplemented, Message: message}
+}
+
+// BackendUnavailable returns an error for a failure of a backend, as
+// described by New.
+func BackendUnavailable(cause error, format string, args ...interface{}) *Error {
+	return New(KindBackendUnavailable, cause, format, args...)
+}
+
+// Internal returns an error for a failure of the server itself, as
+// described by New.
+func Internal(cause error, format string, args ...interface{}) *Error {
+	return New(KindInternal, cause, format, args...)
+}
+
+func (e *Error) Error() string {
+	msg := e.Detail
+	if msg == "" {
+		msg = e.message()
+	}
+	if e.Cause != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.Cause)
+	}
+	return msg
+}
+
+func (e *Error) message() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.Kind.Status())
+}
+
+var counts = struct {
+	sync.Mutex
+	m map[Kind]int
+}{m: make(map[Kind]int)}
+
+// Report logs the given error at the level of its kind, if it has a detail,
+// and counts it, without writing a response. This is for errors that occur
+// too late to change the response, such as while writing its body. The log
+// line includes the ID of the given request, if it has one.
+//
+// Any error that isn't an *Error is treated as an internal error.
+func Report(req *http.Request, err error) *Error {
+	e, ok := err.(*Error)
+	if !ok {
+		e = Internal(err, "unexpected error")
+	}
+
+	counts.Lock()
+	counts.m[e.Kind]++
+	counts.Unlock()
+
+	if e.Detail != "" {
+		level := logging.Error
+		if info, ok := kinds[e.Kind]; ok {
+			level = info.level
+		}
+		if id := requestid.Get(req); id != "" {
+			logging.Logf(level, "%s request_id=%s", e, id)
+		} else {
+			logging.Logf(level, "%s", e)
+		}
+	}
+	return e
+}
+
+// Write reports the given error as Report does, and then responds with the
+// status code of its kind and a JSON body giving its message and the ID of
+// the given request, as in {"errors": ["Not Found"], "request_id": "..."}.
+func Write(wr http.ResponseWriter, req *http.Request, err error) {
+	e := Report(req, err)
+	buf, _ := json.MarshalIndent(&errorResponse{
+		Errors:    []string{e.message()},
+		RequestID: requestid.Get(req),
+	}, "", "  ")
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(e.Kind.Status())
+	wr.Write(buf)
+}
+
+// Handler adapts the given function into a handler function that writes the
+// error response for any error the function returns. The function must not
+// return an error once it has begun writing its response.
+func Handler(fn func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		if err := fn(wr, req); err != nil {
+			Write(wr, req, err)
+		}
+	}
+}
+
+// NotFoundHandler responds to any request with 404 Not Found, for routers
+// to use for requests that match none of their routes.
+var NotFoundHandler http.Handler = http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+	Write(wr, req, NotFound())
+})
+
+// Counts returns the number of errors of each kind that have been reported
+// so far, keyed by the labels of the kinds.
+func Counts() map[string]int {
+	counts.Lock()
+	defer counts.Unlock()
+
+	ret := make(map[string]int, len(kinds))
+	for kind := range kinds {
+		ret[string(kind)] = counts.m[kind]
+	}
+	return ret
+}
+
+type errorResponse struct {
+	Errors    []string `json:"errors"`
+	RequestID string   `json:"request_id,omitempty"`
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+)
+
+// Authenticator is implemented by each of the ways of deciding whether a
+// request to the registry is allowed.
+//
+// Tokens is the built-in implementation. Organizations with their own
+// authentication systems can either run an external program using Plugin,
+// or build their own server binary around their own implementation.
+type Authenticator interface {
+	// Authenticate returns the decision for the given request. An error
+	// means that no decision could be made, and so the request is failed
+	// rather than rejected.
+	Authenticate(req *Request) (*Result, error)
+}
+
+// Request is the metadata about an HTTP request that is given to an
+// Authenticator.
+type Request struct {
+	Method     string              `json:"method"`
+	Host       string              `json:"host"`
+	Path       string              `json:"path"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+
+	// Token is the bearer token from the Authorization header, or an empty
+	// string if there is none.
+	Token string `json:"token"`
+}
+
+// Result is the decision of an Authenticator.
+type Result struct {
+	Allow bool `json:"allow"`
+
+	// Identity optionally names the user or system that made an allowed
+	// request, which is then available to the handler from Identity.
+	Identity string `json:"identity,omitempty"`
+}
+
+// NewRequest returns the metadata about the given HTTP request.
+func NewRequest(req *http.Request) *Request {
+	return &Request{
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		RemoteAddr: req.RemoteAddr,
+		Headers:    req.Header,
+		Token:      BearerToken(req),
+	}
+}
+
+// Any is an Authenticator that allows a request if any of its elements
+// allow it, trying each in turn.
+type Any []Authenticator
+
+// Authenticate implements Authenticator.
+func (a Any) Authenticate(req *Request) (*Result, error) {
+	for _, authn := range a {
+		result, err := authn.Authenticate(req)
+		if err != nil || result.Allow {
+			return result, err
+		}
+	}
+	return &Result{}, nil
+}
+
+// Wrap returns a function that wraps handler functions so that they respond
+// with 401 Unauthorized unless the given authenticator allows the request,
+// or with 503 Service Unavailable if it fails.
+func Wrap(authn Authenticator) func(http.HandlerFunc) http.HandlerFunc {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(wr http.ResponseWriter, req *http.Request) {
+			result, err := authn.Authenticate(NewRequest(req))
+			if err != nil {
+				apierror.Write(wr, req, apierror.BackendUnavailable(err, "failed to authenticate request for %s", req.URL.Path))
+				return
+			}
+			if !result.Allow {
+				wr.Header().Set("WWW-Authenticate", "Bearer")
+				apierror.Write(wr, req, apierror.Unauthorized())
+				return
+			}
+			if result.Identity != "" {
+				req = req.WithContext(context.WithValue(req.Context(), identityKey{}, result.Identity))
+			}
+			fn(wr, req)
+		}
+	}
+}
+
+type identityKey struct{}
+
+// Identity returns the identity given by the authenticator that allowed
+// the given request, or an empty string if there is none.
+func Identity(req *http.Request) string {
+	identity, _ := req.Context().Value(identityKey{}).(string)
+	return identity
+}
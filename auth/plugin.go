@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Plugin is an Authenticator that runs an external program for each
+// request, so that bespoke authentication systems can be integrated without
+// changing the server itself.
+//
+// The program is given the Request as JSON on its standard input, and must
+// write a Result as JSON to its standard output and then exit successfully.
+// Anything it writes to its standard error is passed through to that of the
+// server, for logging.
+type Plugin struct {
+	command  []string
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*pluginCacheEntry
+}
+
+type pluginCacheEntry struct {
+	result  *Result
+	expires time.Time
+}
+
+var _ Authenticator = (*Plugin)(nil)
+
+// NewPlugin creates an authenticator that runs the given command, killing
+// it if it hasn't finished within the given timeout. If timeout is zero,
+// the command may run for as long as it likes.
+//
+// If cacheTTL is not zero then each result is reused for that long for
+// requests with the same method, host, path and token. Other metadata is
+// not considered, so a plugin whose decisions depend on anything else must
+// not be cached.
+func NewPlugin(command []string, timeout, cacheTTL time.Duration) *Plugin {
+	return &Plugin{
+		command:  command,
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+		cache:    make(map[[sha256.Size]byte]*pluginCacheEntry),
+	}
+}
+
+// Authenticate implements Authenticator.
+func (p *Plugin) Authenticate(req *Request) (*Result, error) {
+	if p.cacheTTL == 0 {
+		return p.run(req)
+	}
+
+	// The key is a hash so that the cache doesn't retain tokens.
+	key := sha256.Sum256([]byte(req.Method + "\x00" + req.Host + "\x00" + req.Path + "\x00" + req.Token))
+	now := time.Now()
+	p.mu.Lock()
+	entry := p.cache[key]
+	p.mu.Unlock()
+	if entry != nil && now.Before(entry.expires) {
+		return entry.result, nil
+	}
+
+	result, err := p.run(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, e := range p.cache {
+		if !now.Before(e.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = &pluginCacheEntry{
+		result:  result,
+		expires: now.Add(p.cacheTTL),
+	}
+	return result, nil
+}
+
+func (p *Plugin) run(req *Request) (*Result, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("auth plugin %s timed out after %s", p.command[0], p.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth plugin %s failed: %s", p.command[0], err)
+	}
+
+	var result Result
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("invalid result from auth plugin %s: %s", p.command[0], err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,146 @@
+// Package auth implements authentication of requests to the registry
+// servers, using either bearer tokens or an external plugin program.
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// Tokens is a set of valid bearer tokens, given either directly or in a
+// token file that is re-read whenever its modification time changes.
+//
+// Tokens are stored only as SHA256 hashes, so that looking them up does not
+// reveal anything about valid tokens through timing.
+type Tokens struct {
+	static map[[sha256.Size]byte]struct{}
+	file   string
+
+	mu         sync.Mutex
+	fromFile   map[[sha256.Size]byte]struct{}
+	fileMod    time.Time
+	fileLoaded bool
+}
+
+// NewTokens creates a token set containing the given static tokens and,
+// if filename is not empty, the tokens in the given file.
+//
+// The file contains one token per line. Anything following a "#" on a line
+// is a comment, and blank lines are ignored.
+func NewTokens(static []string, filename string) *Tokens {
+	ret := &Tokens{
+		static: make(map[[sha256.Size]byte]struct{}),
+		file:   filename,
+	}
+	for _, token := range static {
+		ret.static[sha256.Sum256([]byte(token))] = struct{}{}
+	}
+	return ret
+}
+
+// Valid returns true if the given token is in the set.
+func (t *Tokens) Valid(token string) bool {
+	if token == "" {
+		return false
+	}
+	key := sha256.Sum256([]byte(token))
+	if _, ok := t.static[key]; ok {
+		return true
+	}
+	if t.file == "" {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reloadFile()
+	_, ok := t.fromFile[key]
+	return ok
+}
+
+var _ Authenticator = (*Tokens)(nil)
+
+// Authenticate implements Authenticator, allowing any request that has a
+// valid bearer token.
+func (t *Tokens) Authenticate(req *Request) (*Result, error) {
+	return &Result{
+		Allow: t.Valid(req.Token),
+	}, nil
+}
+
+// Wrap returns a handler function that responds with 401 Unauthorized
+// unless the request has an Authorization header with a valid bearer
+// token, and otherwise calls the given function.
+func (t *Tokens) Wrap(fn http.HandlerFunc) http.HandlerFunc {
+	return Wrap(t)(fn)
+}
+
+// BearerToken returns the bearer token from the Authorization header of
+// the given request, or an empty string if there is none.
+func BearerToken(req *http.Request) string {
+	const prefix = "bearer "
+	header := req.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// reloadFile re-reads the token file if it has changed since it was last
+// read. The caller must hold t.mu.
+//
+// If the file cannot be read, the previously-loaded tokens remain in effect.
+func (t *Tokens) reloadFile() {
+	info, err := os.Stat(t.file)
+	if err != nil {
+		if !t.fileLoaded || !os.IsNotExist(err) {
+			logging.Errorf("failed to read token file %s: %s", t.file, err)
+		}
+		if os.IsNotExist(err) {
+			// A missing file just means no tokens have been issued yet,
+			// or that they have all been revoked.
+			t.fromFile = nil
+			t.fileLoaded = true
+		}
+		return
+	}
+	if t.fileLoaded && info.ModTime().Equal(t.fileMod) {
+		return
+	}
+
+	f, err := os.Open(t.file)
+	if err != nil {
+		logging.Errorf("failed to read token file %s: %s", t.file, err)
+		return
+	}
+	defer f.Close()
+
+	tokens := make(map[[sha256.Size]byte]struct{})
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		tokens[sha256.Sum256([]byte(line))] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		logging.Errorf("failed to read token file %s: %s", t.file, err)
+		return
+	}
+
+	t.fromFile = tokens
+	t.fileMod = info.ModTime()
+	t.fileLoaded = true
+}
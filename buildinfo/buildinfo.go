@@ -0,0 +1,104 @@
+// Package buildinfo describes the build of the registry's servers, so that
+// operators can confirm which build is deployed.
+//
+// Release builds set the variables in this package with the linker, as in:
+//
+//	go build -ldflags "-X github.com/apparentlymart/terraform-simple-registry/buildinfo.Version=1.2.0 \
+//	    -X github.com/apparentlymart/terraform-simple-registry/buildinfo.Commit=$(git rev-parse HEAD) \
+//	    -X github.com/apparentlymart/terraform-simple-registry/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Otherwise the commit and date are taken from the version control
+// information that the Go toolchain records, if any.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+var (
+	// Version is the release version of the build, or "dev" if it isn't
+	// a release.
+	Version = "dev"
+
+	// Commit is the id of the git commit that the build was made from.
+	Commit = ""
+
+	// Date is when the build was made, in RFC 3339 format.
+	Date = ""
+)
+
+// Info describes a build.
+type Info struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+
+	// Modified is set if the build was made from a work tree with
+	// uncommitted changes, which is known only if the commit was recorded
+	// by the Go toolchain.
+	Modified bool `json:"modified,omitempty"`
+
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the description of the running build.
+func Get() Info {
+	ret := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	if ret.Commit != "" {
+		return ret
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				ret.Commit = setting.Value
+			case "vcs.time":
+				if ret.Date == "" {
+					ret.Date = setting.Value
+				}
+			case "vcs.modified":
+				ret.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return ret
+}
+
+// String returns a description of the build, as printed by the -version
+// option of the servers.
+func (i Info) String() string {
+	var details []string
+	if i.Commit != "" {
+		commit := i.Commit
+		if i.Modified {
+			commit += " (modified)"
+		}
+		details = append(details, "commit "+commit)
+	}
+	if i.Date != "" {
+		details = append(details, "built "+i.Date)
+	}
+	details = append(details, i.GoVersion)
+	return fmt.Sprintf("%s (%s)", i.Version, strings.Join(details, ", "))
+}
+
+// LogFields returns the description of the build as the key=value fields
+// that the servers log at startup.
+func (i Info) LogFields() string {
+	ret := fmt.Sprintf("version=%s", i.Version)
+	if i.Commit != "" {
+		ret += fmt.Sprintf(" commit=%s modified=%t", i.Commit, i.Modified)
+	}
+	if i.Date != "" {
+		ret += fmt.Sprintf(" build_date=%s", i.Date)
+	}
+	return ret + fmt.Sprintf(" go_version=%s", i.GoVersion)
+}
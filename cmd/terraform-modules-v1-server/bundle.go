@@ -0,0 +1,536 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// A bundle is an uncompressed tar file whose first entry is its manifest,
+// named bundleManifestName, followed by a file of checksums in the format
+// of the sha256sum utility and then the archive of each version.
+const (
+	bundleManifestName  = "bundle.json"
+	bundleChecksumsName = "SHA256SUMS"
+	bundleFormatVersion = 1
+)
+
+type bundleManifest struct {
+	FormatVersion int             `json:"format_version"`
+	Hostname      string          `json:"hostname"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Modules       []*bundleModule `json:"modules"`
+}
+
+type bundleModule struct {
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Provider  string           `json:"provider"`
+	Versions  []*bundleVersion `json:"versions"`
+}
+
+type bundleVersion struct {
+	Version string `json:"version"`
+
+	// Archive is the name of the version's archive within the bundle.
+	Archive string `json:"archive"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// bundleMain implements the "bundle" subcommand, which writes the archives
+// of selected module versions, along with a manifest describing them, into
+// a single file that can be carried into an isolated network and there
+// loaded into another registry by the "unbundle" subcommand.
+func bundleMain(args []string) int {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "configuration file or directory (may be repeated)")
+	outFile := fs.String("out", "", "file to write the bundle into")
+	versionsStr := fs.String("versions", "", "version constraint selecting which versions to bundle")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bundle -config=PATH -out=FILE [options] [NAMESPACE/NAME/PROVIDER...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *outFile == "" {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(configPaths)
+	if cfg == nil {
+		return 1
+	}
+	constraints, ok := parseConstraintsFlag(*versionsStr)
+	if !ok {
+		return 1
+	}
+
+	var mods []*config.Module
+	if fs.NArg() == 0 {
+		for _, byNamespace := range cfg.Modules {
+			for _, byName := range byNamespace {
+				for _, modCfg := range byName {
+					mods = append(mods, modCfg)
+				}
+			}
+		}
+	}
+	for _, addr := range fs.Args() {
+		parts := strings.Split(addr, "/")
+		if len(parts) != 3 {
+			log.Printf("invalid module address %q: must be NAMESPACE/NAME/PROVIDER", addr)
+			return 1
+		}
+		modCfg := cfg.Modules.Get(parts[0], parts[1], parts[2])
+		if modCfg == nil {
+			log.Printf("no module block for %q %q %q in the configuration", parts[0], parts[1], parts[2])
+			return 1
+		}
+		mods = append(mods, modCfg)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return bundleModulePath(mods[i]) < bundleModulePath(mods[j])
+	})
+
+	// The archives are written to a temporary directory first, since their
+	// checksums must be in the manifest that precedes them in the bundle.
+	tmpDir, err := ioutil.TempDir("", "terraform-bundle-")
+	if err != nil {
+		log.Printf("failed to create temporary directory: %s", err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manifest := &bundleManifest{
+		FormatVersion: bundleFormatVersion,
+		Hostname:      cfg.Hostname.ForDisplay(),
+		CreatedAt:     time.Now().UTC(),
+		Modules:       []*bundleModule{},
+	}
+	for _, modCfg := range mods {
+		bm, err := bundleModuleArchives(tmpDir, modCfg, constraints)
+		if err != nil {
+			log.Printf("failed to bundle module configured at %s: %s", modCfg.DeclRange, err)
+			return 1
+		}
+		manifest.Modules = append(manifest.Modules, bm)
+		log.Printf("bundled %s/%s/%s with %d versions", modCfg.Namespace, modCfg.Name, modCfg.Provider, len(bm.Versions))
+	}
+
+	if err := writeBundle(*outFile, tmpDir, manifest); err != nil {
+		log.Printf("failed to write bundle: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// bundleModulePath returns the directory within a bundle that holds the
+// archives of the given module.
+func bundleModulePath(modCfg *config.Module) string {
+	return path.Join("modules", modCfg.Namespace, modCfg.Name, modCfg.Provider)
+}
+
+// bundleModuleArchives writes the archive of each of the versions of the
+// given module that match the given constraints into the given directory,
+// at the same paths as they will have in the bundle, and returns the
+// module's entry in the manifest.
+func bundleModuleArchives(dir string, modCfg *config.Module, constraints version.Constraints) (*bundleModule, error) {
+	src, release, err := modulesv1.OpenSource(modCfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	versions, err := src.ListVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &bundleModule{
+		Namespace: modCfg.Namespace,
+		Name:      modCfg.Name,
+		Provider:  modCfg.Provider,
+		Versions:  []*bundleVersion{},
+	}
+	for _, v := range versions {
+		if modCfg.Yanked(v) || (constraints != nil && !constraints.Check(v)) {
+			continue
+		}
+
+		treeId, err := src.ContentId(v)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Join(bundleModulePath(modCfg), v.String()+".tgz")
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		cw := &countWriter{w: io.MultiWriter(f, h)}
+		err = modulesv1.LocalArchiver().WriteArchive(src, v, treeId, cw)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write archive for version %s: %s", v, err)
+		}
+
+		ret.Versions = append(ret.Versions, &bundleVersion{
+			Version: v.String(),
+			Archive: name,
+			SHA256:  hex.EncodeToString(h.Sum(nil)),
+			Size:    cw.n,
+		})
+	}
+	return ret, nil
+}
+
+// writeBundle writes the bundle described by the given manifest to the
+// given file, reading the archives it lists from the given directory.
+func writeBundle(filename, dir string, manifest *bundleManifest) error {
+	manifestBuf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var sums bytes.Buffer
+	for _, bm := range manifest.Modules {
+		for _, bv := range bm.Versions {
+			fmt.Fprintf(&sums, "%s  %s\n", bv.SHA256, bv.Archive)
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	for _, entry := range []struct {
+		name string
+		buf  []byte
+	}{
+		{bundleManifestName, manifestBuf},
+		{bundleChecksumsName, sums.Bytes()},
+	} {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     entry.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(entry.buf)),
+			ModTime:  manifest.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.buf); err != nil {
+			return err
+		}
+	}
+
+	for _, bm := range manifest.Modules {
+		for _, bv := range bm.Versions {
+			err := tw.WriteHeader(&tar.Header{
+				Name:     bv.Archive,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     bv.Size,
+				ModTime:  manifest.CreatedAt,
+			})
+			if err != nil {
+				return err
+			}
+			archive, err := os.Open(filepath.Join(dir, filepath.FromSlash(bv.Archive)))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, archive)
+			archive.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// unbundleMain implements the "unbundle" subcommand, which adds the
+// versions in a bundle written by the "bundle" subcommand to the git
+// repositories or archive directories of the correspondingly-named modules
+// in the configuration.
+func unbundleMain(args []string) int {
+	fs := flag.NewFlagSet("unbundle", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "configuration file or directory (may be repeated)")
+	versionsStr := fs.String("versions", "", "version constraint selecting which versions to unbundle")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s unbundle -config=PATH [options] BUNDLE [NAMESPACE/NAME/PROVIDER...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(configPaths)
+	if cfg == nil {
+		return 1
+	}
+	constraints, ok := parseConstraintsFlag(*versionsStr)
+	if !ok {
+		return 1
+	}
+	selected := make(map[string]bool)
+	for _, addr := range fs.Args()[1:] {
+		if len(strings.Split(addr, "/")) != 3 {
+			log.Printf("invalid module address %q: must be NAMESPACE/NAME/PROVIDER", addr)
+			return 1
+		}
+		selected[strings.ToLower(addr)] = true
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Printf("failed to open bundle: %s", err)
+		return 1
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+
+	manifest, err := readBundleManifest(tr)
+	if err != nil {
+		log.Printf("invalid bundle %s: %s", fs.Arg(0), err)
+		return 1
+	}
+
+	// Each archive is unbundled as it is reached, so the versions that are
+	// wanted are first collected by their names within the bundle.
+	targets := make(map[string]*unbundleTarget)
+	status := 0
+	for _, bm := range manifest.Modules {
+		addr := fmt.Sprintf("%s/%s/%s", bm.Namespace, bm.Name, bm.Provider)
+		if len(selected) != 0 && !selected[strings.ToLower(addr)] {
+			continue
+		}
+		delete(selected, strings.ToLower(addr))
+
+		target, err := openUnbundleTarget(cfg.Modules, bm)
+		if err != nil {
+			log.Printf("failed to unbundle %s: %s", addr, err)
+			status = 1
+			continue
+		}
+		for _, bv := range bm.Versions {
+			v, err := versionscheme.Scheme(target.cfg.VersionScheme).ParseVersion(bv.Version)
+			if err != nil {
+				log.Printf("failed to unbundle %s version %s: invalid version", addr, bv.Version)
+				status = 1
+				continue
+			}
+			if constraints != nil && !constraints.Check(v) {
+				continue
+			}
+			exists, err := target.src.HasVersion(v)
+			if err != nil {
+				log.Printf("failed to check version %s of %s: %s", v, addr, err)
+				status = 1
+				continue
+			}
+			if exists {
+				continue
+			}
+			targets[bv.Archive] = &unbundleTarget{
+				cfg:     target.cfg,
+				src:     target.src,
+				version: v,
+				entry:   bv,
+			}
+		}
+	}
+	for addr := range selected {
+		log.Printf("bundle has no module %s", addr)
+		status = 1
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("failed to read bundle: %s", err)
+			return 1
+		}
+		target := targets[hdr.Name]
+		if target == nil {
+			continue
+		}
+		delete(targets, hdr.Name)
+
+		if err := target.unbundle(tr, manifest); err != nil {
+			log.Printf("failed to unbundle %s/%s/%s version %s: %s", target.cfg.Namespace, target.cfg.Name, target.cfg.Provider, target.version, err)
+			status = 1
+			continue
+		}
+		log.Printf("unbundled %s/%s/%s version %s", target.cfg.Namespace, target.cfg.Name, target.cfg.Provider, target.version)
+	}
+	for name := range targets {
+		log.Printf("bundle is missing archive %s", name)
+		status = 1
+	}
+
+	return status
+}
+
+// readBundleManifest reads the manifest from the start of the bundle being
+// read by the given reader.
+func readBundleManifest(tr *tar.Reader) (*bundleManifest, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != bundleManifestName {
+		return nil, fmt.Errorf("bundle does not begin with %s", bundleManifestName)
+	}
+
+	var manifest bundleManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", bundleManifestName, err)
+	}
+	if manifest.FormatVersion != bundleFormatVersion {
+		return nil, fmt.Errorf("unsupported bundle format version %d", manifest.FormatVersion)
+	}
+	return &manifest, nil
+}
+
+// unbundleTarget is a module that versions are being unbundled into, and
+// optionally one particular version being unbundled.
+type unbundleTarget struct {
+	cfg *config.Module
+	src module.Source
+
+	version *version.Version
+	entry   *bundleVersion
+}
+
+// openUnbundleTarget returns the module in the given configuration that the
+// versions of the given module in a bundle are to be added to.
+func openUnbundleTarget(modules config.Modules, bm *bundleModule) (*unbundleTarget, error) {
+	cfg := modules.Get(bm.Namespace, bm.Name, bm.Provider)
+	if cfg == nil {
+		return nil, fmt.Errorf("no module block for %q %q %q in the configuration", bm.Namespace, bm.Name, bm.Provider)
+	}
+
+	if cfg.ArchiveDir != "" {
+		// Archive directories have nothing to release.
+		src, _, err := modulesv1.OpenSource(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &unbundleTarget{cfg: cfg, src: src}, nil
+	}
+	if cfg.S3 != nil {
+		return nil, fmt.Errorf("module configured at %s is served from S3, so its archives must be uploaded there instead", cfg.DeclRange)
+	}
+	mod, err := openImportRepo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &unbundleTarget{cfg: cfg, src: mod}, nil
+}
+
+// unbundle reads the target version's archive from the given reader,
+// checks it against the manifest, and then adds it to the target module.
+func (t *unbundleTarget) unbundle(r io.Reader, manifest *bundleManifest) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, t.entry.Size+1))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf)
+	if int64(len(buf)) != t.entry.Size || hex.EncodeToString(sum[:]) != strings.ToLower(t.entry.SHA256) {
+		return fmt.Errorf("archive %s does not match its checksum in the manifest", t.entry.Archive)
+	}
+
+	switch src := t.src.(type) {
+	case *module.ArchiveDir:
+		// The archive is checked before it is added, since the server
+		// would otherwise only find out it is invalid once it is requested.
+		if _, err := module.ReadArchive(bytes.NewReader(buf)); err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+		return src.AddVersion(t.version, bytes.NewReader(buf))
+	case *module.Module:
+		files, err := module.ReadArchive(bytes.NewReader(buf))
+		if err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+		message := fmt.Sprintf(
+			"Import %s/%s/%s version %s from bundle\n\nBundle-Hostname: %s\nBundle-Created-At: %s\nArchive-SHA256: %s\nImported-At: %s\n",
+			t.cfg.Namespace, t.cfg.Name, t.cfg.Provider, t.version,
+			manifest.Hostname, manifest.CreatedAt.UTC().Format(time.RFC3339), t.entry.SHA256,
+			time.Now().UTC().Format(time.RFC3339),
+		)
+		return src.ImportVersion(t.version, files, message)
+	default:
+		return fmt.Errorf("versions cannot be added to the module configured at %s", t.cfg.DeclRange)
+	}
+}
+
+// parseConstraintsFlag parses the value of a -versions flag, returning nil
+// constraints if it is empty. It logs an error if the value is invalid.
+func parseConstraintsFlag(s string) (version.Constraints, bool) {
+	if s == "" {
+		return nil, true
+	}
+	ret, err := version.NewConstraint(s)
+	if err != nil {
+		log.Printf("invalid version constraint %q: %s", s, err)
+		return nil, false
+	}
+	return ret, true
+}
+
+// countWriter is an io.Writer that counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// doctorMain implements the "doctor" subcommand, which opens the source of
+// every module in the configuration and reports those that can't be read,
+// have no versions or have tags that look like versions but aren't, so that
+// broken modules can be found before their consumers find them.
+func doctorMain(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s doctor CONFIG-PATH...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(fs.Args())
+	if cfg == nil {
+		return 1
+	}
+
+	type doctorModule struct {
+		prefix string
+		cfg    *config.Module
+	}
+	var mods []doctorModule
+	usesGit := false
+	addModules := func(prefix string, modules config.Modules) {
+		for _, byNamespace := range modules {
+			for _, byName := range byNamespace {
+				for _, modCfg := range byName {
+					mods = append(mods, doctorModule{prefix, modCfg})
+					usesGit = usesGit || (modCfg.ArchiveDir == "" && modCfg.S3 == nil)
+				}
+			}
+		}
+	}
+	addModules("", cfg.Modules)
+	for hostname, vhost := range cfg.VirtualHosts {
+		addModules(hostname.ForDisplay()+"/", vhost.Modules)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return doctorAddr(mods[i].prefix, mods[i].cfg) < doctorAddr(mods[j].prefix, mods[j].cfg)
+	})
+
+	status := 0
+	if usesGit {
+		if err := module.CheckBackend(); err != nil {
+			fmt.Printf("git backend %s: error: %s\n", module.Backend, err)
+			// Every git module would fail in the same way.
+			return 1
+		}
+		fmt.Printf("git backend %s: ok\n", module.Backend)
+	}
+	for _, mod := range mods {
+		summary, problems := checkModule(mod.cfg)
+		addr := doctorAddr(mod.prefix, mod.cfg)
+		if len(problems) == 0 {
+			// Each healthy module gets a line too, so that a module that
+			// is missing from the configuration is noticeable.
+			fmt.Printf("%s: ok, %s\n", addr, summary)
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", addr, problem)
+		}
+		status = 1
+	}
+	if status == 0 {
+		fmt.Printf("Found no problems with %d modules.\n", len(mods))
+	}
+	return status
+}
+
+// doctorAddr returns the address of the given module as reported by the
+// "doctor" subcommand, with the given prefix naming its virtual host, if
+// any.
+func doctorAddr(prefix string, modCfg *config.Module) string {
+	return fmt.Sprintf("%s%s/%s/%s", prefix, modCfg.Namespace, modCfg.Name, modCfg.Provider)
+}
+
+// checkModule returns descriptions of the problems with the given module,
+// along with a summary of its versions for when there are none.
+func checkModule(modCfg *config.Module) (string, []string) {
+	if modCfg.GitURL != "" {
+		if _, err := os.Stat(modCfg.GitDir); os.IsNotExist(err) {
+			return "", []string{fmt.Sprintf("error: the mirror of %s has not been cloned yet", modCfg.GitURL)}
+		}
+	}
+	src, release, err := modulesv1.OpenSource(modCfg)
+	if err != nil {
+		return "", []string{fmt.Sprintf("error: %s", err)}
+	}
+	defer release()
+	versions, err := src.ListVersions()
+	if err != nil {
+		return "", []string{fmt.Sprintf("error: failed to list versions: %s", err)}
+	}
+
+	var problems []string
+	if mod, ok := src.(*module.Module); ok {
+		tagProblems, err := mod.TagProblems()
+		if err != nil {
+			return "", []string{fmt.Sprintf("error: failed to list tags: %s", err)}
+		}
+		for _, p := range tagProblems {
+			problems = append(problems, fmt.Sprintf("warning: tag %s: %s", p.Tag, p.Problem))
+		}
+	}
+	if len(versions) == 0 {
+		return "", append(problems, "warning: no versions")
+	}
+	return fmt.Sprintf("%d versions, latest %s", len(versions), versions[0]), problems
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// exportMain implements the "export" subcommand, which renders the whole
+// registry as a tree of static files that can be served by any web server.
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	outDir := fs.String("out", "", "directory to write the static registry into")
+	basePath := fs.String("base-path", "/v1/modules/", "URL path under which the modules.v1 service is written")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export -out=DIR [options] CONFIG-PATH...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *outDir == "" {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(fs.Args())
+	if cfg == nil {
+		return 1
+	}
+
+	base := "/" + strings.Trim(*basePath, "/") + "/"
+	status := exportRegistry(*outDir, base, cfg.Hostname, cfg.Modules)
+
+	// Each virtual host is written into a subdirectory named after its
+	// hostname, which a web server can serve as the root of that hostname.
+	for hostname, vhost := range cfg.VirtualHosts {
+		if vhostStatus := exportRegistry(filepath.Join(*outDir, hostname.String()), base, hostname, vhost.Modules); vhostStatus != 0 {
+			status = vhostStatus
+		}
+	}
+
+	return status
+}
+
+// exportRegistry writes the discovery document and the modules of the
+// given hostname beneath the given directory, returning the exit status.
+func exportRegistry(outDir, base string, hostname svchost.Hostname, modules config.Modules) int {
+	disco := map[string]string{
+		"modules.v1": base,
+	}
+	err := writeExportJSON(filepath.Join(outDir, ".well-known", "terraform.json"), disco)
+	if err != nil {
+		log.Printf("failed to write discovery document for %s: %s", hostname.ForDisplay(), err)
+		return 1
+	}
+
+	status := 0
+	for _, byNamespace := range modules {
+		for _, byName := range byNamespace {
+			for _, modCfg := range byName {
+				dir := filepath.Join(outDir, filepath.FromSlash(path.Join(base, modCfg.Namespace, modCfg.Name, modCfg.Provider)))
+				err := exportModule(hostname, dir, modCfg)
+				if err != nil {
+					log.Printf("failed to export module configured at %s: %s", modCfg.DeclRange, err)
+					status = 1
+				}
+			}
+		}
+	}
+
+	return status
+}
+
+func exportModule(hostname svchost.Hostname, dir string, modCfg *config.Module) error {
+	src, release, err := modulesv1.OpenSource(modCfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	allVersions, err := src.ListVersions()
+	if err != nil {
+		return err
+	}
+	var versions []*version.Version
+	for _, v := range allVersions {
+		if !modCfg.Yanked(v) {
+			versions = append(versions, v)
+		}
+	}
+
+	listed := versions
+	if modCfg.Prereleases == config.PrereleasesHidden {
+		// Static files can't honor the "prereleases" query string argument,
+		// so hidden prereleases are never listed, though they can still be
+		// downloaded directly just as from the server.
+		listed = nil
+		for _, v := range versions {
+			if v.Prerelease() == "" {
+				listed = append(listed, v)
+			}
+		}
+	}
+
+	versionsResp := modulesv1.VersionsResponse(hostname, modCfg, listed)
+	err = writeExportJSON(filepath.Join(dir, "versions"), versionsResp)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		treeId, err := src.ContentId(v)
+		if err != nil {
+			return err
+		}
+
+		versionDir := filepath.Join(dir, v.String())
+		archiveName := treeId + ".tgz"
+
+		// Static file servers can't produce an X-Terraform-Get header, so
+		// we write the alternative JSON response body instead. The location
+		// is resolved relative to the URL of the download endpoint itself.
+		downloadResp := map[string]string{
+			"location": "./" + archiveName,
+		}
+		err = writeExportJSON(filepath.Join(versionDir, "download"), downloadResp)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Create(filepath.Join(versionDir, archiveName))
+		if err != nil {
+			return err
+		}
+		err = modulesv1.LocalArchiver().WriteArchive(src, v, treeId, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write archive for version %s: %s", v, err)
+		}
+	}
+
+	log.Printf("exported %s/%s/%s with %d versions", modCfg.Namespace, modCfg.Name, modCfg.Provider, len(versions))
+	return nil
+}
+
+func writeExportJSON(filename string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0644)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// generateConfigMain implements the "generate-config" subcommand, which
+// finds the bare git repositories in a directory tree laid out as
+// NAMESPACE/NAME/PROVIDER and writes a module block for each of them.
+func generateConfigMain(args []string) int {
+	fs := flag.NewFlagSet("generate-config", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "existing configuration file or directory, whose modules are skipped (may be repeated)")
+	out := fs.String("out", "", "configuration file to append the module blocks to, instead of printing them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s generate-config [options] DIR\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	root, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Printf("invalid directory %q: %s", fs.Arg(0), err)
+		return 1
+	}
+
+	var existing config.Modules
+	if len(configPaths) != 0 {
+		cfg := loadConfig(configPaths)
+		if cfg == nil {
+			return 1
+		}
+		existing = cfg.Modules
+	}
+
+	repos, err := findModuleRepos(root)
+	if err != nil {
+		log.Printf("failed to scan %s: %s", root, err)
+		return 1
+	}
+
+	var blocks []string
+	for _, repo := range repos {
+		if existing != nil {
+			if modCfg := existing.Get(repo.namespace, repo.name, repo.provider); modCfg != nil {
+				log.Printf("skipping %s, since %s/%s/%s is already declared at %s", repo.gitDir, repo.namespace, repo.name, repo.provider, modCfg.DeclRange)
+				continue
+			}
+		}
+		blocks = append(blocks, fmt.Sprintf("module %q %q %q {\n  git_dir = %q\n}\n", repo.namespace, repo.name, repo.provider, repo.gitDir))
+	}
+	if len(blocks) == 0 {
+		log.Printf("found no new module repositories in %s", root)
+		return 1
+	}
+
+	if *out == "" {
+		fmt.Print(strings.Join(blocks, "\n"))
+		return 0
+	}
+	if err := appendBlock(*out, strings.Join(blocks, "\n")); err != nil {
+		log.Printf("failed to write module blocks to %s: %s", *out, err)
+		return 1
+	}
+	log.Printf("added %d module blocks to %s", len(blocks), *out)
+	return 0
+}
+
+// moduleRepo is a git repository found by findModuleRepos.
+type moduleRepo struct {
+	namespace, name, provider string
+	gitDir                    string
+}
+
+// findModuleRepos returns the bare git repositories at NAMESPACE/NAME/PROVIDER
+// beneath the given directory, in lexical order of their paths. A ".git"
+// suffix on the provider's directory name is ignored, as is anything whose
+// path doesn't consist of valid identifiers or that isn't a git repository.
+func findModuleRepos(root string) ([]moduleRepo, error) {
+	var ret []moduleRepo
+	namespaces, err := subdirs(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, namespace := range namespaces {
+		names, err := subdirs(filepath.Join(root, namespace))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			providers, err := subdirs(filepath.Join(root, namespace, name))
+			if err != nil {
+				return nil, err
+			}
+			for _, dirName := range providers {
+				gitDir := filepath.Join(root, namespace, name, dirName)
+				provider := strings.TrimSuffix(dirName, ".git")
+				if !config.ValidIdentifier(namespace) || !config.ValidIdentifier(name) || !config.ValidIdentifier(provider) {
+					log.Printf("skipping %s, since its path is not a valid module address", gitDir)
+					continue
+				}
+				if module.Load(gitDir) == nil {
+					log.Printf("skipping %s, since it is not a git repository", gitDir)
+					continue
+				}
+				ret = append(ret, moduleRepo{
+					namespace: namespace,
+					name:      name,
+					provider:  provider,
+					gitDir:    gitDir,
+				})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// subdirs returns the names of the directories within the given directory,
+// in lexical order, leaving out hidden ones.
+func subdirs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			ret = append(ret, info.Name())
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/server"
+	"github.com/apparentlymart/terraform-simple-registry/upstream"
+)
+
+// gitHubTokenEnv is the environment variable that the "github-config"
+// subcommand reads its GitHub API token from, so that it needn't be given
+// on the command line.
+const gitHubTokenEnv = "GITHUB_TOKEN"
+
+// gitHubConfigMain implements the "github-config" subcommand, which finds
+// the repositories of a GitHub organization that are named like modules,
+// as "terraform-PROVIDER-NAME", and writes a module block mirroring each
+// of them.
+func gitHubConfigMain(args []string) int {
+	fs := flag.NewFlagSet("github-config", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "existing configuration file or directory, whose modules are skipped (may be repeated)")
+	out := fs.String("out", "", "configuration file to append the module blocks to, instead of printing them")
+	namespace := fs.String("namespace", "", "namespace to declare the modules in, instead of the organization's name")
+	apiURL := fs.String("api-url", upstream.DefaultGitHubAPIURL, "base URL of the GitHub API")
+	useSSH := fs.Bool("ssh", false, "mirror the repositories using their SSH URLs rather than their HTTPS URLs")
+	includeArchived := fs.Bool("include-archived", false, "include archived repositories")
+	clone := fs.Bool("clone", false, "clone each mirror into the configuration's git_mirror_dir now, rather than when the server first starts")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s github-config [options] ORGANIZATION\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	org := fs.Arg(0)
+	if *namespace == "" {
+		*namespace = org
+	}
+	if !config.ValidIdentifier(*namespace) {
+		log.Printf("invalid namespace %q: must be a valid identifier", *namespace)
+		return 1
+	}
+
+	var existing config.Modules
+	settings := &config.ModuleSettings{}
+	if len(configPaths) != 0 {
+		cfg := loadConfig(configPaths)
+		if cfg == nil {
+			return 1
+		}
+		existing = cfg.Modules
+		settings = &cfg.ModuleSettings
+	}
+	if *clone && settings.GitMirrorDir == "" {
+		log.Printf("-clone requires -config to give a configuration that sets git_mirror_dir")
+		return 1
+	}
+
+	client, err := server.NewUpstreamClient(settings)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	repos, err := client.GitHubRepos(*apiURL, org, os.Getenv(gitHubTokenEnv))
+	if err != nil {
+		log.Printf("failed to list repositories of %s: %s", org, err)
+		return 1
+	}
+
+	var blocks []string
+	status := 0
+	for _, repo := range repos {
+		provider, name, ok := parseModuleRepoName(repo.Name)
+		if !ok {
+			continue
+		}
+		if repo.Archived && !*includeArchived {
+			log.Printf("skipping %s, since it is archived", repo.Name)
+			continue
+		}
+		if existing != nil {
+			if modCfg := existing.Get(*namespace, name, provider); modCfg != nil {
+				log.Printf("skipping %s, since %s/%s/%s is already declared at %s", repo.Name, *namespace, name, provider, modCfg.DeclRange)
+				continue
+			}
+		}
+
+		gitURL := repo.CloneURL
+		if *useSSH {
+			gitURL = repo.SSHURL
+		}
+		if *clone {
+			tlsConfig, err := settings.OutboundTLS.TLSConfig()
+			if err != nil {
+				log.Printf("invalid outbound TLS configuration at %s: %s", settings.OutboundTLS.DeclRange, err)
+				return 1
+			}
+			gitDir := settings.MirrorGitDir(gitURL)
+			if _, err := module.Mirror(gitURL, gitDir, tlsConfig); err != nil {
+				log.Printf("failed to clone %s: %s", gitURL, err)
+				status = 1
+				continue
+			}
+			log.Printf("cloned %s into %s", gitURL, gitDir)
+		}
+		blocks = append(blocks, fmt.Sprintf("module %q %q %q {\n  git_url = %q\n}\n", *namespace, name, provider, gitURL))
+	}
+	if len(blocks) == 0 {
+		log.Printf("found no new module repositories in %s", org)
+		return 1
+	}
+
+	if *out == "" {
+		fmt.Print(strings.Join(blocks, "\n"))
+		return status
+	}
+	if err := appendBlock(*out, strings.Join(blocks, "\n")); err != nil {
+		log.Printf("failed to write module blocks to %s: %s", *out, err)
+		return 1
+	}
+	log.Printf("added %d module blocks to %s", len(blocks), *out)
+	return status
+}
+
+// parseModuleRepoName returns the provider and name of the module in the
+// repository with the given name, which must follow the convention of
+// naming module repositories "terraform-PROVIDER-NAME". The name may itself
+// contain dashes, but the provider may not.
+func parseModuleRepoName(repoName string) (string, string, bool) {
+	if !strings.HasPrefix(repoName, "terraform-") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(repoName, "terraform-"), "-", 2)
+	if len(parts) != 2 || !config.ValidIdentifier(parts[0]) || !config.ValidIdentifier(parts[1]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
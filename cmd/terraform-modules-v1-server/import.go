@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/server"
+	"github.com/apparentlymart/terraform-simple-registry/upstream"
+)
+
+// importMain implements the "import" subcommand, which mirrors versions of
+// modules from another registry into the git repositories of the
+// correspondingly-named modules in the configuration.
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "configuration file or directory (may be repeated)")
+	registry := fs.String("registry", "registry.terraform.io", "hostname of the registry to import from")
+	versionsStr := fs.String("versions", "", "version constraint selecting which versions to import")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import -config=PATH [options] NAMESPACE/NAME/PROVIDER...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(configPaths)
+	if cfg == nil {
+		return 1
+	}
+
+	host, err := svchost.ForComparison(*registry)
+	if err != nil {
+		log.Printf("invalid registry hostname %q: %s", *registry, err)
+		return 1
+	}
+
+	var constraints version.Constraints
+	if *versionsStr != "" {
+		constraints, err = version.NewConstraint(*versionsStr)
+		if err != nil {
+			log.Printf("invalid version constraint %q: %s", *versionsStr, err)
+			return 1
+		}
+	}
+
+	client, err := server.NewUpstreamClient(&cfg.ModuleSettings)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	status := 0
+	for _, addr := range fs.Args() {
+		parts := strings.Split(addr, "/")
+		if len(parts) != 3 {
+			log.Printf("invalid module address %q: must be NAMESPACE/NAME/PROVIDER", addr)
+			status = 1
+			continue
+		}
+
+		err := importModule(client, host, cfg.Modules, parts[0], parts[1], parts[2], constraints)
+		if err != nil {
+			log.Printf("failed to import %s: %s", addr, err)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func importModule(client *upstream.Client, host svchost.Hostname, modules config.Modules, namespace, name, provider string, constraints version.Constraints) error {
+	cfg := modules.Get(namespace, name, provider)
+	if cfg == nil {
+		return fmt.Errorf("no module block for %q %q %q in the configuration", namespace, name, provider)
+	}
+
+	mod, err := openImportRepo(cfg)
+	if err != nil {
+		return err
+	}
+
+	versions, err := client.ModuleVersions(host, namespace, name, provider)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if constraints != nil && !constraints.Check(v) {
+			continue
+		}
+
+		exists, err := mod.HasVersion(v)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		location, err := client.ModuleLocation(host, namespace, name, provider, v)
+		if err != nil {
+			return err
+		}
+		files, err := client.FetchModuleFiles(location)
+		if err != nil {
+			return fmt.Errorf("failed to fetch version %s: %s", v, err)
+		}
+
+		message := fmt.Sprintf(
+			"Import %s/%s/%s/%s version %s\n\nUpstream-Registry: %s\nUpstream-Version: %s\nSource-Location: %s\nImported-At: %s\n",
+			host.ForDisplay(), namespace, name, provider, v,
+			host.ForDisplay(), v, location, time.Now().UTC().Format(time.RFC3339),
+		)
+		if err := mod.ImportVersion(v, files, message); err != nil {
+			return fmt.Errorf("failed to import version %s: %s", v, err)
+		}
+		log.Printf("imported %s/%s/%s version %s from %s", namespace, name, provider, v, location)
+	}
+
+	return nil
+}
+
+// openImportRepo opens the git repository of the given module so that
+// versions can be imported into it, first creating it as an empty bare
+// repository if it doesn't exist yet. It returns an error if the module's
+// configuration means that imported versions wouldn't be served.
+func openImportRepo(cfg *config.Module) (*module.Module, error) {
+	if cfg.GitDir == "" {
+		return nil, fmt.Errorf("module configured at %s does not have a git repository to import into", cfg.DeclRange)
+	}
+	if cfg.GitURL != "" {
+		// Anything we imported into the mirror would be pruned by the next
+		// fetch from the remote repository.
+		return nil, fmt.Errorf("module configured at %s is mirrored from %s, so versions must be imported there instead", cfg.DeclRange, cfg.GitURL)
+	}
+	if cfg.Path != "" {
+		return nil, fmt.Errorf("module configured at %s is in a subdirectory of its repository, which importing does not support", cfg.DeclRange)
+	}
+	if cfg.TagPattern != nil {
+		return nil, fmt.Errorf("module configured at %s has custom tag names, which importing does not support", cfg.DeclRange)
+	}
+	if cfg.TrustedKeys != nil {
+		// The imported tags aren't signed, so they would all be hidden.
+		return nil, fmt.Errorf("module configured at %s serves only signed tags, which importing cannot create", cfg.DeclRange)
+	}
+	mod, err := module.Create(cfg.GitDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git repository at %s: %s", cfg.GitDir, err)
+	}
+	return mod, nil
+}
+
+// pathsFlag is a flag.Value that collects the values of a flag that may
+// be given multiple times.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pathsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// listModule is a module as printed by the "list" subcommand. Its JSON
+// encoding is the output of "list -json".
+type listModule struct {
+	Hostname  string   `json:"hostname"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Provider  string   `json:"provider"`
+	Latest    string   `json:"latest,omitempty"`
+	Versions  []string `json:"versions"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// listMain implements the "list" subcommand, which prints each module in
+// the configuration along with the versions that the server would serve.
+func listMain(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the modules as JSON rather than as a table")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s list [options] CONFIG-PATH...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(fs.Args())
+	if cfg == nil {
+		return 1
+	}
+
+	// The versions are listed through module sets, as the server does, so
+	// that modules and versions are left out in the same way, including
+	// those of the main hostname that were deleted or pinned through the
+	// admin API.
+	mods := []*listModule{}
+	addModules := func(hostname string, set *modulesv1.ModuleSet, modules config.Modules) {
+		for _, byNamespace := range modules {
+			for _, byName := range byNamespace {
+				for _, modCfg := range byName {
+					if set.Get(modCfg.Namespace, modCfg.Name, modCfg.Provider) == nil {
+						continue
+					}
+					mods = append(mods, newListModule(set, hostname, modCfg))
+				}
+			}
+		}
+	}
+	set := modulesv1.NewModuleSet(cfg.Modules, cfg.VersionCacheTTL)
+	if cfg.Admin != nil && cfg.Admin.AuditLog != "" {
+		if err := set.LoadAuditLog(cfg.Admin.AuditLog); err != nil {
+			log.Printf("failed to load audit log: %s", err)
+			return 1
+		}
+	}
+	addModules(cfg.Hostname.ForDisplay(), set, cfg.Modules)
+	for hostname, vhost := range cfg.VirtualHosts {
+		addModules(hostname.ForDisplay(), modulesv1.NewModuleSet(vhost.Modules, cfg.VersionCacheTTL), vhost.Modules)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		a, b := mods[i], mods[j]
+		if a.Hostname != b.Hostname {
+			// The main hostname's modules come first.
+			return a.Hostname == cfg.Hostname.ForDisplay() || (b.Hostname != cfg.Hostname.ForDisplay() && a.Hostname < b.Hostname)
+		}
+		return strings.ToLower(a.Namespace+"/"+a.Name+"/"+a.Provider) < strings.ToLower(b.Namespace+"/"+b.Name+"/"+b.Provider)
+	})
+
+	status := 0
+	for _, mod := range mods {
+		if mod.Error != "" {
+			log.Printf("failed to list versions of %s/%s/%s: %s", mod.Namespace, mod.Name, mod.Provider, mod.Error)
+			status = 1
+		}
+	}
+
+	if *jsonOutput {
+		buf, err := json.MarshalIndent(mods, "", "  ")
+		if err != nil {
+			log.Printf("failed to encode modules as JSON: %s", err)
+			return 1
+		}
+		fmt.Printf("%s\n", buf)
+		return status
+	}
+
+	// The hostname column is needed only to tell virtual hosts apart.
+	showHostname := len(cfg.VirtualHosts) != 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if showHostname {
+		fmt.Fprint(tw, "HOSTNAME\t")
+	}
+	fmt.Fprint(tw, "NAMESPACE\tNAME\tPROVIDER\tLATEST\tVERSIONS\n")
+	for _, mod := range mods {
+		if showHostname {
+			fmt.Fprintf(tw, "%s\t", mod.Hostname)
+		}
+		latest, versions := mod.Latest, strings.Join(mod.Versions, ", ")
+		if mod.Error != "" {
+			latest, versions = "-", "(error)"
+		} else if latest == "" {
+			latest = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", mod.Namespace, mod.Name, mod.Provider, latest, versions)
+	}
+	tw.Flush()
+	return status
+}
+
+// newListModule returns the listing of the given module of the given set,
+// on the given hostname.
+func newListModule(set *modulesv1.ModuleSet, hostname string, modCfg *config.Module) *listModule {
+	ret := &listModule{
+		Hostname:  hostname,
+		Namespace: modCfg.Namespace,
+		Name:      modCfg.Name,
+		Provider:  modCfg.Provider,
+		Versions:  []string{},
+	}
+
+	versions, err := set.AllVersions(modCfg, false)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	for _, v := range versions {
+		ret.Versions = append(ret.Versions, v.String())
+	}
+	latest, err := set.LatestVersion(modCfg, false)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	if latest != nil {
+		ret.Latest = latest.String()
+	}
+	return ret
+}
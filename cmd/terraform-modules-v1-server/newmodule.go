@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// newModuleMain implements the "new-module" subcommand, which creates an
+// empty git repository for a new module, adds a module block for it to the
+// configuration and prints the source address that its consumers will use.
+func newModuleMain(args []string) int {
+	fs := flag.NewFlagSet("new-module", flag.ExitOnError)
+	var configPaths pathsFlag
+	fs.Var(&configPaths, "config", "configuration file or directory (may be repeated)")
+	gitDir := fs.String("git-dir", "", "directory in which to create the module's git repository, if its namespace has no git storage")
+	out := fs.String("out", "", "configuration file to append the new module block to, instead of printing it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s new-module -config=PATH [options] NAMESPACE/NAME/PROVIDER\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	addr := fs.Arg(0)
+	parts := strings.Split(addr, "/")
+	if len(parts) != 3 {
+		log.Printf("invalid module address %q: must be NAMESPACE/NAME/PROVIDER", addr)
+		return 1
+	}
+	for _, part := range parts {
+		if !config.ValidIdentifier(part) {
+			log.Printf("invalid module address %q: %q is not a valid identifier", addr, part)
+			return 1
+		}
+	}
+	namespace, name, provider := parts[0], parts[1], parts[2]
+
+	cfg := loadConfig(configPaths)
+	if cfg == nil {
+		return 1
+	}
+	if existing := cfg.Modules.Get(namespace, name, provider); existing != nil {
+		log.Printf("module %s is already declared at %s", addr, existing.DeclRange)
+		return 1
+	}
+
+	// A namespace with git storage already gives the module a location,
+	// so the block needn't repeat it.
+	var block string
+	ns := cfg.Namespaces[config.NormalizeIdentifier(namespace)]
+	if storage, ok := nsStorage(ns).(*config.GitStorage); ok && *gitDir == "" {
+		*gitDir = filepath.Join(storage.BaseDir, name, provider)
+		block = fmt.Sprintf("module %q %q %q {\n  # git_dir defaults to %s\n}\n", namespace, name, provider, *gitDir)
+	} else if *gitDir != "" {
+		abs, err := filepath.Abs(*gitDir)
+		if err != nil {
+			log.Printf("invalid git directory %q: %s", *gitDir, err)
+			return 1
+		}
+		*gitDir = abs
+		block = fmt.Sprintf("module %q %q %q {\n  git_dir = %q\n}\n", namespace, name, provider, *gitDir)
+	} else {
+		log.Printf("namespace %q has no git storage, so -git-dir must be set", namespace)
+		return 1
+	}
+
+	if module.Load(*gitDir) != nil {
+		log.Printf("a git repository already exists at %s", *gitDir)
+		return 1
+	}
+	if _, err := module.Create(*gitDir); err != nil {
+		log.Printf("failed to create git repository at %s: %s", *gitDir, err)
+		return 1
+	}
+	log.Printf("created git repository at %s", *gitDir)
+
+	if *out == "" {
+		fmt.Printf("\n%s\n", block)
+	} else {
+		if err := appendBlock(*out, block); err != nil {
+			log.Printf("failed to write module block to %s: %s", *out, err)
+			return 1
+		}
+		log.Printf("added module block to %s", *out)
+	}
+
+	fmt.Printf("Push tags named like v1.0.0 to %s to publish versions of the module,\n", *gitDir)
+	fmt.Printf("which its consumers can then use with:\n\n")
+	fmt.Printf("  source = %q\n", fmt.Sprintf("%s/%s/%s/%s", cfg.Hostname.ForDisplay(), namespace, name, provider))
+	return 0
+}
+
+// nsStorage returns the storage of the given namespace, or nil if it is nil
+// or has no storage.
+func nsStorage(ns *config.Namespace) config.Storage {
+	if ns == nil {
+		return nil
+	}
+	return ns.Storage
+}
+
+// appendBlock appends the given configuration block to the given file,
+// separating it from any existing content with a blank line.
+func appendBlock(filename, block string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		block = "\n" + block
+	}
+	if _, err := f.WriteString(block); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/apparentlymart/terraform-simple-registry/server"
+)
+
+// validateMain implements the "validate" subcommand, which loads the
+// configuration in the same way as the server does at startup, reporting
+// any problems with it, but then exits rather than serving anything.
+func validateMain(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.BoolVar(&modulesServer.Strict, "strict", false, "also check that the git repository or archive directory of every module exists and is readable")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate [options] CONFIG-PATH...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	cfg := loadConfig(fs.Args())
+	if cfg == nil {
+		return 1
+	}
+
+	// The certificates and outbound TLS settings are otherwise only checked
+	// once the server listens or first connects to something.
+	if err := cfg.Listeners.CheckCertificates(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if cfg.Admin != nil {
+		if err := cfg.Admin.Listeners.CheckCertificates(); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	if _, err := server.NewUpstreamClient(&cfg.ModuleSettings); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	fmt.Println("The configuration is valid.")
+	return 0
+}
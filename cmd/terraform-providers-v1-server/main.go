@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/apparentlymart/terraform-simple-registry/buildinfo"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/providersv1"
+	"github.com/apparentlymart/terraform-simple-registry/server"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+)
+
+func realMain(args []string) int {
+	cfg := loadConfig(args)
+	if cfg == nil {
+		return 1
+	}
+	if err := server.ConfigureLog(cfg.Log); err != nil {
+		logging.Errorf("%s", err)
+		return 1
+	}
+
+	logging.Infof("build: %s", buildinfo.Get().LogFields())
+	server.LogSummary(cfg.Hostname, nil, cfg.Providers, nil)
+
+	handler := server.NewHandler(
+		cfg.BasePath, cfg.Discovery, nil,
+		providersv1.NewHandler(cfg.Hostname, cfg.Providers, server.AuthWrapper(nil)),
+	)
+	listeners := config.NewListenerGroup(handler, cfg.DrainTimeout)
+	go server.ReloadOnSignal(func() bool {
+		return reload(args, listeners)
+	}, listeners)
+	server.ShutdownListeners(listeners)
+	listeners.Update(cfg.Listeners)
+	server.NotifySystemd(listeners)
+
+	// The listeners serve in the background until the process exits.
+	select {}
+}
+
+// reload loads the configuration from the given paths again, updating the
+// given listener group accordingly, and returns false if the new
+// configuration is invalid.
+//
+// Only the listeners and the log level are reloaded, so other changes to the
+// configuration, including to the provider declarations, require a restart.
+func reload(args []string, listeners *config.ListenerGroup) bool {
+	cfg := loadConfig(args)
+	if cfg == nil {
+		return false
+	}
+	server.SetLogLevel(cfg.Log)
+	listeners.Update(cfg.Listeners)
+	return true
+}
+
+// loadConfig parses and decodes the configuration files and directories
+// at the given paths, writing any diagnostics to stderr. It returns nil if
+// there were any errors.
+func loadConfig(args []string) *config.ProvidersConfig {
+	var cfg *config.ProvidersConfig
+	ok := server.LoadConfig(args, func(parser *hclparse.Parser, body hcl.Body) hcl.Diagnostics {
+		var diags hcl.Diagnostics
+		cfg, diags = config.LoadProvidersConfig(body)
+		return diags
+	})
+	if !ok {
+		return nil
+	}
+
+	return cfg
+}
+
+func main() {
+	server.Main("terraform-providers-v1-server", nil, realMain)
+}
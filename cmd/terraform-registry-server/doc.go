@@ -0,0 +1,9 @@
+// terraform-registry-server provides a single server that implements all of
+// the Terraform registry protocols supported by this repository, along with
+// the service discovery document that allows Terraform to find them.
+//
+// This is a convenience for small deployments that would otherwise need to
+// run a separate server for each protocol and combine them with a frontend
+// server. The separate servers remain available for deployments that need
+// more control.
+package main
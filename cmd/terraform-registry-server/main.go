@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/providersv1"
+	"github.com/apparentlymart/terraform-simple-registry/server"
+	"github.com/apparentlymart/terraform-simple-registry/worker"
+)
+
+// services returns the handler for the module and provider registries at
+// their base paths, given the handler for the modules.
+func services(cfg *config.RegistryConfig, modules http.Handler) http.Handler {
+	services := mux.NewRouter()
+	services.PathPrefix(config.ModulesBasePath).Handler(http.StripPrefix(
+		strings.TrimSuffix(config.ModulesBasePath, "/"),
+		modules,
+	))
+	services.PathPrefix(config.ProvidersBasePath).Handler(http.StripPrefix(
+		strings.TrimSuffix(config.ProvidersBasePath, "/"),
+		providersv1.NewHandler(cfg.Hostname, cfg.Providers, server.AuthWrapper(cfg.Auth)),
+	))
+	return services
+}
+
+// commands are the subcommands that may be given as the first command line
+// argument. Any other arguments are configuration paths for the server.
+var commands = map[string]func(args []string) int{
+	server.WorkerCommand: worker.Main,
+}
+
+func main() {
+	registryServer := server.NewModulesServer(config.LoadRegistryConfig, services)
+	server.Main("terraform-registry-server", commands, registryServer.Run)
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/forwarded"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// Access log formats, as set in the "format" attribute of an access_log
+// block.
+const (
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// accessLog describes where and how a listener logs the requests that it
+// serves. A listener block that binds several addresses shares a single
+// accessLog between all of them, so that they also share the open file.
+type accessLog struct {
+	// Path is the file that lines are appended to, or empty to write them
+	// along with the server's other log output.
+	Path   string
+	Format string
+
+	open sync.Once
+	w    io.Writer
+	err  error
+	mu   sync.Mutex
+}
+
+// writer returns the writer that log lines are written to, opening the log
+// file the first time it is called.
+func (al *accessLog) writer() (io.Writer, error) {
+	al.open.Do(func() {
+		if al.Path == "" {
+			al.w = log.Writer()
+			return
+		}
+		// The file is opened for appending so that it can be rotated by
+		// truncating it in place.
+		al.w, al.err = os.OpenFile(al.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	})
+	return al.w, al.err
+}
+
+// Handler returns a handler that passes requests to the given handler and
+// then logs them, or an error if the log file can't be opened.
+func (al *accessLog) Handler(next http.Handler) (http.Handler, error) {
+	w, err := al.writer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %s", err)
+	}
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &accessLogRecorder{ResponseWriter: wr}
+		if flusher, ok := wr.(http.Flusher); ok {
+			// The event stream relies on being able to flush its
+			// responses, so we must not hide that from it.
+			next.ServeHTTP(&flushingAccessLogRecorder{rec, flusher}, req)
+		} else {
+			next.ServeHTTP(rec, req)
+		}
+		line := al.line(req, rec, start, time.Since(start))
+
+		al.mu.Lock()
+		defer al.mu.Unlock()
+		w.Write(line)
+	}), nil
+}
+
+// line returns the log line, including its trailing newline, for the given
+// request whose response was recorded by the given recorder.
+func (al *accessLog) line(req *http.Request, rec *accessLogRecorder, start time.Time, duration time.Duration) []byte {
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if al.Format == accessLogJSON {
+		buf, _ := json.Marshal(struct {
+			Time       time.Time `json:"time"`
+			Client     string    `json:"client"`
+			Scheme     string    `json:"scheme"`
+			Method     string    `json:"method"`
+			Path       string    `json:"path"`
+			Protocol   string    `json:"protocol"`
+			Status     int       `json:"status"`
+			Bytes      int64     `json:"bytes"`
+			DurationMS float64   `json:"duration_ms"`
+			Referer    string    `json:"referer,omitempty"`
+			UserAgent  string    `json:"user_agent,omitempty"`
+			RequestID  string    `json:"request_id"`
+		}{
+			Time:       start.UTC(),
+			Client:     client,
+			Scheme:     forwarded.Scheme(req),
+			Method:     req.Method,
+			Path:       req.URL.RequestURI(),
+			Protocol:   req.Proto,
+			Status:     status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(duration) / float64(time.Millisecond),
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+			// The handler that assigns the ID is inside this one, so it
+			// is seen only in the response.
+			RequestID: rec.Header().Get(requestid.Header),
+		})
+		return append(buf, '\n')
+	}
+
+	line := fmt.Sprintf(
+		"%s - - [%s] %s %d %d",
+		client, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(req.Method+" "+req.URL.RequestURI()+" "+req.Proto),
+		status, rec.bytes,
+	)
+	if al.Format == accessLogCombined {
+		line += " " + accessLogQuote(req.Referer()) + " " + accessLogQuote(req.UserAgent())
+	}
+	return []byte(line + "\n")
+}
+
+// accessLogQuote quotes a header value for the combined format, which uses
+// "-" for a header that wasn't sent.
+func accessLogQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// accessLogRecorder is a ResponseWriter that records the status and size of
+// the response written through it.
+type accessLogRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessLogRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessLogRecorder) Write(buf []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(buf)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// flushingAccessLogRecorder is an accessLogRecorder for a ResponseWriter that
+// can be flushed.
+type flushingAccessLogRecorder struct {
+	*accessLogRecorder
+	flusher http.Flusher
+}
+
+func (r *flushingAccessLogRecorder) Flush() {
+	r.flusher.Flush()
+}
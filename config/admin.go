@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Admin is the configuration for the administrative API, which is served
+// on its own listeners so that it need not be exposed to registry clients.
+type Admin struct {
+	Listeners Listeners
+
+	// AuditLog is the file recording the changes made through the admin
+	// API, or an empty string if they are to be kept only in memory.
+	AuditLog string
+
+	// ReadyChecksSources is whether the readiness check also requires the
+	// source of every module to be openable, such as its git repository.
+	ReadyChecksSources bool
+
+	// Tokens and TokenFile give the bearer tokens that the admin API
+	// requires, other than for its health checks, in the same way as for
+	// an Auth. If neither is set, the admin API is not authenticated.
+	Tokens    []string
+	TokenFile string
+
+	// ModulesFile is the file of module blocks that can be changed through
+	// the admin API, or an empty string if they can't be. It is read along
+	// with the rest of the configuration, in the JSON variant of the
+	// configuration syntax, and may contain only module blocks.
+	ModulesFile string
+
+	// Pprof is whether the admin API serves the runtime profiling data of
+	// the net/http/pprof package, under "/debug/pprof/".
+	Pprof bool
+
+	DeclRange hcl.Range
+}
+
+// loadAdminConfig decodes the optional "admin" block from the given body,
+// returning nil if it isn't present. The block contains "http" and
+// "fastcgi" listener blocks of the same form as at the top level, along with
+// the optional "audit_log", "ready_checks_sources", "tokens", "token_file",
+// "modules_file" and "pprof" attributes.
+func loadAdminConfig(body hcl.Body) (*Admin, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "admin",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Admin
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate admin block",
+				Detail:   fmt.Sprintf("The admin API was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		listeners, blockRemain, listenersDiags := loadListenersConfig(block.Body)
+		diags = append(diags, listenersDiags...)
+		type admin struct {
+			AuditLog           *string  `hcl:"audit_log,attr"`
+			ReadyChecksSources *bool    `hcl:"ready_checks_sources,attr"`
+			Tokens             []string `hcl:"tokens,attr"`
+			TokenFile          *string  `hcl:"token_file,attr"`
+			ModulesFile        *string  `hcl:"modules_file,attr"`
+			Pprof              *bool    `hcl:"pprof,attr"`
+		}
+		var raw admin
+		diags = append(diags, gohcl.DecodeBody(blockRemain, nil, &raw)...)
+
+		if len(listeners) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No admin listeners",
+				Detail:   "An admin block must contain at least one \"http\" or \"fastcgi\" listener block.",
+				Subject:  &block.DefRange,
+			})
+		}
+
+		ret = &Admin{
+			Listeners: listeners,
+			Tokens:    raw.Tokens,
+			DeclRange: block.DefRange,
+		}
+		if raw.AuditLog != nil {
+			ret.AuditLog = *raw.AuditLog
+		}
+		if raw.ReadyChecksSources != nil {
+			ret.ReadyChecksSources = *raw.ReadyChecksSources
+		}
+		if raw.TokenFile != nil {
+			ret.TokenFile = *raw.TokenFile
+		}
+		if raw.Pprof != nil {
+			ret.Pprof = *raw.Pprof
+		}
+		if raw.ModulesFile != nil {
+			ret.ModulesFile = *raw.ModulesFile
+			if !strings.HasSuffix(ret.ModulesFile, ".json") {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid modules_file",
+					Detail:   "The modules file is written in the JSON variant of the configuration syntax, so its name must end with \".json\".",
+					Subject:  &block.DefRange,
+				})
+			}
+			if len(ret.Tokens) == 0 && ret.TokenFile == "" {
+				// Anyone who can reach the admin API could otherwise
+				// serve any directory on the host as a module.
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "No admin tokens configured",
+					Detail:   "An admin block that sets \"modules_file\" must also set at least one of \"tokens\" and \"token_file\", so that changes to the modules are authenticated.",
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+	}
+
+	return ret, remain, diags
+}
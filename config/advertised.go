@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/hashicorp/terraform/svchost"
+)
+
+// advertised is what a listener advertises in place of the server's
+// hostname and base path, so that clients that reach the server in
+// different ways, such as through a unix socket and through a public
+// reverse proxy, each get responses that are correct for them. Either field
+// is nil if the listener doesn't override it.
+type advertised struct {
+	Hostname *svchost.Hostname
+	BasePath *string
+}
+
+type advertisedKey struct{}
+
+// Handler returns a handler that passes requests to the given handler with
+// the overrides recorded, for AdvertisedHostname and AdvertisedBasePath.
+func (a *advertised) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(wr, req.WithContext(context.WithValue(req.Context(), advertisedKey{}, a)))
+	})
+}
+
+// AdvertisedHostname returns the hostname to use in the response to the
+// given request, which is that of the listener that received it if it sets
+// one, or otherwise the given hostname.
+func AdvertisedHostname(req *http.Request, hostname svchost.Hostname) svchost.Hostname {
+	if a, ok := req.Context().Value(advertisedKey{}).(*advertised); ok && a.Hostname != nil {
+		return *a.Hostname
+	}
+	return hostname
+}
+
+// AdvertisedBasePath returns the base path under which the given request is
+// served, which is that of the listener that received it if it sets one, or
+// otherwise the given base path.
+func AdvertisedBasePath(req *http.Request, basePath string) string {
+	if a, ok := req.Context().Value(advertisedKey{}).(*advertised); ok && a.BasePath != nil {
+		return *a.BasePath
+	}
+	return basePath
+}
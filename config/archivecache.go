@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// ArchiveCache is the configuration for the on-disk cache of generated
+// module archives.
+type ArchiveCache struct {
+	Dir string
+
+	// MaxSize is the total size in bytes of the archives to retain, beyond
+	// which the least recently used archives are removed.
+	MaxSize int64
+
+	// VerifyInterval is how often the cached archives are checked for
+	// corruption, or zero if they are never checked.
+	VerifyInterval time.Duration
+
+	DeclRange hcl.Range
+}
+
+// loadArchiveCacheConfig decodes the optional "archive_cache" block from the
+// given body, returning nil if it isn't present.
+func loadArchiveCacheConfig(body hcl.Body) (*ArchiveCache, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "archive_cache",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *ArchiveCache
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate archive_cache block",
+				Detail:   fmt.Sprintf("The archive cache was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type archiveCache struct {
+			Dir            string  `hcl:"dir,attr"`
+			MaxSizeMB      int64   `hcl:"max_size_mb,attr"`
+			VerifyInterval *string `hcl:"verify_interval,attr"`
+		}
+		var raw archiveCache
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+		if raw.MaxSizeMB <= 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid archive cache size",
+				Detail:   "The \"max_size_mb\" argument must be a positive number of megabytes.",
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		var verifyInterval time.Duration
+		if raw.VerifyInterval != nil {
+			var err error
+			verifyInterval, err = time.ParseDuration(*raw.VerifyInterval)
+			if err != nil || verifyInterval < time.Minute {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid verify_interval",
+					Detail:   "The \"verify_interval\" argument must be a duration of at least one minute, such as \"24h\".",
+					Subject:  &block.DefRange,
+				})
+				continue
+			}
+		}
+
+		ret = &ArchiveCache{
+			Dir:            raw.Dir,
+			MaxSize:        raw.MaxSizeMB * 1024 * 1024,
+			VerifyInterval: verifyInterval,
+			DeclRange:      block.DefRange,
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Auth is the configuration for requiring bearer token authentication on
+// requests to the server.
+type Auth struct {
+	// Tokens are tokens given directly in the configuration.
+	Tokens []string
+
+	// TokenFile is a file containing further tokens, one per line, which is
+	// re-read whenever it changes. This is empty if no file is configured.
+	TokenFile string
+
+	// Plugin is an external program that decides whether requests are
+	// allowed, or nil if only the tokens are accepted.
+	Plugin *AuthPlugin
+
+	DeclRange hcl.Range
+}
+
+// AuthPlugin is the configuration for an external program that is run to
+// authenticate each request that doesn't have one of the configured tokens.
+type AuthPlugin struct {
+	// Command is the program to run and its arguments.
+	Command []string
+
+	// Timeout is how long the program may run before the request is
+	// rejected.
+	Timeout time.Duration
+
+	// CacheTTL is how long each of the program's decisions is reused for
+	// identical requests. If zero, the program is run for every request.
+	CacheTTL time.Duration
+
+	DeclRange hcl.Range
+}
+
+// defaultAuthPluginTimeout is the timeout for an auth plugin that doesn't
+// set one explicitly.
+const defaultAuthPluginTimeout = 10 * time.Second
+
+// loadAuthConfig decodes the optional "auth" block from the given body,
+// returning nil if it isn't present.
+func loadAuthConfig(body hcl.Body) (*Auth, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "auth",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Auth
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate auth block",
+				Detail:   fmt.Sprintf("Authentication was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		plugin, blockRemain, pluginDiags := loadAuthPluginConfig(block.Body)
+		diags = append(diags, pluginDiags...)
+
+		type auth struct {
+			Tokens    []string `hcl:"tokens,attr"`
+			TokenFile *string  `hcl:"token_file,attr"`
+		}
+		var raw auth
+		bodyDiags := gohcl.DecodeBody(blockRemain, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Auth{
+			Tokens:    raw.Tokens,
+			Plugin:    plugin,
+			DeclRange: block.DefRange,
+		}
+		if raw.TokenFile != nil {
+			ret.TokenFile = *raw.TokenFile
+		}
+		if len(ret.Tokens) == 0 && ret.TokenFile == "" && ret.Plugin == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No tokens configured",
+				Detail:   "An auth block must set at least one of \"tokens\" and \"token_file\", or contain a \"plugin\" block.",
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
+
+// loadAuthPluginConfig decodes the optional "plugin" block from the body of
+// an "auth" block, returning nil if it isn't present.
+func loadAuthPluginConfig(body hcl.Body) (*AuthPlugin, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "plugin",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *AuthPlugin
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate plugin block",
+				Detail:   fmt.Sprintf("An auth plugin was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		pluginSchema := &hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{
+				{
+					Name:     "command",
+					Required: true,
+				},
+				{
+					Name: "timeout",
+				},
+				{
+					Name: "cache_ttl",
+				},
+			},
+		}
+		pluginContent, contentDiags := block.Body.Content(pluginSchema)
+		diags = append(diags, contentDiags...)
+		if contentDiags.HasErrors() {
+			continue
+		}
+
+		plugin := &AuthPlugin{
+			Timeout:   defaultAuthPluginTimeout,
+			DeclRange: block.DefRange,
+		}
+		attr := pluginContent.Attributes["command"]
+		valDiags := gohcl.DecodeExpression(attr.Expr, nil, &plugin.Command)
+		diags = append(diags, valDiags...)
+		if !valDiags.HasErrors() && len(plugin.Command) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid plugin command",
+				Detail:   "The plugin command must include at least the program to run.",
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+		}
+		if attr, exists := pluginContent.Attributes["timeout"]; exists {
+			var durDiags hcl.Diagnostics
+			plugin.Timeout, durDiags = decodeDuration(attr)
+			diags = append(diags, durDiags...)
+		}
+		if attr, exists := pluginContent.Attributes["cache_ttl"]; exists {
+			var durDiags hcl.Diagnostics
+			plugin.CacheTTL, durDiags = decodeDuration(attr)
+			diags = append(diags, durDiags...)
+		}
+		ret = plugin
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// loadBasePathConfig decodes the optional "base_path" attribute, which is
+// the path under which the server's services are served when it shares a
+// host with other applications. The result has a leading slash and no
+// trailing slash, or is empty if the services are at the root.
+func loadBasePathConfig(body hcl.Body) (string, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name: "base_path",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+	attr, ok := content.Attributes["base_path"]
+	if !ok || diags.HasErrors() {
+		return "", remain, diags
+	}
+
+	ret, valDiags := decodeBasePath(attr)
+	diags = append(diags, valDiags...)
+	return ret, remain, diags
+}
+
+// decodeBasePath decodes a base path from the given attribute, in the same
+// form as loadBasePathConfig returns it.
+func decodeBasePath(attr *hcl.Attribute) (string, hcl.Diagnostics) {
+	var raw string
+	diags := gohcl.DecodeExpression(attr.Expr, nil, &raw)
+	if diags.HasErrors() {
+		return "", diags
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasPrefix(raw, "/") || u.Path != raw || strings.Contains(raw, "//") || hasDotSegment(raw) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid base path",
+			Detail:   "The base path must be an absolute URL path with no query string, such as \"/terraform\".",
+			Subject:  attr.Expr.Range().Ptr(),
+		})
+		return "", diags
+	}
+
+	return strings.TrimSuffix(raw, "/"), diags
+}
+
+// hasDotSegment returns true if the given path has a "." or ".." segment,
+// which clients would remove before making requests.
+func hasDotSegment(path string) bool {
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// basePathServices returns a copy of the given discovery services with the
+// given base path prepended to each of their URLs.
+func basePathServices(basePath string, services map[string]string) map[string]string {
+	ret := make(map[string]string, len(services))
+	for id, loc := range services {
+		ret[id] = basePath + loc
+	}
+	return ret
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+)
+
+// clientFilter restricts the clients that a listener serves by their IP
+// address, which is that given by a trusted proxy if the request came
+// through one.
+type clientFilter struct {
+	// Allowed, if not empty, are the only networks whose clients are
+	// served, and clients in any of the Denied networks are never served,
+	// even if they are also in an allowed network.
+	Allowed []*net.IPNet
+	Denied  []*net.IPNet
+}
+
+// Handler returns a handler that passes the requests of the clients that
+// the filter allows to the given handler, and responds to any others with
+// 403 Forbidden.
+func (f *clientFilter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if !f.allows(req.RemoteAddr) {
+			apierror.Write(wr, req, apierror.Forbidden())
+			return
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+// allows returns true if the client with the given address, which may
+// have a port, is to be served.
+func (f *clientFilter) allows(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		// We can't know which networks a client without an address is in,
+		// such as one connecting through a unix socket, so it's served
+		// only if no network is required.
+		return len(f.Allowed) == 0
+	}
+
+	for _, n := range f.Denied {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allowed) == 0 {
+		return true
+	}
+	for _, n := range f.Allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
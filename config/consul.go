@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Consul is the configuration for registering the server as a service with
+// the local Consul agent, so that other services can discover it.
+type Consul struct {
+	// Address is the base URL of the agent's HTTP API, and Token is the ACL
+	// token to present to it, if any.
+	Address string
+	Token   string
+
+	// ServiceName, ServiceID, ServiceAddress, ServicePort and Tags describe
+	// the service being registered. ServiceAddress may be empty to use the
+	// address of the agent's node.
+	ServiceName    string
+	ServiceID      string
+	ServiceAddress string
+	ServicePort    int
+	Tags           []string
+
+	// CheckURL is polled by the agent every CheckInterval, allowing up to
+	// CheckTimeout for a response, to decide whether the service is healthy.
+	// A service that remains unhealthy for DeregisterAfter is removed.
+	CheckURL        string
+	CheckInterval   time.Duration
+	CheckTimeout    time.Duration
+	DeregisterAfter time.Duration
+
+	DeclRange hcl.Range
+}
+
+// The defaults for the optional arguments of a "consul" block.
+const (
+	defaultConsulAddress         = "http://127.0.0.1:8500"
+	defaultConsulServiceName     = "terraform-registry"
+	defaultConsulCheckInterval   = 10 * time.Second
+	defaultConsulCheckTimeout    = 5 * time.Second
+	defaultConsulDeregisterAfter = 10 * time.Minute
+)
+
+// loadConsulConfig decodes the optional "consul" block from the given body,
+// returning nil if it isn't present. Its address and token default to those
+// given by the standard CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN environment
+// variables.
+func loadConsulConfig(body hcl.Body) (*Consul, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "consul",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Consul
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate consul block",
+				Detail:   fmt.Sprintf("Consul registration was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type consulCheck struct {
+			URL             string  `hcl:"url,attr"`
+			Interval        *string `hcl:"interval,attr"`
+			Timeout         *string `hcl:"timeout,attr"`
+			DeregisterAfter *string `hcl:"deregister_after,attr"`
+		}
+		type consul struct {
+			Address        *string     `hcl:"address,attr"`
+			Token          *string     `hcl:"token,attr"`
+			ServiceName    *string     `hcl:"service_name,attr"`
+			ServiceID      *string     `hcl:"service_id,attr"`
+			ServiceAddress *string     `hcl:"service_address,attr"`
+			ServicePort    int         `hcl:"service_port,attr"`
+			Tags           *[]string   `hcl:"tags,attr"`
+			Check          consulCheck `hcl:"check,block"`
+		}
+		var raw consul
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Consul{
+			Address:         os.Getenv("CONSUL_HTTP_ADDR"),
+			Token:           os.Getenv("CONSUL_HTTP_TOKEN"),
+			ServiceName:     defaultConsulServiceName,
+			ServicePort:     raw.ServicePort,
+			CheckURL:        raw.Check.URL,
+			CheckInterval:   defaultConsulCheckInterval,
+			CheckTimeout:    defaultConsulCheckTimeout,
+			DeregisterAfter: defaultConsulDeregisterAfter,
+			DeclRange:       block.DefRange,
+		}
+		if raw.Address != nil {
+			ret.Address = *raw.Address
+		}
+		if ret.Address == "" {
+			ret.Address = defaultConsulAddress
+		}
+		if raw.Token != nil {
+			ret.Token = *raw.Token
+		}
+		if raw.ServiceName != nil {
+			ret.ServiceName = *raw.ServiceName
+		}
+		if raw.ServiceAddress != nil {
+			ret.ServiceAddress = *raw.ServiceAddress
+		}
+		if raw.Tags != nil {
+			ret.Tags = *raw.Tags
+		}
+		if raw.ServiceID != nil {
+			ret.ServiceID = *raw.ServiceID
+		} else {
+			// The default distinguishes the instances of the service on
+			// different hosts and ports.
+			host, _ := os.Hostname()
+			ret.ServiceID = fmt.Sprintf("%s-%s-%d", ret.ServiceName, host, ret.ServicePort)
+		}
+
+		if u, err := url.Parse(ret.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid Consul address",
+				Detail:   fmt.Sprintf("The Consul agent address %q must be an absolute http or https URL.", ret.Address),
+				Subject:  &block.DefRange,
+			})
+		}
+		if ret.ServicePort < 1 || ret.ServicePort > 65535 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid service_port",
+				Detail:   "The \"service_port\" argument must be a TCP port number.",
+				Subject:  &block.DefRange,
+			})
+		}
+		if u, err := url.Parse(ret.CheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid check URL",
+				Detail:   "The \"url\" argument of the check block must be an absolute http or https URL.",
+				Subject:  &block.DefRange,
+			})
+		}
+		for _, d := range []struct {
+			arg   string
+			value *string
+			dst   *time.Duration
+		}{
+			{"interval", raw.Check.Interval, &ret.CheckInterval},
+			{"timeout", raw.Check.Timeout, &ret.CheckTimeout},
+			{"deregister_after", raw.Check.DeregisterAfter, &ret.DeregisterAfter},
+		} {
+			if d.value == nil {
+				continue
+			}
+			dur, err := time.ParseDuration(*d.value)
+			if err != nil || dur < time.Second {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid check " + d.arg,
+					Detail:   fmt.Sprintf("The %q argument of the check block must be a duration of at least one second, such as \"10s\".", d.arg),
+					Subject:  &block.DefRange,
+				})
+				continue
+			}
+			*d.dst = dur
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// CORS is the configuration for allowing browser-based applications on
+// other origins to call the registry's APIs.
+type CORS struct {
+	// AllowedOrigins are the origins whose scripts may make requests,
+	// such as "https://catalog.example.com". An origin may begin with a
+	// "*." wildcard after its scheme to match any subdomain, or be "*" to
+	// match any origin at all.
+	AllowedOrigins []string
+
+	// AllowedMethods and AllowedHeaders are the methods and request headers
+	// that scripts may use, and ExposedHeaders are the response headers
+	// that they may read.
+	AllowedMethods []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with cookies or HTTP authentication,
+	// and MaxAge is how long browsers may cache the result of a preflight
+	// request, or zero to use their default.
+	AllowCredentials bool
+	MaxAge           time.Duration
+
+	DeclRange hcl.Range
+}
+
+// Defaults for the lists of a cors block. The registry's APIs are read-only,
+// and the exposed headers are those that carry information in their
+// responses.
+var (
+	defaultCORSMethods        = []string{"GET", "HEAD"}
+	defaultCORSHeaders        = []string{"Authorization"}
+	defaultCORSExposedHeaders = []string{"X-Request-ID", "X-Terraform-Get"}
+)
+
+// loadCORSConfig decodes the optional "cors" block from the given body,
+// returning nil if it isn't present.
+func loadCORSConfig(body hcl.Body) (*CORS, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "cors",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *CORS
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate cors block",
+				Detail:   fmt.Sprintf("CORS was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type cors struct {
+			AllowedOrigins   []string       `hcl:"allowed_origins,attr"`
+			AllowedMethods   *[]string      `hcl:"allowed_methods,attr"`
+			AllowedHeaders   *[]string      `hcl:"allowed_headers,attr"`
+			ExposedHeaders   *[]string      `hcl:"exposed_headers,attr"`
+			AllowCredentials *bool          `hcl:"allow_credentials,attr"`
+			MaxAge           *hcl.Attribute `hcl:"max_age,attr"`
+		}
+		var raw cors
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &CORS{
+			AllowedOrigins: raw.AllowedOrigins,
+			AllowedMethods: defaultCORSMethods,
+			AllowedHeaders: defaultCORSHeaders,
+			ExposedHeaders: defaultCORSExposedHeaders,
+			DeclRange:      block.DefRange,
+		}
+		if raw.AllowedMethods != nil {
+			ret.AllowedMethods = nil
+			for _, method := range *raw.AllowedMethods {
+				ret.AllowedMethods = append(ret.AllowedMethods, strings.ToUpper(method))
+			}
+		}
+		if raw.AllowedHeaders != nil {
+			ret.AllowedHeaders = *raw.AllowedHeaders
+		}
+		if raw.ExposedHeaders != nil {
+			ret.ExposedHeaders = *raw.ExposedHeaders
+		}
+		if raw.AllowCredentials != nil {
+			ret.AllowCredentials = *raw.AllowCredentials
+		}
+		if raw.MaxAge != nil {
+			var durDiags hcl.Diagnostics
+			ret.MaxAge, durDiags = decodeDuration(raw.MaxAge)
+			diags = append(diags, durDiags...)
+		}
+
+		if len(ret.AllowedOrigins) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid CORS origins",
+				Detail:   "The \"allowed_origins\" argument must contain at least one origin.",
+				Subject:  &block.DefRange,
+			})
+		}
+		for _, origin := range ret.AllowedOrigins {
+			if origin == "*" {
+				if ret.AllowCredentials {
+					// Browsers refuse this combination, and it would let
+					// any site act as the user if they didn't.
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid CORS origins",
+						Detail:   "The origin \"*\" cannot be allowed when \"allow_credentials\" is set. List the origins to allow instead.",
+						Subject:  &block.DefRange,
+					})
+				}
+				continue
+			}
+			if !validCORSOrigin(origin) {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid CORS origins",
+					Detail:   fmt.Sprintf("The origin %q is not valid. Must be a scheme and host with no path, such as \"https://catalog.example.com\" or \"https://*.example.com\", or \"*\".", origin),
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+		for _, method := range ret.AllowedMethods {
+			if !validHTTPToken(method) {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid CORS method",
+					Detail:   fmt.Sprintf("The method %q is not a valid HTTP method.", method),
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+		for _, header := range append(append([]string(nil), ret.AllowedHeaders...), ret.ExposedHeaders...) {
+			if !validHTTPToken(header) {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid CORS header",
+					Detail:   fmt.Sprintf("The header %q is not a valid HTTP header name.", header),
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+	}
+
+	return ret, remain, diags
+}
+
+// validCORSOrigin returns true if the given string is an origin as sent by
+// browsers, other than that its host may begin with a "*." wildcard.
+func validCORSOrigin(origin string) bool {
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// validHTTPToken returns true if the given string is a valid HTTP method or
+// header name.
+func validHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > '~' || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Discovery is the configuration for the service discovery document that
+// Terraform requests from /.well-known/terraform.json.
+type Discovery struct {
+	// Services maps service identifiers, like "modules.v1", to the URL of
+	// each service. Relative URLs are resolved by Terraform relative to the
+	// URL of the discovery document itself.
+	Services map[string]string
+
+	DeclRange hcl.Range
+}
+
+// loadDiscoveryConfig decodes the optional "discovery" block from the given
+// body, returning nil if it isn't present. If the block does not set
+// "services", the given defaults are used instead.
+func loadDiscoveryConfig(body hcl.Body, defaults map[string]string) (*Discovery, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "discovery",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Discovery
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate discovery block",
+				Detail:   fmt.Sprintf("The discovery document was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type discovery struct {
+			Services *map[string]string `hcl:"services,attr"`
+		}
+		var raw discovery
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Discovery{
+			Services:  defaults,
+			DeclRange: block.DefRange,
+		}
+		if raw.Services == nil {
+			continue
+		}
+
+		ret.Services = *raw.Services
+		for id, loc := range ret.Services {
+			if _, err := url.Parse(loc); err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid service URL",
+					Detail:   fmt.Sprintf("The URL for service %q is invalid: %s.", id, err),
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// decodeDuration decodes the given attribute as a duration string in the
+// format accepted by time.ParseDuration, such as "1h30m".
+func decodeDuration(attr *hcl.Attribute) (time.Duration, hcl.Diagnostics) {
+	var raw string
+	diags := gohcl.DecodeExpression(attr.Expr, nil, &raw)
+	if diags.HasErrors() {
+		return 0, diags
+	}
+
+	ret, err := time.ParseDuration(raw)
+	if err != nil || ret < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid duration",
+			Detail:   fmt.Sprintf("The value for %q must be a non-negative duration such as \"30s\" or \"24h\".", attr.Name),
+			Subject:  attr.Expr.Range().Ptr(),
+		})
+		return 0, diags
+	}
+	return ret, diags
+}
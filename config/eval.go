@@ -0,0 +1,81 @@
+package config
+
+import (
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// bindEvalContext returns a body whose expressions, including those of its
+// nested blocks, are all evaluated in the given context, whatever context
+// they are decoded with. This lets the decoders of each part of the
+// configuration keep decoding with a nil context, while the configuration
+// can still call the functions of the configuration language.
+func bindEvalContext(body hcl.Body, ctx *hcl.EvalContext) hcl.Body {
+	return evalBody{body, ctx}
+}
+
+type evalBody struct {
+	hcl.Body
+	ctx *hcl.EvalContext
+}
+
+func (b evalBody) Content(schema *hcl.BodySchema) (*hcl.BodyContent, hcl.Diagnostics) {
+	content, diags := b.Body.Content(schema)
+	return b.content(content), diags
+}
+
+func (b evalBody) PartialContent(schema *hcl.BodySchema) (*hcl.BodyContent, hcl.Body, hcl.Diagnostics) {
+	content, remain, diags := b.Body.PartialContent(schema)
+	if remain != nil {
+		remain = evalBody{remain, b.ctx}
+	}
+	return b.content(content), remain, diags
+}
+
+func (b evalBody) JustAttributes() (hcl.Attributes, hcl.Diagnostics) {
+	attrs, diags := b.Body.JustAttributes()
+	return b.attributes(attrs), diags
+}
+
+func (b evalBody) content(content *hcl.BodyContent) *hcl.BodyContent {
+	if content == nil {
+		return nil
+	}
+
+	// The content is copied rather than changed in place, since it may
+	// belong to the underlying body.
+	ret := &hcl.BodyContent{
+		Attributes:       b.attributes(content.Attributes),
+		MissingItemRange: content.MissingItemRange,
+	}
+	for _, block := range content.Blocks {
+		newBlock := *block
+		newBlock.Body = evalBody{block.Body, b.ctx}
+		ret.Blocks = append(ret.Blocks, &newBlock)
+	}
+	return ret
+}
+
+func (b evalBody) attributes(attrs hcl.Attributes) hcl.Attributes {
+	if attrs == nil {
+		return nil
+	}
+
+	ret := make(hcl.Attributes, len(attrs))
+	for name, attr := range attrs {
+		newAttr := *attr
+		newAttr.Expr = evalExpr{attr.Expr, b.ctx}
+		ret[name] = &newAttr
+	}
+	return ret
+}
+
+// evalExpr is an expression that is always evaluated in a given context.
+type evalExpr struct {
+	hcl.Expression
+	ctx *hcl.EvalContext
+}
+
+func (e evalExpr) Value(*hcl.EvalContext) (cty.Value, hcl.Diagnostics) {
+	return e.Expression.Value(e.ctx)
+}
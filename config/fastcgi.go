@@ -0,0 +1,261 @@
+package config
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"sync"
+	"time"
+)
+
+// serveFastCGI is like fcgi.Serve, except that the context of each request
+// is canceled when the web server aborts the request or closes its
+// connection, as net/http does when a client disconnects. net/http/fcgi
+// handles aborts itself without telling the handler, and so it would
+// otherwise continue to produce a response that nobody will receive.
+//
+// Once stop is closed, it closes the listener and then waits for up to
+// drainTimeout, as http.Server.Shutdown does, for the requests in progress
+// to complete before closing the connections, which web servers may
+// otherwise keep open indefinitely.
+func serveFastCGI(l net.Listener, handler http.Handler, stop <-chan struct{}, drainTimeout time.Duration) error {
+	srv := &fastCGIServer{
+		conns: make(map[*fastCGIConn]struct{}),
+	}
+	handler = srv.track(handler)
+
+	accepted := make(chan error, 1)
+	go func() {
+		for {
+			rwc, err := l.Accept()
+			if err != nil {
+				accepted <- err
+				return
+			}
+			conn := &fastCGIConn{
+				Conn:     rwc,
+				requests: make(map[*fastCGIRequest]struct{}),
+			}
+			srv.add(conn)
+			// Each connection is served separately so that its handler can
+			// find the requests that belong to it.
+			go fcgi.Serve(&fastCGIConnListener{conn: conn}, conn.handler(handler))
+		}
+	}()
+
+	select {
+	case err := <-accepted:
+		return err
+	case <-stop:
+		l.Close()
+		srv.drain(drainTimeout)
+		return nil
+	}
+}
+
+// fastCGIServer tracks the connections and requests in progress for a
+// single FastCGI listener, so that it can be stopped gracefully.
+type fastCGIServer struct {
+	mu     sync.Mutex
+	conns  map[*fastCGIConn]struct{}
+	active sync.WaitGroup
+}
+
+func (s *fastCGIServer) add(c *fastCGIConn) {
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	c.onClose = func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}
+}
+
+// track wraps the given handler so that the server knows which requests
+// are in progress.
+func (s *fastCGIServer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		s.active.Add(1)
+		defer s.active.Done()
+		next.ServeHTTP(wr, req)
+	})
+}
+
+// drain waits for up to the given timeout for the requests in progress to
+// complete, and then closes all of the connections.
+func (s *fastCGIServer) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	conns := make([]*fastCGIConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// fastCGIAbortRequest is the FCGI_ABORT_REQUEST record type.
+const fastCGIAbortRequest = 2
+
+// fastCGIConn is a FastCGI connection that watches the records read from it
+// for aborts, and for the connection closing, and cancels the requests in
+// progress on it when they happen.
+type fastCGIConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	requests map[*fastCGIRequest]struct{}
+	closed   bool
+
+	// onClose, if set, is called when the connection is closed.
+	onClose   func()
+	closeOnce sync.Once
+
+	// header is the partially-read header of the next record, and skip is
+	// the number of bytes remaining in the body of the current one.
+	header    [8]byte
+	headerLen int
+	skip      int
+}
+
+type fastCGIRequest struct {
+	cancel context.CancelFunc
+}
+
+func (c *fastCGIConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.scan(p[:n])
+	if err != nil {
+		c.cancel(true)
+	}
+	return n, err
+}
+
+func (c *fastCGIConn) Close() error {
+	c.cancel(true)
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return c.Conn.Close()
+}
+
+// scan follows the record boundaries in the given bytes read from the
+// connection, looking for aborts.
+func (c *fastCGIConn) scan(b []byte) {
+	for len(b) > 0 {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(b) {
+				n = len(b)
+			}
+			c.skip -= n
+			b = b[n:]
+			continue
+		}
+
+		n := copy(c.header[c.headerLen:], b)
+		c.headerLen += n
+		b = b[n:]
+		if c.headerLen < len(c.header) {
+			return
+		}
+		c.headerLen = 0
+
+		// The header is version, type, request id, content length, padding
+		// length and a reserved byte.
+		c.skip = int(binary.BigEndian.Uint16(c.header[4:6])) + int(c.header[6])
+		if c.header[1] == fastCGIAbortRequest {
+			c.cancel(false)
+		}
+	}
+}
+
+// cancel cancels the requests in progress on the connection, and if closed
+// is set then also any that start later.
+//
+// An abort record identifies its request only by its FastCGI request id,
+// which isn't visible to handlers, and so it can only be attributed to a
+// request when that request is the only one in progress. Web servers don't
+// multiplex requests on a connection in practice, but if one does then its
+// aborted requests are canceled only once the connection is closed.
+func (c *fastCGIConn) cancel(closed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if closed {
+		c.closed = true
+	} else if len(c.requests) != 1 {
+		return
+	}
+	for r := range c.requests {
+		r.cancel()
+		delete(c.requests, r)
+	}
+}
+
+// handler wraps the given handler so that each request it serves from the
+// receiver is given a context that is canceled by cancel.
+func (c *fastCGIConn) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		r := &fastCGIRequest{cancel: cancel}
+		c.mu.Lock()
+		if c.closed {
+			cancel()
+		} else {
+			c.requests[r] = struct{}{}
+		}
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.requests, r)
+			c.mu.Unlock()
+		}()
+
+		next.ServeHTTP(wr, req.WithContext(ctx))
+	})
+}
+
+// fastCGIConnListener is a net.Listener that yields just one connection,
+// for serving it with fcgi.Serve.
+type fastCGIConnListener struct {
+	conn     net.Conn
+	accepted bool
+}
+
+func (l *fastCGIConnListener) Accept() (net.Conn, error) {
+	if l.accepted {
+		// fcgi.Serve returns on this error, but the connection is served
+		// by a separate goroutine that continues until it closes.
+		return nil, io.EOF
+	}
+	l.accepted = true
+	return l.conn, nil
+}
+
+func (l *fastCGIConnListener) Close() error {
+	return nil
+}
+
+func (l *fastCGIConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+)
+
+// ParseFiles uses the given parser to read the configuration files at the
+// given paths, which may each be either an individual file or a directory
+// containing potentially-many configuration files. The result is a single
+// body that merges together the contents of all of the files, along with
+// those of the files that they include with "include" blocks.
+//
+// Files with a .json suffix are parsed as JSON-flavored HCL, while all other
+// files are parsed as native HCL syntax.
+//
+// If the returned diagnostics contains errors, the returned body may be
+// incomplete and so should not be decoded.
+func ParseFiles(parser *hclparse.Parser, paths []string) (hcl.Body, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	if len(paths) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "No configuration files specified",
+			Detail:   "At least one configuration file or configuration directory must be given.",
+		})
+	}
+
+	l := &fileLoader{
+		parser: parser,
+		loaded: make(map[string]bool),
+	}
+	for _, path := range paths {
+		diags = append(diags, l.loadPath(path, nil)...)
+	}
+
+	return mergeBodies(l.bodies), diags
+}
+
+// fileLoader reads configuration files for ParseFiles, following their
+// "include" blocks.
+type fileLoader struct {
+	parser *hclparse.Parser
+	bodies []hcl.Body
+
+	// loaded are the absolute paths of the files read so far, so that a
+	// file that is included more than once, such as by overlapping
+	// patterns or by a file that includes itself, is read only once.
+	loaded map[string]bool
+}
+
+// includeSchema is the schema of the "include" blocks, whose label is a
+// glob pattern of the files to include.
+var includeSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{
+			Type:       "include",
+			LabelNames: []string{"pattern"},
+		},
+	},
+}
+
+// loadPath reads the configuration file at the given path, or each of the
+// files in the directory at the given path. The given range is that of the
+// "include" block that named the path, or nil if it was given on the
+// command line.
+func (l *fileLoader) loadPath(path string, subject *hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	info, err := os.Stat(path)
+	if err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Configuration file not found",
+			Detail:   fmt.Sprintf("Failed to read %s as a configuration file: %s", path, err),
+			Subject:  subject,
+		})
+		return diags
+	}
+
+	if !info.IsDir() {
+		return l.loadFile(path)
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return diags
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		diags = append(diags, l.loadFile(filepath.Join(path, entry.Name()))...)
+	}
+	return diags
+}
+
+// loadFile reads the configuration file at the given path, and then the
+// files that it includes.
+func (l *fileLoader) loadFile(path string) hcl.Diagnostics {
+	if abs, err := filepath.Abs(path); err == nil {
+		if l.loaded[abs] {
+			return nil
+		}
+		l.loaded[abs] = true
+	}
+
+	var file *hcl.File
+	var diags hcl.Diagnostics
+	if match, _ := filepath.Match("*.json", filepath.Base(path)); match {
+		file, diags = l.parser.ParseJSONFile(path)
+	} else {
+		file, diags = l.parser.ParseHCLFile(path)
+	}
+	if file == nil || diags.HasErrors() {
+		return diags
+	}
+
+	content, remain, contentDiags := file.Body.PartialContent(includeSchema)
+	diags = append(diags, contentDiags...)
+	l.bodies = append(l.bodies, remain)
+	for _, block := range content.Blocks {
+		_, bodyDiags := block.Body.Content(&hcl.BodySchema{})
+		diags = append(diags, bodyDiags...)
+
+		// Patterns are relative to the directory of the file that includes
+		// them, so that a configuration can be moved as a whole.
+		pattern := block.Labels[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid include pattern",
+				Detail:   fmt.Sprintf("The pattern %q is not a valid glob pattern: %s.", block.Labels[0], err),
+				Subject:  block.LabelRanges[0].Ptr(),
+			})
+			continue
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			// A pattern without wildcards names a single file that must
+			// exist, while one with wildcards may match nothing yet, such
+			// as a team's directory with no modules in it.
+			matches = []string{pattern}
+		}
+		for _, match := range matches {
+			diags = append(diags, l.loadPath(match, &block.DefRange)...)
+		}
+	}
+	return diags
+}
+
+// LoadModulesFile uses the given parser to read the modules file that is
+// managed through the admin API, as named by an Admin's ModulesFile, and
+// adds the modules that it declares to the given modules, with the given
+// settings as their defaults. The file is treated as empty if it doesn't
+// exist yet.
+//
+// If contents isn't nil then it is used in place of the contents of the
+// file, so that a change to the file can be checked before it is written.
+func LoadModulesFile(parser *hclparse.Parser, filename string, contents []byte, modules Modules, settings ModuleSettings) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	if contents == nil {
+		var err error
+		contents, err = ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return diags
+		}
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read modules file",
+				Detail:   fmt.Sprintf("Failed to read %s as the modules file: %s", filename, err),
+			})
+			return diags
+		}
+	}
+
+	file, fileDiags := parser.ParseJSON(contents, filename)
+	diags = append(diags, fileDiags...)
+	if fileDiags.HasErrors() {
+		return diags
+	}
+
+	// The file is rewritten with only its module blocks whenever the admin
+	// API changes it, so anything else would be lost.
+	content, contentDiags := file.Body.Content(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{moduleBlockSchema},
+	})
+	diags = append(diags, contentDiags...)
+	if contentDiags.HasErrors() {
+		return diags
+	}
+
+	_, fileModules, modulesDiags := decodeModuleBlocks(content.Blocks, settings)
+	diags = append(diags, modulesDiags...)
+	for nsKey, byNamespace := range fileModules {
+		for nameKey, byName := range byNamespace {
+			for providerKey, mod := range byName {
+				if existing := modules.Get(nsKey, nameKey, providerKey); existing != nil {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Duplicate module declaration",
+						Detail:   fmt.Sprintf("A module block for %q %q %q was already declared at %s.", mod.Namespace, mod.Name, mod.Provider, existing.DeclRange),
+						Subject:  &mod.DeclRange,
+					})
+					continue
+				}
+				if modules[nsKey] == nil {
+					modules[nsKey] = make(map[string]map[string]*Module)
+				}
+				if modules[nsKey][nameKey] == nil {
+					modules[nsKey][nameKey] = make(map[string]*Module)
+				}
+				modules[nsKey][nameKey][providerKey] = mod
+			}
+		}
+	}
+
+	return diags
+}
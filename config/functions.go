@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// evalContext returns the context in which the expressions of the
+// configuration are evaluated, which gives them the functions of the
+// configuration language.
+func evalContext() *hcl.EvalContext {
+	return &hcl.EvalContext{
+		Functions: map[string]function.Function{
+			"env":       envFunc,
+			"file":      fileFunc,
+			"trimspace": trimSpaceFunc,
+		},
+	}
+}
+
+// envFunc returns the value of the environment variable with the given
+// name. It fails if the variable isn't set, unless it is given a second
+// argument to return instead.
+var envFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "name",
+			Type: cty.String,
+		},
+	},
+	VarParam: &function.Parameter{
+		Name: "default",
+		Type: cty.String,
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		if len(args) > 2 {
+			return cty.UnknownVal(cty.String), fmt.Errorf("too many arguments; env takes a name and an optional default")
+		}
+		name := args[0].AsString()
+		if value, ok := os.LookupEnv(name); ok {
+			return cty.StringVal(value), nil
+		}
+		if len(args) == 2 {
+			return args[1], nil
+		}
+		return cty.UnknownVal(cty.String), fmt.Errorf("the environment variable %s is not set", name)
+	},
+})
+
+// fileFunc returns the contents of the file at the given path, which is
+// relative to the server's working directory.
+var fileFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "path",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		path := args[0].AsString()
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cty.UnknownVal(cty.String), err
+		}
+		if !utf8.Valid(buf) {
+			return cty.UnknownVal(cty.String), fmt.Errorf("the contents of %s are not valid UTF-8", path)
+		}
+		return cty.StringVal(string(buf)), nil
+	},
+})
+
+// trimSpaceFunc returns the given string without its leading and trailing
+// whitespace, such as the newline that ends most files read with file.
+var trimSpaceFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "str",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.StringVal(strings.TrimSpace(args[0].AsString())), nil
+	},
+})
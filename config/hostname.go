@@ -23,12 +23,18 @@ func loadHostnameConfig(body hcl.Body) (svchost.Hostname, hcl.Body, hcl.Diagnost
 		return svchost.Hostname(""), remain, diags
 	}
 
-	expr := content.Attributes["hostname"].Expr
-	var raw string
-	valDiags := gohcl.DecodeExpression(expr, nil, &raw)
+	ret, valDiags := decodeHostname(content.Attributes["hostname"].Expr)
 	diags = append(diags, valDiags...)
-	if valDiags.HasErrors() {
-		return svchost.Hostname(""), remain, diags
+	return ret, remain, diags
+}
+
+// decodeHostname decodes a hostname from the given expression, normalizing
+// it as Terraform does.
+func decodeHostname(expr hcl.Expression) (svchost.Hostname, hcl.Diagnostics) {
+	var raw string
+	diags := gohcl.DecodeExpression(expr, nil, &raw)
+	if diags.HasErrors() {
+		return svchost.Hostname(""), diags
 	}
 
 	ret, err := svchost.ForComparison(raw)
@@ -39,8 +45,8 @@ func loadHostnameConfig(body hcl.Body) (svchost.Hostname, hcl.Body, hcl.Diagnost
 			Detail:   fmt.Sprintf("The given hostname is invalid: %s", err),
 			Subject:  expr.Range().Ptr(),
 		})
-		return svchost.Hostname(""), remain, diags
+		return svchost.Hostname(""), diags
 	}
 
-	return ret, remain, diags
+	return ret, diags
 }
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// identifierPattern matches the identifiers accepted for namespaces, names,
+// providers and provider types. This is the same pattern used for module
+// namespaces and names by the public Terraform registry.
+var identifierPattern = regexp.MustCompile(`^[0-9A-Za-z](?:[0-9A-Za-z_-]{0,62}[0-9A-Za-z])?$`)
+
+// ValidIdentifier returns true if the given string is acceptable as a
+// namespace, name, provider, or provider type.
+func ValidIdentifier(s string) bool {
+	return identifierPattern.MatchString(s)
+}
+
+// NormalizeIdentifier returns the normalized form of a namespace, name,
+// provider, or provider type, which are all case-insensitive in the
+// registry protocols. Two identifiers are considered equivalent if their
+// normalized forms are equal.
+func NormalizeIdentifier(s string) string {
+	return strings.ToLower(s)
+}
+
+// checkBlockLabels returns error diagnostics for any labels of the given
+// block that are not valid identifiers.
+func checkBlockLabels(block *hcl.Block, labelNames ...string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for i, label := range block.Labels {
+		if ValidIdentifier(label) {
+			continue
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid identifier",
+			Detail:   fmt.Sprintf("%q is not a valid %s: must be between 1 and 64 ASCII letters, digits, dashes and underscores, starting and ending with a letter or digit.", label, labelNames[i]),
+			Subject:  block.LabelRanges[i].Ptr(),
+		})
+	}
+	return diags
+}
+
+// caseConflictNote returns a sentence to append to a duplicate declaration
+// error message if the two given labels differ only in case, or an empty
+// string otherwise.
+func caseConflictNote(a, b string) string {
+	if a == b {
+		return ""
+	}
+	return fmt.Sprintf(" Identifiers are not case-sensitive, so %q is equivalent to %q.", a, b)
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// DefaultDrainTimeout is how long a listener that is being stopped waits for
+// the requests in progress to complete, after which their connections are
+// closed, unless "drain_timeout" is set. Event streams, in particular,
+// never complete by themselves.
+const DefaultDrainTimeout = 30 * time.Second
+
+// ListenerGroup serves a handler on a set of listeners that can be changed
+// while it is serving, such as when the configuration is reloaded, without
+// interrupting the requests in progress on the listeners that remain.
+type ListenerGroup struct {
+	handler      http.Handler
+	drainTimeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]*runningListener
+}
+
+type runningListener struct {
+	listener  Listener
+	stop      chan struct{}
+	listening chan struct{}
+	done      chan struct{}
+	bound     bool
+}
+
+// NewListenerGroup returns a group that serves the given handler, initially
+// on no listeners. Listeners that are stopped wait for up to drainTimeout
+// for the requests in progress on them to complete.
+func NewListenerGroup(handler http.Handler, drainTimeout time.Duration) *ListenerGroup {
+	return &ListenerGroup{
+		handler:      handler,
+		drainTimeout: drainTimeout,
+		running:      make(map[string]*runningListener),
+	}
+}
+
+// Update starts serving on each of the given listeners that the group isn't
+// already serving on, and stops serving on any others once the requests in
+// progress on them complete. Each listener runs in its own goroutine, and
+// any that fail to listen are logged using the "logging" package, and will
+// be tried again by the next update that includes them.
+//
+// Listeners are identified by their protocol and address, so one whose
+// other settings, such as TLS, have changed continues with its previous
+// settings until the server restarts, since otherwise it would briefly
+// refuse connections while its socket was bound again.
+func (g *ListenerGroup) Update(ls Listeners) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	want := make(map[string]Listener, len(ls))
+	for l := range ls {
+		want[l.String()] = l
+	}
+
+	for key, r := range g.running {
+		if _, ok := want[key]; !ok {
+			logging.Infof("stopping: %s", key)
+			close(r.stop)
+			delete(g.running, key)
+		}
+	}
+	for key, l := range want {
+		if _, ok := g.running[key]; ok {
+			continue
+		}
+		r := &runningListener{
+			listener:  l,
+			stop:      make(chan struct{}),
+			listening: make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+		g.running[key] = r
+		go g.serve(key, r)
+	}
+}
+
+// Shutdown stops all of the group's listeners, as Update does for those it
+// removes, and returns once they have all finished draining.
+func (g *ListenerGroup) Shutdown() {
+	g.mu.Lock()
+	var done []chan struct{}
+	for _, r := range g.running {
+		done = append(done, r.done)
+	}
+	g.mu.Unlock()
+
+	g.Update(nil)
+	for _, ch := range done {
+		<-ch
+	}
+}
+
+// WaitListening returns once each of the group's listeners has either begun
+// listening or failed to.
+func (g *ListenerGroup) WaitListening() {
+	g.mu.Lock()
+	var listening []chan struct{}
+	for _, r := range g.running {
+		listening = append(listening, r.listening)
+	}
+	g.mu.Unlock()
+
+	for _, ch := range listening {
+		<-ch
+	}
+}
+
+// Bound returns the number of the group's listeners that are currently
+// listening.
+func (g *ListenerGroup) Bound() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+	for _, r := range g.running {
+		if r.bound {
+			n++
+		}
+	}
+	return n
+}
+
+func (g *ListenerGroup) serve(key string, r *runningListener) {
+	defer close(r.done)
+
+	socket, err := r.listener.Listen()
+	if err == nil {
+		g.mu.Lock()
+		r.bound = true
+		g.mu.Unlock()
+	}
+	close(r.listening)
+	if err == nil {
+		err = r.listener.Serve(socket, g.handler, r.stop, g.drainTimeout)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r.bound = false
+	if g.running[key] == r {
+		// The listener failed by itself rather than being stopped, so the
+		// next update should try it again.
+		delete(g.running, key)
+	}
+	if err != nil {
+		logging.Errorf("failed to listen: %s: %s", key, err)
+	}
+}
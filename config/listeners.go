@@ -1,17 +1,25 @@
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
-	"net/http/fcgi"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/hashicorp/hcl2/gohcl"
 	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/apparentlymart/terraform-simple-registry/forwarded"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+	"github.com/apparentlymart/terraform-simple-registry/tracing"
 )
 
 type Listeners map[Listener]struct{}
@@ -23,34 +31,75 @@ type Listeners map[Listener]struct{}
 // additional goroutines as requests arrive.
 //
 // This function never returns. If any of the listeners fail to listen, errors
-// will be logged using the "log" package.
+// will be logged using the "logging" package. Servers whose listeners can be
+// reloaded use a ListenerGroup instead.
 func (ls Listeners) ListenAndServe(handler http.Handler) {
-	for l := range ls {
-		go func(l Listener) {
-			err := l.ListenAndServe(handler)
-			if err != nil {
-				log.Printf("failed to listen: %s", err)
-			}
-		}(l)
-	}
+	NewListenerGroup(handler, DefaultDrainTimeout).Update(ls)
 
 	// Block forever
 	never := make(chan struct{})
 	<-never
 }
 
+// CheckCertificates reads the certificate files of each of the listeners,
+// returning an error describing the first that can't be read. Listeners
+// otherwise read them only when they first listen.
+func (ls Listeners) CheckCertificates() error {
+	for l := range ls {
+		var conf listenerConfig
+		switch l := l.(type) {
+		case httpListener:
+			conf = l.conf
+		case fastCGIListener:
+			conf = l.conf
+		}
+		if conf.TLS == nil {
+			continue
+		}
+		for _, t := range conf.TLS.Blocks {
+			if _, err := loadCertificate(t.CertFile, t.KeyFile); err != nil {
+				return fmt.Errorf("invalid certificate for listener %s: %s", l, err)
+			}
+		}
+	}
+	return nil
+}
+
 func loadListenersConfig(body hcl.Body) (Listeners, hcl.Body, hcl.Diagnostics) {
 	// We use some local types here to make our decoding a bit more declarative,
 	// and then produce the _real_ listener types before we return.
 
 	type tls struct {
-		CertFile string `hcl:"cert_file,attr"`
-		KeyFile  string `hcl:"key_file,attr"`
+		CertFile         string         `hcl:"cert_file,attr"`
+		KeyFile          string         `hcl:"key_file,attr"`
+		ServerNames      *hcl.Attribute `hcl:"server_names,attr"`
+		MinVersion       *hcl.Attribute `hcl:"min_version,attr"`
+		MaxVersion       *hcl.Attribute `hcl:"max_version,attr"`
+		CipherSuites     *hcl.Attribute `hcl:"cipher_suites,attr"`
+		CurvePreferences *hcl.Attribute `hcl:"curve_preferences,attr"`
+	}
+	type accessLogBlock struct {
+		Path   *string        `hcl:"path,attr"`
+		Format *hcl.Attribute `hcl:"format,attr"`
 	}
 	type listener struct {
-		Address      *string `hcl:"address,attr"`
-		SocketNumber *int    `hcl:"socket_number,attr"`
-		TLS          *tls    `hcl:"tls,block"`
+		Address      *hcl.Attribute  `hcl:"address,attr"`
+		Addresses    *hcl.Attribute  `hcl:"addresses,attr"`
+		SocketNumber *hcl.Attribute  `hcl:"socket_number,attr"`
+		SocketName   *hcl.Attribute  `hcl:"socket_name,attr"`
+		Proxies      *hcl.Attribute  `hcl:"trusted_proxies,attr"`
+		Allowed      *hcl.Attribute  `hcl:"allowed_clients,attr"`
+		Denied       *hcl.Attribute  `hcl:"denied_clients,attr"`
+		TLS          []tls           `hcl:"tls,block"`
+		AccessLog    *accessLogBlock `hcl:"access_log,block"`
+		H2C          *hcl.Attribute  `hcl:"h2c,attr"`
+		Hostname     *hcl.Attribute  `hcl:"hostname,attr"`
+		BasePath     *hcl.Attribute  `hcl:"base_path,attr"`
+
+		ReadTimeout       *hcl.Attribute `hcl:"read_timeout,attr"`
+		ReadHeaderTimeout *hcl.Attribute `hcl:"read_header_timeout,attr"`
+		WriteTimeout      *hcl.Attribute `hcl:"write_timeout,attr"`
+		IdleTimeout       *hcl.Attribute `hcl:"idle_timeout,attr"`
 	}
 	type listenersConfig struct {
 		HTTP    []listener `hcl:"http,block"`
@@ -63,126 +112,495 @@ func loadListenersConfig(body hcl.Body) (Listeners, hcl.Body, hcl.Diagnostics) {
 
 	ret := make(map[Listener]struct{})
 
-	listenerConf := func(lc listener) listenerConfig {
-		if lc.Address != nil && lc.SocketNumber != nil {
-			diags = append(diags, &hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Invalid listener configuration",
-				Detail:   "Cannot set both \"address\" and \"socket_number\" for the same listener.",
-				// FIXME: We don't have access to the source range here :(
-			})
+	// listenerConfs returns one listenerConfig for each socket that the
+	// given listener block binds, which is more than one only if it sets
+	// "addresses" or a "socket_name" that several sockets share.
+	listenerConfs := func(lc listener) []listenerConfig {
+		var first *hcl.Attribute
+		for _, attr := range []*hcl.Attribute{lc.Address, lc.Addresses, lc.SocketNumber, lc.SocketName} {
+			if attr == nil {
+				continue
+			}
+			if first != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid listener configuration",
+					Detail:   fmt.Sprintf("Only one of \"address\", \"addresses\", \"socket_number\" and \"socket_name\" may be set for the same listener, but both %q and %q are set.", first.Name, attr.Name),
+					Subject:  &attr.Range,
+				})
+				break
+			}
+			first = attr
 		}
 
-		var socket socketConfig
+		var sockets []socketConfig
 
 		switch {
 		case lc.Address != nil:
-			if strings.HasPrefix(*lc.Address, "/") {
-				socket = unixSocketPath(*lc.Address)
+			var addr string
+			diags = append(diags, gohcl.DecodeExpression(lc.Address.Expr, nil, &addr)...)
+			if strings.HasPrefix(addr, "/") {
+				sockets = append(sockets, unixSocketPath(addr))
 			} else {
-				socket = tcpAddress(*lc.Address)
+				sockets = append(sockets, tcpAddress(addr))
+			}
+		case lc.Addresses != nil:
+			var addrs []string
+			valDiags := gohcl.DecodeExpression(lc.Addresses.Expr, nil, &addrs)
+			diags = append(diags, valDiags...)
+			if !valDiags.HasErrors() && len(addrs) == 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid listener configuration",
+					Detail:   "A listener's \"addresses\" must contain at least one address.",
+					Subject:  &lc.Addresses.Range,
+				})
+			}
+			for _, addr := range addrs {
+				if strings.HasPrefix(addr, "/") {
+					sockets = append(sockets, unixSocketPath(addr))
+				} else {
+					sockets = append(sockets, tcpFamilyAddress(addr))
+				}
 			}
 		case lc.SocketNumber != nil:
-			socket = socketActivationIndex(*lc.SocketNumber)
+			var num int
+			diags = append(diags, gohcl.DecodeExpression(lc.SocketNumber.Expr, nil, &num)...)
+			sockets = append(sockets, socketActivationIndex(num))
+		case lc.SocketName != nil:
+			var socketName string
+			valDiags := gohcl.DecodeExpression(lc.SocketName.Expr, nil, &socketName)
+			diags = append(diags, valDiags...)
+			if !valDiags.HasErrors() && (socketName == "" || strings.Contains(socketName, ":")) {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid listener configuration",
+					Detail:   fmt.Sprintf("The socket name %q is not valid. A socket name must not be empty or contain colons.", socketName),
+					Subject:  &lc.SocketName.Range,
+				})
+			}
+			// A socket unit gives the same name to all of its sockets, so
+			// a name selects each of the sockets that were passed with
+			// it. If there are none then we still produce one, so that
+			// the failure is logged when it tries to listen.
+			n := 0
+			for _, name := range socketActivationNames() {
+				if name == socketName {
+					n++
+				}
+			}
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				sockets = append(sockets, socketActivationName{socketName, i})
+			}
 		default:
 			diags = append(diags, &hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  "Invalid listener configuration",
-				Detail:   "A listener must have either \"address\" or \"socket_number\" set.",
+				Detail:   "A listener must have one of \"address\", \"addresses\", \"socket_number\" or \"socket_name\" set.",
 				// FIXME: We don't have access to the source range here :(
 			})
-			socket = tcpAddress("") // placeholder value
+			sockets = append(sockets, tcpAddress("")) // placeholder value
 		}
 
-		var tls *listenerTLS
-		if lc.TLS != nil {
-			tls = &listenerTLS{
-				CertFile: lc.TLS.CertFile,
-				KeyFile:  lc.TLS.KeyFile,
+		var tls *listenerTLSSet
+		if len(lc.TLS) > 0 {
+			tls = &listenerTLSSet{}
+			for _, raw := range lc.TLS {
+				block, tlsDiags := newListenerTLS(
+					raw.CertFile, raw.KeyFile, raw.ServerNames,
+					raw.MinVersion, raw.MaxVersion,
+					raw.CipherSuites, raw.CurvePreferences,
+				)
+				diags = append(diags, tlsDiags...)
+				tls.Blocks = append(tls.Blocks, block)
 			}
+			diags = append(diags, tls.validate()...)
 		}
 
-		return listenerConfig{
-			Socket: socket,
-			TLS:    tls,
+		// networks parses the IP addresses and CIDR prefixes listed in the
+		// given attribute. If nonEmpty is set, the list must contain at
+		// least one network, and the given detail explains why.
+		networks := func(attr *hcl.Attribute, nonEmpty string) []*net.IPNet {
+			var list []string
+			valDiags := gohcl.DecodeExpression(attr.Expr, nil, &list)
+			diags = append(diags, valDiags...)
+			if valDiags.HasErrors() {
+				return nil
+			}
+			if nonEmpty != "" && len(list) == 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid listener configuration",
+					Detail:   nonEmpty,
+					Subject:  &attr.Range,
+				})
+			}
+
+			var ret []*net.IPNet
+			for _, cidr := range list {
+				n, err := parseNetwork(cidr)
+				if err != nil {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid network",
+						Detail:   fmt.Sprintf("The %q entry %q is not valid. Must be an IP address or a CIDR prefix such as \"10.0.0.0/8\".", attr.Name, cidr),
+						Subject:  &attr.Range,
+					})
+					continue
+				}
+				ret = append(ret, n)
+			}
+			return ret
 		}
+
+		var proxies *trustedProxies
+		if lc.Proxies != nil {
+			proxies = &trustedProxies{
+				Nets: networks(lc.Proxies, ""),
+			}
+		}
+
+		var clients *clientFilter
+		if lc.Allowed != nil || lc.Denied != nil {
+			clients = &clientFilter{}
+			if lc.Allowed != nil {
+				clients.Allowed = networks(lc.Allowed, "A listener's \"allowed_clients\" must contain at least one network. To allow any client, omit it.")
+			}
+			if lc.Denied != nil {
+				clients.Denied = networks(lc.Denied, "")
+			}
+		}
+
+		var al *accessLog
+		if lc.AccessLog != nil {
+			al = &accessLog{
+				Format: accessLogCommon,
+			}
+			if lc.AccessLog.Path != nil {
+				al.Path = *lc.AccessLog.Path
+			}
+			if attr := lc.AccessLog.Format; attr != nil {
+				valDiags := gohcl.DecodeExpression(attr.Expr, nil, &al.Format)
+				diags = append(diags, valDiags...)
+				if !valDiags.HasErrors() {
+					switch al.Format {
+					case accessLogCommon, accessLogCombined, accessLogJSON:
+					default:
+						diags = append(diags, &hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Invalid access log format",
+							Detail:   fmt.Sprintf("The access log format %q is not supported. Must be \"common\", \"combined\" or \"json\".", al.Format),
+							Subject:  &attr.Range,
+						})
+					}
+				}
+			}
+		}
+
+		h2c := false
+		if lc.H2C != nil {
+			diags = append(diags, gohcl.DecodeExpression(lc.H2C.Expr, nil, &h2c)...)
+		}
+		if h2c && tls != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid listener configuration",
+				Detail:   "A listener with \"tls\" always supports HTTP/2, so \"h2c\" may be set only for listeners without it.",
+				Subject:  &lc.H2C.Range,
+			})
+		}
+
+		timeouts := listenerTimeouts{
+			ReadHeader: defaultReadHeaderTimeout,
+			Idle:       defaultIdleTimeout,
+		}
+		for _, timeout := range []struct {
+			attr *hcl.Attribute
+			dst  *time.Duration
+		}{
+			{lc.ReadTimeout, &timeouts.Read},
+			{lc.ReadHeaderTimeout, &timeouts.ReadHeader},
+			{lc.WriteTimeout, &timeouts.Write},
+			{lc.IdleTimeout, &timeouts.Idle},
+		} {
+			if timeout.attr != nil {
+				var durDiags hcl.Diagnostics
+				*timeout.dst, durDiags = decodeDuration(timeout.attr)
+				diags = append(diags, durDiags...)
+			}
+		}
+
+		var adv *advertised
+		if lc.Hostname != nil || lc.BasePath != nil {
+			adv = &advertised{}
+			if lc.Hostname != nil {
+				hostname, hostDiags := decodeHostname(lc.Hostname.Expr)
+				diags = append(diags, hostDiags...)
+				adv.Hostname = &hostname
+			}
+			if lc.BasePath != nil {
+				basePath, pathDiags := decodeBasePath(lc.BasePath)
+				diags = append(diags, pathDiags...)
+				adv.BasePath = &basePath
+			}
+		}
+
+		confs := make([]listenerConfig, len(sockets))
+		for i, socket := range sockets {
+			confs[i] = listenerConfig{
+				Socket:         socket,
+				TLS:            tls,
+				AccessLog:      al,
+				TrustedProxies: proxies,
+				Clients:        clients,
+				Advertised:     adv,
+				H2C:            h2c,
+				Timeouts:       timeouts,
+			}
+		}
+		return confs
 	}
 
 	for _, lc := range raw.HTTP {
-		ret[httpListener{conf: listenerConf(lc)}] = struct{}{}
+		for _, conf := range listenerConfs(lc) {
+			ret[httpListener{conf: conf}] = struct{}{}
+		}
 	}
 	for _, lc := range raw.FastCGI {
-		ret[fastCGIListener{conf: listenerConf(lc)}] = struct{}{}
+		for _, attr := range []*hcl.Attribute{lc.ReadTimeout, lc.ReadHeaderTimeout, lc.WriteTimeout, lc.IdleTimeout} {
+			if attr != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid listener configuration",
+					Detail:   fmt.Sprintf("Only http listeners accept %q, since the web server manages the connections of its clients for fastcgi listeners.", attr.Name),
+					Subject:  attr.NameRange.Ptr(),
+				})
+			}
+		}
+		if lc.H2C != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid listener configuration",
+				Detail:   "Only http listeners accept \"h2c\", since HTTP/2 is between the client and the web server for fastcgi listeners.",
+				Subject:  lc.H2C.NameRange.Ptr(),
+			})
+		}
+		for _, conf := range listenerConfs(lc) {
+			ret[fastCGIListener{conf: conf}] = struct{}{}
+		}
 	}
 
 	return ret, raw.Remain, diags
 }
 
 type Listener interface {
-	ListenAndServe(handler http.Handler) error
+	// Listen binds the listener's socket and logs the address that it is
+	// listening on.
+	Listen() (net.Listener, error)
+
+	// Serve serves requests from the given socket, which was returned by
+	// Listen, with the given handler. Once stop is closed, it stops
+	// accepting connections and returns after the requests in progress
+	// complete, or after drainTimeout if they don't, closing their
+	// connections.
+	Serve(socket net.Listener, handler http.Handler, stop <-chan struct{}, drainTimeout time.Duration) error
+
+	// String describes the listener in the same key=value form as the
+	// log lines written once it is listening.
+	String() string
 }
 
 type httpListener struct {
 	conf listenerConfig
 }
 
-func (l httpListener) ListenAndServe(handler http.Handler) error {
-	socket, err := l.conf.Listen()
+func (l httpListener) String() string {
+	return fmt.Sprintf("protocol=http address=%s", l.conf.Socket)
+}
+
+func (l httpListener) Listen() (net.Listener, error) {
+	// With TLS, clients choose HTTP/2 when they negotiate the connection.
+	socket, err := l.conf.Listen("h2", "http/1.1")
 	if err != nil {
+		return nil, err
+	}
+	logging.Infof("listening: protocol=http address=%s tls=%t h2c=%t", socket.Addr(), l.conf.TLS != nil, l.conf.H2C)
+	return socket, nil
+}
+
+func (l httpListener) Serve(socket net.Listener, handler http.Handler, stop <-chan struct{}, drainTimeout time.Duration) error {
+	handler, err := l.conf.Handler(handler)
+	if err != nil {
+		socket.Close()
 		return err
 	}
 
-	server := http.Server{
-		Handler: handler,
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       l.conf.Timeouts.Read,
+		ReadHeaderTimeout: l.conf.Timeouts.ReadHeader,
+		WriteTimeout:      l.conf.Timeouts.Write,
+		IdleTimeout:       l.conf.Timeouts.Idle,
+	}
+	if l.conf.H2C {
+		// Clients, or more usually proxies, that know in advance that
+		// the server speaks HTTP/2 can then use it without TLS.
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(socket)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+		return nil
 	}
-	return server.Serve(socket)
 }
 
 type fastCGIListener struct {
 	conf listenerConfig
 }
 
-func (l fastCGIListener) ListenAndServe(handler http.Handler) error {
+func (l fastCGIListener) String() string {
+	return fmt.Sprintf("protocol=fastcgi address=%s", l.conf.Socket)
+}
+
+func (l fastCGIListener) Listen() (net.Listener, error) {
 	socket, err := l.conf.Listen()
 	if err != nil {
+		return nil, err
+	}
+	logging.Infof("listening: protocol=fastcgi address=%s tls=%t", socket.Addr(), l.conf.TLS != nil)
+	return socket, nil
+}
+
+func (l fastCGIListener) Serve(socket net.Listener, handler http.Handler, stop <-chan struct{}, drainTimeout time.Duration) error {
+	handler, err := l.conf.Handler(handler)
+	if err != nil {
+		socket.Close()
 		return err
 	}
 
-	return fcgi.Serve(socket, handler)
+	return serveFastCGI(socket, handler, stop, drainTimeout)
 }
 
 type listenerConfig struct {
-	Socket socketConfig
-	TLS    *listenerTLS
+	Socket    socketConfig
+	TLS       *listenerTLSSet
+	AccessLog *accessLog
+
+	TrustedProxies *trustedProxies
+	Clients        *clientFilter
+	Advertised     *advertised
+
+	// H2C is set for an HTTP listener that accepts HTTP/2 without TLS.
+	H2C bool
+
+	Timeouts listenerTimeouts
+}
+
+// Defaults for the timeouts of HTTP listeners, which would otherwise have
+// none. Slow clients can then hold only a few connections open without
+// sending requests, while downloads and event streams, which can take any
+// amount of time, are unaffected.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// listenerTimeouts are the timeouts of an HTTP listener, as for the fields
+// of http.Server with the same names. Zero means no timeout.
+type listenerTimeouts struct {
+	Read       time.Duration
+	ReadHeader time.Duration
+	Write      time.Duration
+	Idle       time.Duration
 }
 
-func (lc *listenerConfig) Listen() (net.Listener, error) {
+// trustedProxies are the networks of the reverse proxies whose forwarded
+// headers a listener believes. Like the other settings of a listener, they
+// are referred to by pointer so that the listener can be a map key.
+type trustedProxies struct {
+	Nets []*net.IPNet
+}
+
+// Handler wraps the given handler with the behavior that every request
+// has, such as being assigned an ID and traced, along with any that the
+// listener configures, such as logging it.
+func (lc *listenerConfig) Handler(handler http.Handler) (http.Handler, error) {
+	if lc.Advertised != nil {
+		handler = lc.Advertised.Handler(handler)
+	}
+	if lc.Clients != nil {
+		handler = lc.Clients.Handler(handler)
+	}
+	handler = requestid.Handler(tracing.Handler(handler))
+	if lc.AccessLog != nil {
+		var err error
+		handler, err = lc.AccessLog.Handler(handler)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if lc.TrustedProxies != nil {
+		// This must come first so that everything else sees the client
+		// rather than the proxy.
+		handler = forwarded.Handler(lc.TrustedProxies.Nets, handler)
+	}
+	return handler, nil
+}
+
+// parseNetwork parses an element of a list of networks, such as
+// "trusted_proxies", which is either a CIDR prefix or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ret, err := net.ParseCIDR(s)
+	return ret, err
+}
+
+// Listen binds the listener's socket, which offers the given application
+// protocols to clients if it uses TLS.
+func (lc *listenerConfig) Listen(nextProtos ...string) (net.Listener, error) {
 	l, err := lc.Socket.Listen()
 	if err != nil {
 		return nil, err
 	}
 
 	if lc.TLS != nil {
-		cert, err := tls.LoadX509KeyPair(lc.TLS.CertFile, lc.TLS.KeyFile)
+		tlsConfig, err := lc.TLS.Config(nextProtos)
 		if err != nil {
 			return nil, err
 		}
 
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-
 		l = tls.NewListener(l, tlsConfig)
 	}
 
 	return l, nil
 }
 
-type listenerTLS struct {
-	CertFile string
-	KeyFile  string
-}
-
 type socketConfig interface {
 	Listen() (net.Listener, error)
 }
@@ -193,6 +611,26 @@ func (a tcpAddress) Listen() (net.Listener, error) {
 	return net.Listen("tcp", string(a))
 }
 
+// tcpFamilyAddress is a TCP address given in "addresses". Unlike tcpAddress,
+// an IP address binds only its own address family, so that "[::]:443" and
+// "0.0.0.0:443" can be listed together without conflicting on systems where
+// IPv6 sockets also accept IPv4 connections by default.
+type tcpFamilyAddress string
+
+func (a tcpFamilyAddress) Listen() (net.Listener, error) {
+	network := "tcp"
+	if host, _, err := net.SplitHostPort(string(a)); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				network = "tcp4"
+			} else {
+				network = "tcp6"
+			}
+		}
+	}
+	return net.Listen(network, string(a))
+}
+
 type unixSocketPath string
 
 func (a unixSocketPath) Listen() (net.Listener, error) {
@@ -201,18 +639,87 @@ func (a unixSocketPath) Listen() (net.Listener, error) {
 
 type socketActivationIndex int
 
+func (i socketActivationIndex) String() string {
+	return fmt.Sprintf("socket:%d", int(i))
+}
+
 func (i socketActivationIndex) Listen() (net.Listener, error) {
-	listeners, err := activation.Listeners(false)
-	if err != nil {
-		return nil, err
-	}
+	files := socketActivationFiles()
 	idx := int(i)
-	if idx >= len(listeners) {
-		return nil, fmt.Errorf("insufficent sockets passed by supervisor: need at least %d but only got %d", idx+1, len(listeners))
+	if idx >= len(files) {
+		return nil, fmt.Errorf("insufficent sockets passed by supervisor: need at least %d but only got %d", idx+1, len(files))
 	}
-	ret := listeners[idx]
-	if ret == nil {
+	// FileListener duplicates the descriptor, so the socket can be listened
+	// on again after the returned listener is closed, such as when a
+	// listener is removed and then added back by a reload.
+	ret, err := net.FileListener(files[idx])
+	if err != nil {
 		return nil, fmt.Errorf("supervisor-passed socket %d is not stream-based", idx)
 	}
 	return ret, nil
 }
+
+var activationFiles struct {
+	once  sync.Once
+	files []*os.File
+}
+
+// socketActivationFiles returns the sockets passed by the launching program.
+// They are retrieved only once, since each call to activation.Files returns
+// new files for the same descriptors, which close them when they are
+// garbage collected.
+func socketActivationFiles() []*os.File {
+	activationFiles.once.Do(func() {
+		activationFiles.files = activation.Files(false)
+	})
+	return activationFiles.files
+}
+
+// socketActivationName is the socket with the given name that was passed by
+// the launching program, as set by FileDescriptorName in a systemd socket
+// unit. Since several sockets can share a name, N selects which of those
+// with the name it is, in the order they were passed.
+type socketActivationName struct {
+	Name string
+	N    int
+}
+
+func (n socketActivationName) String() string {
+	if n.N == 0 {
+		return fmt.Sprintf("socket:%s", n.Name)
+	}
+	return fmt.Sprintf("socket:%s#%d", n.Name, n.N)
+}
+
+func (n socketActivationName) Listen() (net.Listener, error) {
+	seen := 0
+	for idx, name := range socketActivationNames() {
+		if name != n.Name {
+			continue
+		}
+		if seen == n.N {
+			return socketActivationIndex(idx).Listen()
+		}
+		seen++
+	}
+	if seen == 0 {
+		return nil, fmt.Errorf("no socket named %q was passed by supervisor", n.Name)
+	}
+	return nil, fmt.Errorf("insufficent sockets named %q passed by supervisor: need at least %d but only got %d", n.Name, n.N+1, seen)
+}
+
+// socketActivationNames returns the names of the sockets passed by the
+// launching program, in the same order as the sockets themselves, or nil if
+// it didn't pass any names.
+func socketActivationNames() []string {
+	// As with the sockets, the names are only for us if LISTEN_PID is our
+	// own process, rather than one of our ancestors.
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	names := os.Getenv("LISTEN_FDNAMES")
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, ":")
+}
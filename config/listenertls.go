@@ -0,0 +1,406 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// tlsVersions are the values accepted by "min_version" and "max_version".
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the values accepted by "curve_preferences".
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// listenerTLSSet is the TLS configuration of a listener, from its "tls"
+// blocks, each of which gives the certificate for some of the server names
+// that clients ask for. The first block is the default, for clients that
+// ask for a name that no block matches or for no name at all.
+type listenerTLSSet struct {
+	Blocks []*listenerTLS
+}
+
+// listenerTLS is the TLS configuration of a listener from one "tls" block.
+// Any of the version, cipher suite and curve settings that are unset use
+// the defaults of crypto/tls.
+type listenerTLS struct {
+	CertFile string
+	KeyFile  string
+
+	// ServerNames are the names that the block's certificate is presented
+	// for, which may begin with a "*." wildcard. If empty, the names in the
+	// certificate itself are used.
+	ServerNames []string
+
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+
+	// serverNamesRange is the source range of the block's "server_names",
+	// or nil if it isn't set.
+	serverNamesRange *hcl.Range
+}
+
+// newListenerTLS validates the settings of a listener's "tls" block other
+// than its certificate, given by the attributes that are set, and returns
+// the resulting configuration.
+func newListenerTLS(certFile, keyFile string, serverNames, minVersion, maxVersion, cipherSuites, curves *hcl.Attribute) (*listenerTLS, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	ret := &listenerTLS{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+
+	if serverNames != nil {
+		var names []string
+		valDiags := gohcl.DecodeExpression(serverNames.Expr, nil, &names)
+		diags = append(diags, valDiags...)
+		if !valDiags.HasErrors() && len(names) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid TLS server name",
+				Detail:   "A tls block's \"server_names\" must contain at least one name. To use the names in the certificate, omit it.",
+				Subject:  &serverNames.Range,
+			})
+		}
+		for _, name := range names {
+			if !validServerName(name) {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid TLS server name",
+					Detail:   fmt.Sprintf("The server name %q is not valid. Must be a hostname, optionally beginning with a \"*.\" wildcard.", name),
+					Subject:  &serverNames.Range,
+				})
+				continue
+			}
+			ret.ServerNames = append(ret.ServerNames, strings.ToLower(name))
+		}
+		ret.serverNamesRange = &serverNames.Range
+	}
+
+	var minRaw, maxRaw string
+	for _, setting := range []struct {
+		attr *hcl.Attribute
+		raw  *string
+		dst  *uint16
+	}{
+		{minVersion, &minRaw, &ret.MinVersion},
+		{maxVersion, &maxRaw, &ret.MaxVersion},
+	} {
+		if setting.attr == nil {
+			continue
+		}
+		valDiags := gohcl.DecodeExpression(setting.attr.Expr, nil, setting.raw)
+		diags = append(diags, valDiags...)
+		if valDiags.HasErrors() {
+			continue
+		}
+		v, ok := tlsVersions[*setting.raw]
+		if !ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid TLS version",
+				Detail:   fmt.Sprintf("The %s %q is not supported. Must be \"1.0\", \"1.1\", \"1.2\" or \"1.3\".", setting.attr.Name, *setting.raw),
+				Subject:  &setting.attr.Range,
+			})
+			continue
+		}
+		*setting.dst = v
+	}
+	if ret.MinVersion != 0 && ret.MaxVersion != 0 && ret.MinVersion > ret.MaxVersion {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid TLS version",
+			Detail:   fmt.Sprintf("The min_version %q is greater than the max_version %q.", minRaw, maxRaw),
+			Subject:  &minVersion.Range,
+		})
+	}
+
+	if cipherSuites != nil {
+		var names []string
+		diags = append(diags, gohcl.DecodeExpression(cipherSuites.Expr, nil, &names)...)
+		suites := make(map[string]*tls.CipherSuite)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite
+		}
+		for _, name := range names {
+			suite, ok := suites[name]
+			if !ok {
+				detail := fmt.Sprintf("The cipher suite %q is not supported.", name)
+				for _, insecure := range tls.InsecureCipherSuites() {
+					if insecure.Name == name {
+						detail = fmt.Sprintf("The cipher suite %q is not supported because it has known security issues.", name)
+					}
+				}
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid TLS cipher suite",
+					Detail:   detail + " Cipher suites are given by their IANA names, such as \"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\".",
+					Subject:  &cipherSuites.Range,
+				})
+				continue
+			}
+			ret.CipherSuites = append(ret.CipherSuites, suite.ID)
+		}
+	}
+
+	if curves != nil {
+		var names []string
+		diags = append(diags, gohcl.DecodeExpression(curves.Expr, nil, &names)...)
+		for _, name := range names {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid TLS curve",
+					Detail:   fmt.Sprintf("The curve %q is not supported. Must be \"X25519\", \"P256\", \"P384\" or \"P521\".", name),
+					Subject:  &curves.Range,
+				})
+				continue
+			}
+			ret.CurvePreferences = append(ret.CurvePreferences, curve)
+		}
+	}
+
+	return ret, diags
+}
+
+// validate checks that no two of the set's blocks are given the same
+// server name.
+func (s *listenerTLSSet) validate() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	seen := make(map[string]bool)
+	for _, t := range s.Blocks {
+		for _, name := range t.ServerNames {
+			if seen[name] {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate TLS server name",
+					Detail:   fmt.Sprintf("The server name %q is given by more than one of the listener's tls blocks.", name),
+					Subject:  t.serverNamesRange,
+				})
+			}
+			seen[name] = true
+		}
+	}
+	return diags
+}
+
+// Config reads the certificate files of each of the set's blocks and
+// returns the TLS server configuration that they describe, which uses the
+// settings of the block that matches the server name that each client asks
+// for and that offers clients the given application protocols, in order of
+// preference. The certificates are read again whenever their files change,
+// as described for certReloader.
+func (s *listenerTLSSet) Config(nextProtos []string) (*tls.Config, error) {
+	certs := make([]*certReloader, len(s.Blocks))
+	configs := make([]*tls.Config, len(s.Blocks))
+	for i, t := range s.Blocks {
+		cert, err := newCertReloader(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+		configs[i] = &tls.Config{
+			GetCertificate:   cert.GetCertificate,
+			NextProtos:       nextProtos,
+			MinVersion:       t.MinVersion,
+			MaxVersion:       t.MaxVersion,
+			CipherSuites:     t.CipherSuites,
+			CurvePreferences: t.CurvePreferences,
+		}
+	}
+	if len(configs) == 1 {
+		return configs[0], nil
+	}
+
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+			if name == "" {
+				return configs[0], nil
+			}
+			for i, t := range s.Blocks {
+				patterns := t.ServerNames
+				if len(patterns) == 0 {
+					patterns = certs[i].Names()
+				}
+				for _, pattern := range patterns {
+					if matchServerName(pattern, name) {
+						return configs[i], nil
+					}
+				}
+			}
+			return configs[0], nil
+		},
+	}, nil
+}
+
+// validServerName returns true if the given string is a hostname, or a
+// hostname whose first label is a "*" wildcard.
+func validServerName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchServerName returns true if the given lowercase server name matches
+// the given pattern, where a "*" wildcard matches exactly one label, as in
+// a certificate.
+func matchServerName(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == name
+	}
+	dot := strings.IndexByte(name, '.')
+	return dot > 0 && name[dot:] == pattern[1:]
+}
+
+// certCheckInterval is the most often that a certReloader checks whether
+// its files have changed.
+const certCheckInterval = 10 * time.Second
+
+// certReloads counts the calls to ReloadCertificates, so that each
+// certReloader can tell when it must check its files regardless of
+// certCheckInterval.
+var certReloads int64
+
+// ReloadCertificates makes every listener check whether its certificate
+// files have changed when it next accepts a connection, rather than waiting
+// until it next would by itself.
+func ReloadCertificates() {
+	atomic.AddInt64(&certReloads, 1)
+}
+
+// certReloader presents the certificate in a pair of files, reading it
+// again when either file changes, so that a certificate can be renewed
+// without restarting the server. The files are checked when a connection
+// is accepted, at most once every certCheckInterval.
+//
+// If the new files can't be read, such as when only one of them has been
+// replaced so far, the previous certificate continues to be presented and
+// the files are checked again next time.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	stamp   string
+	checked time.Time
+	reloads int64
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		reloads:  atomic.LoadInt64(&certReloads),
+		checked:  time.Now(),
+	}
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.stamp = cert, stamp
+	return r, nil
+}
+
+// loadCertificate loads the certificate in the given files, parsing its
+// leaf so that its names are available to Names.
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// Names returns the DNS names of the certificate currently being presented.
+func (r *certReloader) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert.Leaf.DNSNames
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reloads := atomic.LoadInt64(&certReloads)
+	if reloads == r.reloads && time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.reloads, r.checked = reloads, time.Now()
+
+	stamp, err := r.fileStamp()
+	if err != nil || stamp == r.stamp {
+		return r.cert, nil
+	}
+	cert, err := loadCertificate(r.certFile, r.keyFile)
+	if err != nil {
+		logging.Errorf("failed to reload certificate %s: %s", r.certFile, err)
+		return r.cert, nil
+	}
+	logging.Infof("reloaded certificate %s", r.certFile)
+	r.cert, r.stamp = cert, stamp
+	return r.cert, nil
+}
+
+// fileStamp returns a string that changes whenever either of the files
+// does. The files are followed through any symlinks, since tools such as
+// Kubernetes replace a certificate by switching a symlink.
+func (r *certReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d:%d:", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
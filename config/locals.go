@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// loadLocalsConfig decodes the "locals" blocks from the given body, whose
+// attributes are local values that the rest of the configuration can refer
+// to as "local.NAME", so that settings shared by many blocks, such as the
+// directory containing all of the git repositories, need only be written
+// once. It returns the context in which the rest of the configuration is
+// evaluated, which has both the local values and the functions of the
+// configuration language.
+//
+// Local values can refer to each other, as long as they don't do so in a
+// cycle, and can call the functions too.
+func loadLocalsConfig(body hcl.Body) (*hcl.EvalContext, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "locals",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	pending := make(map[string]*hcl.Attribute)
+	for _, block := range content.Blocks {
+		attrs, attrsDiags := block.Body.JustAttributes()
+		diags = append(diags, attrsDiags...)
+		for name, attr := range attrs {
+			if existing, exists := pending[name]; exists {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate local value",
+					Detail:   fmt.Sprintf("A local value named %q was already declared at %s.", name, existing.NameRange),
+					Subject:  &attr.NameRange,
+				})
+				continue
+			}
+			pending[name] = attr
+		}
+	}
+
+	ctx := evalContext()
+	values := make(map[string]cty.Value)
+	ctx.Variables = map[string]cty.Value{
+		"local": cty.EmptyObjectVal,
+	}
+
+	// Each pass evaluates the local values whose references to other local
+	// values have all been evaluated already, until there are none left or
+	// those that are left refer to each other in a cycle.
+	for len(pending) != 0 {
+		var ready []string
+		for name, attr := range pending {
+			if localsReady(attr, pending) {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			var names []string
+			for name := range pending {
+				names = append(names, "local."+name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				attr := pending[strings.TrimPrefix(name, "local.")]
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Cycle in local values",
+					Detail:   fmt.Sprintf("The local value %s can't be evaluated, since the local values %s refer to each other.", name, strings.Join(names, ", ")),
+					Subject:  &attr.NameRange,
+				})
+			}
+			break
+		}
+
+		sort.Strings(ready)
+		for _, name := range ready {
+			val, valDiags := pending[name].Expr.Value(ctx)
+			diags = append(diags, valDiags...)
+			if valDiags.HasErrors() {
+				// References to a broken local value are then unknown, so
+				// that they don't report the same problem again.
+				val = cty.DynamicVal
+			}
+			values[name] = val
+			delete(pending, name)
+		}
+		// The object is made from a copy, since the next pass adds to the
+		// values.
+		locals := make(map[string]cty.Value, len(values))
+		for name, val := range values {
+			locals[name] = val
+		}
+		ctx.Variables["local"] = cty.ObjectVal(locals)
+	}
+
+	return ctx, remain, diags
+}
+
+// localsReady returns true if the given attribute refers to none of the
+// given local values that haven't been evaluated yet.
+func localsReady(attr *hcl.Attribute, pending map[string]*hcl.Attribute) bool {
+	for _, traversal := range attr.Expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if step, ok := traversal[1].(hcl.TraverseAttr); ok && pending[step.Name] != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Log is the configuration of the server's own log, as opposed to the
+// access logs of its listeners.
+type Log struct {
+	// Level is the least important level of the lines that are logged.
+	Level logging.Level
+
+	// File is the file that lines are appended to, or empty to write them
+	// to stderr.
+	File string
+
+	// MaxSize is the size in bytes beyond which File is rotated, keeping
+	// MaxFiles previous files, or zero if it is never rotated.
+	MaxSize  int64
+	MaxFiles int
+
+	// Syslog and Journald, if either is set, send the log to a syslog
+	// daemon or to the systemd journal instead of stderr or File.
+	Syslog   *LogSyslog
+	Journald *LogJournald
+
+	DeclRange hcl.Range
+}
+
+// LogSyslog is the configuration for sending the server's log to a syslog
+// daemon.
+type LogSyslog struct {
+	// Network and Address are the address of the daemon, as for net.Dial,
+	// or both empty for the local daemon.
+	Network string
+	Address string
+
+	Facility syslog.Priority
+
+	// Tag identifies the server's lines, or is empty to use the name of
+	// the program.
+	Tag string
+}
+
+// LogJournald is the configuration for sending the server's log to the
+// systemd journal.
+type LogJournald struct {
+	// Tag is the syslog identifier of the server's lines, or is empty to
+	// use the name of the program.
+	Tag string
+}
+
+// defaultLogMaxFiles is the number of rotated log files kept unless
+// "max_files" is set.
+const defaultLogMaxFiles = 5
+
+// loadLogConfig decodes the optional "log" block from the given body,
+// returning nil if it isn't present.
+func loadLogConfig(body hcl.Body) (*Log, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "log",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Log
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate log block",
+				Detail:   fmt.Sprintf("The log was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type logBlock struct {
+			Level     *string `hcl:"level,attr"`
+			File      *string `hcl:"file,attr"`
+			MaxSizeMB *int64  `hcl:"max_size_mb,attr"`
+			MaxFiles  *int    `hcl:"max_files,attr"`
+			Syslog    *struct {
+				Address  *string `hcl:"address,attr"`
+				Facility *string `hcl:"facility,attr"`
+				Tag      *string `hcl:"tag,attr"`
+			} `hcl:"syslog,block"`
+			Journald *struct {
+				Tag *string `hcl:"tag,attr"`
+			} `hcl:"journald,block"`
+		}
+		var raw logBlock
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Log{
+			Level:     logging.Info,
+			MaxFiles:  defaultLogMaxFiles,
+			DeclRange: block.DefRange,
+		}
+		if raw.Level != nil {
+			level, ok := logging.ParseLevel(*raw.Level)
+			if !ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid log level",
+					Detail:   fmt.Sprintf("The log level %q is not one of \"debug\", \"info\", \"warn\" and \"error\".", *raw.Level),
+					Subject:  &block.DefRange,
+				})
+			}
+			ret.Level = level
+		}
+		if raw.File != nil {
+			ret.File = *raw.File
+		}
+		if raw.MaxSizeMB != nil {
+			if *raw.MaxSizeMB <= 0 || ret.File == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid log file size",
+					Detail:   "The \"max_size_mb\" argument must be a positive number of megabytes, and requires \"file\" to be set.",
+					Subject:  &block.DefRange,
+				})
+			}
+			ret.MaxSize = *raw.MaxSizeMB * 1024 * 1024
+		}
+		if raw.MaxFiles != nil {
+			if *raw.MaxFiles < 0 || ret.MaxSize == 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid max_files",
+					Detail:   "The \"max_files\" argument must be zero or a positive number of files, and requires \"max_size_mb\" to be set.",
+					Subject:  &block.DefRange,
+				})
+			}
+			ret.MaxFiles = *raw.MaxFiles
+		}
+
+		if raw.Syslog != nil {
+			ret.Syslog = &LogSyslog{
+				Facility: syslog.LOG_DAEMON,
+			}
+			if raw.Syslog.Address != nil {
+				// The address is a URL such as "udp://logs.example.com:514", so
+				// that it can name the network without a separate argument.
+				u, err := url.Parse(*raw.Syslog.Address)
+				if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid syslog address",
+						Detail:   fmt.Sprintf("The syslog address %q must be a udp or tcp URL, such as \"udp://logs.example.com:514\".", *raw.Syslog.Address),
+						Subject:  &block.DefRange,
+					})
+				} else {
+					ret.Syslog.Network, ret.Syslog.Address = u.Scheme, u.Host
+				}
+			}
+			if raw.Syslog.Facility != nil {
+				facility, ok := logging.ParseSyslogFacility(*raw.Syslog.Facility)
+				if !ok {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid syslog facility",
+						Detail:   fmt.Sprintf("The syslog facility %q is not one of the standard facilities, such as \"daemon\" or \"local0\".", *raw.Syslog.Facility),
+						Subject:  &block.DefRange,
+					})
+				}
+				ret.Syslog.Facility = facility
+			}
+			if raw.Syslog.Tag != nil {
+				ret.Syslog.Tag = *raw.Syslog.Tag
+			}
+		}
+		if raw.Journald != nil {
+			ret.Journald = &LogJournald{}
+			if raw.Journald.Tag != nil {
+				ret.Journald.Tag = *raw.Journald.Tag
+			}
+		}
+
+		destinations := 0
+		for _, set := range []bool{ret.File != "", ret.Syslog != nil, ret.Journald != nil} {
+			if set {
+				destinations++
+			}
+		}
+		if destinations > 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting log destinations",
+				Detail:   "Only one of \"file\", a syslog block and a journald block may be set, since the log is sent to just one of them.",
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
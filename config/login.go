@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Login is the configuration for the built-in implementation of the
+// login.v1 service, which allows "terraform login" to obtain a token
+// from the registry.
+type Login struct {
+	// TokenFile is the file that newly-issued tokens are appended to.
+	TokenFile string
+
+	// Users maps usernames to bcrypt hashes of their passwords, which they
+	// use to authenticate when authorizing Terraform to obtain a token.
+	Users map[string]string
+
+	// Ports is the inclusive range of TCP ports Terraform may listen on
+	// to receive the redirect at the end of the authorization flow.
+	Ports [2]int
+
+	DeclRange hcl.Range
+}
+
+// loadLoginConfig decodes the optional "login" block from the given body,
+// returning nil if it isn't present.
+func loadLoginConfig(body hcl.Body) (*Login, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "login",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Login
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate login block",
+				Detail:   fmt.Sprintf("The login service was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type login struct {
+			TokenFile string            `hcl:"token_file,attr"`
+			Users     map[string]string `hcl:"users,attr"`
+			Ports     *[]int            `hcl:"ports,attr"`
+		}
+		var raw login
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Login{
+			TokenFile: raw.TokenFile,
+			Users:     raw.Users,
+			Ports:     [2]int{10000, 10010},
+			DeclRange: block.DefRange,
+		}
+		for username, hash := range raw.Users {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid password hash",
+					Detail:   fmt.Sprintf("The password for user %q must be given as a bcrypt hash: %s.", username, err),
+					Subject:  &block.DefRange,
+				})
+			}
+		}
+		if raw.Ports != nil {
+			ports := *raw.Ports
+			if len(ports) != 2 || ports[0] < 1024 || ports[1] > 65535 || ports[0] > ports[1] {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid login ports",
+					Detail:   "The \"ports\" argument must be a list of two numbers giving an inclusive range of TCP ports between 1024 and 65535.",
+					Subject:  &block.DefRange,
+				})
+				continue
+			}
+			ret.Ports = [2]int{ports[0], ports[1]}
+		}
+	}
+
+	return ret, remain, diags
+}
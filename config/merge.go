@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// mergeBodies returns a body that merges together the contents of the given
+// bodies, as hcl.MergeBodies does.
+//
+// The version of hcl.MergeBodies that we depend on loses the remaining
+// contents of the bodies after PartialContent, which would leave each part
+// of the configuration seeing only the first file that declares it, so we
+// merge the bodies ourselves.
+func mergeBodies(bodies []hcl.Body) hcl.Body {
+	if len(bodies) == 1 {
+		return bodies[0]
+	}
+	return mergedBody(bodies)
+}
+
+type mergedBody []hcl.Body
+
+func (mb mergedBody) Content(schema *hcl.BodySchema) (*hcl.BodyContent, hcl.Diagnostics) {
+	content, _, diags := mb.mergedContent(schema, false)
+	return content, diags
+}
+
+func (mb mergedBody) PartialContent(schema *hcl.BodySchema) (*hcl.BodyContent, hcl.Body, hcl.Diagnostics) {
+	return mb.mergedContent(schema, true)
+}
+
+func (mb mergedBody) JustAttributes() (hcl.Attributes, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	ret := make(hcl.Attributes)
+	for _, body := range mb {
+		attrs, attrsDiags := body.JustAttributes()
+		diags = append(diags, attrsDiags...)
+		for name, attr := range attrs {
+			if existing := ret[name]; existing != nil {
+				diags = append(diags, duplicateAttributeDiag(attr, existing))
+				continue
+			}
+			ret[name] = attr
+		}
+	}
+	return ret, diags
+}
+
+func (mb mergedBody) MissingItemRange() hcl.Range {
+	if len(mb) == 0 {
+		return hcl.Range{
+			Filename: "<empty>",
+		}
+	}
+	return mb[0].MissingItemRange()
+}
+
+func (mb mergedBody) mergedContent(schema *hcl.BodySchema, partial bool) (*hcl.BodyContent, hcl.Body, hcl.Diagnostics) {
+	// Any one of the bodies can set a required attribute, so none of them
+	// are required to, and we check for each of them once they are merged.
+	bodySchema := &hcl.BodySchema{
+		Blocks: schema.Blocks,
+	}
+	for _, attrS := range schema.Attributes {
+		attrS.Required = false
+		bodySchema.Attributes = append(bodySchema.Attributes, attrS)
+	}
+
+	var diags hcl.Diagnostics
+	ret := &hcl.BodyContent{
+		Attributes:       make(hcl.Attributes),
+		MissingItemRange: mb.MissingItemRange(),
+	}
+	var remains mergedBody
+	for _, body := range mb {
+		var content *hcl.BodyContent
+		var contentDiags hcl.Diagnostics
+		if partial {
+			var remain hcl.Body
+			content, remain, contentDiags = body.PartialContent(bodySchema)
+			if remain != nil {
+				remains = append(remains, remain)
+			}
+		} else {
+			content, contentDiags = body.Content(bodySchema)
+		}
+		diags = append(diags, contentDiags...)
+		if content == nil {
+			continue
+		}
+
+		for name, attr := range content.Attributes {
+			if existing := ret.Attributes[name]; existing != nil {
+				diags = append(diags, duplicateAttributeDiag(attr, existing))
+				continue
+			}
+			ret.Attributes[name] = attr
+		}
+		ret.Blocks = append(ret.Blocks, content.Blocks...)
+	}
+
+	for _, attrS := range schema.Attributes {
+		if attrS.Required && ret.Attributes[attrS.Name] == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required attribute",
+				Detail:   fmt.Sprintf("The attribute %q is required, but was not set in any of the configuration files.", attrS.Name),
+			})
+		}
+	}
+
+	return ret, remains, diags
+}
+
+func duplicateAttributeDiag(attr, existing *hcl.Attribute) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Duplicate attribute",
+		Detail:   fmt.Sprintf("The attribute %q was already set at %s.", attr.Name, existing.NameRange),
+		Subject:  &attr.NameRange,
+	}
+}
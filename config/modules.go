@@ -1,9 +1,19 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	version "github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform/svchost"
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/hashicorp/hcl2/gohcl"
 	"github.com/hashicorp/hcl2/hcl"
@@ -11,9 +21,100 @@ import (
 
 // ModulesConfig is the root type of a configuration for a modules server.
 type ModulesConfig struct {
-	Hostname  svchost.Hostname
-	Listeners Listeners
-	Modules   Modules
+	Hostname        svchost.Hostname
+	BasePath        string
+	Listeners       Listeners
+	Discovery       *Discovery
+	Login           *Login
+	Auth            *Auth
+	Publish         *Publish
+	Webhooks        *Webhooks
+	Proxy           *Proxy
+	Admin           *Admin
+	Consul          *Consul
+	Tracing         *Tracing
+	Log             *Log
+	RateLimit       *RateLimit
+	CORS            *CORS
+	SecurityHeaders *SecurityHeaders
+	Namespaces      Namespaces
+	Modules         Modules
+	VirtualHosts    VirtualHosts
+	ModuleSettings
+}
+
+// ModuleSettings are the settings that apply to the set of modules as a
+// whole, rather than to individual modules.
+type ModuleSettings struct {
+	// OrphanGracePeriod is how long a module removed from the configuration
+	// by a reload continues to be served. If zero, removed modules are no
+	// longer served as soon as the new configuration is loaded.
+	OrphanGracePeriod time.Duration
+
+	// VersionCacheTTL is how long the list of available versions of each
+	// module is cached for. If zero, the versions are read from the git
+	// repository for every request.
+	VersionCacheTTL time.Duration
+
+	// ArchiveWorkers is the number of worker subprocesses to use for
+	// generating module archives. If zero, archives are generated within
+	// the server process itself.
+	ArchiveWorkers int
+
+	// ArchiveConcurrency is the most archives that may be generated at
+	// once, or zero for no limit. Requests for further archives wait for
+	// up to ArchiveQueueTimeout and then fail.
+	ArchiveConcurrency  int
+	ArchiveQueueTimeout time.Duration
+
+	// ArchiveCache configures the caching of generated archives on disk,
+	// or is nil if archives are generated for every download.
+	ArchiveCache *ArchiveCache
+
+	// IndexFile is a file in which the index of available versions is saved
+	// on shutdown and loaded at startup, or an empty string if the index is
+	// always rebuilt from the module sources.
+	IndexFile string
+
+	// DownloadsFile is a file in which the download counts of each module
+	// are saved periodically and on shutdown, and loaded at startup, or an
+	// empty string if they are counted only since the server started.
+	DownloadsFile string
+
+	// DrainTimeout is how long the server waits for the requests in
+	// progress on a listener to complete when it stops listening, whether
+	// because the listener was removed by a reload or because the server
+	// is exiting.
+	DrainTimeout time.Duration
+
+	// Strict is whether the server refuses to load a configuration in
+	// which the git repository or archive directory of any module is
+	// missing or unreadable, rather than failing only the requests for
+	// such modules.
+	Strict bool
+
+	// GitMirrorDir is the directory containing the mirrors that the server
+	// maintains of the repositories of any modules that set "git_url".
+	GitMirrorDir string
+
+	// GitFetchInterval is how often the mirrors in GitMirrorDir are fetched
+	// from their remote repositories. If zero, they are fetched only at
+	// startup and when the configuration is reloaded.
+	GitFetchInterval time.Duration
+
+	// Prereleases is the default prerelease policy of modules that don't
+	// set their own.
+	Prereleases PrereleasePolicy
+
+	// OutboundTLS configures the TLS connections made to the remote
+	// repositories of mirrors, to S3 and to the registries that modules are
+	// imported from, or is nil to use the defaults.
+	OutboundTLS *OutboundTLS
+
+	// OutboundProxy is the proxy through which the server makes requests to
+	// S3 and to the registries that modules are imported from, or nil to
+	// use the proxy given by the standard environment variables.
+	OutboundProxy *OutboundProxy
 }
 
 // LoadModulesConfig processes a raw HCL Body into a configuration for a
@@ -26,6 +127,12 @@ type ModulesConfig struct {
 func LoadModulesConfig(body hcl.Body) (*ModulesConfig, hcl.Diagnostics) {
 	var diags hcl.Diagnostics
 
+	// Every part of the configuration can refer to the local values and
+	// call the configuration language's functions.
+	ctx, remain, localsDiags := loadLocalsConfig(body)
+	body = bindEvalContext(remain, ctx)
+	diags = append(diags, localsDiags...)
+
 	listeners, remain, listenersDiags := loadListenersConfig(body)
 	body = remain
 	diags = append(diags, listenersDiags...)
@@ -34,37 +141,339 @@ func LoadModulesConfig(body hcl.Body) (*ModulesConfig, hcl.Diagnostics) {
 	body = remain
 	diags = append(diags, hostnameDiags...)
 
+	basePath, remain, basePathDiags := loadBasePathConfig(body)
+	body = remain
+	diags = append(diags, basePathDiags...)
+
+	discovery, remain, discoveryDiags := loadDiscoveryConfig(body, basePathServices(basePath, map[string]string{
+		"modules.v1": "/",
+	}))
+	body = remain
+	diags = append(diags, discoveryDiags...)
+
+	login, remain, loginDiags := loadLoginConfig(body)
+	body = remain
+	diags = append(diags, loginDiags...)
+
+	auth, remain, authDiags := loadAuthConfig(body)
+	body = remain
+	diags = append(diags, authDiags...)
+
+	publish, remain, publishDiags := loadPublishConfig(body)
+	body = remain
+	diags = append(diags, publishDiags...)
+
+	webhooks, remain, webhooksDiags := loadWebhooksConfig(body)
+	body = remain
+	diags = append(diags, webhooksDiags...)
+
+	proxy, remain, proxyDiags := loadProxyConfig(body)
+	body = remain
+	diags = append(diags, proxyDiags...)
+
+	admin, remain, adminDiags := loadAdminConfig(body)
+	body = remain
+	diags = append(diags, adminDiags...)
+
+	consul, remain, consulDiags := loadConsulConfig(body)
+	body = remain
+	diags = append(diags, consulDiags...)
+
+	tracing, remain, tracingDiags := loadTracingConfig(body)
+	body = remain
+	diags = append(diags, tracingDiags...)
+
+	logCfg, remain, logDiags := loadLogConfig(body)
+	body = remain
+	diags = append(diags, logDiags...)
+
+	rateLimit, remain, rateLimitDiags := loadRateLimitConfig(body)
+	body = remain
+	diags = append(diags, rateLimitDiags...)
+
+	cors, remain, corsDiags := loadCORSConfig(body)
+	body = remain
+	diags = append(diags, corsDiags...)
+
+	securityHeaders, remain, securityHeadersDiags := loadSecurityHeadersConfig(body)
+	body = remain
+	diags = append(diags, securityHeadersDiags...)
+
+	namespaces, modules, settings, remain, modulesDiags := loadModulesDeclsConfig(body)
+	body = remain
+	diags = append(diags, modulesDiags...)
+
+	virtualHosts, remain, virtualHostsDiags := loadVirtualHostsConfig(body, hostname, settings)
+	body = remain
+	diags = append(diags, virtualHostsDiags...)
+
+	// Anything left over at this point is not valid.
+	_, extraDiags := body.Content(&hcl.BodySchema{})
+	diags = append(diags, extraDiags...)
+
+	return &ModulesConfig{
+		Hostname:        hostname,
+		BasePath:        basePath,
+		Listeners:       listeners,
+		Discovery:       discovery,
+		Login:           login,
+		Auth:            auth,
+		Publish:         publish,
+		Webhooks:        webhooks,
+		Proxy:           proxy,
+		Admin:           admin,
+		Consul:          consul,
+		Tracing:         tracing,
+		Log:             logCfg,
+		RateLimit:       rateLimit,
+		CORS:            cors,
+		SecurityHeaders: securityHeaders,
+		Namespaces:      namespaces,
+		Modules:         modules,
+		VirtualHosts:    virtualHosts,
+
+		ModuleSettings: settings,
+	}, diags
+}
+
+// defaultArchiveQueueTimeout is how long a request for an archive waits to
+// begin generating it when "archive_concurrency" archives are already being
+// generated, unless "archive_queue_timeout" is set.
+const defaultArchiveQueueTimeout = 30 * time.Second
+
+// loadModulesDeclsConfig decodes the "namespace" and "module" blocks, and
+// the settings that apply to the set of modules as a whole.
+func loadModulesDeclsConfig(body hcl.Body) (Namespaces, Modules, ModuleSettings, hcl.Body, hcl.Diagnostics) {
+	var settings ModuleSettings
+
+	archiveCache, body, diags := loadArchiveCacheConfig(body)
+	settings.ArchiveCache = archiveCache
+
+	outboundTLS, body, tlsDiags := loadOutboundTLSConfig(body)
+	diags = append(diags, tlsDiags...)
+	settings.OutboundTLS = outboundTLS
+
+	outboundProxy, body, proxyDiags := loadOutboundProxyConfig(body)
+	diags = append(diags, proxyDiags...)
+	settings.OutboundProxy = outboundProxy
+
 	schema := &hcl.BodySchema{
-		Blocks: []hcl.BlockHeaderSchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name: "orphan_grace_period",
+			},
+			{
+				Name: "version_cache_ttl",
+			},
+			{
+				Name: "archive_workers",
+			},
+			{
+				Name: "archive_concurrency",
+			},
+			{
+				Name: "archive_queue_timeout",
+			},
+			{
+				Name: "index_file",
+			},
+			{
+				Name: "downloads_file",
+			},
+			{
+				Name: "strict",
+			},
 			{
-				Type:       "module",
-				LabelNames: []string{"namespace", "name", "provider"},
+				Name: "drain_timeout",
 			},
+			{
+				Name: "prereleases",
+			},
+			{
+				Name: "git_mirror_dir",
+			},
+			{
+				Name: "git_fetch_interval",
+			},
+		},
+		Blocks: []hcl.BlockHeaderSchema{
+			namespaceBlockSchema,
+			moduleBlockSchema,
 		},
 	}
-	content, modulesDiags := body.Content(schema)
-	diags = append(diags, modulesDiags...)
+	content, remain, contentDiags := body.PartialContent(schema)
+	diags = append(diags, contentDiags...)
+
+	if attr, exists := content.Attributes["orphan_grace_period"]; exists {
+		var durDiags hcl.Diagnostics
+		settings.OrphanGracePeriod, durDiags = decodeDuration(attr)
+		diags = append(diags, durDiags...)
+	}
+	if attr, exists := content.Attributes["version_cache_ttl"]; exists {
+		var durDiags hcl.Diagnostics
+		settings.VersionCacheTTL, durDiags = decodeDuration(attr)
+		diags = append(diags, durDiags...)
+	}
+	if attr, exists := content.Attributes["archive_workers"]; exists {
+		valDiags := gohcl.DecodeExpression(attr.Expr, nil, &settings.ArchiveWorkers)
+		diags = append(diags, valDiags...)
+		if !valDiags.HasErrors() && settings.ArchiveWorkers < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid archive_workers",
+				Detail:   "The number of archive workers must not be negative.",
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+		}
+	}
+
+	if attr, exists := content.Attributes["archive_concurrency"]; exists {
+		valDiags := gohcl.DecodeExpression(attr.Expr, nil, &settings.ArchiveConcurrency)
+		diags = append(diags, valDiags...)
+		if !valDiags.HasErrors() && settings.ArchiveConcurrency < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid archive_concurrency",
+				Detail:   "The number of archives generated concurrently must not be negative.",
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+		}
+	}
+	settings.ArchiveQueueTimeout = defaultArchiveQueueTimeout
+	if attr, exists := content.Attributes["archive_queue_timeout"]; exists {
+		var durDiags hcl.Diagnostics
+		settings.ArchiveQueueTimeout, durDiags = decodeDuration(attr)
+		diags = append(diags, durDiags...)
+	}
+
+	if attr, exists := content.Attributes["index_file"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &settings.IndexFile)...)
+	}
+	if attr, exists := content.Attributes["downloads_file"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &settings.DownloadsFile)...)
+	}
+	settings.DrainTimeout = DefaultDrainTimeout
+	if attr, exists := content.Attributes["drain_timeout"]; exists {
+		var durDiags hcl.Diagnostics
+		settings.DrainTimeout, durDiags = decodeDuration(attr)
+		diags = append(diags, durDiags...)
+	}
+	if attr, exists := content.Attributes["strict"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &settings.Strict)...)
+	}
+	settings.Prereleases = PrereleasesLatest
+	if attr, exists := content.Attributes["prereleases"]; exists {
+		var value string
+		valDiags := gohcl.DecodeExpression(attr.Expr, nil, &value)
+		diags = append(diags, valDiags...)
+		if !valDiags.HasErrors() {
+			var policyDiags hcl.Diagnostics
+			settings.Prereleases, policyDiags = decodePrereleasePolicy(value, attr.Expr.Range())
+			diags = append(diags, policyDiags...)
+		}
+	}
+	if attr, exists := content.Attributes["git_mirror_dir"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &settings.GitMirrorDir)...)
+	}
+	if attr, exists := content.Attributes["git_fetch_interval"]; exists {
+		var durDiags hcl.Diagnostics
+		settings.GitFetchInterval, durDiags = decodeDuration(attr)
+		diags = append(diags, durDiags...)
+	}
+
+	namespaces, modules, blocksDiags := decodeModuleBlocks(content.Blocks, settings)
+	diags = append(diags, blocksDiags...)
+
+	return namespaces, modules, settings, remain, diags
+}
+
+var moduleBlockSchema = hcl.BlockHeaderSchema{
+	Type:       "module",
+	LabelNames: []string{"namespace", "name", "provider"},
+}
+
+// decodeModuleBlocks decodes the "namespace" and "module" blocks among the
+// given blocks, ignoring any others. The given settings provide the defaults
+// for the modules.
+func decodeModuleBlocks(blocks hcl.Blocks, settings ModuleSettings) (Namespaces, Modules, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	namespaces := make(Namespaces)
+	for _, block := range blocks {
+		if block.Type != "namespace" {
+			continue
+		}
+		if labelDiags := checkBlockLabels(block, "namespace"); labelDiags.HasErrors() {
+			diags = append(diags, labelDiags...)
+			continue
+		}
+		key := NormalizeIdentifier(block.Labels[0])
+		ns, nsDiags := loadNamespaceConfig(block)
+		diags = append(diags, nsDiags...)
+		if existing, exists := namespaces[key]; exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate namespace declaration",
+				Detail:   fmt.Sprintf("A namespace block for %q was already declared at %s.%s", ns.Name, existing.DeclRange, caseConflictNote(ns.Name, existing.Name)),
+				Subject:  &ns.DeclRange,
+			})
+			continue
+		}
+		namespaces[key] = ns
+	}
 
 	type module struct {
-		GitDir string `hcl:"git_dir,attr"`
+		GitDir             *string            `hcl:"git_dir,attr"`
+		GitURL             *string            `hcl:"git_url,attr"`
+		Path               *string            `hcl:"path,attr"`
+		TagPrefix          *string            `hcl:"tag_prefix,attr"`
+		TagPattern         *string            `hcl:"tag_pattern,attr"`
+		ArchiveDir         *string            `hcl:"archive_dir,attr"`
+		Links              *map[string]string `hcl:"links,attr"`
+		ContentType        *string            `hcl:"content_type,attr"`
+		ContentDisposition *string            `hcl:"content_disposition,attr"`
+		Prereleases        *string            `hcl:"prereleases,attr"`
+		VersionScheme      *string            `hcl:"version_scheme,attr"`
+		YankedVersions     *[]string          `hcl:"yanked_versions,attr"`
+		Deprecated         *string            `hcl:"deprecated,attr"`
+		DeprecatedVersions *map[string]string `hcl:"deprecated_versions,attr"`
+		TrustedKeyFiles    *[]string          `hcl:"trusted_key_files,attr"`
+		Exclude            *[]string          `hcl:"exclude,attr"`
+		Submodules         *map[string]string `hcl:"submodules,attr"`
+		LFSDir             *string            `hcl:"lfs_dir,attr"`
+		S3                 *struct {
+			Body hcl.Body `hcl:",remain"`
+		} `hcl:"s3,block"`
 	}
 
 	modules := make(Modules)
-	for _, block := range content.Blocks {
+	for _, block := range blocks {
+		if block.Type != "module" {
+			continue
+		}
+		if labelDiags := checkBlockLabels(block, "namespace", "module name", "provider"); labelDiags.HasErrors() {
+			diags = append(diags, labelDiags...)
+			continue
+		}
 		namespace, name, provider := block.Labels[0], block.Labels[1], block.Labels[2]
+		nsKey, nameKey, providerKey := NormalizeIdentifier(namespace), NormalizeIdentifier(name), NormalizeIdentifier(provider)
 		declRange := hcl.RangeBetween(block.TypeRange, block.LabelRanges[2])
-		if modules[namespace] == nil {
-			modules[namespace] = make(map[string]map[string]*Module)
+		if modules[nsKey] == nil {
+			modules[nsKey] = make(map[string]map[string]*Module)
 		}
-		if modules[namespace][name] == nil {
-			modules[namespace][name] = make(map[string]*Module)
+		if modules[nsKey][nameKey] == nil {
+			modules[nsKey][nameKey] = make(map[string]*Module)
 		}
-		if existing, exists := modules[namespace][name][provider]; exists {
+		if existing, exists := modules[nsKey][nameKey][providerKey]; exists {
 			diags = append(diags, &hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  "Duplicate module declaration",
-				Detail:   fmt.Sprintf("A module block for %q %q %q was already declared at %s.", namespace, name, provider, existing.DeclRange),
-				Subject:  &declRange,
+				Detail: fmt.Sprintf(
+					"A module block for %q %q %q was already declared at %s.%s",
+					namespace, name, provider, existing.DeclRange,
+					caseConflictNote(namespace+"/"+name+"/"+provider, existing.Namespace+"/"+existing.Name+"/"+existing.Provider),
+				),
+				Subject: &declRange,
 			})
 			continue
 		}
@@ -76,28 +485,517 @@ func LoadModulesConfig(body hcl.Body) (*ModulesConfig, hcl.Diagnostics) {
 			continue
 		}
 
-		modules[namespace][name][provider] = &Module{
-			GitDir:    raw.GitDir,
-			DeclRange: declRange,
+		mod := &Module{
+			Namespace:     namespace,
+			Name:          name,
+			Provider:      provider,
+			Prereleases:   settings.Prereleases,
+			OutboundTLS:   settings.OutboundTLS,
+			OutboundProxy: settings.OutboundProxy,
+			DeclRange:     declRange,
+		}
+		if raw.GitDir != nil {
+			mod.GitDir = *raw.GitDir
+		}
+		if raw.GitURL != nil {
+			if raw.GitDir != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Conflicting module locations",
+					Detail:   fmt.Sprintf("Module %q %q %q may not set both \"git_url\" and \"git_dir\", since the server chooses the directory of the mirror of \"git_url\" itself.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			if settings.GitMirrorDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Missing git_mirror_dir",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"git_url\", so \"git_mirror_dir\" must be set to the directory in which to keep its mirror.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			mod.GitURL = *raw.GitURL
+			mod.GitDir = settings.MirrorGitDir(mod.GitURL)
+		}
+		if raw.ArchiveDir != nil {
+			mod.ArchiveDir = *raw.ArchiveDir
+		}
+		if raw.S3 != nil {
+			loc, locDiags := decodeS3Location(raw.S3.Body, declRange)
+			diags = append(diags, locDiags...)
+			if locDiags.HasErrors() {
+				continue
+			}
+			mod.S3 = loc
+		}
+		if mod.locationCount() > 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting module locations",
+				Detail:   fmt.Sprintf("Module %q %q %q may set only one of \"git_dir\", \"archive_dir\" and an \"s3\" block.", namespace, name, provider),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		if raw.Path != nil {
+			mod.Path = *raw.Path
+		}
+		if raw.Links != nil {
+			mod.Links = *raw.Links
+		}
+		if raw.ContentType != nil {
+			mod.ContentType = *raw.ContentType
+		}
+		if raw.Prereleases != nil {
+			policy, policyDiags := decodePrereleasePolicy(*raw.Prereleases, declRange)
+			diags = append(diags, policyDiags...)
+			if policyDiags.HasErrors() {
+				continue
+			}
+			mod.Prereleases = policy
+		}
+		if raw.VersionScheme != nil {
+			scheme, schemeDiags := decodeVersionScheme(*raw.VersionScheme, declRange)
+			diags = append(diags, schemeDiags...)
+			if schemeDiags.HasErrors() {
+				continue
+			}
+			mod.VersionScheme = scheme
+		}
+		// The yanked and deprecated versions are parsed with the module's
+		// version scheme, so that they can be written as its tags name them.
+		if raw.YankedVersions != nil {
+			for _, s := range *raw.YankedVersions {
+				v, err := mod.VersionScheme.parseVersion(s)
+				if err != nil {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid yanked version",
+						Detail:   fmt.Sprintf("The \"yanked_versions\" argument contains %q, which is not a valid version number.", s),
+						Subject:  &declRange,
+					})
+					continue
+				}
+				mod.YankedVersions = append(mod.YankedVersions, v)
+			}
+		}
+		if raw.Deprecated != nil {
+			mod.Deprecated = *raw.Deprecated
+		}
+		if raw.DeprecatedVersions != nil {
+			mod.DeprecatedVersions = make(map[string]string)
+			for s, message := range *raw.DeprecatedVersions {
+				v, err := mod.VersionScheme.parseVersion(s)
+				if err != nil {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid deprecated version",
+						Detail:   fmt.Sprintf("The \"deprecated_versions\" argument contains %q, which is not a valid version number.", s),
+						Subject:  &declRange,
+					})
+					continue
+				}
+				mod.DeprecatedVersions[v.String()] = message
+			}
+		}
+		if raw.ContentDisposition != nil {
+			switch *raw.ContentDisposition {
+			case "attachment", "inline":
+				mod.ContentDisposition = *raw.ContentDisposition
+			default:
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid content disposition",
+					Detail:   "The \"content_disposition\" argument must be either \"attachment\" or \"inline\".",
+					Subject:  &declRange,
+				})
+				continue
+			}
+		}
+		if ns := namespaces[nsKey]; ns != nil && ns.Storage != nil {
+			ns.Storage.applyModuleDefaults(mod, name, provider)
+		}
+		if mod.locationCount() == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing module location",
+				Detail:   fmt.Sprintf("Module %q %q %q must set \"git_dir\" or \"archive_dir\" or have an \"s3\" block, or belong to a namespace with a storage block.", namespace, name, provider),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		if mod.Path != "" && mod.GitDir == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid module path",
+				Detail:   fmt.Sprintf("Module %q %q %q sets \"path\", which applies only to modules in git repositories.", namespace, name, provider),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		if raw.TagPrefix != nil || raw.TagPattern != nil {
+			pattern, moreDiags := decodeTagPattern(raw.TagPrefix, raw.TagPattern, declRange)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				continue
+			}
+			if mod.GitDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid tag settings",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"tag_prefix\" or \"tag_pattern\", which apply only to modules in git repositories.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			mod.TagPattern = pattern
+		}
+		if raw.TrustedKeyFiles != nil {
+			if mod.GitDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid trusted_key_files",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"trusted_key_files\", which applies only to modules in git repositories.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			keys, moreDiags := loadTrustedKeys(*raw.TrustedKeyFiles, declRange)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				continue
+			}
+			mod.TrustedKeyFiles = *raw.TrustedKeyFiles
+			mod.TrustedKeys = keys
 		}
+		if raw.Exclude != nil {
+			if mod.GitDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid exclude",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"exclude\", which applies only to modules in git repositories, since other archives are served as they are.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			moreDiags := checkExcludePatterns(*raw.Exclude, declRange)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				continue
+			}
+			mod.Exclude = *raw.Exclude
+		}
+		if raw.Submodules != nil {
+			if mod.GitDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid submodules",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"submodules\", which applies only to modules in git repositories.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			mod.Submodules = make(map[string]string, len(*raw.Submodules))
+			for subPath, gitDir := range *raw.Submodules {
+				mod.Submodules[path.Clean(strings.Trim(subPath, "/"))] = gitDir
+			}
+		}
+		if raw.LFSDir != nil {
+			if mod.GitDir == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid lfs_dir",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"lfs_dir\", which applies only to modules in git repositories.", namespace, name, provider),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			mod.LFSDir = *raw.LFSDir
+		}
+
+		modules[nsKey][nameKey][providerKey] = mod
 	}
 
-	return &ModulesConfig{
-		Hostname:  hostname,
-		Listeners: listeners,
-		Modules:   modules,
-	}, diags
+	return namespaces, modules, diags
 }
 
 // ModulesConfig is a map of many modules to serve from a module registry
 // service. The keys of each respective map are the "namespace" (an arbitrary
 // container that may be used to model internal departments, etc), the module
-// name, and the provider.
+// name, and the provider, each normalized using NormalizeIdentifier.
 type Modules map[string]map[string]map[string]*Module
 
+// Get returns the configuration for the given module, or nil if no such
+// module is configured. The given identifiers need not be normalized.
+func (m Modules) Get(namespace, name, provider string) *Module {
+	return m.ByName(namespace, name)[NormalizeIdentifier(provider)]
+}
+
+// ByName returns the configurations for all of the modules with the given
+// namespace and name, keyed by normalized provider. The given identifiers
+// need not be normalized. The result is nil if there are no such modules.
+func (m Modules) ByName(namespace, name string) map[string]*Module {
+	return m[NormalizeIdentifier(namespace)][NormalizeIdentifier(name)]
+}
+
 // ModuleConfig is the configuration for a single module to be served from
 // a module registry service.
 type Module struct {
-	GitDir    string
+	// Namespace, Name and Provider are the identifiers of the module as
+	// written in its declaration, which may differ in case from the keys
+	// used to find it in Modules.
+	Namespace string
+	Name      string
+	Provider  string
+
+	// Exactly one of GitDir, ArchiveDir and S3 is set. GitDir is a git
+	// repository whose version-shaped tags are the versions of the module,
+	// while ArchiveDir is a directory of pre-built archives named like
+	// "1.2.3.tgz" and S3 is the location of such archives in a bucket.
+	GitDir     string
+	ArchiveDir string
+	S3         *S3Location
+
+	// GitURL is the URL of a remote git repository that is mirrored into
+	// GitDir by the server, or an empty string if GitDir is maintained by
+	// some other means.
+	GitURL string
+
+	// Path is the directory within the git repository that contains the
+	// module, as a slash-separated path relative to the root of the
+	// repository, or an empty string if the module is the whole repository.
+	Path string
+
+	// TagPattern matches the names of the tags in the git repository that
+	// give the versions of the module, with a single capture group for the
+	// version number. If nil, the versions are the tags named like "v1.2.3".
+	TagPattern *regexp.Regexp
+
+	// TrustedKeys are the PGP public keys read from the armored keyring
+	// files TrustedKeyFiles. If any are set, only the tags signed by one of
+	// them give versions of the module, and all others are hidden.
+	TrustedKeyFiles []string
+	TrustedKeys     openpgp.EntityList
+
+	// Exclude are patterns of the paths to leave out of the module's
+	// archives, in addition to those in the ignore file of each version, as
+	// described by module.ExcludePatternMatches.
+	Exclude []string
+
+	// Submodules maps the paths of the submodules whose contents are
+	// included in the module's archives, relative to the root of the
+	// module, to the directories of the git repositories that contain their
+	// commits. Other submodules are left out of archives.
+	Submodules map[string]string
+
+	// LFSDir is a directory of git-lfs objects, laid out like the "lfs"
+	// directory of a git repository, whose objects are archived in place of
+	// the pointer files that refer to them. If it is empty, pointer files
+	// are archived as they are.
+	LFSDir string
+
+	// Links is arbitrary named link metadata, such as a documentation URL,
+	// that is included verbatim in the API responses for the module.
+	Links map[string]string
+
+	// ContentType and ContentDisposition override the corresponding headers
+	// of archive download responses, if set. ContentDisposition is the
+	// disposition type only, either "attachment" or "inline"; the filename
+	// parameter is always included.
+	ContentType        string
+	ContentDisposition string
+
+	// YankedVersions are versions that have been withdrawn, and so are
+	// neither listed nor available for download even though they still
+	// exist in the module's source.
+	YankedVersions []*version.Version
+
+	// Deprecated is a message explaining why the module is deprecated, or
+	// an empty string if it isn't. DeprecatedVersions gives such a message
+	// for particular versions, keyed by their normalized version strings.
+	Deprecated         string
+	DeprecatedVersions map[string]string
+
+	// Prereleases decides how the module's prerelease versions are offered
+	// to clients, defaulting to the top-level "prereleases" setting.
+	Prereleases PrereleasePolicy
+
+	// VersionScheme decides which tag names or archive file names are
+	// versions of the module, and how they are ordered, or is empty to use
+	// VersionsLoose.
+	VersionScheme VersionScheme
+
+	// OutboundTLS is the configuration of the TLS connections made to
+	// GitURL or S3, shared by all modules, or nil to use the defaults.
+	OutboundTLS *OutboundTLS
+
+	// OutboundProxy is the proxy for requests to S3, shared by all modules,
+	// or nil to use the proxy given by the environment.
+	OutboundProxy *OutboundProxy
+
 	DeclRange hcl.Range
 }
+
+// decodeTagPattern returns the pattern for the tag names given by the
+// "tag_prefix" or "tag_pattern" argument of a module block, whichever is set.
+// The pattern must match the whole of a tag name.
+func decodeTagPattern(prefix, pattern *string, declRange hcl.Range) (*regexp.Regexp, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if prefix != nil && pattern != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting tag settings",
+			Detail:   "Only one of \"tag_prefix\" and \"tag_pattern\" may be set.",
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+	if prefix != nil {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(*prefix) + "(.+)$"), diags
+	}
+
+	if _, err := regexp.Compile(*pattern); err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid tag_pattern",
+			Detail:   fmt.Sprintf("The \"tag_pattern\" argument must be a valid regular expression: %s.", err),
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+	ret := regexp.MustCompile("^(?:" + *pattern + ")$")
+	if ret.NumSubexp() != 1 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid tag_pattern",
+			Detail:   "The \"tag_pattern\" argument must have exactly one capture group, which matches the version number.",
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+	return ret, diags
+}
+
+// loadTrustedKeys reads the armored PGP keyrings in the files given by the
+// "trusted_key_files" argument of a module block.
+func loadTrustedKeys(filenames []string, declRange hcl.Range) (openpgp.EntityList, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if len(filenames) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid trusted_key_files",
+			Detail:   "The \"trusted_key_files\" argument must list at least one key file, since otherwise no tags could be trusted.",
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+
+	var ret openpgp.EntityList
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unreadable trusted key file",
+				Detail:   fmt.Sprintf("Failed to open trusted key file %s: %s.", filename, err),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		keys, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid trusted key file",
+				Detail:   fmt.Sprintf("The file %s must contain ASCII-armored PGP public keys: %s.", filename, err),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		ret = append(ret, keys...)
+	}
+	return ret, diags
+}
+
+// checkExcludePatterns checks that each of the patterns given by the
+// "exclude" argument of a module block is well-formed.
+func checkExcludePatterns(patterns []string, declRange hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, pattern := range patterns {
+		trimmed := strings.Trim(pattern, "/")
+		if _, err := path.Match(trimmed, ""); err != nil || trimmed == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid exclude pattern",
+				Detail:   fmt.Sprintf("The exclude pattern %q is not a valid pattern, such as \"examples/\" or \"*.tftest.hcl\".", pattern),
+				Subject:  &declRange,
+			})
+		}
+	}
+	return diags
+}
+
+// Yanked returns true if the given version of the module has been yanked.
+func (m *Module) Yanked(v *version.Version) bool {
+	for _, yanked := range m.YankedVersions {
+		if yanked.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deprecation returns the message explaining why the given version of the
+// module is deprecated, or an empty string if it isn't. If v is nil, the
+// result applies to the module as a whole.
+//
+// A message for a specific version takes precedence over the module's.
+func (m *Module) Deprecation(v *version.Version) string {
+	if v != nil {
+		if message, ok := m.DeprecatedVersions[v.String()]; ok {
+			return message
+		}
+	}
+	return m.Deprecated
+}
+
+// locationCount returns how many of the module's location settings are set.
+func (m *Module) locationCount() int {
+	count := 0
+	if m.GitDir != "" {
+		count++
+	}
+	if m.ArchiveDir != "" {
+		count++
+	}
+	if m.S3 != nil {
+		count++
+	}
+	return count
+}
+
+// MirrorGitDir returns the directory in which the server keeps its mirror of
+// the repository at the given URL, for a module that sets it as "git_url".
+func (s *ModuleSettings) MirrorGitDir(url string) string {
+	return filepath.Join(s.GitMirrorDir, mirrorDirName(url))
+}
+
+// mirrorDirName returns the name of the directory within the mirror
+// directory for the mirror of the repository at the given URL. This is
+// named for the repository so that operators can recognize it, but also
+// includes a hash of the whole URL to keep similarly-named repositories
+// apart.
+func mirrorDirName(url string) string {
+	base := strings.TrimSuffix(path.Base(strings.TrimRight(url, "/")), ".git")
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, base)
+	hash := sha256.Sum256([]byte(url))
+	return base + "-" + hex.EncodeToString(hash[:4]) + ".git"
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Namespaces is a map of normalized namespace names to settings that apply
+// to all of the modules declared within each namespace.
+type Namespaces map[string]*Namespace
+
+// Namespace is the configuration for a single namespace of modules.
+type Namespace struct {
+	// Name is the namespace name as written in its declaration.
+	Name string
+
+	// Storage is the default storage backend for modules in this namespace,
+	// used for any module block that does not specify its own location.
+	// This is nil if no storage block was given.
+	Storage Storage
+
+	DeclRange hcl.Range
+}
+
+// Storage is implemented by each of the storage backends that can be
+// selected for a namespace using a "storage" block.
+type Storage interface {
+	// applyModuleDefaults populates any location settings that were not
+	// set explicitly in the given module's block, using the given name
+	// and provider to derive the appropriate location within the storage.
+	applyModuleDefaults(mod *Module, name, provider string)
+}
+
+// GitStorage is a Storage that expects each module to be a bare git
+// repository at NAME/PROVIDER under a base directory.
+type GitStorage struct {
+	BaseDir string
+}
+
+func (s *GitStorage) applyModuleDefaults(mod *Module, name, provider string) {
+	if mod.locationCount() == 0 {
+		mod.GitDir = filepath.Join(s.BaseDir, name, provider)
+	}
+}
+
+// ArchiveStorage is a Storage that expects each module to be a directory
+// of pre-built archives at NAME/PROVIDER under a base directory.
+type ArchiveStorage struct {
+	BaseDir string
+}
+
+func (s *ArchiveStorage) applyModuleDefaults(mod *Module, name, provider string) {
+	if mod.locationCount() == 0 {
+		mod.ArchiveDir = filepath.Join(s.BaseDir, name, provider)
+	}
+}
+
+// S3Storage is a Storage that expects each module to be a set of pre-built
+// archives under the key prefix NAME/PROVIDER within a bucket, itself
+// beneath any prefix given in Location.
+type S3Storage struct {
+	Location S3Location
+}
+
+func (s *S3Storage) applyModuleDefaults(mod *Module, name, provider string) {
+	if mod.locationCount() == 0 {
+		loc := s.Location
+		loc.Prefix = path.Join(loc.Prefix, name, provider)
+		mod.S3 = &loc
+	}
+}
+
+var namespaceBlockSchema = hcl.BlockHeaderSchema{
+	Type:       "namespace",
+	LabelNames: []string{"name"},
+}
+
+func loadNamespaceConfig(block *hcl.Block) (*Namespace, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       "storage",
+				LabelNames: []string{"type"},
+			},
+		},
+	}
+	content, diags := block.Body.Content(schema)
+
+	ns := &Namespace{
+		Name:      block.Labels[0],
+		DeclRange: hcl.RangeBetween(block.TypeRange, block.LabelRanges[0]),
+	}
+
+	for _, sb := range content.Blocks {
+		if ns.Storage != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate storage block",
+				Detail:   "Only one storage block is allowed per namespace.",
+				Subject:  &sb.DefRange,
+			})
+			continue
+		}
+
+		switch sb.Labels[0] {
+		case "git":
+			type gitStorage struct {
+				BaseDir string `hcl:"base_dir,attr"`
+			}
+			var raw gitStorage
+			bodyDiags := gohcl.DecodeBody(sb.Body, nil, &raw)
+			diags = append(diags, bodyDiags...)
+			if bodyDiags.HasErrors() {
+				continue
+			}
+			ns.Storage = &GitStorage{
+				BaseDir: raw.BaseDir,
+			}
+		case "archive":
+			type archiveStorage struct {
+				BaseDir string `hcl:"base_dir,attr"`
+			}
+			var raw archiveStorage
+			bodyDiags := gohcl.DecodeBody(sb.Body, nil, &raw)
+			diags = append(diags, bodyDiags...)
+			if bodyDiags.HasErrors() {
+				continue
+			}
+			ns.Storage = &ArchiveStorage{
+				BaseDir: raw.BaseDir,
+			}
+		case "s3":
+			loc, locDiags := decodeS3Location(sb.Body, sb.DefRange)
+			diags = append(diags, locDiags...)
+			if locDiags.HasErrors() {
+				continue
+			}
+			ns.Storage = &S3Storage{
+				Location: *loc,
+			}
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported storage type",
+				Detail:   fmt.Sprintf("Storage type %q is not supported. The supported types are \"git\", \"archive\" and \"s3\".", sb.Labels[0]),
+				Subject:  sb.LabelRanges[0].Ptr(),
+			})
+		}
+	}
+
+	return ns, diags
+}
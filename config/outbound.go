@@ -0,0 +1,234 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// OutboundTLS is the configuration of the TLS connections that the server
+// makes to other services, such as the remote repositories of mirrored
+// modules, S3 and the registries that modules are imported from.
+type OutboundTLS struct {
+	// CAFile is a file of PEM-encoded certificates of the certificate
+	// authorities to trust in addition to those trusted by the system, or
+	// an empty string to trust only those of the system.
+	CAFile string
+
+	// CertFile and KeyFile are the PEM-encoded client certificate and key
+	// presented to servers that ask for one, or empty strings if there is
+	// no client certificate.
+	CertFile string
+	KeyFile  string
+
+	DeclRange hcl.Range
+}
+
+// TLSConfig reads the certificate files and returns the TLS client
+// configuration described by the receiver. For convenience, it returns nil
+// if the receiver is nil, which callers can then use as meaning the default
+// configuration.
+func (t *OutboundTLS) TLSConfig() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	ret := &tls.Config{}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		ret.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
+
+// loadOutboundTLSConfig decodes the optional "outbound_tls" block from the
+// given body, returning nil if it isn't present.
+func loadOutboundTLSConfig(body hcl.Body) (*OutboundTLS, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "outbound_tls",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *OutboundTLS
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate outbound_tls block",
+				Detail:   fmt.Sprintf("Outbound TLS was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type outboundTLS struct {
+			CAFile   *string `hcl:"ca_file,attr"`
+			CertFile *string `hcl:"cert_file,attr"`
+			KeyFile  *string `hcl:"key_file,attr"`
+		}
+		var raw outboundTLS
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+		if (raw.CertFile == nil) != (raw.KeyFile == nil) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Incomplete client certificate",
+				Detail:   "The \"cert_file\" and \"key_file\" arguments must be set together.",
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		ret = &OutboundTLS{
+			DeclRange: block.DefRange,
+		}
+		if raw.CAFile != nil {
+			ret.CAFile = *raw.CAFile
+		}
+		if raw.CertFile != nil {
+			ret.CertFile, ret.KeyFile = *raw.CertFile, *raw.KeyFile
+		}
+	}
+
+	return ret, remain, diags
+}
+
+// OutboundProxy is the configuration of the HTTP proxy through which the
+// server makes its own HTTP and HTTPS requests to other services.
+type OutboundProxy struct {
+	// URL is the URL of the proxy, such as "http://proxy.example.com:3128".
+	URL *url.URL
+
+	// NoProxy is the hosts that are contacted directly rather than through
+	// the proxy, each being a hostname that also matches its subdomains, an
+	// IP address, a CIDR range of IP addresses, or "*" to match all hosts.
+	NoProxy []string
+
+	DeclRange hcl.Range
+}
+
+// Proxy returns the URL of the proxy to use for the given request, or nil
+// if it should be sent directly, for use as the Proxy of an http.Transport.
+// Requests to loopback addresses are always sent directly.
+//
+// For convenience, if the receiver is nil then the proxy is instead selected
+// by the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func (p *OutboundProxy) Proxy(req *http.Request) (*url.URL, error) {
+	if p == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil, nil
+	}
+	for _, entry := range p.NoProxy {
+		if entry == "*" {
+			return nil, nil
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return nil, nil
+			}
+			continue
+		}
+		entry = strings.ToLower(strings.TrimPrefix(entry, "."))
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return nil, nil
+		}
+	}
+	return p.URL, nil
+}
+
+// loadOutboundProxyConfig decodes the optional "outbound_proxy" block from
+// the given body, returning nil if it isn't present.
+func loadOutboundProxyConfig(body hcl.Body) (*OutboundProxy, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "outbound_proxy",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *OutboundProxy
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate outbound_proxy block",
+				Detail:   fmt.Sprintf("The outbound proxy was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type outboundProxy struct {
+			URL     string    `hcl:"url,attr"`
+			NoProxy *[]string `hcl:"no_proxy,attr"`
+		}
+		var raw outboundProxy
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+		proxyURL, err := url.Parse(raw.URL)
+		if err == nil && (proxyURL.Host == "" || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5")) {
+			err = fmt.Errorf("must be an absolute URL using http, https or socks5")
+		}
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid proxy URL",
+				Detail:   fmt.Sprintf("The \"url\" argument is not a valid proxy URL: %s.", err),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		ret = &OutboundProxy{
+			URL:       proxyURL,
+			DeclRange: block.DefRange,
+		}
+		if raw.NoProxy != nil {
+			ret.NoProxy = *raw.NoProxy
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// PrereleasePolicy decides how the prerelease versions of a module, such as
+// 1.3.0-rc1, are offered to clients that don't ask for them explicitly.
+type PrereleasePolicy string
+
+const (
+	// PrereleasesLatest treats prereleases like any other version, so that
+	// a prerelease can be the latest version of a module. This is the
+	// default.
+	PrereleasesLatest PrereleasePolicy = "latest"
+
+	// PrereleasesListed includes prereleases in the list of versions, but
+	// never selects one as the latest version.
+	PrereleasesListed PrereleasePolicy = "listed"
+
+	// PrereleasesHidden excludes prereleases from the list of versions as
+	// well as from being the latest version.
+	PrereleasesHidden PrereleasePolicy = "hidden"
+)
+
+// decodePrereleasePolicy validates the value of a "prereleases" argument.
+func decodePrereleasePolicy(value string, rng hcl.Range) (PrereleasePolicy, hcl.Diagnostics) {
+	switch policy := PrereleasePolicy(value); policy {
+	case PrereleasesLatest, PrereleasesListed, PrereleasesHidden:
+		return policy, nil
+	default:
+		return "", hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid prereleases",
+				Detail:   fmt.Sprintf("The \"prereleases\" argument must be %q, %q or %q.", PrereleasesLatest, PrereleasesListed, PrereleasesHidden),
+				Subject:  &rng,
+			},
+		}
+	}
+}
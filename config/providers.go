@@ -0,0 +1,212 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// ProvidersConfig is the root type of a configuration for a providers server.
+type ProvidersConfig struct {
+	Hostname     svchost.Hostname
+	BasePath     string
+	Listeners    Listeners
+	Discovery    *Discovery
+	Log          *Log
+	DrainTimeout time.Duration
+	Providers    Providers
+}
+
+// LoadProvidersConfig processes a raw HCL Body into a configuration for a
+// provider registry server.
+//
+// If the returned diagnostics has errors, the returned configuration may
+// be incomplete or invalid. Otherwise, the returned configuration is complete
+// and guaranteed to be statically valid. (References to files, TCP ports,
+// etc are not checked until they are used.)
+func LoadProvidersConfig(body hcl.Body) (*ProvidersConfig, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	// Every part of the configuration can refer to the local values and
+	// call the configuration language's functions.
+	ctx, remain, localsDiags := loadLocalsConfig(body)
+	body = bindEvalContext(remain, ctx)
+	diags = append(diags, localsDiags...)
+
+	listeners, remain, listenersDiags := loadListenersConfig(body)
+	body = remain
+	diags = append(diags, listenersDiags...)
+
+	hostname, remain, hostnameDiags := loadHostnameConfig(body)
+	body = remain
+	diags = append(diags, hostnameDiags...)
+
+	basePath, remain, basePathDiags := loadBasePathConfig(body)
+	body = remain
+	diags = append(diags, basePathDiags...)
+
+	discovery, remain, discoveryDiags := loadDiscoveryConfig(body, basePathServices(basePath, map[string]string{
+		"providers.v1": "/",
+	}))
+	body = remain
+	diags = append(diags, discoveryDiags...)
+
+	logCfg, remain, logDiags := loadLogConfig(body)
+	body = remain
+	diags = append(diags, logDiags...)
+
+	drainTimeout, remain, drainTimeoutDiags := loadDrainTimeoutConfig(body)
+	body = remain
+	diags = append(diags, drainTimeoutDiags...)
+
+	providers, remain, providersDiags := loadProvidersDeclsConfig(body)
+	body = remain
+	diags = append(diags, providersDiags...)
+
+	// Anything left over at this point is not valid.
+	_, extraDiags := body.Content(&hcl.BodySchema{})
+	diags = append(diags, extraDiags...)
+
+	return &ProvidersConfig{
+		Hostname:     hostname,
+		BasePath:     basePath,
+		Listeners:    listeners,
+		Discovery:    discovery,
+		Log:          logCfg,
+		DrainTimeout: drainTimeout,
+		Providers:    providers,
+	}, diags
+}
+
+// loadDrainTimeoutConfig decodes the optional "drain_timeout" attribute,
+// which the modules server instead decodes along with its other module
+// settings. The result is DefaultDrainTimeout if it isn't set.
+func loadDrainTimeoutConfig(body hcl.Body) (time.Duration, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name: "drain_timeout",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+	attr, ok := content.Attributes["drain_timeout"]
+	if !ok || diags.HasErrors() {
+		return DefaultDrainTimeout, remain, diags
+	}
+
+	ret, durDiags := decodeDuration(attr)
+	diags = append(diags, durDiags...)
+	return ret, remain, diags
+}
+
+// loadProvidersDeclsConfig decodes the "provider" blocks.
+func loadProvidersDeclsConfig(body hcl.Body) (Providers, hcl.Body, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       "provider",
+				LabelNames: []string{"namespace", "type"},
+			},
+		},
+	}
+	content, remain, contentDiags := body.PartialContent(schema)
+	diags = append(diags, contentDiags...)
+
+	type provider struct {
+		Dir        string    `hcl:"dir,attr"`
+		Protocols  *[]string `hcl:"protocols,attr"`
+		GPGKeyFile string    `hcl:"gpg_key_file,attr"`
+	}
+
+	providers := make(Providers)
+	for _, block := range content.Blocks {
+		if labelDiags := checkBlockLabels(block, "namespace", "provider type"); labelDiags.HasErrors() {
+			diags = append(diags, labelDiags...)
+			continue
+		}
+		namespace, typeName := block.Labels[0], block.Labels[1]
+		nsKey, typeKey := NormalizeIdentifier(namespace), NormalizeIdentifier(typeName)
+		declRange := hcl.RangeBetween(block.TypeRange, block.LabelRanges[1])
+		if providers[nsKey] == nil {
+			providers[nsKey] = make(map[string]*Provider)
+		}
+		if existing, exists := providers[nsKey][typeKey]; exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate provider declaration",
+				Detail: fmt.Sprintf(
+					"A provider block for %q %q was already declared at %s.%s",
+					namespace, typeName, existing.DeclRange,
+					caseConflictNote(namespace+"/"+typeName, existing.Namespace+"/"+existing.Type),
+				),
+				Subject: &declRange,
+			})
+			continue
+		}
+
+		var raw provider
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		protocols := []string{"5.0"}
+		if raw.Protocols != nil {
+			protocols = *raw.Protocols
+		}
+
+		providers[nsKey][typeKey] = &Provider{
+			Namespace:  namespace,
+			Type:       typeName,
+			Dir:        raw.Dir,
+			Protocols:  protocols,
+			GPGKeyFile: raw.GPGKeyFile,
+			DeclRange:  declRange,
+		}
+	}
+
+	return providers, remain, diags
+}
+
+// Providers is a map of many providers to serve from a provider registry
+// service. The keys of each respective map are the namespace and the
+// provider type name, each normalized using NormalizeIdentifier.
+type Providers map[string]map[string]*Provider
+
+// Get returns the configuration for the given provider, or nil if no such
+// provider is configured. The given identifiers need not be normalized.
+func (p Providers) Get(namespace, typeName string) *Provider {
+	return p[NormalizeIdentifier(namespace)][NormalizeIdentifier(typeName)]
+}
+
+// Provider is the configuration for a single provider to be served from
+// a provider registry service.
+type Provider struct {
+	// Namespace and Type are the identifiers of the provider as written in
+	// its declaration, which may differ in case from the keys used to find
+	// it in Providers.
+	Namespace string
+	Type      string
+
+	// Dir is a directory containing the release files for all versions of
+	// the provider, named in the same way as for official releases.
+	Dir string
+
+	// Protocols is the list of plugin protocol versions to report for
+	// any version that does not have a manifest file declaring its own.
+	Protocols []string
+
+	// GPGKeyFile is the path to an ASCII-armored GPG public key that was
+	// used to sign the SHA256SUMS files in Dir.
+	GPGKeyFile string
+
+	DeclRange hcl.Range
+}
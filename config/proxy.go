@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/terraform/svchost"
+)
+
+// Proxy is the configuration for passing requests for modules in namespaces
+// that aren't declared locally on to an upstream registry, such as the
+// public registry, so that one hostname can serve both private modules and
+// a cached mirror of public ones.
+type Proxy struct {
+	// Upstream is the hostname of the registry that requests are passed to.
+	Upstream svchost.Hostname
+
+	// CacheDir is the directory in which the responses and archives from
+	// the upstream registry are cached.
+	CacheDir string
+
+	// CacheTTL is how long the list of versions of each module is cached
+	// for before it is fetched from the upstream registry again. Archives
+	// are cached indefinitely, since a version's contents don't change.
+	CacheTTL time.Duration
+
+	DeclRange hcl.Range
+}
+
+const (
+	// defaultProxyUpstream is the registry that requests are passed to
+	// unless "upstream" is set.
+	defaultProxyUpstream = "registry.terraform.io"
+
+	// defaultProxyCacheTTL is how long version lists are cached for unless
+	// "cache_ttl" is set.
+	defaultProxyCacheTTL = time.Hour
+)
+
+// loadProxyConfig decodes the optional "proxy" block from the given body,
+// returning nil if it isn't present.
+func loadProxyConfig(body hcl.Body) (*Proxy, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "proxy",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Proxy
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate proxy block",
+				Detail:   fmt.Sprintf("The proxy was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type proxy struct {
+			Upstream *hcl.Attribute `hcl:"upstream,attr"`
+			CacheDir string         `hcl:"cache_dir,attr"`
+			CacheTTL *hcl.Attribute `hcl:"cache_ttl,attr"`
+		}
+		var raw proxy
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Proxy{
+			Upstream:  svchost.Hostname(defaultProxyUpstream),
+			CacheDir:  raw.CacheDir,
+			CacheTTL:  defaultProxyCacheTTL,
+			DeclRange: block.DefRange,
+		}
+		if raw.Upstream != nil {
+			var hostDiags hcl.Diagnostics
+			ret.Upstream, hostDiags = decodeHostname(raw.Upstream.Expr)
+			diags = append(diags, hostDiags...)
+		}
+		if raw.CacheTTL != nil {
+			var durDiags hcl.Diagnostics
+			ret.CacheTTL, durDiags = decodeDuration(raw.CacheTTL)
+			diags = append(diags, durDiags...)
+		}
+		if ret.CacheDir == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid proxy cache directory",
+				Detail:   "The \"cache_dir\" argument must not be empty.",
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Publish is the configuration for the API through which new versions of
+// modules can be published over HTTP, such as by CI systems, rather than by
+// writing to the modules' git repositories or archive directories directly.
+type Publish struct {
+	// Tokens and TokenFile give the bearer tokens that allow publishing, in
+	// the same way as for an Auth. They are separate from the tokens that
+	// allow reading from the registry.
+	Tokens    []string
+	TokenFile string
+
+	// MaxSize is the largest archive, in bytes, that may be uploaded.
+	MaxSize int64
+
+	DeclRange hcl.Range
+}
+
+// defaultPublishMaxSizeMB is the largest archive that may be published,
+// in megabytes, unless "max_size_mb" is set.
+const defaultPublishMaxSizeMB = 64
+
+// loadPublishConfig decodes the optional "publish" block from the given
+// body, returning nil if it isn't present.
+func loadPublishConfig(body hcl.Body) (*Publish, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "publish",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Publish
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate publish block",
+				Detail:   fmt.Sprintf("Publishing was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type publish struct {
+			Tokens    []string `hcl:"tokens,attr"`
+			TokenFile *string  `hcl:"token_file,attr"`
+			MaxSizeMB *int64   `hcl:"max_size_mb,attr"`
+		}
+		var raw publish
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Publish{
+			Tokens:    raw.Tokens,
+			MaxSize:   defaultPublishMaxSizeMB * 1024 * 1024,
+			DeclRange: block.DefRange,
+		}
+		if raw.TokenFile != nil {
+			ret.TokenFile = *raw.TokenFile
+		}
+		if len(ret.Tokens) == 0 && ret.TokenFile == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No tokens configured",
+				Detail:   "A publish block must set at least one of \"tokens\" and \"token_file\".",
+				Subject:  &block.DefRange,
+			})
+		}
+		if raw.MaxSizeMB != nil {
+			if *raw.MaxSizeMB <= 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid publish size limit",
+					Detail:   "The \"max_size_mb\" argument must be a positive number of megabytes.",
+					Subject:  &block.DefRange,
+				})
+			}
+			ret.MaxSize = *raw.MaxSizeMB * 1024 * 1024
+		}
+	}
+
+	return ret, remain, diags
+}
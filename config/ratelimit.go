@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Rate limit keys, as set in the "key" attribute of a rate_limit block.
+const (
+	RateLimitByClientIP = "client_ip"
+	RateLimitByToken    = "token"
+)
+
+// RateLimit is the configuration for limiting the rate of the requests that
+// each client makes.
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate allowed for each client, and
+	// Burst is how many requests a client may make at once after not
+	// making any for a while.
+	RequestsPerSecond float64
+	Burst             int
+
+	// Key decides what counts as the same client, and is either
+	// RateLimitByClientIP or RateLimitByToken.
+	Key string
+
+	DeclRange hcl.Range
+}
+
+// loadRateLimitConfig decodes the optional "rate_limit" block from the given
+// body, returning nil if it isn't present.
+func loadRateLimitConfig(body hcl.Body) (*RateLimit, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "rate_limit",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *RateLimit
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate rate_limit block",
+				Detail:   fmt.Sprintf("Rate limiting was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type rateLimit struct {
+			RequestsPerSecond float64 `hcl:"requests_per_second,attr"`
+			Burst             *int    `hcl:"burst,attr"`
+			Key               *string `hcl:"key,attr"`
+		}
+		var raw rateLimit
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		// By default a client can make a second's worth of requests at
+		// once.
+		ret = &RateLimit{
+			RequestsPerSecond: raw.RequestsPerSecond,
+			Burst:             int(math.Max(1, math.Ceil(raw.RequestsPerSecond))),
+			Key:               RateLimitByClientIP,
+			DeclRange:         block.DefRange,
+		}
+		if raw.Burst != nil {
+			ret.Burst = *raw.Burst
+		}
+		if raw.Key != nil {
+			ret.Key = *raw.Key
+		}
+
+		if ret.RequestsPerSecond <= 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid requests_per_second",
+				Detail:   "The \"requests_per_second\" argument must be a number greater than zero.",
+				Subject:  &block.DefRange,
+			})
+		}
+		if ret.Burst < 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid burst",
+				Detail:   "The \"burst\" argument must be at least 1.",
+				Subject:  &block.DefRange,
+			})
+		}
+		switch ret.Key {
+		case RateLimitByClientIP, RateLimitByToken:
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid rate limit key",
+				Detail:   fmt.Sprintf("The rate limit key %q is not supported. Must be %q or %q.", ret.Key, RateLimitByClientIP, RateLimitByToken),
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
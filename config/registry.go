@@ -0,0 +1,152 @@
+package config
+
+import (
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// RegistryConfig is the root type of a configuration for the combined
+// registry server, which serves both modules and providers. Its module
+// settings are those of a modules server.
+type RegistryConfig struct {
+	ModulesConfig
+	Providers Providers
+}
+
+// Default base paths for the services in the combined registry server.
+const (
+	ModulesBasePath   = "/v1/modules/"
+	ProvidersBasePath = "/v1/providers/"
+)
+
+// LoadRegistryConfig processes a raw HCL Body into a configuration for the
+// combined registry server. The configuration may contain any of the
+// settings accepted by either LoadModulesConfig or LoadProvidersConfig.
+//
+// The combined server always serves the discovery document, so if there is
+// no "discovery" block the result has a default Discovery describing the
+// services at their default base paths.
+func LoadRegistryConfig(body hcl.Body) (*RegistryConfig, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	// Every part of the configuration can refer to the local values and
+	// call the configuration language's functions.
+	ctx, remain, localsDiags := loadLocalsConfig(body)
+	body = bindEvalContext(remain, ctx)
+	diags = append(diags, localsDiags...)
+
+	listeners, remain, listenersDiags := loadListenersConfig(body)
+	body = remain
+	diags = append(diags, listenersDiags...)
+
+	hostname, remain, hostnameDiags := loadHostnameConfig(body)
+	body = remain
+	diags = append(diags, hostnameDiags...)
+
+	basePath, remain, basePathDiags := loadBasePathConfig(body)
+	body = remain
+	diags = append(diags, basePathDiags...)
+
+	defaultServices := basePathServices(basePath, map[string]string{
+		"modules.v1":   ModulesBasePath,
+		"providers.v1": ProvidersBasePath,
+	})
+	discovery, remain, discoveryDiags := loadDiscoveryConfig(body, defaultServices)
+	body = remain
+	diags = append(diags, discoveryDiags...)
+	if discovery == nil {
+		discovery = &Discovery{
+			Services: defaultServices,
+		}
+	}
+
+	login, remain, loginDiags := loadLoginConfig(body)
+	body = remain
+	diags = append(diags, loginDiags...)
+
+	auth, remain, authDiags := loadAuthConfig(body)
+	body = remain
+	diags = append(diags, authDiags...)
+
+	publish, remain, publishDiags := loadPublishConfig(body)
+	body = remain
+	diags = append(diags, publishDiags...)
+
+	webhooks, remain, webhooksDiags := loadWebhooksConfig(body)
+	body = remain
+	diags = append(diags, webhooksDiags...)
+
+	proxy, remain, proxyDiags := loadProxyConfig(body)
+	body = remain
+	diags = append(diags, proxyDiags...)
+
+	admin, remain, adminDiags := loadAdminConfig(body)
+	body = remain
+	diags = append(diags, adminDiags...)
+
+	consul, remain, consulDiags := loadConsulConfig(body)
+	body = remain
+	diags = append(diags, consulDiags...)
+
+	tracing, remain, tracingDiags := loadTracingConfig(body)
+	body = remain
+	diags = append(diags, tracingDiags...)
+
+	logCfg, remain, logDiags := loadLogConfig(body)
+	body = remain
+	diags = append(diags, logDiags...)
+
+	rateLimit, remain, rateLimitDiags := loadRateLimitConfig(body)
+	body = remain
+	diags = append(diags, rateLimitDiags...)
+
+	cors, remain, corsDiags := loadCORSConfig(body)
+	body = remain
+	diags = append(diags, corsDiags...)
+
+	securityHeaders, remain, securityHeadersDiags := loadSecurityHeadersConfig(body)
+	body = remain
+	diags = append(diags, securityHeadersDiags...)
+
+	namespaces, modules, settings, remain, modulesDiags := loadModulesDeclsConfig(body)
+	body = remain
+	diags = append(diags, modulesDiags...)
+
+	virtualHosts, remain, virtualHostsDiags := loadVirtualHostsConfig(body, hostname, settings)
+	body = remain
+	diags = append(diags, virtualHostsDiags...)
+
+	providers, remain, providersDiags := loadProvidersDeclsConfig(body)
+	body = remain
+	diags = append(diags, providersDiags...)
+
+	// Anything left over at this point is not valid.
+	_, extraDiags := body.Content(&hcl.BodySchema{})
+	diags = append(diags, extraDiags...)
+
+	return &RegistryConfig{
+		ModulesConfig: ModulesConfig{
+			Hostname:        hostname,
+			BasePath:        basePath,
+			Listeners:       listeners,
+			Discovery:       discovery,
+			Login:           login,
+			Auth:            auth,
+			Publish:         publish,
+			Webhooks:        webhooks,
+			Proxy:           proxy,
+			Admin:           admin,
+			Consul:          consul,
+			Tracing:         tracing,
+			Log:             logCfg,
+			RateLimit:       rateLimit,
+			CORS:            cors,
+			SecurityHeaders: securityHeaders,
+			Namespaces:      namespaces,
+			Modules:         modules,
+			VirtualHosts:    virtualHosts,
+
+			ModuleSettings: settings,
+		},
+		Providers: providers,
+	}, diags
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// S3Location is the location of a module's pre-built archives in an Amazon
+// S3 bucket, or in a bucket in a service compatible with S3.
+type S3Location struct {
+	Bucket string
+
+	// Prefix is the key prefix under which the archives are named like
+	// "1.2.3.tgz", or an empty string if they are at the root of the bucket.
+	Prefix string
+
+	Region string
+
+	// Endpoint is the base URL of an S3-compatible service, or an empty
+	// string to use Amazon S3 itself.
+	Endpoint string
+
+	// AccessKeyID and SecretAccessKey are the credentials to use, or empty
+	// strings to use the credentials from the standard AWS environment
+	// variables.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// RedirectExpiry is how long the pre-signed URLs given to clients for
+	// downloading archives remain valid. If zero, archives are instead
+	// streamed to clients through the server.
+	RedirectExpiry time.Duration
+
+	DeclRange hcl.Range
+}
+
+// defaultS3RedirectExpiry is the validity period of pre-signed URLs when
+// redirection is enabled without an explicit "redirect_expiry".
+const defaultS3RedirectExpiry = 15 * time.Minute
+
+// s3Location is the raw form of an "s3" block in a module block, or of an
+// "s3" storage block in a namespace.
+type s3Location struct {
+	Bucket          string  `hcl:"bucket,attr"`
+	Prefix          *string `hcl:"prefix,attr"`
+	Region          string  `hcl:"region,attr"`
+	Endpoint        *string `hcl:"endpoint,attr"`
+	AccessKeyID     *string `hcl:"access_key_id,attr"`
+	SecretAccessKey *string `hcl:"secret_access_key,attr"`
+	Redirect        *bool   `hcl:"redirect,attr"`
+	RedirectExpiry  *string `hcl:"redirect_expiry,attr"`
+}
+
+func decodeS3Location(body hcl.Body, declRange hcl.Range) (*S3Location, hcl.Diagnostics) {
+	var raw s3Location
+	diags := gohcl.DecodeBody(body, nil, &raw)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	ret := &S3Location{
+		Bucket:    raw.Bucket,
+		Region:    raw.Region,
+		DeclRange: declRange,
+	}
+	if raw.Prefix != nil {
+		ret.Prefix = *raw.Prefix
+	}
+	if raw.Endpoint != nil {
+		ret.Endpoint = *raw.Endpoint
+	}
+	if (raw.AccessKeyID == nil) != (raw.SecretAccessKey == nil) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Incomplete S3 credentials",
+			Detail:   "The \"access_key_id\" and \"secret_access_key\" arguments must be set together.",
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+	if raw.AccessKeyID != nil {
+		ret.AccessKeyID = *raw.AccessKeyID
+		ret.SecretAccessKey = *raw.SecretAccessKey
+	}
+
+	if raw.Redirect != nil && *raw.Redirect {
+		ret.RedirectExpiry = defaultS3RedirectExpiry
+		if raw.RedirectExpiry != nil {
+			expiry, err := time.ParseDuration(*raw.RedirectExpiry)
+			if err != nil || expiry < time.Second {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid redirect_expiry",
+					Detail:   "The \"redirect_expiry\" argument must be a duration of at least one second, such as \"15m\".",
+					Subject:  &declRange,
+				})
+				return nil, diags
+			}
+			ret.RedirectExpiry = expiry
+		}
+	} else if raw.RedirectExpiry != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Unused redirect_expiry",
+			Detail:   "The \"redirect_expiry\" argument applies only when \"redirect\" is true.",
+			Subject:  &declRange,
+		})
+		return nil, diags
+	}
+
+	return ret, diags
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// SecurityHeaders is the configuration for the headers sent on every
+// response to tell browsers to apply security restrictions, for deployments
+// that aren't behind a proxy that would add them.
+type SecurityHeaders struct {
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header,
+	// which is sent only on responses to HTTPS requests, and
+	// HSTSIncludeSubdomains and HSTSPreload add its directives of the same
+	// names.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// Headers are the other headers to send, by their canonical names.
+	Headers map[string]string
+
+	DeclRange hcl.Range
+}
+
+// defaultHSTSMaxAge is a year, the minimum that browsers' preload lists
+// accept.
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// defaultSecurityHeaders are sent unless overridden by the "headers" argument
+// of a security_headers block. The registry serves only JSON and archives,
+// so nothing it sends needs to be rendered, framed or run by a browser.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Referrer-Policy":         "no-referrer",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+}
+
+// loadSecurityHeadersConfig decodes the optional "security_headers" block
+// from the given body, returning nil if it isn't present.
+func loadSecurityHeadersConfig(body hcl.Body) (*SecurityHeaders, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "security_headers",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *SecurityHeaders
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate security_headers block",
+				Detail:   fmt.Sprintf("Security headers were already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type securityHeaders struct {
+			HSTSMaxAge            *hcl.Attribute     `hcl:"hsts_max_age,attr"`
+			HSTSIncludeSubdomains *bool              `hcl:"hsts_include_subdomains,attr"`
+			HSTSPreload           *bool              `hcl:"hsts_preload,attr"`
+			Headers               *map[string]string `hcl:"headers,attr"`
+		}
+		var raw securityHeaders
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &SecurityHeaders{
+			HSTSMaxAge: defaultHSTSMaxAge,
+			Headers:    make(map[string]string),
+			DeclRange:  block.DefRange,
+		}
+		if raw.HSTSMaxAge != nil {
+			var durDiags hcl.Diagnostics
+			ret.HSTSMaxAge, durDiags = decodeDuration(raw.HSTSMaxAge)
+			diags = append(diags, durDiags...)
+		}
+		if raw.HSTSIncludeSubdomains != nil {
+			ret.HSTSIncludeSubdomains = *raw.HSTSIncludeSubdomains
+		}
+		if raw.HSTSPreload != nil {
+			ret.HSTSPreload = *raw.HSTSPreload
+		}
+
+		for name, value := range defaultSecurityHeaders {
+			ret.Headers[name] = value
+		}
+		if raw.Headers != nil {
+			for name, value := range *raw.Headers {
+				if !validHTTPToken(name) {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid security header",
+						Detail:   fmt.Sprintf("The header %q is not a valid HTTP header name.", name),
+						Subject:  &block.DefRange,
+					})
+					continue
+				}
+				name = http.CanonicalHeaderKey(name)
+				if name == "Strict-Transport-Security" {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid security header",
+						Detail:   "The Strict-Transport-Security header is configured with the \"hsts_max_age\", \"hsts_include_subdomains\" and \"hsts_preload\" arguments, rather than in \"headers\".",
+						Subject:  &block.DefRange,
+					})
+					continue
+				}
+
+				// An empty value turns off one of the default headers.
+				if value == "" {
+					delete(ret.Headers, name)
+				} else {
+					ret.Headers[name] = value
+				}
+			}
+		}
+
+		if ret.HSTSPreload && (!ret.HSTSIncludeSubdomains || ret.HSTSMaxAge < defaultHSTSMaxAge) {
+			// Browsers' preload lists reject a hostname whose header doesn't
+			// also have these, so the directive would do nothing.
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid HSTS preload",
+				Detail:   "The \"hsts_preload\" argument requires \"hsts_include_subdomains\" to be set and \"hsts_max_age\" to be at least a year (\"8760h\").",
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Tracing is the configuration for exporting traces of the requests that
+// the server handles to an OpenTelemetry collector.
+type Tracing struct {
+	// Endpoint is the base URL of the collector's OTLP/HTTP receiver, and
+	// Headers are added to every request to it, such as for
+	// authentication.
+	Endpoint string
+	Headers  map[string]string
+
+	// ServiceName is the name that identifies the server in the traces.
+	ServiceName string
+
+	// SampleRatio is the fraction of traces beginning at the server that
+	// are exported, from zero to one.
+	SampleRatio float64
+
+	DeclRange hcl.Range
+}
+
+// defaultTracingServiceName is the service name of traces unless
+// "service_name" or the OTEL_SERVICE_NAME environment variable is set.
+const defaultTracingServiceName = "terraform-registry"
+
+// loadTracingConfig decodes the optional "tracing" block from the given
+// body, returning nil if it isn't present. Its endpoint and service name
+// default to those given by the standard OTEL_EXPORTER_OTLP_ENDPOINT and
+// OTEL_SERVICE_NAME environment variables.
+func loadTracingConfig(body hcl.Body) (*Tracing, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "tracing",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Tracing
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate tracing block",
+				Detail:   fmt.Sprintf("Tracing was already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type tracing struct {
+			Endpoint    *string            `hcl:"endpoint,attr"`
+			Headers     *map[string]string `hcl:"headers,attr"`
+			ServiceName *string            `hcl:"service_name,attr"`
+			SampleRatio *float64           `hcl:"sample_ratio,attr"`
+		}
+		var raw tracing
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+
+		ret = &Tracing{
+			Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+			ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+			SampleRatio: 1,
+			DeclRange:   block.DefRange,
+		}
+		if raw.Endpoint != nil {
+			ret.Endpoint = *raw.Endpoint
+		}
+		if raw.Headers != nil {
+			ret.Headers = *raw.Headers
+		}
+		if raw.ServiceName != nil {
+			ret.ServiceName = *raw.ServiceName
+		}
+		if ret.ServiceName == "" {
+			ret.ServiceName = defaultTracingServiceName
+		}
+		if raw.SampleRatio != nil {
+			ret.SampleRatio = *raw.SampleRatio
+		}
+
+		if u, err := url.Parse(ret.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tracing endpoint",
+				Detail:   fmt.Sprintf("The tracing endpoint %q must be an absolute http or https URL, such as \"http://localhost:4318\".", ret.Endpoint),
+				Subject:  &block.DefRange,
+			})
+		}
+		if ret.SampleRatio < 0 || ret.SampleRatio > 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid sample_ratio",
+				Detail:   "The \"sample_ratio\" argument must be a number from 0 to 1.",
+				Subject:  &block.DefRange,
+			})
+		}
+	}
+
+	return ret, remain, diags
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// VersionScheme decides which tag names or archive file names give the
+// versions of a module, and how those versions are ordered. The schemes are
+// described in detail by the versionscheme package, which implements them.
+type VersionScheme string
+
+const (
+	// VersionsLoose accepts any version number that Terraform does. This is
+	// the default.
+	VersionsLoose VersionScheme = "loose"
+
+	// VersionsSemver accepts only strict semantic versions.
+	VersionsSemver VersionScheme = "semver"
+
+	// VersionsCalVer accepts date-based versions like "2023.04.01" or
+	// "2023-04-01", comparing each of their parts numerically.
+	VersionsCalVer VersionScheme = "calver"
+)
+
+// decodeVersionScheme validates the value of a "version_scheme" argument.
+func decodeVersionScheme(value string, rng hcl.Range) (VersionScheme, hcl.Diagnostics) {
+	switch scheme := VersionScheme(value); scheme {
+	case VersionsLoose, VersionsSemver, VersionsCalVer:
+		return scheme, nil
+	default:
+		return "", hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid version_scheme",
+				Detail:   fmt.Sprintf("The \"version_scheme\" argument must be %q, %q or %q.", VersionsLoose, VersionsSemver, VersionsCalVer),
+				Subject:  &rng,
+			},
+		}
+	}
+}
+
+// parseVersion returns the version that the given string represents under
+// the receiving scheme, as the module package does for tag names.
+func (s VersionScheme) parseVersion(raw string) (*version.Version, error) {
+	return versionscheme.Scheme(s).ParseVersion(raw)
+}
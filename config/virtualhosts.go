@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/terraform/svchost"
+)
+
+// VirtualHost is a set of modules served for a hostname other than the
+// server's main one, to requests whose Host header gives that hostname.
+type VirtualHost struct {
+	Hostname   svchost.Hostname
+	Namespaces Namespaces
+	Modules    Modules
+
+	DeclRange hcl.Range
+}
+
+// VirtualHosts maps each hostname other than the main one to the modules
+// served for it.
+type VirtualHosts map[svchost.Hostname]*VirtualHost
+
+// loadVirtualHostsConfig decodes the "registry" blocks from the given body.
+// The modules within them take their defaults from the given settings, as
+// for the modules of the main hostname, which is given so that it isn't
+// declared again.
+func loadVirtualHostsConfig(body hcl.Body, hostname svchost.Hostname, settings ModuleSettings) (VirtualHosts, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       "registry",
+				LabelNames: []string{"hostname"},
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	ret := make(VirtualHosts)
+	for _, block := range content.Blocks {
+		declRange := hcl.RangeBetween(block.TypeRange, block.LabelRanges[0])
+		host, err := svchost.ForComparison(block.Labels[0])
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid hostname",
+				Detail:   fmt.Sprintf("The given hostname is invalid: %s", err),
+				Subject:  &block.LabelRanges[0],
+			})
+			continue
+		}
+		if host == hostname {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate registry hostname",
+				Detail:   fmt.Sprintf("The hostname %q is the main hostname of the server, so its modules must be declared outside of any registry block.", host.ForDisplay()),
+				Subject:  &declRange,
+			})
+			continue
+		}
+		if existing, exists := ret[host]; exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate registry hostname",
+				Detail:   fmt.Sprintf("A registry block for %q was already declared at %s.", host.ForDisplay(), existing.DeclRange),
+				Subject:  &declRange,
+			})
+			continue
+		}
+
+		blockContent, contentDiags := block.Body.Content(&hcl.BodySchema{
+			Blocks: []hcl.BlockHeaderSchema{
+				namespaceBlockSchema,
+				moduleBlockSchema,
+			},
+		})
+		diags = append(diags, contentDiags...)
+		namespaces, modules, modulesDiags := decodeModuleBlocks(blockContent.Blocks, settings)
+		diags = append(diags, modulesDiags...)
+
+		ret[host] = &VirtualHost{
+			Hostname:   host,
+			Namespaces: namespaces,
+			Modules:    modules,
+			DeclRange:  declRange,
+		}
+	}
+
+	return ret, remain, diags
+}
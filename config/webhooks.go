@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl2/gohcl"
+	"github.com/hashicorp/hcl2/hcl"
+)
+
+// Webhooks is the configuration for the endpoints that receive push
+// webhooks from GitHub and GitLab, so that new versions of the affected
+// modules are served as soon as they are pushed.
+type Webhooks struct {
+	// Secret is the secret that each webhook must be signed with, for
+	// GitHub, or that it must give as its token, for GitLab.
+	Secret string
+
+	DeclRange hcl.Range
+}
+
+// loadWebhooksConfig decodes the optional "webhooks" block from the given
+// body, returning nil if it isn't present.
+func loadWebhooksConfig(body hcl.Body) (*Webhooks, hcl.Body, hcl.Diagnostics) {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "webhooks",
+			},
+		},
+	}
+	content, remain, diags := body.PartialContent(schema)
+
+	var ret *Webhooks
+	for _, block := range content.Blocks {
+		if ret != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate webhooks block",
+				Detail:   fmt.Sprintf("Webhooks were already configured at %s.", ret.DeclRange),
+				Subject:  &block.DefRange,
+			})
+			continue
+		}
+
+		type webhooks struct {
+			Secret string `hcl:"secret,attr"`
+		}
+		var raw webhooks
+		bodyDiags := gohcl.DecodeBody(block.Body, nil, &raw)
+		diags = append(diags, bodyDiags...)
+		if bodyDiags.HasErrors() {
+			continue
+		}
+		if raw.Secret == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid webhook secret",
+				Detail:   "The \"secret\" argument must not be empty, since anyone could then trigger updates.",
+				Subject:  &block.DefRange,
+			})
+		}
+
+		ret = &Webhooks{
+			Secret:    raw.Secret,
+			DeclRange: block.DefRange,
+		}
+	}
+
+	return ret, remain, diags
+}
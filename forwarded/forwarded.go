@@ -0,0 +1,102 @@
+// Package forwarded takes the address and scheme of the client that made a
+// request from the X-Forwarded-For and X-Forwarded-Proto headers set by a
+// reverse proxy in front of the registry's servers, rather than from the
+// connection, which comes from the proxy.
+//
+// The headers are believed only from proxies that are trusted, since any
+// other client could set them to anything.
+package forwarded
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	forHeader   = "X-Forwarded-For"
+	protoHeader = "X-Forwarded-Proto"
+)
+
+// Handler returns a handler that passes requests to the given handler,
+// replacing the RemoteAddr of those that come from one of the given
+// networks with the address of the client that the proxy forwarded them
+// for. The client's scheme can then be retrieved with Scheme.
+//
+// When several proxies forwarded a request, each appending to
+// X-Forwarded-For, the client is the last address in the header that isn't
+// itself trusted, since the addresses before that were set by the client.
+func Handler(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		peer := parseIP(req.RemoteAddr)
+		if peer == nil || !contains(trusted, peer) {
+			next.ServeHTTP(wr, req)
+			return
+		}
+
+		var hops []string
+		for _, header := range req.Header[forHeader] {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				// Whatever came before an address we can't parse is
+				// unreliable, so the last proxy we understood is as
+				// close to the client as we can get.
+				break
+			}
+			client = ip
+			if !contains(trusted, ip) {
+				break
+			}
+		}
+
+		// The request is copied so that the caller's is left as it was.
+		forwarded := *req
+		forwarded.RemoteAddr = client.String()
+		req = &forwarded
+		// The first proxy that the client connected to is the one whose
+		// scheme matters, and it sets the header before any others do.
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get(protoHeader), ",")[0]))
+		if proto == "http" || proto == "https" {
+			req = req.WithContext(context.WithValue(req.Context(), schemeKey{}, proto))
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+type schemeKey struct{}
+
+// Scheme returns the scheme, "http" or "https", by which the client made the
+// given request, as set by a trusted proxy, or otherwise by which it was
+// made to the server.
+func Scheme(req *http.Request) string {
+	if scheme, ok := req.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// parseIP returns the IP address in the given address, which may have a
+// port, or nil if it doesn't contain one.
+func parseIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is renamed aside once it grows beyond a
+// maximum size, keeping a limited number of the previous files. The current
+// file has the given path and the previous ones have ".1", ".2" and so on
+// appended to it, from newest to oldest.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the log file at the given path for appending,
+// creating it if necessary. If maxSize is zero then the file is never
+// rotated, but can still be rotated by truncating it in place. Otherwise
+// it is rotated before a write would take it beyond maxSize bytes, keeping
+// maxFiles previous files.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write appends the given bytes to the file, first rotating it if they
+// would take it beyond its maximum size. A single write is never split
+// between files, so that each log line is whole.
+func (r *RotatingFile) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		// A previous rotation failed to open the new file.
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// The log itself can't report this, so it goes to stderr.
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %s\n", r.path, err)
+			if r.f == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := r.f.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file aside, removing the oldest of the
+// previous files, and opens a new one in its place. If the files can't be
+// renamed then the current file is opened again, so that logging can
+// continue.
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	err := r.renameFiles()
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (r *RotatingFile) renameFiles() error {
+	if r.maxFiles == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	os.Remove(r.rotatedPath(r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(r.rotatedPath(i), r.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.rotatedPath(1))
+}
+
+func (r *RotatingFile) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
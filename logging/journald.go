@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/coreos/go-systemd/journal"
+)
+
+var journalPriorities = map[Level]journal.Priority{
+	Debug: journal.PriDebug,
+	Info:  journal.PriInfo,
+	Warn:  journal.PriWarning,
+	Error: journal.PriErr,
+}
+
+// journalReservedFields are the journal fields that have a meaning of their
+// own, which log line fields of the same name must not override.
+var journalReservedFields = map[string]bool{
+	"MESSAGE":           true,
+	"MESSAGE_ID":        true,
+	"PRIORITY":          true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"ERRNO":             true,
+	"SYSLOG_FACILITY":   true,
+	"SYSLOG_IDENTIFIER": true,
+	"SYSLOG_PID":        true,
+}
+
+// JournaldSink is a sink that sends the log to the local systemd journal,
+// with the priority of each line's level and with its fields as journal
+// fields, named in uppercase, so that "request_id=..." can be found with
+// "journalctl REQUEST_ID=...".
+type JournaldSink struct {
+	tag string
+}
+
+// NewJournaldSink returns a sink that sends the log to the systemd journal
+// with the given syslog identifier, or an error if the journal isn't
+// available.
+func NewJournaldSink(tag string) (*JournaldSink, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("the systemd journal is not available")
+	}
+	return &JournaldSink{tag: tag}, nil
+}
+
+func (s *JournaldSink) WriteLine(l Level, line string) error {
+	vars := map[string]string{
+		"SYSLOG_IDENTIFIER": s.tag,
+	}
+	for name, value := range Fields(line) {
+		name = strings.ToUpper(name)
+		if journalReservedFields[name] || strings.HasPrefix(name, "_") {
+			continue
+		}
+		vars[name] = value
+	}
+	return journal.Send(line, journalPriorities[l], vars)
+}
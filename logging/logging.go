@@ -0,0 +1,127 @@
+// Package logging writes the log lines of the registry's servers at one of
+// several levels, so that the less important ones can be left out of a busy
+// server's log, and can direct the log to a file that is rotated once it
+// grows too large.
+//
+// Log lines are written through the standard library's log package, so its
+// output and flags apply to them too, unless a Sink is set to send them to
+// syslog or the systemd journal instead. Each is prefixed by the name of its
+// level, as in "warning: ...".
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the importance of a log line.
+type Level int32
+
+// The levels, from least to most important.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+// levelPrefixes are the prefixes of the log lines at each level, which for
+// warnings is spelled out in full.
+var levelPrefixes = map[Level]string{
+	Debug: "debug: ",
+	Info:  "info: ",
+	Warn:  "warning: ",
+	Error: "error: ",
+}
+
+// String returns the name of the level, as given to ParseLevel.
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel returns the level with the given name, which is one of
+// "debug", "info", "warn" and "error", ignoring case. "warning" is accepted
+// too.
+func ParseLevel(s string) (Level, bool) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		return Warn, true
+	}
+	for l, name := range levelNames {
+		if name == s {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// minLevel is the least important level that is logged, which is Info
+// unless SetLevel is called.
+var minLevel = int32(Info)
+
+// SetLevel sets the least important level that is logged. Lines at less
+// important levels are discarded.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&minLevel, int32(l))
+}
+
+// Enabled returns true if lines at the given level are logged, so that
+// callers can avoid the work of preparing lines that would be discarded.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&minLevel)
+}
+
+// Logf logs a line at the given level, with its arguments handled in the
+// manner of fmt.Printf.
+func Logf(l Level, format string, args ...interface{}) {
+	output(l, format, args)
+}
+
+// Debugf logs a line at the debug level, for detail that is only needed
+// when investigating a problem.
+func Debugf(format string, args ...interface{}) {
+	output(Debug, format, args)
+}
+
+// Infof logs a line at the info level, for the normal operation of the
+// server.
+func Infof(format string, args ...interface{}) {
+	output(Info, format, args)
+}
+
+// Warnf logs a line at the warn level, for failures that the server
+// recovered from.
+func Warnf(format string, args ...interface{}) {
+	output(Warn, format, args)
+}
+
+// Errorf logs a line at the error level, for failures that an operator
+// should look into.
+func Errorf(format string, args ...interface{}) {
+	output(Error, format, args)
+}
+
+func output(l Level, format string, args []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	if s := currentSink(); s != nil {
+		writeSink(s, l, levelPrefixes[l]+fmt.Sprintf(format, args...))
+		return
+	}
+	// The call depth skips this function and the exported one that called
+	// it, so that the Lshortfile flag names the caller.
+	log.Output(3, levelPrefixes[l]+fmt.Sprintf(format, args...))
+}
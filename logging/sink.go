@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sink is a destination for the log other than the writer of the standard
+// library's log package, such as a syslog daemon, which is given the level
+// of each line so that it can record it in its own way.
+type Sink interface {
+	// WriteLine records a single log line at the given level. The line
+	// includes its level prefix but not a timestamp or a trailing newline.
+	WriteLine(l Level, line string) error
+}
+
+var sink struct {
+	sync.RWMutex
+	s Sink
+}
+
+// SetSink directs the log to the given sink. Lines that are written through
+// the standard library's log package rather than this one, such as by the
+// archive workers, are passed to the sink at the info level.
+func SetSink(s Sink) {
+	sink.Lock()
+	sink.s = s
+	sink.Unlock()
+
+	// The sink records its own timestamps.
+	log.SetFlags(0)
+	log.SetOutput(sinkWriter{s})
+}
+
+func currentSink() Sink {
+	sink.RLock()
+	defer sink.RUnlock()
+	return sink.s
+}
+
+func writeSink(s Sink, l Level, line string) {
+	if err := s.WriteLine(l, line); err != nil {
+		// The log itself can't report this, so it goes to stderr along
+		// with the line that was lost.
+		fmt.Fprintf(os.Stderr, "failed to write log: %s\n%s\n", err, line)
+	}
+}
+
+// sinkWriter is a writer that passes each line written to it to a sink.
+type sinkWriter struct {
+	s Sink
+}
+
+func (w sinkWriter) Write(buf []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n")) {
+		writeSink(w.s, Info, string(line))
+	}
+	return len(buf), nil
+}
+
+// Fields returns the fields of the given log line, which are the words of
+// the form key=value whose keys are lowercase identifiers, as in
+// "request_id=...".
+func Fields(line string) map[string]string {
+	ret := make(map[string]string)
+	for _, word := range strings.Fields(line) {
+		eq := strings.Index(word, "=")
+		if eq <= 0 || !validFieldName(word[:eq]) {
+			continue
+		}
+		ret[word[:eq]] = word[eq+1:]
+	}
+	return ret
+}
+
+func validFieldName(name string) bool {
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// ParseSyslogFacility returns the syslog facility with the given name, such
+// as "daemon" or "local0", ignoring case.
+func ParseSyslogFacility(s string) (syslog.Priority, bool) {
+	facility, ok := syslogFacilities[strings.ToLower(s)]
+	return facility, ok
+}
+
+// SyslogSink is a sink that sends the log to a syslog daemon, with the
+// severity of each line's level.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink returns a sink that sends the log to the syslog daemon at
+// the given address, using the given network as for net.Dial, with the
+// given facility and tag. If network and address are empty, it sends the
+// log to the local syslog daemon.
+//
+// If the daemon becomes unavailable then the sink connects to it again for
+// the next line.
+func NewSyslogSink(network, address string, facility syslog.Priority, tag string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, address, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+func (s *SyslogSink) WriteLine(l Level, line string) error {
+	switch l {
+	case Debug:
+		return s.w.Debug(line)
+	case Warn:
+		return s.w.Warning(line)
+	case Error:
+		return s.w.Err(line)
+	default:
+		return s.w.Info(line)
+	}
+}
@@ -0,0 +1,273 @@
+// Package login implements the server side of Terraform's login.v1 protocol,
+// which is the OAuth 2.0 authorization code grant with PKCE.
+//
+// Users authenticate with a username and password using HTTP basic
+// authentication, and the tokens issued at the end of the flow are appended
+// to a token file that the registry servers can then use to authenticate
+// subsequent requests.
+package login
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+const (
+	// ClientID is the OAuth client id that Terraform is told to use in the
+	// discovery document. It is the only client id the server accepts.
+	ClientID = "terraform-cli"
+
+	// AuthorizationPath and TokenPath are the paths of the authorization
+	// and token endpoints respectively.
+	AuthorizationPath = "/oauth/authorization"
+	TokenPath         = "/oauth/token"
+
+	codeLifetime = 5 * time.Minute
+)
+
+// Server is an OAuth 2.0 authorization server for Terraform CLI.
+type Server struct {
+	users     map[string]string
+	tokenFile string
+	ports     [2]int
+
+	mu    sync.Mutex
+	codes map[string]*authzCode
+}
+
+type authzCode struct {
+	username    string
+	redirectURI string
+	challenge   string
+	expires     time.Time
+}
+
+// NewServer creates a new server that authenticates the given users, whose
+// passwords are given as bcrypt hashes, and appends the tokens it issues to
+// the given token file. Terraform's redirect listener must use a port in
+// the given inclusive range.
+func NewServer(users map[string]string, tokenFile string, ports [2]int) *Server {
+	return &Server{
+		users:     users,
+		tokenFile: tokenFile,
+		ports:     ports,
+		codes:     make(map[string]*authzCode),
+	}
+}
+
+// DiscoveryDoc returns the value to use for "login.v1" in the service
+// discovery document, for a server whose endpoints are under the given base
+// path.
+func (s *Server) DiscoveryDoc(basePath string) map[string]interface{} {
+	return map[string]interface{}{
+		"client":      ClientID,
+		"grant_types": []string{"authz_code"},
+		"authz":       basePath + AuthorizationPath,
+		"token":       basePath + TokenPath,
+		"ports":       []int{s.ports[0], s.ports[1]},
+	}
+}
+
+// ServeAuthorization handles requests to the authorization endpoint, which
+// the user visits in their browser.
+func (s *Server) ServeAuthorization(wr http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != ClientID || !s.validRedirect(redirectURI) {
+		// We can't redirect back to the client if we don't trust the
+		// redirect URI, so we just report the error directly.
+		http.Error(wr, "Invalid client_id or redirect_uri.", 400)
+		return
+	}
+
+	ret := redirectURI.Query()
+	ret.Set("state", q.Get("state"))
+	redirect := func() {
+		redirectURI.RawQuery = ret.Encode()
+		http.Redirect(wr, req, redirectURI.String(), http.StatusFound)
+	}
+
+	switch {
+	case q.Get("response_type") != "code":
+		ret.Set("error", "unsupported_response_type")
+		redirect()
+		return
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		ret.Set("error", "invalid_request")
+		ret.Set("error_description", "PKCE with the S256 method is required")
+		redirect()
+		return
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok || !s.checkPassword(username, password) {
+		wr.Header().Set("WWW-Authenticate", `Basic realm="Terraform Registry", charset="UTF-8"`)
+		http.Error(wr, "Please log in to authorize Terraform to access this registry.", 401)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		logging.Errorf("failed to generate authorization code: %s", err)
+		wr.WriteHeader(500)
+		return
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for k, c := range s.codes {
+		if now.After(c.expires) {
+			delete(s.codes, k)
+		}
+	}
+	s.codes[code] = &authzCode{
+		username:    username,
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		expires:     now.Add(codeLifetime),
+	}
+	s.mu.Unlock()
+
+	ret.Set("code", code)
+	redirect()
+}
+
+// ServeToken handles requests to the token endpoint, which Terraform uses
+// to exchange an authorization code for a token.
+func (s *Server) ServeToken(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		wr.WriteHeader(405)
+		return
+	}
+
+	if req.PostFormValue("grant_type") != "authorization_code" {
+		writeTokenError(wr, "unsupported_grant_type")
+		return
+	}
+	if req.PostFormValue("client_id") != ClientID {
+		writeTokenError(wr, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	code := s.codes[req.PostFormValue("code")]
+	delete(s.codes, req.PostFormValue("code")) // codes may only be used once
+	s.mu.Unlock()
+
+	if code == nil || time.Now().After(code.expires) || code.redirectURI != req.PostFormValue("redirect_uri") {
+		writeTokenError(wr, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.challenge)) != 1 {
+		writeTokenError(wr, "invalid_grant")
+		return
+	}
+
+	token, err := s.issueToken(code.username)
+	if err != nil {
+		logging.Errorf("failed to issue token for %s: %s", code.username, err)
+		wr.WriteHeader(500)
+		return
+	}
+	logging.Infof("issued a new token for %s", code.username)
+
+	writeTokenJSON(wr, 200, map[string]string{
+		"access_token": token,
+		"token_type":   "bearer",
+	})
+}
+
+func (s *Server) checkPassword(username, password string) bool {
+	hash, ok := s.users[username]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// validRedirect returns true if the given URL is one that Terraform CLI
+// would use: a loopback address on one of our configured ports.
+func (s *Server) validRedirect(u *url.URL) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	return port >= s.ports[0] && port <= s.ports[1]
+}
+
+// issueToken generates a new token and appends it to the token file, with
+// a comment recording who it was issued to.
+func (s *Server) issueToken(username string) (string, error) {
+	token, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(s.tokenFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(f, "%s # issued to %s at %s\n", token, username, time.Now().UTC().Format(time.RFC3339))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func writeTokenError(wr http.ResponseWriter, code string) {
+	writeTokenJSON(wr, 400, map[string]string{
+		"error": code,
+	})
+}
+
+func writeTokenJSON(wr http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		wr.WriteHeader(500)
+		logging.Errorf("error in JSON encoding: %s", err)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("Cache-Control", "no-store")
+	wr.WriteHeader(status)
+	wr.Write(buf)
+}
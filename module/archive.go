@@ -0,0 +1,109 @@
+package module
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// ReadArchive reads the files from the given gzipped tar archive, in the
+// form expected by ImportVersion. Directory entries, and entries of types
+// other than files and symlinks, are ignored.
+//
+// It is an error for the archive to contain no files, or any entry whose
+// path is absolute or leads outside of the root of the module.
+func ReadArchive(r io.Reader) ([]ImportFile, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+
+	var files []ImportFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid file path %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, ImportFile{
+				Path:       name,
+				Executable: hdr.Mode&0111 != 0,
+				Contents:   contents,
+			})
+		case tar.TypeSymlink:
+			files = append(files, ImportFile{
+				Path:       name,
+				LinkTarget: hdr.Linkname,
+			})
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("archive contains no files")
+	}
+	return files, nil
+}
+
+// WriteArchive writes a gzipped tar archive of the given files to the given
+// writer, with their times all set to the given time. As with the archives
+// of versions, the entries have no owner and their permissions are decided
+// only by whether they are executable.
+func WriteArchive(files []ImportFile, t time.Time, w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	zw.Header = gzip.Header{
+		OS: 255, // unknown
+	}
+	tw := tar.NewWriter(zw)
+
+	err := writeArchiveFiles(tw, files, t)
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeArchiveFiles(tw *tar.Writer, files []ImportFile, t time.Time) error {
+	for _, f := range files {
+		if f.LinkTarget != "" {
+			hdr := tarHeader(f.Path, tar.TypeSymlink, 0777, 0, t)
+			hdr.Linkname = f.LinkTarget
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mode := int64(0644)
+		if f.Executable {
+			mode = 0755
+		}
+		if err := tw.WriteHeader(tarHeader(f.Path, tar.TypeReg, mode, int64(len(f.Contents)), t)); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
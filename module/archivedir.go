@@ -0,0 +1,186 @@
+package module
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// ArchiveDir is a Source that serves pre-built archives from a directory,
+// where each version is a gzipped tar archive named like "1.2.3.tgz".
+type ArchiveDir struct {
+	dir    string
+	scheme versionscheme.Scheme
+}
+
+var _ Source = (*ArchiveDir)(nil)
+
+// LoadArchiveDir creates a Source that serves the archives in the given
+// directory.
+func LoadArchiveDir(dir string) *ArchiveDir {
+	return &ArchiveDir{
+		dir: dir,
+	}
+}
+
+// WithVersionScheme returns a copy of the source whose file names are
+// interpreted as version numbers using the given scheme.
+func (d ArchiveDir) WithVersionScheme(scheme versionscheme.Scheme) *ArchiveDir {
+	d.scheme = scheme
+	return &d
+}
+
+// ListVersions implements Source. Files whose names are not a valid version
+// number followed by ".tgz" are ignored.
+func (d *ArchiveDir) ListVersions() ([]*version.Version, error) {
+	files, err := d.files()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*version.Version, 0, len(files))
+	for _, f := range files {
+		ret = append(ret, f.version)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		// j and i are inverted here because we want reverse order
+		return ret[j].LessThan(ret[i])
+	})
+	return ret, nil
+}
+
+// HasVersion implements Source.
+func (d *ArchiveDir) HasVersion(v *version.Version) (bool, error) {
+	filename, err := d.filename(v)
+	if err != nil {
+		return false, err
+	}
+	return filename != "", nil
+}
+
+// ContentId implements Source, returning the SHA-1 hash of the archive for
+// the given version.
+func (d *ArchiveDir) ContentId(v *version.Version) (string, error) {
+	f, err := d.open(v)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// OpenArchive implements Source, returning the archive file itself.
+func (d *ArchiveDir) OpenArchive(v *version.Version) (io.ReadCloser, error) {
+	return d.open(v)
+}
+
+// AddVersion adds an archive for the given version to the directory,
+// reading its contents from the given reader, which must give a gzipped tar
+// archive. The archive is named after the version in its canonical form, and
+// becomes visible only once it has been completely written.
+//
+// It is an error to add a version that already exists.
+func (d *ArchiveDir) AddVersion(v *version.Version, r io.Reader) error {
+	exists, err := d.HasVersion(v)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("version %s already exists", v)
+	}
+
+	tmp, err := ioutil.TempFile(d.dir, ".publish-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	// Unlike renaming, linking fails if the archive was created by someone
+	// else in the meantime.
+	err = os.Link(tmp.Name(), filepath.Join(d.dir, v.String()+".tgz"))
+	if os.IsExist(err) {
+		return fmt.Errorf("version %s already exists", v)
+	}
+	return err
+}
+
+func (d *ArchiveDir) open(v *version.Version) (*os.File, error) {
+	filename, err := d.filename(v)
+	if err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return nil, fmt.Errorf("no archive for version %s in %s", v, d.dir)
+	}
+	return os.Open(filename)
+}
+
+type archiveFile struct {
+	name    string
+	version *version.Version
+}
+
+// filename returns the path of the archive for the given version, or an
+// empty string if there is none. Different spellings of the same version,
+// such as "1.0.tgz" and "1.0.0.tgz", are not distinguished.
+func (d *ArchiveDir) filename(v *version.Version) (string, error) {
+	files, err := d.files()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if f.version.Equal(v) {
+			return filepath.Join(d.dir, f.name), nil
+		}
+	}
+	return "", nil
+}
+
+func (d *ArchiveDir) files() ([]archiveFile, error) {
+	infos, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []archiveFile
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, ".tgz") {
+			continue
+		}
+		v, err := d.scheme.ParseVersion(strings.TrimSuffix(name, ".tgz"))
+		if err != nil {
+			continue
+		}
+		ret = append(ret, archiveFile{
+			name:    name,
+			version: v,
+		})
+	}
+	return ret, nil
+}
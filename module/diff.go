@@ -0,0 +1,134 @@
+package module
+
+import (
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+)
+
+// Diff is a summary of the differences between two versions of a module.
+type Diff struct {
+	Files []FileChange
+
+	// Variables and Outputs summarize the changes to the input variables
+	// and output values declared in the root directory of the module.
+	Variables NameChanges
+	Outputs   NameChanges
+}
+
+// FileChange describes a change to a single file between two versions.
+type FileChange struct {
+	Path string
+
+	// Status is one of "added", "removed" or "modified".
+	Status string
+}
+
+// NameChanges records which of a set of names were added or removed
+// between two versions.
+type NameChanges struct {
+	Added   []string
+	Removed []string
+}
+
+// DiffVersions compares the trees of the two given versions.
+//
+// The variable and output summaries are based on a best-effort parse of the
+// .tf files in the root of each tree, so files that cannot be parsed may
+// cause some declarations to be missed.
+func (m Module) DiffVersions(from, to *version.Version) (*Diff, error) {
+	files, err := m.diffFiles(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Diff{
+		Files: files,
+	}
+
+	fromVars, fromOutputs, err := m.rootDeclarations(from)
+	if err != nil {
+		return nil, err
+	}
+	toVars, toOutputs, err := m.rootDeclarations(to)
+	if err != nil {
+		return nil, err
+	}
+	ret.Variables = compareNames(fromVars, toVars)
+	ret.Outputs = compareNames(fromOutputs, toOutputs)
+
+	return ret, nil
+}
+
+// rootDeclarations returns the names of the variables and outputs declared
+// in the .tf files at the root of the tree of the given version.
+func (m Module) rootDeclarations(v *version.Version) (variables, outputs map[string]struct{}, err error) {
+	variables = make(map[string]struct{})
+	outputs = make(map[string]struct{})
+
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       "variable",
+				LabelNames: []string{"name"},
+			},
+			{
+				Type:       "output",
+				LabelNames: []string{"name"},
+			},
+		},
+	}
+
+	parser := hclparse.NewParser()
+	err = m.walkVersion(v, func(entry treeEntry) error {
+		if entry.Dir {
+			return errSkipDir
+		}
+		if !strings.HasSuffix(entry.Path, ".tf") {
+			return nil
+		}
+
+		// We ignore any diagnostics here, since older Terraform syntax
+		// may not be fully understood but we can usually still find the
+		// block headers we're interested in.
+		f, _ := parser.ParseHCL(entry.Contents, entry.Path)
+		if f == nil {
+			return nil
+		}
+		content, _, _ := f.Body.PartialContent(schema)
+		for _, block := range content.Blocks {
+			switch block.Type {
+			case "variable":
+				variables[block.Labels[0]] = struct{}{}
+			case "output":
+				outputs[block.Labels[0]] = struct{}{}
+			}
+		}
+		return nil
+	})
+
+	return variables, outputs, err
+}
+
+func compareNames(from, to map[string]struct{}) NameChanges {
+	ret := NameChanges{
+		Added:   []string{},
+		Removed: []string{},
+	}
+	for name := range to {
+		if _, exists := from[name]; !exists {
+			ret.Added = append(ret.Added, name)
+		}
+	}
+	for name := range from {
+		if _, exists := to[name]; !exists {
+			ret.Removed = append(ret.Removed, name)
+		}
+	}
+	sort.Strings(ret.Added)
+	sort.Strings(ret.Removed)
+	return ret
+}
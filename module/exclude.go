@@ -0,0 +1,81 @@
+package module
+
+import (
+	"path"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// IgnoreFilename is the name of the file in the root of a module that lists
+// patterns of the paths to leave out of its archives, one per line. Blank
+// lines and lines beginning with "#" are ignored.
+const IgnoreFilename = ".registryignore"
+
+// WithExclude returns a copy of the module whose archives leave out the
+// files and directories matching any of the given patterns, in addition to
+// those matching the patterns in the ignore file of each version. See
+// ExcludePatternMatches for the syntax of the patterns.
+func (m Module) WithExclude(patterns []string) *Module {
+	m.exclude = patterns
+	return &m
+}
+
+// Exclude returns the patterns of the paths to leave out of the module's
+// archives, not including those from the ignore files of its versions.
+func (m Module) Exclude() []string {
+	return m.exclude
+}
+
+// versionExclude returns all of the patterns of the paths to leave out of
+// the archive of the given version.
+func (m Module) versionExclude(v *version.Version) ([]string, error) {
+	src, err := m.versionFile(v, IgnoreFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := append([]string(nil), m.exclude...)
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, line)
+	}
+	return ret, nil
+}
+
+// ExcludePatternMatches returns true if the given exclude pattern matches
+// the given slash-separated path, relative to the root of the module, of a
+// file or (if dir is true) a directory. It returns an error only if the
+// pattern is malformed.
+//
+// Patterns use the syntax of path.Match. A pattern ending in "/" matches
+// only directories. A pattern containing any other "/" is matched against
+// the whole path, ignoring any leading "/", while one without is matched
+// against the last element of the path, so that "*.tfstate" matches such
+// files in any directory.
+func ExcludePatternMatches(pattern, name string, dir bool) (bool, error) {
+	if strings.HasSuffix(pattern, "/") {
+		if !dir {
+			return false, nil
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		return path.Match(strings.TrimPrefix(pattern, "/"), name)
+	}
+	return path.Match(pattern, path.Base(name))
+}
+
+// excluded returns true if the given path matches any of the given
+// patterns. Malformed patterns match nothing.
+func excluded(patterns []string, name string, dir bool) bool {
+	for _, pattern := range patterns {
+		if match, _ := ExcludePatternMatches(pattern, name, dir); match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,711 @@
+//go:build gogit
+// +build gogit
+
+package module
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+	"golang.org/x/crypto/openpgp"
+	git "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// Module is a module whose versions are the version-shaped tags of a git
+// repository.
+//
+// This implementation, selected by the "gogit" build tag, uses go-git so
+// that the program can be built without cgo.
+type Module struct {
+	gitDir string
+	repo   *git.Repository
+
+	// mu serializes the use of repo, since go-git doesn't make its
+	// repositories safe to use from more than one goroutine at a time. It
+	// is shared by the copies of the module that the With methods return,
+	// and records whether repo has been closed.
+	mu *repoLock
+
+	// path is the directory within the repository that contains the
+	// module, or an empty string if it is the whole repository.
+	path string
+
+	// tagPattern is the pattern of the names of the tags that give the
+	// module's versions, or nil for tags named like "v1.2.3".
+	tagPattern *regexp.Regexp
+
+	// versionScheme decides which tag names are versions, and how they
+	// are ordered.
+	versionScheme versionscheme.Scheme
+
+	// trustedKeys are the keys that must have signed a tag for it to give
+	// a version, or nil if tags needn't be signed.
+	trustedKeys openpgp.EntityList
+
+	// exclude are patterns of the paths to leave out of archives, in
+	// addition to those in the ignore file of each version.
+	exclude []string
+
+	// submodules maps the paths of the submodules to include in archives
+	// to the git repositories that contain their commits.
+	submodules map[string]string
+
+	// lfsDir is the directory of the git-lfs objects that are archived in
+	// place of their pointer files, or an empty string to archive the
+	// pointer files as they are.
+	lfsDir string
+}
+
+// Backend names the git implementation that the module package was built
+// with, which is the pure-Go go-git library.
+const Backend = "go-git"
+
+// Load creates a new Module object that reads its data from the given
+// git repository directory.
+//
+// This function returns nil if the given directory cannot be opened as
+// a git repository for any reason.
+func Load(gitDir string) *Module {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil
+	}
+
+	return &Module{
+		gitDir: gitDir,
+		repo:   repo,
+		mu:     new(repoLock),
+	}
+}
+
+// Create opens the bare git repository at the given directory, first
+// initializing a new, empty bare repository there if none exists yet.
+func Create(gitDir string) (*Module, error) {
+	if mod := Load(gitDir); mod != nil {
+		return mod, nil
+	}
+
+	if err := os.MkdirAll(gitDir, 0755); err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainInit(gitDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Module{
+		gitDir: gitDir,
+		repo:   repo,
+		mu:     new(repoLock),
+	}, nil
+}
+
+// Close closes the module's git repository, once any use of it that is in
+// progress has finished. The module and its copies can't be used afterwards.
+func (m Module) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mu.closed {
+		return nil
+	}
+	m.mu.closed = true
+	if s, ok := m.repo.Storer.(io.Closer); ok {
+		return s.Close()
+	}
+	return nil
+}
+
+// GitDir returns the directory of the module's git repository.
+func (m Module) GitDir() string {
+	return m.gitDir
+}
+
+// tagNames returns the names of all of the tags in the repository, without
+// their "refs/tags/" prefix.
+func (m Module) tagNames() ([]string, error) {
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	it, err := m.repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var ret []string
+	err = it.ForEach(func(ref *plumbing.Reference) error {
+		ret = append(ret, ref.Name().Short())
+		return nil
+	})
+	return ret, err
+}
+
+// tagObject returns the raw contents of the annotated tag object that the
+// tag of the given name refers to, or nil if it is a lightweight tag.
+func (m Module) tagObject(name string) ([]byte, error) {
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	ref, err := m.repo.Reference(plumbing.NewTagReferenceName(name), true)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := m.repo.Storer.EncodedObject(plumbing.AnyObject, ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type() != plumbing.TagObject {
+		return nil, nil
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (m Module) GetVersionTreeId(v *version.Version) (string, error) {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return tree.Hash.String(), nil
+}
+
+// tagCommit returns the commit that the tag of the given name refers to.
+// The caller must hold m.mu.
+func (m Module) tagCommit(tag string) (*object.Commit, error) {
+	ref, err := m.repo.Reference(plumbing.NewTagReferenceName(tag), true)
+	if err != nil {
+		return nil, err
+	}
+	return peelCommit(m.repo, ref.Hash())
+}
+
+// peelCommit returns the commit that the object with the given hash refers
+// to, following any chain of annotated tags.
+func peelCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	obj, err := repo.Object(plumbing.AnyObject, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o, nil
+		case *object.Tag:
+			obj, err = o.Object()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%s does not refer to a commit", hash)
+		}
+	}
+}
+
+// versionTree returns the tree of the module's directory in the commit of
+// the given tag, which is the tag of the given version. The caller must hold
+// m.mu, locking it only once it has found the tag, since versionTag locks
+// m.mu itself.
+func (m Module) versionTree(v *version.Version, tag string) (*object.Tree, error) {
+	commit, err := m.tagCommit(tag)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil || m.path == "" {
+		return tree, err
+	}
+
+	subTree, err := tree.Tree(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("version %s has no directory %s", v, m.path)
+	}
+	return subTree, nil
+}
+
+// versionFile returns the contents of the file at the given path within the
+// tree of the given version, or nil if there is no such file.
+func (m Module) versionFile(v *version.Version, path string) ([]byte, error) {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := tree.FindEntry(path)
+	if err != nil || !entry.Mode.IsFile() {
+		return nil, nil
+	}
+	return readBlob(m.repo, entry.Hash)
+}
+
+// walkVersion calls the given function for each file and directory in the
+// tree of the given version, visiting each directory before its contents.
+//
+// The repository is unlocked while the function runs, so that a slow
+// reader of an archive doesn't hold up the other users of the repository.
+func (m Module) walkVersion(v *version.Version, fn func(treeEntry) error) error {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return err
+	}
+	return walkTree(m.repo, tree, "", m.submodules, func(entry treeEntry) error {
+		m.mu.Unlock()
+		err := fn(entry)
+		m.mu.Lock()
+		if err == nil && m.mu.closed {
+			err = ErrClosed
+		}
+		return err
+	})
+}
+
+// walkTree calls the given function for each file and directory in the given
+// tree, as described for walkVersion. The trees of the submodules whose paths
+// are keys of the given map are walked as if they were directories, with
+// their commits read from the repositories given by the corresponding
+// values, while other submodules are skipped.
+func walkTree(repo *git.Repository, tree *object.Tree, prefix string, submodules map[string]string, fn func(treeEntry) error) error {
+	for _, entry := range tree.Entries {
+		switch {
+		case entry.Mode == filemode.Dir:
+			path := prefix + entry.Name
+			err := fn(treeEntry{
+				Path: path,
+				Dir:  true,
+				Mode: modeDir,
+			})
+			if err == errSkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			subTree, err := repo.TreeObject(entry.Hash)
+			if err != nil {
+				return err
+			}
+			err = walkTree(repo, subTree, path+"/", submodules, fn)
+			if err != nil {
+				return err
+			}
+		case entry.Mode == filemode.Submodule:
+			path := prefix + entry.Name
+			gitDir, ok := submodules[path]
+			if !ok {
+				continue
+			}
+			subRepo, subTree, err := submoduleTree(gitDir, entry.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to read submodule %s from %s: %s", path, gitDir, err)
+			}
+
+			err = fn(treeEntry{
+				Path: path,
+				Dir:  true,
+				Mode: modeDir,
+			})
+			if err == errSkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = walkTree(subRepo, subTree, path+"/", submodules, fn)
+			if err != nil {
+				return err
+			}
+		case entry.Mode.IsFile():
+			contents, err := readBlob(repo, entry.Hash)
+			if err != nil {
+				return err
+			}
+
+			err = fn(treeEntry{
+				Path:     prefix + entry.Name,
+				Mode:     int64(entry.Mode),
+				Contents: contents,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// submoduleTree returns the tree of the commit with the given hash in the
+// repository in the given directory.
+func submoduleTree(gitDir string, hash plumbing.Hash) (*git.Repository, *object.Tree, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo, tree, nil
+}
+
+func readBlob(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// diffFiles returns the files that differ between the trees of the two
+// given versions.
+func (m Module) diffFiles(from, to *version.Version) ([]FileChange, error) {
+	fromTag, err := m.versionTag(from)
+	if err != nil {
+		return nil, err
+	}
+	toTag, err := m.versionTag(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	fromTree, err := m.versionTree(from, fromTag)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := m.versionTree(to, toTag)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]FileChange, 0, len(changes))
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+
+		switch action {
+		case merkletrie.Insert:
+			ret = append(ret, FileChange{Path: change.To.Name, Status: "added"})
+		case merkletrie.Delete:
+			ret = append(ret, FileChange{Path: change.From.Name, Status: "removed"})
+		default:
+			ret = append(ret, FileChange{Path: change.To.Name, Status: "modified"})
+		}
+	}
+
+	// libgit2 reports its deltas in path order, so we do the same.
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+
+	return ret, nil
+}
+
+// commitImport writes the given tree to the repository and then creates
+// a commit for it and an annotated tag for the given version.
+func (m Module) commitImport(root *importTree, v *version.Version, message string) error {
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	treeId, err := writeImportTree(m.repo.Storer, root)
+	if err != nil {
+		return err
+	}
+
+	sig := object.Signature{
+		Name:  importSignatureName,
+		Email: importSignatureEmail,
+		When:  time.Now(),
+	}
+
+	commit := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   message,
+		TreeHash:  treeId,
+	}
+	commitId, err := storeObject(m.repo.Storer, commit)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.repo.CreateTag(fmt.Sprintf("v%s", v), commitId, &git.CreateTagOptions{
+		Tagger:  &sig,
+		Message: message,
+	})
+	return err
+}
+
+// createVersionTag creates an annotated tag for the given version pointing
+// at the commit with the given id.
+func (m Module) createVersionTag(v *version.Version, commitId, message string) error {
+	hash := plumbing.NewHash(commitId)
+
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if _, err := m.repo.CommitObject(hash); err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return ErrCommitNotFound
+		}
+		return err
+	}
+
+	sig := object.Signature{
+		Name:  importSignatureName,
+		Email: importSignatureEmail,
+		When:  time.Now(),
+	}
+	_, err := m.repo.CreateTag(fmt.Sprintf("v%s", v), hash, &git.CreateTagOptions{
+		Tagger:  &sig,
+		Message: message,
+	})
+	return err
+}
+
+func writeImportTree(s storer.EncodedObjectStorer, t *importTree) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+
+	for name, f := range t.files {
+		contents := f.Contents
+		mode := filemode.Regular
+		switch {
+		case f.LinkTarget != "":
+			contents = []byte(f.LinkTarget)
+			mode = filemode.Symlink
+		case f.Executable:
+			mode = filemode.Executable
+		}
+
+		obj := s.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		_, err = w.Write(contents)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		blobId, err := s.SetEncodedObject(obj)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		tree.Entries = append(tree.Entries, object.TreeEntry{
+			Name: name,
+			Mode: mode,
+			Hash: blobId,
+		})
+	}
+
+	for name, sub := range t.dirs {
+		subId, err := writeImportTree(s, sub)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{
+			Name: name,
+			Mode: filemode.Dir,
+			Hash: subId,
+		})
+	}
+
+	// git requires tree entries to be sorted as if directory names had
+	// a trailing slash.
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return treeEntrySortKey(tree.Entries[i]) < treeEntrySortKey(tree.Entries[j])
+	})
+
+	return storeObject(s, tree)
+}
+
+func treeEntrySortKey(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
+// storeObject encodes the given object into the given storage and returns
+// its hash.
+func storeObject(s storer.EncodedObjectStorer, o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// FetchRemoteFiles clones the git repository at the given URL into a
+// temporary directory and returns the files from the tree of the given ref,
+// which may be any revision string understood by git, such as a tag name,
+// a branch name or a commit id. If ref is empty, the remote HEAD is used.
+//
+// The result is suitable to pass to ImportVersion. Submodules are ignored.
+// A non-nil tlsConfig is not supported by this implementation.
+func FetchRemoteFiles(url, ref string, tlsConfig *tls.Config) ([]ImportFile, error) {
+	if tlsConfig != nil {
+		return nil, errTLSConfigUnsupported
+	}
+
+	dir, err := ioutil.TempDir("", "terraform-simple-registry-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainClone(dir, true, &git.CloneOptions{
+		URL: url,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return nil, err
+	}
+	commit, err := peelCommit(repo, *hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []ImportFile
+	err = walkTree(repo, tree, "", nil, func(entry treeEntry) error {
+		if !entry.Dir {
+			files = append(files, importFileFromEntry(entry))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// errTLSConfigUnsupported is returned when a custom TLS configuration is
+// given for connecting to a remote repository, since this version of go-git
+// has no way to use one.
+var errTLSConfigUnsupported = errors.New("TLS settings for remote repositories are not supported when built with go-git")
+
+// fetchMirror fetches the tags of the repository at the given URL into the
+// module's repository, replacing any that have changed.
+//
+// Unlike the libgit2 implementation, tags that no longer exist in the
+// remote repository are not removed, since this version of go-git cannot
+// prune. A non-nil tlsConfig is not supported either.
+func (m Module) fetchMirror(url string, tlsConfig *tls.Config) error {
+	if tlsConfig != nil {
+		return errTLSConfigUnsupported
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	_, err := m.repo.Remote(mirrorRemoteName)
+	if err == git.ErrRemoteNotFound {
+		_, err = m.repo.CreateRemote(&gitconfig.RemoteConfig{
+			Name:  mirrorRemoteName,
+			URLs:  []string{url},
+			Fetch: []gitconfig.RefSpec{mirrorRefspec},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	err = m.repo.Fetch(&git.FetchOptions{
+		RemoteName: mirrorRemoteName,
+		Tags:       git.NoTags,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
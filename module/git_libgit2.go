@@ -0,0 +1,714 @@
+//go:build !gogit
+// +build !gogit
+
+package module
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+	"golang.org/x/crypto/openpgp"
+	git "gopkg.in/libgit2/git2go.v24"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// Module is a module whose versions are the version-shaped tags of a git
+// repository.
+//
+// By default the repository is accessed using libgit2. Building with the
+// "gogit" tag selects a pure-Go implementation instead.
+type Module struct {
+	gitDir string
+	repo   *git.Repository
+
+	// mu serializes the use of repo, since libgit2 doesn't allow a
+	// repository to be used from more than one thread at a time. It is
+	// shared by the copies of the module that the With methods return,
+	// and records whether repo has been closed.
+	mu *repoLock
+
+	// path is the directory within the repository that contains the
+	// module, or an empty string if it is the whole repository.
+	path string
+
+	// tagPattern is the pattern of the names of the tags that give the
+	// module's versions, or nil for tags named like "v1.2.3".
+	tagPattern *regexp.Regexp
+
+	// versionScheme decides which tag names are versions, and how they
+	// are ordered.
+	versionScheme versionscheme.Scheme
+
+	// trustedKeys are the keys that must have signed a tag for it to give
+	// a version, or nil if tags needn't be signed.
+	trustedKeys openpgp.EntityList
+
+	// exclude are patterns of the paths to leave out of archives, in
+	// addition to those in the ignore file of each version.
+	exclude []string
+
+	// submodules maps the paths of the submodules to include in archives
+	// to the git repositories that contain their commits.
+	submodules map[string]string
+
+	// lfsDir is the directory of the git-lfs objects that are archived in
+	// place of their pointer files, or an empty string to archive the
+	// pointer files as they are.
+	lfsDir string
+}
+
+// Backend names the git implementation that the module package was built
+// with, which is libgit2.
+const Backend = "libgit2"
+
+// Load creates a new Module object that reads its data from the given
+// git repository directory.
+//
+// This function returns nil if the given directory cannot be opened as
+// a git repository for any reason.
+func Load(gitDir string) *Module {
+	repo, err := git.OpenRepository(gitDir)
+	if err != nil {
+		return nil
+	}
+
+	return &Module{
+		gitDir: gitDir,
+		repo:   repo,
+		mu:     new(repoLock),
+	}
+}
+
+// Create opens the bare git repository at the given directory, first
+// initializing a new, empty bare repository there if none exists yet.
+func Create(gitDir string) (*Module, error) {
+	if mod := Load(gitDir); mod != nil {
+		return mod, nil
+	}
+
+	if err := os.MkdirAll(gitDir, 0755); err != nil {
+		return nil, err
+	}
+	repo, err := git.InitRepository(gitDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Module{
+		gitDir: gitDir,
+		repo:   repo,
+		mu:     new(repoLock),
+	}, nil
+}
+
+// Close closes the module's git repository, once any use of it that is in
+// progress has finished. The module and its copies can't be used afterwards.
+func (m Module) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mu.closed {
+		return nil
+	}
+	m.mu.closed = true
+	m.repo.Free()
+	return nil
+}
+
+// GitDir returns the directory of the module's git repository.
+func (m Module) GitDir() string {
+	return m.gitDir
+}
+
+// tagNames returns the names of all of the tags in the repository, without
+// their "refs/tags/" prefix.
+func (m Module) tagNames() ([]string, error) {
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	it, err := m.repo.NewReferenceNameIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for {
+		name, err := it.Next()
+
+		if err, ok := err.(*git.GitError); ok && err.Code == git.ErrIterOver {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(name, "refs/tags/") {
+			ret = append(ret, name[10:])
+		}
+	}
+
+	return ret, nil
+}
+
+// tagObject returns the raw contents of the annotated tag object that the
+// tag of the given name refers to, or nil if it is a lightweight tag.
+func (m Module) tagObject(name string) ([]byte, error) {
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	ref, err := m.repo.References.Lookup("refs/tags/" + name)
+	if err != nil {
+		return nil, err
+	}
+	odb, err := m.repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	_, typ, err := odb.ReadHeader(ref.Target())
+	if err != nil {
+		return nil, err
+	}
+	if typ != git.ObjectTag {
+		return nil, nil
+	}
+
+	obj, err := odb.Read(ref.Target())
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Free()
+	return append([]byte(nil), obj.Data()...), nil
+}
+
+func (m Module) GetVersionTreeId(v *version.Version) (string, error) {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return tree.Id().String(), nil
+}
+
+// tagCommit returns the commit that the tag of the given name refers to.
+// The caller must hold m.mu.
+func (m Module) tagCommit(tag string) (*git.Commit, error) {
+	ref, err := m.repo.References.Lookup("refs/tags/" + tag)
+	if err != nil {
+		return nil, err
+	}
+
+	commitObj, err := ref.Peel(git.ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	return commitObj.AsCommit()
+}
+
+// versionTree returns the tree of the module's directory in the commit of
+// the given tag, which is the tag of the given version. The caller must hold
+// m.mu, locking it only once it has found the tag, since versionTag locks
+// m.mu itself.
+func (m Module) versionTree(v *version.Version, tag string) (*git.Tree, error) {
+	commit, err := m.tagCommit(tag)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil || m.path == "" {
+		return tree, err
+	}
+
+	entry, err := tree.EntryByPath(m.path)
+	if err != nil || entry.Type != git.ObjectTree {
+		return nil, fmt.Errorf("version %s has no directory %s", v, m.path)
+	}
+	return m.repo.LookupTree(entry.Id)
+}
+
+// versionFile returns the contents of the file at the given path within the
+// tree of the given version, or nil if there is no such file.
+func (m Module) versionFile(v *version.Version, path string) ([]byte, error) {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := tree.EntryByPath(path)
+	if err != nil || entry.Type != git.ObjectBlob {
+		return nil, nil
+	}
+	blob, err := m.repo.LookupBlob(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+	return blob.Contents(), nil
+}
+
+// walkVersion calls the given function for each file and directory in the
+// tree of the given version, visiting each directory before its contents.
+//
+// The repository is unlocked while the function runs, so that a slow
+// reader of an archive doesn't hold up the other users of the repository.
+func (m Module) walkVersion(v *version.Version, fn func(treeEntry) error) error {
+	tag, err := m.versionTag(v)
+	if err != nil {
+		return err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	tree, err := m.versionTree(v, tag)
+	if err != nil {
+		return err
+	}
+	return walkTree(m.repo, tree, "", m.submodules, func(entry treeEntry) error {
+		m.mu.Unlock()
+		err := fn(entry)
+		m.mu.Lock()
+		if err == nil && m.mu.closed {
+			err = ErrClosed
+		}
+		return err
+	})
+}
+
+// walkTree calls the given function for each file and directory in the given
+// tree, as described for walkVersion. The trees of the submodules whose paths
+// are keys of the given map are walked as if they were directories, with
+// their commits read from the repositories given by the corresponding
+// values, while other submodules are skipped.
+func walkTree(repo *git.Repository, tree *git.Tree, prefix string, submodules map[string]string, fn func(treeEntry) error) error {
+	ct := tree.EntryCount()
+
+	for i := uint64(0); i < ct; i++ {
+		entry := tree.EntryByIndex(i)
+		switch entry.Type {
+		case git.ObjectTree:
+			path := prefix + entry.Name
+			err := fn(treeEntry{
+				Path: path,
+				Dir:  true,
+				Mode: modeDir,
+			})
+			if err == errSkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			subTree, err := repo.LookupTree(entry.Id)
+			if err != nil {
+				return err
+			}
+			err = walkTree(repo, subTree, path+"/", submodules, fn)
+			subTree.Free()
+			if err != nil {
+				return err
+			}
+		case git.ObjectCommit:
+			path := prefix + entry.Name
+			gitDir, ok := submodules[path]
+			if !ok {
+				continue
+			}
+			err := walkSubmodule(gitDir, entry.Id, path, submodules, fn)
+			if err != nil {
+				return err
+			}
+		case git.ObjectBlob:
+			blob, err := repo.LookupBlob(entry.Id)
+			if err != nil {
+				return err
+			}
+			contents := blob.Contents()
+			blob.Free()
+
+			err = fn(treeEntry{
+				Path:     prefix + entry.Name,
+				Mode:     int64(entry.Filemode),
+				Contents: contents,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// walkSubmodule walks the tree of the commit with the given id, read from
+// the repository in the given directory, as the directory at the given path
+// of the tree that walkTree is walking.
+//
+// The repository is opened again for every archive, so it is freed as soon
+// as the walk is done rather than being left for the garbage collector,
+// along with the objects read from it.
+func walkSubmodule(gitDir string, id *git.Oid, path string, submodules map[string]string, fn func(treeEntry) error) error {
+	repo, tree, err := submoduleTree(gitDir, id)
+	if err != nil {
+		return fmt.Errorf("failed to read submodule %s from %s: %s", path, gitDir, err)
+	}
+	defer repo.Free()
+	defer tree.Free()
+
+	err = fn(treeEntry{
+		Path: path,
+		Dir:  true,
+		Mode: modeDir,
+	})
+	if err == errSkipDir {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return walkTree(repo, tree, path+"/", submodules, fn)
+}
+
+// submoduleTree returns the tree of the commit with the given id in the
+// repository in the given directory. The caller must free both.
+func submoduleTree(gitDir string, id *git.Oid) (*git.Repository, *git.Tree, error) {
+	repo, err := git.OpenRepository(gitDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := repo.LookupCommit(id)
+	if err != nil {
+		repo.Free()
+		return nil, nil, err
+	}
+	tree, err := commit.Tree()
+	commit.Free()
+	if err != nil {
+		repo.Free()
+		return nil, nil, err
+	}
+	return repo, tree, nil
+}
+
+// diffFiles returns the files that differ between the trees of the two
+// given versions.
+func (m Module) diffFiles(from, to *version.Version) ([]FileChange, error) {
+	fromTag, err := m.versionTag(from)
+	if err != nil {
+		return nil, err
+	}
+	toTag, err := m.versionTag(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	fromTree, err := m.versionTree(from, fromTag)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := m.versionTree(to, toTag)
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := m.repo.DiffTreeToTree(fromTree, toTree, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]FileChange, 0, n)
+	for i := 0; i < n; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+
+		switch delta.Status {
+		case git.DeltaAdded:
+			ret = append(ret, FileChange{Path: delta.NewFile.Path, Status: "added"})
+		case git.DeltaDeleted:
+			ret = append(ret, FileChange{Path: delta.OldFile.Path, Status: "removed"})
+		default:
+			ret = append(ret, FileChange{Path: delta.NewFile.Path, Status: "modified"})
+		}
+	}
+
+	return ret, nil
+}
+
+// commitImport writes the given tree to the repository and then creates
+// a commit for it and an annotated tag for the given version.
+func (m Module) commitImport(root *importTree, v *version.Version, message string) error {
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	treeId, err := writeImportTree(m.repo, root)
+	if err != nil {
+		return err
+	}
+	tree, err := m.repo.LookupTree(treeId)
+	if err != nil {
+		return err
+	}
+
+	sig := &git.Signature{
+		Name:  importSignatureName,
+		Email: importSignatureEmail,
+		When:  time.Now(),
+	}
+
+	commitId, err := m.repo.CreateCommit("", sig, sig, message, tree)
+	if err != nil {
+		return err
+	}
+	commit, err := m.repo.LookupCommit(commitId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.repo.Tags.Create(fmt.Sprintf("v%s", v), commit, sig, message)
+	return err
+}
+
+// createVersionTag creates an annotated tag for the given version pointing
+// at the commit with the given id.
+func (m Module) createVersionTag(v *version.Version, commitId, message string) error {
+	oid, err := git.NewOid(commitId)
+	if err != nil {
+		return err
+	}
+
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	commit, err := m.repo.LookupCommit(oid)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return ErrCommitNotFound
+		}
+		return err
+	}
+
+	sig := &git.Signature{
+		Name:  importSignatureName,
+		Email: importSignatureEmail,
+		When:  time.Now(),
+	}
+	_, err = m.repo.Tags.Create(fmt.Sprintf("v%s", v), commit, sig, message)
+	return err
+}
+
+func writeImportTree(repo *git.Repository, t *importTree) (*git.Oid, error) {
+	tb, err := repo.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	defer tb.Free()
+
+	names := make([]string, 0, len(t.files))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := t.files[name]
+
+		contents := f.Contents
+		mode := git.FilemodeBlob
+		switch {
+		case f.LinkTarget != "":
+			contents = []byte(f.LinkTarget)
+			mode = git.FilemodeLink
+		case f.Executable:
+			mode = git.FilemodeBlobExecutable
+		}
+
+		blobId, err := repo.CreateBlobFromBuffer(contents)
+		if err != nil {
+			return nil, err
+		}
+		if err := tb.Insert(name, blobId, mode); err != nil {
+			return nil, err
+		}
+	}
+
+	names = names[:0]
+	for name := range t.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		subId, err := writeImportTree(repo, t.dirs[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := tb.Insert(name, subId, git.FilemodeTree); err != nil {
+			return nil, err
+		}
+	}
+
+	return tb.Write()
+}
+
+// FetchRemoteFiles clones the git repository at the given URL into a
+// temporary directory and returns the files from the tree of the given ref,
+// which may be any revision string understood by git, such as a tag name,
+// a branch name or a commit id. If ref is empty, the remote HEAD is used.
+//
+// The result is suitable to pass to ImportVersion. Submodules are ignored.
+// If tlsConfig is not nil then its root certificates are trusted, in
+// addition to those of the system, when cloning over HTTPS.
+func FetchRemoteFiles(url, ref string, tlsConfig *tls.Config) ([]ImportFile, error) {
+	dir, err := ioutil.TempDir("", "terraform-simple-registry-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.Clone(url, dir, &git.CloneOptions{
+		Bare: true,
+		FetchOptions: &git.FetchOptions{
+			RemoteCallbacks: remoteCallbacks(tlsConfig),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	obj, err := repo.RevparseSingle(ref)
+	if err != nil {
+		return nil, err
+	}
+	commitObj, err := obj.Peel(git.ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := commitObj.AsCommit()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []ImportFile
+	err = walkTree(repo, tree, "", nil, func(entry treeEntry) error {
+		if !entry.Dir {
+			files = append(files, importFileFromEntry(entry))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// fetchMirror fetches the tags of the repository at the given URL into the
+// module's repository, replacing any that have changed and removing any
+// that no longer exist there.
+//
+// SSH URLs are authenticated using the SSH agent, if any.
+func (m Module) fetchMirror(url string, tlsConfig *tls.Config) error {
+	if err := m.mu.lock(); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	remote, err := m.repo.Remotes.Lookup(mirrorRemoteName)
+	if err != nil {
+		remote, err = m.repo.Remotes.CreateWithFetchspec(mirrorRemoteName, url, mirrorRefspec)
+		if err != nil {
+			return err
+		}
+	}
+	defer remote.Free()
+
+	return remote.Fetch(nil, &git.FetchOptions{
+		Prune:           git.FetchPruneOn,
+		RemoteCallbacks: remoteCallbacks(tlsConfig),
+	}, "")
+}
+
+// remoteCallbacks returns the callbacks for connecting to a remote
+// repository, which authenticate SSH connections using the SSH agent.
+//
+// libgit2 verifies HTTPS certificates only against the system's roots, so
+// if tlsConfig has its own then a certificate that libgit2 rejects is
+// checked against them instead. libgit2 cannot present client certificates,
+// so those are ignored.
+func remoteCallbacks(tlsConfig *tls.Config) git.RemoteCallbacks {
+	ret := git.RemoteCallbacks{
+		CredentialsCallback: func(url, username string, allowed git.CredType) (git.ErrorCode, *git.Cred) {
+			if allowed&git.CredTypeSshKey == 0 {
+				return git.ErrPassthrough, nil
+			}
+			ret, cred := git.NewCredSshKeyFromAgent(username)
+			return git.ErrorCode(ret), &cred
+		},
+	}
+	if tlsConfig != nil && tlsConfig.RootCAs != nil {
+		roots := tlsConfig.RootCAs
+		ret.CertificateCheckCallback = func(cert *git.Certificate, valid bool, hostname string) git.ErrorCode {
+			if valid {
+				return git.ErrOk
+			}
+			if cert.Kind != git.CertificateX509 || cert.X509 == nil {
+				return git.ErrCertificate
+			}
+			_, err := cert.X509.Verify(x509.VerifyOptions{
+				DNSName: hostname,
+				Roots:   roots,
+			})
+			if err != nil {
+				return git.ErrCertificate
+			}
+			return git.ErrOk
+		}
+	}
+	return ret
+}
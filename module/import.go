@@ -0,0 +1,132 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// The identity recorded as the author, committer and tagger of imported
+// versions.
+const (
+	importSignatureName  = "terraform-simple-registry"
+	importSignatureEmail = "terraform-simple-registry@localhost"
+)
+
+// ImportFile is a single file to be included in a version created by
+// ImportVersion.
+type ImportFile struct {
+	// Path is the slash-separated path of the file relative to the root
+	// of the module.
+	Path string
+
+	// Executable is true if the file should be marked as executable.
+	Executable bool
+
+	// LinkTarget, if non-empty, causes the file to be created as a symbolic
+	// link to the given target, in which case Contents is ignored.
+	LinkTarget string
+
+	Contents []byte
+}
+
+// ImportVersion creates a new commit containing exactly the given files
+// and then creates an annotated tag for the given version pointing at it.
+//
+// The given message is used both as the commit message and as the tag
+// message, and so is a good place to record the provenance of the files.
+//
+// It is an error to import a version that already exists.
+func (m Module) ImportVersion(v *version.Version, files []ImportFile, message string) error {
+	exists, err := m.HasVersion(v)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("version %s already exists", v)
+	}
+
+	root := &importTree{}
+	for _, f := range files {
+		if err := root.add(strings.Split(path.Clean(f.Path), "/"), f); err != nil {
+			return err
+		}
+	}
+
+	return m.commitImport(root, v, message)
+}
+
+// TagVersion creates an annotated tag for the given version pointing at the
+// commit with the given id, which must be a full hexadecimal commit id of a
+// commit already in the repository. The given message is used as the tag
+// message.
+//
+// It is an error to tag a version that already exists.
+func (m Module) TagVersion(v *version.Version, commitId, message string) error {
+	exists, err := m.HasVersion(v)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("version %s already exists", v)
+	}
+	if !ValidCommitId(commitId) {
+		return fmt.Errorf("invalid commit id %q", commitId)
+	}
+
+	return m.createVersionTag(v, strings.ToLower(commitId), message)
+}
+
+// ErrCommitNotFound is returned by TagVersion if the repository has no
+// commit with the given id.
+var ErrCommitNotFound = errors.New("no such commit")
+
+// ValidCommitId returns true if the given string is a full hexadecimal
+// commit id, as TagVersion requires.
+func ValidCommitId(s string) bool {
+	return commitIdRegexp.MatchString(s)
+}
+
+var commitIdRegexp = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// importTree is a temporary in-memory representation of a directory
+// being assembled by ImportVersion.
+type importTree struct {
+	files map[string]ImportFile
+	dirs  map[string]*importTree
+}
+
+func (t *importTree) add(parts []string, f ImportFile) error {
+	name := parts[0]
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file path %q", f.Path)
+	}
+
+	if len(parts) == 1 {
+		if t.files == nil {
+			t.files = make(map[string]ImportFile)
+		}
+		if _, exists := t.dirs[name]; exists {
+			return fmt.Errorf("%q is both a file and a directory", f.Path)
+		}
+		t.files[name] = f
+		return nil
+	}
+
+	if _, exists := t.files[name]; exists {
+		return fmt.Errorf("%q is both a file and a directory", f.Path)
+	}
+	if t.dirs == nil {
+		t.dirs = make(map[string]*importTree)
+	}
+	sub := t.dirs[name]
+	if sub == nil {
+		sub = &importTree{}
+		t.dirs[name] = sub
+	}
+	return sub.add(parts[1:], f)
+}
@@ -0,0 +1,107 @@
+package module
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lfsPointerPrefix begins every git-lfs pointer file, which git-lfs commits
+// in place of the contents of a file that it manages.
+const lfsPointerPrefix = "version https://git-lfs.github.com/spec/v1\n"
+
+// lfsPointerMaxSize is the size of the largest pointer file that git-lfs
+// will create, so that larger files needn't be parsed.
+const lfsPointerMaxSize = 1024
+
+// lfsPointer is the content of a git-lfs pointer file.
+type lfsPointer struct {
+	// OID is the SHA-256 hash of the object, in lowercase hex.
+	OID  string
+	Size int64
+}
+
+// WithLFSDir returns a copy of the module whose archives contain the
+// objects that git-lfs pointer files refer to, instead of the pointers,
+// reading them from the given directory. The directory has the same layout
+// as the "lfs" directory of a git repository, with each object at a path
+// like "objects/ab/cd/abcd...". If dir is empty, pointer files are archived
+// as they are.
+func (m Module) WithLFSDir(dir string) *Module {
+	m.lfsDir = dir
+	return &m
+}
+
+// LFSDir returns the directory from which the module's git-lfs objects are
+// read, or an empty string if pointer files are archived as they are.
+func (m Module) LFSDir() string {
+	return m.lfsDir
+}
+
+// parseLFSPointer returns the pointer that the given file contents
+// represent, or nil if they aren't a git-lfs pointer file.
+func parseLFSPointer(contents []byte) *lfsPointer {
+	if len(contents) > lfsPointerMaxSize || !bytes.HasPrefix(contents, []byte(lfsPointerPrefix)) {
+		return nil
+	}
+
+	var ret lfsPointer
+	for _, line := range strings.Split(string(contents[len(lfsPointerPrefix):]), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "oid":
+			ret.OID = strings.TrimPrefix(parts[1], "sha256:")
+		case "size":
+			ret.Size, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	}
+	if _, err := hex.DecodeString(ret.OID); err != nil || len(ret.OID) != sha256.Size*2 || ret.Size < 0 {
+		return nil
+	}
+	return &ret
+}
+
+// writeLFSObject writes the given header followed by the object that the
+// given pointer refers to. The header's size must be that of the object.
+//
+// It is an error for the object to be missing or to differ from the
+// pointer, since an archive must not contain a pointer file in place of a
+// file that the module needs.
+func (m Module) writeLFSObject(tw *tar.Writer, hdr *tar.Header, ptr *lfsPointer) error {
+	filename := filepath.Join(m.lfsDir, "objects", ptr.OID[0:2], ptr.OID[2:4], ptr.OID)
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read git-lfs object for %s: %s", hdr.Name, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != ptr.Size {
+		return fmt.Errorf("git-lfs object %s for %s has size %d, not %d", ptr.OID, hdr.Name, info.Size(), ptr.Size)
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hash), f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != ptr.OID {
+		return fmt.Errorf("git-lfs object %s for %s is corrupt", ptr.OID, hdr.Name)
+	}
+	return nil
+}
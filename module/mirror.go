@@ -0,0 +1,57 @@
+package module
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// mirrorRemoteName is the name of the remote in a mirror repository
+	// that refers to the repository being mirrored.
+	mirrorRemoteName = "origin"
+
+	// mirrorRefspec fetches only the tags, since the other refs don't
+	// affect which versions are available.
+	mirrorRefspec = "+refs/tags/*:refs/tags/*"
+)
+
+// Mirror updates the bare git repository at the given directory to match
+// the tags of the remote repository at the given URL, and then returns it.
+//
+// If there is no repository at the directory yet then the remote repository
+// is first cloned into a temporary directory beside it, and then renamed
+// into place, so that an interrupted clone is never mistaken for a complete
+// mirror.
+//
+// If tlsConfig is not nil then its root certificates are trusted, in
+// addition to those of the system, when fetching over HTTPS.
+func Mirror(url, gitDir string, tlsConfig *tls.Config) (*Module, error) {
+	if mod := Load(gitDir); mod != nil {
+		return mod, mod.fetchMirror(url, tlsConfig)
+	}
+
+	parent := filepath.Dir(gitDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir(parent, "."+filepath.Base(gitDir)+"-")
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := Create(tmpDir)
+	if err == nil {
+		err = tmp.fetchMirror(url, tlsConfig)
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpDir, gitDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+
+	return Create(gitDir)
+}
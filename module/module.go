@@ -2,34 +2,139 @@ package module
 
 import (
 	"archive/tar"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	version "github.com/hashicorp/go-version"
-	git "gopkg.in/libgit2/git2go.v24"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// The git file modes that are significant when producing archives. These are
+// the same in all of the git implementations we support.
+const (
+	modeDir        = 0040000
+	modeExecutable = 0100755
+	modeSymlink    = 0120000
 )
 
-type Module struct {
-	repo *git.Repository
+// treeEntry describes a file or directory found while walking the tree of
+// a version. Contents is nil for directories.
+type treeEntry struct {
+	Path     string
+	Dir      bool
+	Mode     int64
+	Contents []byte
 }
 
-// Load creates a new Module object that reads its data from the given
-// git repository directory.
-//
-// This function returns nil if the given directory cannot be opened as
-// a git repository for any reason.
-func Load(gitDir string) *Module {
-	repo, err := git.OpenRepository(gitDir)
-	if err != nil {
-		return nil
-	}
+// errSkipDir may be returned by a walk function for a directory entry to
+// cause the directory's contents to be skipped.
+var errSkipDir = filepath.SkipDir
 
-	return &Module{
-		repo: repo,
+// ErrClosed is returned when a module is used after its repository has been
+// closed by Close.
+var ErrClosed = errors.New("module repository is closed")
+
+// repoLock is held while a module's git repository is in use, and records
+// whether the repository has been closed.
+type repoLock struct {
+	sync.Mutex
+	closed bool
+}
+
+// lock locks the repository, unless it has been closed, in which case it
+// returns ErrClosed without locking it.
+func (l *repoLock) lock() error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return ErrClosed
 	}
+	return nil
+}
+
+// InPath returns a copy of the module that contains only the files within
+// the given directory of the repository, given as a slash-separated path
+// relative to its root, so that one repository can contain many modules.
+// An empty path selects the whole repository.
+func (m Module) InPath(path string) *Module {
+	m.path = strings.Trim(path, "/")
+	return &m
+}
+
+// Path returns the directory within the repository that contains the
+// module, or an empty string if it is the whole repository.
+func (m Module) Path() string {
+	return m.path
+}
+
+// WithTagPattern returns a copy of the module whose versions are given by
+// the tags whose names match the given pattern, which must have exactly one
+// capture group that matches the version number. If the pattern is nil, the
+// versions are given by tags named like "v1.2.3".
+func (m Module) WithTagPattern(pattern *regexp.Regexp) *Module {
+	m.tagPattern = pattern
+	return &m
+}
+
+// TagPattern returns the pattern of the names of the tags that give the
+// module's versions, or nil if they are named like "v1.2.3".
+func (m Module) TagPattern() *regexp.Regexp {
+	return m.tagPattern
+}
+
+// WithVersionScheme returns a copy of the module whose tag names are
+// interpreted as version numbers using the given scheme.
+func (m Module) WithVersionScheme(scheme versionscheme.Scheme) *Module {
+	m.versionScheme = scheme
+	return &m
+}
+
+// VersionScheme returns the scheme by which the module's tag names are
+// interpreted as version numbers.
+func (m Module) VersionScheme() versionscheme.Scheme {
+	return m.versionScheme
+}
+
+// WithTrustedKeys returns a copy of the module whose versions are given only
+// by annotated tags with a PGP signature made by one of the given keys, as
+// created by "git tag -s". If keys is nil, tags needn't be signed.
+func (m Module) WithTrustedKeys(keys openpgp.EntityList) *Module {
+	m.trustedKeys = keys
+	return &m
+}
+
+// TrustedKeys returns the keys that must have signed the module's tags, or
+// nil if they needn't be signed.
+func (m Module) TrustedKeys() openpgp.EntityList {
+	return m.trustedKeys
+}
+
+// WithSubmodules returns a copy of the module whose archives include the
+// contents of the submodules at the paths that are keys of the given map,
+// relative to the root of the module, reading their commits from the git
+// repositories in the directories given by the corresponding values. Other
+// submodules are left out of archives.
+func (m Module) WithSubmodules(submodules map[string]string) *Module {
+	m.submodules = submodules
+	return &m
+}
+
+// Submodules returns the paths of the submodules included in the module's
+// archives and the directories of their repositories.
+func (m Module) Submodules() map[string]string {
+	return m.submodules
 }
 
 // AllVersions returns all of the available versions for the receiving module,
@@ -38,30 +143,18 @@ func Load(gitDir string) *Module {
 // The result may be an empty (or nil) slice if the underlying repository
 // has no version-shaped tags.
 func (m Module) AllVersions() ([]*version.Version, error) {
-	it, err := m.repo.NewReferenceNameIterator()
+	names, err := m.tagNames()
 	if err != nil {
 		return nil, err
 	}
 
 	var ret []*version.Version
-	for {
-		name, err := it.Next()
-
-		if err, ok := err.(*git.GitError); ok && err.Code == git.ErrIterOver {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		if strings.HasPrefix(name, "refs/tags/v") {
-			versionStr := name[11:]
-			v, err := version.NewVersion(versionStr)
-			if err != nil {
-				continue
-			}
-			ret = append(ret, v)
+	for _, name := range names {
+		v := m.tagVersion(name)
+		if v == nil || !m.tagTrusted(name) {
+			continue
 		}
+		ret = append(ret, v)
 	}
 
 	sort.Slice(ret, func(i, j int) bool {
@@ -90,128 +183,264 @@ func (m Module) LatestVersion() (*version.Version, error) {
 // HasVersion returns true if the receiving module has a tag for the given
 // version number.
 func (m Module) HasVersion(v *version.Version) (bool, error) {
-	it, err := m.repo.NewReferenceNameIterator()
+	names, err := m.tagNames()
 	if err != nil {
 		return false, err
 	}
 
-	for {
-		name, err := it.Next()
+	for _, name := range names {
+		gotV := m.tagVersion(name)
+		if gotV != nil && gotV.Equal(v) && m.tagTrusted(name) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
 
-		if err, ok := err.(*git.GitError); ok && err.Code == git.ErrIterOver {
-			break
+// tagVersion returns the version represented by the given tag name, or nil
+// if the tag is not version-shaped.
+func (m Module) tagVersion(name string) *version.Version {
+	var raw string
+	if m.tagPattern != nil {
+		match := m.tagPattern.FindStringSubmatch(name)
+		if len(match) != 2 {
+			return nil
 		}
-		if err != nil {
-			return false, err
+		raw = match[1]
+	} else {
+		if !strings.HasPrefix(name, "v") {
+			return nil
 		}
+		raw = name[1:]
+	}
+	v, err := m.versionScheme.ParseVersion(raw)
+	if err != nil {
+		return nil
+	}
+	return v
+}
 
-		if strings.HasPrefix(name, "refs/tags/v") {
-			versionStr := name[11:]
-			gotV, err := version.NewVersion(versionStr)
-			if err != nil {
+// TagProblem describes a tag that looks like it was meant to give a version
+// of a module, but doesn't.
+type TagProblem struct {
+	Tag     string
+	Problem string
+}
+
+// TagProblems returns the problems with the module's tags that mean they
+// give no version, or not the one that was probably intended. Tags that
+// aren't version-shaped at all aren't problems, since repositories often
+// have other tags too.
+func (m Module) TagProblems() ([]TagProblem, error) {
+	names, err := m.tagNames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var ret []TagProblem
+	seen := make(map[string]string)
+	for _, name := range names {
+		var raw string
+		if m.tagPattern != nil {
+			match := m.tagPattern.FindStringSubmatch(name)
+			if len(match) != 2 {
 				continue
 			}
-
-			if gotV.Equal(v) {
-				return true, nil
+			raw = match[1]
+		} else {
+			if !strings.HasPrefix(name, "v") || len(name) < 2 || name[1] < '0' || name[1] > '9' {
+				continue
 			}
+			raw = name[1:]
 		}
-	}
 
-	return false, nil
+		v, err := m.versionScheme.ParseVersion(raw)
+		switch {
+		case err != nil:
+			ret = append(ret, TagProblem{
+				Tag:     name,
+				Problem: fmt.Sprintf("not a valid version number: %s", err),
+			})
+		case !m.tagTrusted(name):
+			ret = append(ret, TagProblem{
+				Tag:     name,
+				Problem: "not signed by any of the trusted keys",
+			})
+		case seen[v.String()] != "":
+			ret = append(ret, TagProblem{
+				Tag:     name,
+				Problem: fmt.Sprintf("gives the same version, %s, as tag %s", v, seen[v.String()]),
+			})
+		default:
+			seen[v.String()] = name
+		}
+	}
+	return ret, nil
 }
 
-func (m Module) GetVersionTreeId(v *version.Version) (string, error) {
-	commit, err := m.getVersionCommit(v)
+// CheckBackend checks that the git implementation can create a repository
+// in a temporary directory and then open it and list its tags, which fails
+// if, for example, libgit2 is not the version it was built against.
+func CheckBackend() error {
+	dir, err := ioutil.TempDir("", "terraform-registry-check-")
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Create(dir); err != nil {
+		return fmt.Errorf("failed to create a git repository: %s", err)
+	}
+	mod := Load(dir)
+	if mod == nil {
+		return fmt.Errorf("failed to open a newly-created git repository")
+	}
+	if _, err := mod.tagNames(); err != nil {
+		return fmt.Errorf("failed to list tags: %s", err)
+	}
+	return nil
+}
+
+// tagSignatureHeader begins the signature that "git tag -s" appends to the
+// message of an annotated tag, which covers everything in the tag object
+// before it.
+const tagSignatureHeader = "-----BEGIN PGP SIGNATURE-----"
+
+// tagTrusted returns true if the tag of the given name may give a version
+// of the module: either the module has no trusted keys, or the tag is
+// signed by one of them. Any problem reading the tag makes it untrusted.
+func (m Module) tagTrusted(name string) bool {
+	if m.trustedKeys == nil {
+		return true
 	}
 
-	return commit.TreeId().String(), nil
+	raw, err := m.tagObject(name)
+	if err != nil || raw == nil {
+		return false
+	}
+	i := bytes.LastIndex(raw, []byte(tagSignatureHeader))
+	if i < 0 {
+		return false
+	}
+	signed, sig := raw[:i], raw[i:]
+	_, err = openpgp.CheckArmoredDetachedSignature(m.trustedKeys, bytes.NewReader(signed), bytes.NewReader(sig))
+	return err == nil
 }
 
-func (m Module) getVersionCommit(v *version.Version) (*git.Commit, error) {
-	refName := fmt.Sprintf("refs/tags/v%s", v)
-	ref, err := m.repo.References.Lookup(refName)
+// versionTag returns the name of the tag for the given version.
+func (m Module) versionTag(v *version.Version) (string, error) {
+	names, err := m.tagNames()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	commitObj, err := ref.Peel(git.ObjectCommit)
-	if err != nil {
-		return nil, err
+	for _, name := range names {
+		gotV := m.tagVersion(name)
+		if gotV != nil && gotV.Equal(v) && m.tagTrusted(name) {
+			return name, nil
+		}
 	}
-	return commitObj.AsCommit()
+
+	return "", fmt.Errorf("no tag for version %s", v)
 }
 
 // WriteVersionTar recursively writes the contents of the git tree associated
 // with the given version to the given writer. If no such version exists,
 // or if there are any other problems when reading the tree, the resulting
 // tar archive may be incomplete.
+//
+// The archive is reproducible, depending only on the tree: its entries are
+// in the order of the git tree, which is sorted by name, and each is in PAX
+// format with its times all set to archiveTime, no owner, and permissions
+// decided only by whether git records the file as executable. Symlinks are
+// written as symlink entries rather than as files, and if the module has an
+// LFS directory, git-lfs pointer files are replaced by the objects they
+// refer to.
+//
+// The archive leaves out the ignore file and the files and directories that
+// match the module's exclude patterns or those in the ignore file.
 func (m Module) WriteVersionTar(v *version.Version, w io.Writer) error {
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
-	commit, err := m.getVersionCommit(v)
+	exclude, err := m.versionExclude(v)
 	if err != nil {
 		return err
 	}
 
-	committer := commit.Committer()
-	commitTime := committer.When
-	rootTree, err := commit.Tree()
-	if err != nil {
-		return err
-	}
-
-	return m.writeGitTreeTar(rootTree, "", commitTime, tw)
-}
-
-func (m Module) writeGitTreeTar(tree *git.Tree, prefix string, modTime time.Time, tw *tar.Writer) error {
-	ct := tree.EntryCount()
-
-	for i := uint64(0); i < ct; i++ {
-		entry := tree.EntryByIndex(i)
-		switch entry.Type {
-		case git.ObjectTree:
-			newPrefix := prefix + entry.Name + "/"
-			tw.WriteHeader(&tar.Header{
-				Name:       newPrefix,
-				Mode:       0755,
-				Typeflag:   tar.TypeDir,
-				ChangeTime: modTime,
-				AccessTime: modTime,
-				ModTime:    modTime,
-			})
-			newTree, err := m.repo.LookupTree(entry.Id)
-			if err != nil {
-				continue
-			}
-			err = m.writeGitTreeTar(newTree, newPrefix, modTime, tw)
-			if err != nil {
-				return err
-			}
-		case git.ObjectBlob:
-			blob, err := m.repo.LookupBlob(entry.Id)
-			if err != nil {
-				return err
+	return m.walkVersion(v, func(entry treeEntry) error {
+		if entry.Path == IgnoreFilename || excluded(exclude, entry.Path, entry.Dir) {
+			if entry.Dir {
+				return errSkipDir
 			}
+			return nil
+		}
+		if entry.Dir {
+			return tw.WriteHeader(tarHeader(entry.Path+"/", tar.TypeDir, 0755, 0, archiveTime))
+		}
 
-			tw.WriteHeader(&tar.Header{
-				Name:       prefix + entry.Name,
-				Mode:       int64(entry.Filemode),
-				Typeflag:   tar.TypeReg,
-				Size:       blob.Size(),
-				ChangeTime: modTime,
-				AccessTime: modTime,
-				ModTime:    modTime,
-			})
-			_, err = tw.Write(blob.Contents())
-			if err != nil {
-				return err
+		if entry.Mode == modeSymlink {
+			// The blob of a symlink is the path it refers to.
+			hdr := tarHeader(entry.Path, tar.TypeSymlink, 0777, 0, archiveTime)
+			hdr.Linkname = string(entry.Contents)
+			return tw.WriteHeader(hdr)
+		}
+
+		mode := int64(0644)
+		if entry.Mode == modeExecutable {
+			mode = 0755
+		}
+		if m.lfsDir != "" {
+			if ptr := parseLFSPointer(entry.Contents); ptr != nil {
+				return m.writeLFSObject(tw, tarHeader(entry.Path, tar.TypeReg, mode, ptr.Size, archiveTime), ptr)
 			}
 		}
+		err := tw.WriteHeader(tarHeader(entry.Path, tar.TypeReg, mode, int64(len(entry.Contents)), archiveTime))
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(entry.Contents)
+		return err
+	})
+}
+
+// archiveTime is the time of every entry in the archives written by
+// WriteVersionTar. It is fixed, rather than being the time of the tagged
+// commit, so that versions with the same tree have the same archive, as
+// required for the tree id to serve as the content id of the version.
+var archiveTime = time.Unix(0, 0)
+
+// tarHeader returns the header for an entry of an archive written by
+// WriteVersionTar.
+func tarHeader(name string, typeflag byte, mode, size int64, t time.Time) *tar.Header {
+	t = t.UTC()
+	return &tar.Header{
+		Format:     tar.FormatPAX,
+		Name:       name,
+		Typeflag:   typeflag,
+		Mode:       mode,
+		Size:       size,
+		Uid:        0,
+		Gid:        0,
+		ModTime:    t,
+		AccessTime: t,
+		ChangeTime: t,
 	}
+}
 
-	return nil
+// importFileFromEntry converts a file entry from a tree walk into the form
+// expected by ImportVersion.
+func importFileFromEntry(entry treeEntry) ImportFile {
+	f := ImportFile{
+		Path:       entry.Path,
+		Executable: entry.Mode == modeExecutable,
+	}
+	if entry.Mode == modeSymlink {
+		f.LinkTarget = string(entry.Contents)
+	} else {
+		f.Contents = entry.Contents
+	}
+	return f
 }
@@ -0,0 +1,43 @@
+package module
+
+import (
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// SelectVersion returns the newest of the given versions that is allowed
+// by the given constraints, or nil if none are, using the same rules as
+// Terraform's module installer.
+//
+// Pre-release versions are selected only if a constraint requests that
+// exact version, since Terraform never chooses a pre-release otherwise.
+func SelectVersion(versions []*version.Version, constraints version.Constraints) *version.Version {
+	var ret *version.Version
+	for _, v := range versions {
+		if !constraints.Check(v) {
+			continue
+		}
+		if v.Prerelease() != "" && !exactlyRequested(v, constraints) {
+			continue
+		}
+		if ret == nil || v.GreaterThan(ret) {
+			ret = v
+		}
+	}
+	return ret
+}
+
+func exactlyRequested(v *version.Version, constraints version.Constraints) bool {
+	for _, c := range constraints {
+		s := strings.TrimSpace(c.String())
+		if strings.HasPrefix(s, "=") {
+			s = strings.TrimSpace(s[1:])
+		}
+		exact, err := version.NewVersion(s)
+		if err == nil && exact.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,463 @@
+package module
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// S3Options describes where an S3Archives source finds its archives and how
+// it authenticates.
+type S3Options struct {
+	Bucket string
+
+	// Prefix is the key prefix of the archives, which are named like
+	// PREFIX/1.2.3.tgz. It may be empty if the archives are at the root of
+	// the bucket.
+	Prefix string
+
+	Region string
+
+	// Endpoint is the base URL of an S3-compatible service, or empty to use
+	// Amazon S3 itself. Requests to a custom endpoint use path-style URLs,
+	// since most S3-compatible services don't support virtual hosting.
+	Endpoint string
+
+	// If AccessKeyID is empty then credentials are taken from the standard
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// environment variables, and if those aren't set either then requests
+	// are not signed at all, which works only for public buckets.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// RedirectExpiry is how long the URLs returned by ArchiveURL remain
+	// valid. If zero, ArchiveURL returns no URL and archives are instead
+	// streamed through the server by OpenArchive.
+	RedirectExpiry time.Duration
+
+	// Client is the HTTP client used to make requests to S3, or nil to use
+	// http.DefaultClient.
+	Client *http.Client
+
+	// VersionScheme decides which archive names are version numbers, and
+	// how they are ordered.
+	VersionScheme versionscheme.Scheme
+}
+
+// S3Archives is a Source that serves pre-built archives from an Amazon S3
+// bucket, or from a bucket in a service compatible with S3, where each
+// version is a gzipped tar archive with a key named like "PREFIX/1.2.3.tgz".
+type S3Archives struct {
+	opts   S3Options
+	base   *url.URL
+	client *http.Client
+}
+
+var _ Source = (*S3Archives)(nil)
+var _ ArchiveLocator = (*S3Archives)(nil)
+
+// LoadS3Archives creates a Source that serves the archives described by the
+// given options.
+func LoadS3Archives(opts S3Options) (*S3Archives, error) {
+	if opts.AccessKeyID == "" {
+		opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		opts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+
+	var base *url.URL
+	var err error
+	if opts.Endpoint != "" {
+		base, err = url.Parse(strings.TrimSuffix(opts.Endpoint, "/") + "/" + opts.Bucket)
+	} else {
+		base, err = url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com", opts.Bucket, opts.Region))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", err)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3Archives{
+		opts:   opts,
+		base:   base,
+		client: client,
+	}, nil
+}
+
+// ListVersions implements Source. Objects whose names are not a valid
+// version number followed by ".tgz" are ignored.
+func (s *S3Archives) ListVersions() ([]*version.Version, error) {
+	objects, err := s.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*version.Version, 0, len(objects))
+	for _, obj := range objects {
+		ret = append(ret, obj.version)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		// j and i are inverted here because we want reverse order
+		return ret[j].LessThan(ret[i])
+	})
+	return ret, nil
+}
+
+// HasVersion implements Source.
+func (s *S3Archives) HasVersion(v *version.Version) (bool, error) {
+	obj, err := s.object(v)
+	if err != nil {
+		return false, err
+	}
+	return obj != nil, nil
+}
+
+// ContentId implements Source, returning the SHA-1 hash of the key and
+// ETag of the archive for the given version. S3 changes the ETag whenever
+// an object is replaced, but it isn't itself the right shape for an id.
+func (s *S3Archives) ContentId(v *version.Version) (string, error) {
+	obj, err := s.object(v)
+	if err != nil {
+		return "", err
+	}
+	if obj == nil {
+		return "", fmt.Errorf("no archive for version %s in %s", v, s)
+	}
+
+	h := sha1.New()
+	io.WriteString(h, obj.key+"\x00"+obj.etag)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// OpenArchive implements Source, returning the body of the archive object.
+func (s *S3Archives) OpenArchive(v *version.Version) (io.ReadCloser, error) {
+	obj, err := s.object(v)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("no archive for version %s in %s", v, s)
+	}
+
+	resp, err := s.do("GET", obj.key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ArchiveURL implements ArchiveLocator, returning a pre-signed URL for the
+// archive object if RedirectExpiry was set.
+func (s *S3Archives) ArchiveURL(v *version.Version) (string, error) {
+	if s.opts.RedirectExpiry == 0 {
+		return "", nil
+	}
+
+	obj, err := s.object(v)
+	if err != nil {
+		return "", err
+	}
+	if obj == nil {
+		return "", fmt.Errorf("no archive for version %s in %s", v, s)
+	}
+
+	u := s.objectURL(obj.key, nil)
+	if s.opts.AccessKeyID == "" {
+		return u.String(), nil
+	}
+	return s.presign(u, time.Now(), s.opts.RedirectExpiry), nil
+}
+
+// String returns an "s3://" URL for the location of the archives, for use
+// in messages.
+func (s *S3Archives) String() string {
+	return "s3://" + s.opts.Bucket + "/" + s.opts.Prefix
+}
+
+type s3Object struct {
+	key     string
+	etag    string
+	version *version.Version
+}
+
+// object returns the archive object for the given version, or nil if there
+// is none. Different spellings of the same version, such as "1.0.tgz" and
+// "1.0.0.tgz", are not distinguished.
+func (s *S3Archives) object(v *version.Version) (*s3Object, error) {
+	objects, err := s.objects()
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		if objects[i].version.Equal(v) {
+			return &objects[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// objects lists the archive objects directly under the prefix, following
+// continuation tokens until the listing is complete.
+func (s *S3Archives) objects() ([]s3Object, error) {
+	prefix := ""
+	if s.opts.Prefix != "" {
+		prefix = s.opts.Prefix + "/"
+	}
+
+	var ret []s3Object
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				ETag string `xml:"ETag"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing of %s: %s", s, err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if !strings.HasSuffix(name, ".tgz") {
+				continue
+			}
+			v, err := s.opts.VersionScheme.ParseVersion(strings.TrimSuffix(name, ".tgz"))
+			if err != nil {
+				continue
+			}
+			ret = append(ret, s3Object{
+				key:     obj.Key,
+				etag:    obj.ETag,
+				version: v,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return ret, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do makes a signed request for the given object key, or for the bucket
+// itself if the key is empty, returning an error for any response other
+// than 200 OK.
+func (s *S3Archives) do(method, key string, query url.Values) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.AccessKeyID != "" {
+		s.sign(req, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("S3 request for %s failed: %s (%s)", u.Path, s3Err.Message, s3Err.Code)
+		}
+		return nil, fmt.Errorf("S3 request for %s failed: %s", u.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *S3Archives) objectURL(key string, query url.Values) *url.URL {
+	u := *s.base
+	u.Path = strings.TrimSuffix(s.base.Path, "/") + "/" + key
+	u.RawPath = strings.TrimSuffix(s.base.EscapedPath(), "/") + "/" + s3EscapePath(key)
+	u.RawQuery = s3EscapeQuery(query)
+	return &u
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the given
+// request, which must have no body.
+func (s *S3Archives) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := hex.EncodeToString(sha256Sum(""))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headerNames := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+		headerNames = append(headerNames, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	scope, signature := s.signature(now, strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// presign returns the given URL with query string authentication that
+// allows a GET request for it until the given expiry time has passed.
+func (s *S3Archives) presign(u *url.URL, now time.Time, expiry time.Duration) string {
+	now = now.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.opts.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if s.opts.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	rawQuery := s3EscapeQuery(query)
+
+	_, signature := s.signature(now, strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		rawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n"))
+
+	ret := *u
+	ret.RawQuery = rawQuery + "&X-Amz-Signature=" + signature
+	return ret.String()
+}
+
+func (s *S3Archives) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.opts.Region + "/s3/aws4_request"
+}
+
+// signature returns the credential scope and the signature of the given
+// canonical request.
+func (s *S3Archives) signature(now time.Time, canonicalRequest string) (string, string) {
+	scope := s.scope(now)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(sha256Sum(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func sha256Sum(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the given string as required for the canonical request
+// of an AWS signature, which is stricter than url.QueryEscape.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3EscapeQuery encodes the given query in the canonical form, sorted by
+// key, so that it can be used both in the request and when signing it.
+func s3EscapeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,117 @@
+package module
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// Source is a source of the versions of a single module and their contents.
+//
+// Module, which reads the tags of a git repository, is the main
+// implementation, but other implementations can be used to serve modules
+// from elsewhere.
+type Source interface {
+	// ListVersions returns all of the available versions, in reverse order
+	// such that the latest version is at index 0.
+	ListVersions() ([]*version.Version, error)
+
+	// HasVersion returns true if the given version is available.
+	HasVersion(v *version.Version) (bool, error)
+
+	// ContentId returns an identifier for the content of the given version,
+	// which must change whenever the content does. It is used in download
+	// URLs and as a cache key, and so must consist of exactly 40 lowercase
+	// hexadecimal digits, as with a SHA-1 hash.
+	ContentId(v *version.Version) (string, error)
+
+	// OpenArchive returns a reader for a gzipped tar archive of the content
+	// of the given version. The caller must close the reader.
+	OpenArchive(v *version.Version) (io.ReadCloser, error)
+}
+
+// Differ is implemented by sources that can compare two versions.
+type Differ interface {
+	DiffVersions(from, to *version.Version) (*Diff, error)
+}
+
+// ArchiveLocator is implemented by sources whose archives can be downloaded
+// directly by clients, rather than through the registry.
+type ArchiveLocator interface {
+	// ArchiveURL returns an absolute URL from which the archive for the
+	// given version can be downloaded, or an empty string if the archive
+	// must be served by the registry after all.
+	ArchiveURL(v *version.Version) (string, error)
+}
+
+var _ Source = (*Module)(nil)
+var _ Differ = (*Module)(nil)
+
+// ListVersions implements Source. It is the same as AllVersions.
+func (m Module) ListVersions() ([]*version.Version, error) {
+	return m.AllVersions()
+}
+
+// ContentId implements Source, returning the id of the git tree of the
+// given version, or if the module has exclude patterns, submodules or an
+// LFS directory, a hash of that id and those settings.
+func (m Module) ContentId(v *version.Version) (string, error) {
+	treeId, err := m.GetVersionTreeId(v)
+	if err != nil || (len(m.exclude) == 0 && len(m.submodules) == 0 && m.lfsDir == "") {
+		return treeId, err
+	}
+
+	// The same tree gives a different archive for each list of patterns,
+	// each set of included submodules and depending on whether git-lfs
+	// objects are included. The tree records the commit of each submodule
+	// and the hash of each git-lfs object, so their contents needn't be
+	// considered.
+	paths := make([]string, 0, len(m.submodules))
+	for path := range m.submodules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	key := treeId + "\x00" + strings.Join(m.exclude, "\x00") + "\x01" + strings.Join(paths, "\x00")
+	if m.lfsDir != "" {
+		key += "\x01lfs"
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// OpenArchive implements Source. The archive is produced by WriteVersionTar
+// as it is read.
+func (m Module) OpenArchive(v *version.Version) (io.ReadCloser, error) {
+	// Checking that the version exists first allows us to return the most
+	// likely error immediately, rather than on the first read.
+	if _, err := m.GetVersionTreeId(v); err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.WriteVersionArchive(v, w))
+	}()
+	return r, nil
+}
+
+// WriteVersionArchive writes a gzipped tar archive of the contents of the
+// given version to the given writer, using WriteVersionTar. Like the tar
+// archive, the result is reproducible: the gzip header records no name and
+// a zero modification time, as with "gzip -n".
+func (m Module) WriteVersionArchive(v *version.Version, w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	zw.Header = gzip.Header{
+		OS: 255, // unknown
+	}
+	err := m.WriteVersionTar(v, zw)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package modulesv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/auth"
+	"github.com/apparentlymart/terraform-simple-registry/buildinfo"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/pathvars"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// NewAdminHandler returns the handler for the administrative API, which
+// is served only on the listeners in the "admin" block. The status of the
+// given archiver is included in the status response if it is an ArchiveCache,
+// and the server is ready only once at least one of the listeners in the
+// given group is listening for registry requests.
+//
+// If modulesFile isn't nil, the module blocks in it can be changed through
+// the API too. If the configuration sets pprof, the runtime's profiling data
+// is served under "/debug/pprof/". If the configuration sets tokens, all
+// requests other than the health checks require one of them.
+func NewAdminHandler(modules *ModuleSet, archiver Archiver, cfg *config.Admin, listeners *config.ListenerGroup, modulesFile *ModulesFile) http.Handler {
+	ret := mux.NewRouter()
+
+	ret.HandleFunc("/healthz", serveHealthz)
+	ret.HandleFunc("/readyz", readyzHandler(modules, cfg, listeners))
+
+	// Health checks are made by load balancers and orchestrators that
+	// don't have tokens, so only the rest of the API is authenticated.
+	api := mux.NewRouter()
+	ret.NotFoundHandler = api
+	if cfg != nil && (len(cfg.Tokens) != 0 || cfg.TokenFile != "") {
+		authed := auth.Wrap(auth.NewTokens(cfg.Tokens, cfg.TokenFile))
+		ret.NotFoundHandler = authed(api.ServeHTTP)
+	}
+
+	api.HandleFunc("/status", func(wr http.ResponseWriter, req *http.Request) {
+		ret := &apiStatus{
+			Modules:         modules.Count(),
+			OrphanedModules: []apiOrphanedModule{},
+			DeletedModules:  modules.Deletions(),
+			PinnedModules:   modules.Pins(),
+			Errors:          apierror.Counts(),
+			OpenRepos:       repos.Len(),
+		}
+		if cache, ok := archiver.(ArchiveCache); ok {
+			status := cache.CacheStatus()
+			ret.ArchiveCache = &status
+		}
+		for _, o := range modules.Orphans() {
+			ret.OrphanedModules = append(ret.OrphanedModules, apiOrphanedModule{
+				Namespace: o.Module.Namespace,
+				Name:      o.Module.Name,
+				Provider:  o.Module.Provider,
+				RemovedAt: o.RemovedAt.UTC().Format(time.RFC3339),
+				ExpiresAt: o.ExpiresAt.UTC().Format(time.RFC3339),
+			})
+		}
+		sort.Slice(ret.OrphanedModules, func(i, j int) bool {
+			return ret.OrphanedModules[i].ExpiresAt < ret.OrphanedModules[j].ExpiresAt
+		})
+		sort.Slice(ret.DeletedModules, func(i, j int) bool {
+			return ret.DeletedModules[i].Time.Before(ret.DeletedModules[j].Time)
+		})
+		sort.Slice(ret.PinnedModules, func(i, j int) bool {
+			return ret.PinnedModules[i].ExpiresAt.Before(*ret.PinnedModules[j].ExpiresAt)
+		})
+
+		writeAdminJSON(wr, 200, ret)
+	})
+
+	if cfg != nil && cfg.Pprof {
+		// Index serves the named profiles, such as "heap", as well as
+		// the index itself.
+		api.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		api.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		api.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		api.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		api.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+
+	api.HandleFunc("/version", func(wr http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(wr, 200, buildinfo.Get())
+	})
+
+	api.HandleFunc("/audit", func(wr http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(wr, 200, &apiAuditResponse{
+			Entries: modules.AuditTrail(),
+		})
+	})
+
+	api.HandleFunc("/modules/{namespace}/{name}/{provider}", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		_, entry, ok := decodeAuditRequest(wr, req)
+		if !ok {
+			return
+		}
+		result, err := modules.Delete(vars["namespace"], vars["name"], vars["provider"], entry)
+		writeAuditResult(wr, req, result, err)
+	})).Methods("DELETE")
+
+	api.HandleFunc("/modules/{namespace}/{name}/{provider}/restore", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		_, entry, ok := decodeAuditRequest(wr, req)
+		if !ok {
+			return
+		}
+		result, err := modules.Restore(vars["namespace"], vars["name"], vars["provider"], entry)
+		writeAuditResult(wr, req, result, err)
+	})).Methods("POST")
+
+	api.HandleFunc("/modules/{namespace}/{name}/{provider}/pin", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		body, entry, ok := decodeAuditRequest(wr, req)
+		if !ok {
+			return
+		}
+
+		v, err := version.NewVersion(body.Version)
+		if err != nil || !pathvars.ValidVersion(body.Version) {
+			writeAdminJSON(wr, 400, &apiError{Error: "a valid \"version\" is required"})
+			return
+		}
+		duration, err := time.ParseDuration(body.Duration)
+		if err != nil || duration <= 0 {
+			writeAdminJSON(wr, 400, &apiError{Error: "a positive \"duration\" is required, such as \"24h\""})
+			return
+		}
+
+		cfg := modules.Get(vars["namespace"], vars["name"], vars["provider"])
+		if cfg == nil {
+			writeAuditResult(wr, req, nil, ErrModuleNotFound)
+			return
+		}
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			writeAdminError(wr, req, apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange))
+			return
+		}
+		defer release()
+		exists, err := src.HasVersion(v)
+		if err != nil {
+			writeAdminError(wr, req, apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange))
+			return
+		}
+		if !exists {
+			writeAdminJSON(wr, 400, &apiError{Error: fmt.Sprintf("module has no version %s", v)})
+			return
+		}
+
+		result, err := modules.Pin(vars["namespace"], vars["name"], vars["provider"], v, time.Now().Add(duration), entry)
+		writeAuditResult(wr, req, result, err)
+	})).Methods("PUT")
+
+	api.HandleFunc("/modules/{namespace}/{name}/{provider}/pin", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		_, entry, ok := decodeAuditRequest(wr, req)
+		if !ok {
+			return
+		}
+		result, err := modules.Unpin(vars["namespace"], vars["name"], vars["provider"], entry)
+		writeAuditResult(wr, req, result, err)
+	})).Methods("DELETE")
+
+	if modulesFile != nil {
+		registerModulesFileRoutes(api, modules, modulesFile)
+	}
+
+	return ret
+}
+
+// decodeAuditRequest reads the optional JSON body of a request that makes
+// an audited change, responding with 400 Bad Request if it is invalid.
+// The returned entry is populated from the body and the request.
+func decodeAuditRequest(wr http.ResponseWriter, req *http.Request) (*apiAuditRequest, AuditEntry, bool) {
+	var body apiAuditRequest
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&body)
+		if err != nil && err != io.EOF {
+			writeAdminJSON(wr, 400, &apiError{Error: fmt.Sprintf("invalid request body: %s", err)})
+			return nil, AuditEntry{}, false
+		}
+	}
+
+	return &body, AuditEntry{
+		Actor:      body.Actor,
+		Reason:     body.Reason,
+		RemoteAddr: req.RemoteAddr,
+	}, true
+}
+
+func writeAuditResult(wr http.ResponseWriter, req *http.Request, entry *AuditEntry, err error) {
+	switch err {
+	case nil:
+		logging.Infof("admin: %s of %s/%s/%s by %q from %s: %s request_id=%s", entry.Action, entry.Namespace, entry.Name, entry.Provider, entry.Actor, entry.RemoteAddr, entry.Reason, requestid.Get(req))
+		writeAdminJSON(wr, 200, entry)
+	case ErrModuleNotFound:
+		writeAdminJSON(wr, 404, &apiError{Error: err.Error()})
+	case ErrAlreadyDeleted, ErrNotDeleted, ErrNotPinned:
+		writeAdminJSON(wr, 409, &apiError{Error: err.Error()})
+	default:
+		writeAdminError(wr, req, apierror.Internal(err, "failed to record audit entry"))
+	}
+}
+
+// writeAdminError reports the given error as apierror.Write does, but
+// describes it in the admin API's own format.
+func writeAdminError(wr http.ResponseWriter, req *http.Request, err error) {
+	e := apierror.Report(req, err)
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Kind.Status())
+	}
+	writeAdminJSON(wr, e.Kind.Status(), &apiError{Error: msg})
+}
+
+func writeAdminJSON(wr http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		wr.WriteHeader(500)
+		logging.Errorf("error in JSON encoding: %s", err)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	wr.Write(buf)
+}
+
+type apiStatus struct {
+	Modules         int                 `json:"modules"`
+	OrphanedModules []apiOrphanedModule `json:"orphaned_modules"`
+	DeletedModules  []*AuditEntry       `json:"deleted_modules"`
+	PinnedModules   []*AuditEntry       `json:"pinned_modules"`
+	ArchiveCache    *ArchiveCacheStatus `json:"archive_cache,omitempty"`
+
+	// Errors is the number of error responses of each kind since the
+	// server started.
+	Errors map[string]int `json:"errors"`
+
+	// OpenRepos is the number of git repositories currently held open
+	// between requests.
+	OpenRepos int `json:"open_repositories"`
+}
+
+type apiOrphanedModule struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	RemovedAt string `json:"removed_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type apiAuditRequest struct {
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+
+	// Version and Duration are used only when pinning.
+	Version  string `json:"version"`
+	Duration string `json:"duration"`
+}
+
+type apiAuditResponse struct {
+	Entries []*AuditEntry `json:"entries"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,277 @@
+package modulesv1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// NewCachingArchiver returns an Archiver that keeps the archives produced
+// by the given archiver in the given directory, named by their content ids,
+// so that repeated downloads of the same content are served from disk.
+//
+// Once the total size of the cached archives exceeds maxSize bytes, the
+// least recently used archives are removed. Any archives already in the
+// directory are adopted into the cache, using their modification times to
+// decide which were used most recently.
+//
+// The SHA-256 checksum of each archive is recorded beside it, in a file with
+// the additional suffix ".sha256", so that VerifyArchives can detect archives
+// that have since been corrupted.
+func NewCachingArchiver(next Archiver, dir string, maxSize int64) (Archiver, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cachingArchiver{
+		next:    next,
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, ".tgz") {
+			continue
+		}
+		contentId := strings.TrimSuffix(name, ".tgz")
+		// An archive with no checksum file, perhaps because it was cached
+		// by an older version of this program, is checked for validity when
+		// it is first verified and its checksum is then recorded.
+		checksum, _ := ioutil.ReadFile(filepath.Join(dir, name+checksumSuffix))
+		c.entries[contentId] = &cacheEntry{
+			size:     info.Size(),
+			lastUse:  info.ModTime(),
+			checksum: strings.TrimSpace(string(checksum)),
+		}
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+type cachingArchiver struct {
+	next    Archiver
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+
+	// lastVerified is when VerifyArchives last finished, and corrupt is the
+	// number of corrupt archives that it has found since startup.
+	lastVerified time.Time
+	corrupt      int
+}
+
+type cacheEntry struct {
+	size    int64
+	lastUse time.Time
+
+	// checksum is the hex-encoded SHA-256 checksum of the archive, or an
+	// empty string if it isn't known.
+	checksum string
+}
+
+// checksumSuffix is appended to the name of a cached archive to give the
+// name of the file containing its checksum.
+const checksumSuffix = ".sha256"
+
+func (c *cachingArchiver) WriteArchive(src module.Source, v *version.Version, contentId string, w io.Writer) error {
+	f, err := c.openArchive(src, v, contentId)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (c *cachingArchiver) openArchive(src module.Source, v *version.Version, contentId string) (*archiveFile, error) {
+	filename := filepath.Join(c.dir, contentId+".tgz")
+
+	f, checksum, err := c.open(contentId, filename)
+	if err != nil {
+		// Not cached, or the cached file has gone away, so we'll need to
+		// generate it.
+		f, checksum, err = c.fill(src, v, contentId, filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if checksum == "" {
+		// The archive was cached without a checksum and hasn't been
+		// verified since, so we must read it to find one.
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+	return &archiveFile{
+		ReadCloser: f,
+		Size:       info.Size(),
+		SHA256:     checksum,
+	}, nil
+}
+
+// open returns the cached archive for the given content id, marking it as
+// recently used, along with its checksum if known.
+func (c *cachingArchiver) open(contentId, filename string) (*os.File, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[contentId]
+	if !exists {
+		return nil, "", os.ErrNotExist
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		c.size -= entry.size
+		delete(c.entries, contentId)
+		return nil, "", err
+	}
+
+	now := time.Now()
+	entry.lastUse = now
+	// The modification time records the last use across restarts. It
+	// doesn't matter much if this fails.
+	os.Chtimes(filename, now, now)
+	return f, entry.checksum, nil
+}
+
+// fill generates the archive for the given content id into the cache and
+// returns it opened for reading, along with its checksum.
+//
+// The archive is written to a temporary file first, so a partially-written
+// archive is never served from the cache.
+func (c *cachingArchiver) fill(src module.Source, v *version.Version, contentId, filename string) (*os.File, string, error) {
+	tmp, err := ioutil.TempFile(c.dir, "."+contentId+"-")
+	if err != nil {
+		return nil, "", err
+	}
+	tmpName := tmp.Name()
+
+	hash := sha256.New()
+	err = c.next.WriteArchive(src, v, contentId, io.MultiWriter(tmp, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err == nil {
+		// The checksum is written first so that it's never missing for an
+		// archive in the cache. If it is stale because we're interrupted
+		// before the rename, the archive is just rebuilt after the next
+		// verification.
+		err = ioutil.WriteFile(filename+checksumSuffix, []byte(checksum+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return nil, "", err
+	}
+
+	// We open the file before adding it so that it can't be evicted out
+	// from under us; an open file remains readable after it is removed.
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	c.mu.Lock()
+	if old, exists := c.entries[contentId]; exists {
+		// Another request filled the same entry concurrently, and our
+		// rename replaced its file.
+		c.size -= old.size
+	}
+	c.entries[contentId] = &cacheEntry{
+		size:     info.Size(),
+		lastUse:  time.Now(),
+		checksum: checksum,
+	}
+	c.size += info.Size()
+	c.evict()
+	c.mu.Unlock()
+
+	return f, checksum, nil
+}
+
+// evict removes least recently used archives until the cache is within its
+// size limit. The caller must hold c.mu.
+func (c *cachingArchiver) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	contentIds := make([]string, 0, len(c.entries))
+	for contentId := range c.entries {
+		contentIds = append(contentIds, contentId)
+	}
+	sort.Slice(contentIds, func(i, j int) bool {
+		return c.entries[contentIds[i]].lastUse.Before(c.entries[contentIds[j]].lastUse)
+	})
+
+	for _, contentId := range contentIds {
+		if c.size <= c.maxSize {
+			break
+		}
+		if err := c.remove(contentId); err != nil {
+			logging.Errorf("failed to remove cached archive: %s", err)
+		}
+	}
+}
+
+// remove removes the archive with the given content id from the cache,
+// along with its checksum. The caller must hold c.mu.
+func (c *cachingArchiver) remove(contentId string) error {
+	filename := filepath.Join(c.dir, contentId+".tgz")
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(filename + checksumSuffix)
+	c.size -= c.entries[contentId].size
+	delete(c.entries, contentId)
+	return nil
+}
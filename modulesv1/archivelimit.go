@@ -0,0 +1,54 @@
+package modulesv1
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// errArchiversBusy is returned by the Archiver from LimitArchiver when an
+// archive couldn't begin to be generated within the queue timeout.
+var errArchiversBusy = errors.New("too many archives are already being generated")
+
+// archiveRetryAfter is the time that clients are asked to wait before
+// retrying a download that failed with errArchiversBusy.
+const archiveRetryAfter = 10 * time.Second
+
+// LimitArchiver returns an Archiver that passes requests to the given
+// archiver, but allows at most limit of them to be in progress at once.
+// Further requests wait for up to queueTimeout for one of the others to
+// finish, and then fail.
+func LimitArchiver(next Archiver, limit int, queueTimeout time.Duration) Archiver {
+	return &limitArchiver{
+		next:         next,
+		sem:          make(chan struct{}, limit),
+		queueTimeout: queueTimeout,
+	}
+}
+
+type limitArchiver struct {
+	next         Archiver
+	sem          chan struct{}
+	queueTimeout time.Duration
+}
+
+func (a *limitArchiver) WriteArchive(src module.Source, v *version.Version, contentId string, w io.Writer) error {
+	select {
+	case a.sem <- struct{}{}:
+	default:
+		timer := time.NewTimer(a.queueTimeout)
+		defer timer.Stop()
+		select {
+		case a.sem <- struct{}{}:
+		case <-timer.C:
+			return errArchiversBusy
+		}
+	}
+	defer func() { <-a.sem }()
+
+	return a.next.WriteArchive(src, v, contentId, w)
+}
@@ -0,0 +1,101 @@
+package modulesv1
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// Archiver produces the gzipped tar archives that are returned when a
+// module version is downloaded.
+type Archiver interface {
+	// WriteArchive writes the archive for the given version from the given
+	// source to the given writer. contentId is the source's content id for
+	// the version, which identifies the archive content.
+	WriteArchive(src module.Source, v *version.Version, contentId string, w io.Writer) error
+}
+
+// LocalArchiver returns an Archiver that produces archives directly within
+// the calling process.
+func LocalArchiver() Archiver {
+	return localArchiver{}
+}
+
+type localArchiver struct{}
+
+func (localArchiver) WriteArchive(src module.Source, v *version.Version, contentId string, w io.Writer) error {
+	r, err := src.OpenArchive(v)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// archiveOpener is implemented by Archivers that keep their archives in
+// files, which can be opened directly to learn their sizes and checksums.
+type archiveOpener interface {
+	openArchive(src module.Source, v *version.Version, contentId string) (*archiveFile, error)
+}
+
+// archiveFile is an archive opened for reading, whose size and hex-encoded
+// SHA-256 checksum are known before it is read.
+type archiveFile struct {
+	io.ReadCloser
+	Size   int64
+	SHA256 string
+}
+
+// openArchive returns the archive for the given version from the given
+// archiver, opened for reading, so that its size and checksum can be sent
+// before the archive itself.
+//
+// Unless the archiver keeps its archives in files, the archive is first
+// written to a temporary file, which is removed when the result is closed.
+// Writing it fails once the given context is done.
+func openArchive(ctx context.Context, archiver Archiver, src module.Source, v *version.Version, contentId string) (*archiveFile, error) {
+	if opener, ok := archiver.(archiveOpener); ok {
+		return opener.openArchive(src, v, contentId)
+	}
+
+	f, err := ioutil.TempFile("", "terraform-registry-archive-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+	hash := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, hash), ctx: ctx}
+	err = archiver.WriteArchive(src, v, contentId, cw)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return &archiveFile{
+		ReadCloser: tmp,
+		Size:       cw.n,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// tempFile is a file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,156 @@
+package modulesv1
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// ArchiveCache is implemented by Archivers that keep the archives they
+// produce on disk, where they can become corrupted.
+type ArchiveCache interface {
+	Archiver
+
+	// VerifyArchives checks each cached archive against its recorded
+	// checksum, removing any that don't match so that they are rebuilt from
+	// their sources the next time they are downloaded. It returns the
+	// number of archives checked and the number of those that were corrupt.
+	VerifyArchives() (checked, corrupt int)
+
+	// CacheStatus returns a summary of the contents of the cache, and of
+	// the results of VerifyArchives.
+	CacheStatus() ArchiveCacheStatus
+}
+
+// ArchiveCacheStatus summarizes the contents of an ArchiveCache.
+type ArchiveCacheStatus struct {
+	Archives int   `json:"archives"`
+	Size     int64 `json:"size"`
+
+	// LastVerified is when VerifyArchives last finished, or nil if it has
+	// not yet run. CorruptArchives is the total number of corrupt archives
+	// that it has found since startup.
+	LastVerified    *time.Time `json:"last_verified,omitempty"`
+	CorruptArchives int        `json:"corrupt_archives"`
+}
+
+var _ ArchiveCache = (*cachingArchiver)(nil)
+
+func (c *cachingArchiver) VerifyArchives() (checked, corrupt int) {
+	c.mu.Lock()
+	entries := make(map[string]*cacheEntry, len(c.entries))
+	for contentId, entry := range c.entries {
+		entries[contentId] = entry
+	}
+	c.mu.Unlock()
+
+	for contentId, entry := range entries {
+		filename := filepath.Join(c.dir, contentId+".tgz")
+		checksum, err := verifyArchive(filename, entry.checksum)
+		if os.IsNotExist(err) {
+			// Evicted since we started.
+			continue
+		}
+		checked++
+
+		c.mu.Lock()
+		if c.entries[contentId] != entry {
+			// Evicted or replaced since we started, so our result for the
+			// file no longer applies.
+			c.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			logging.Warnf("removing corrupt cached archive %s: %s", filename, err)
+			corrupt++
+			c.corrupt++
+			if err := c.remove(contentId); err != nil {
+				logging.Errorf("failed to remove cached archive: %s", err)
+			}
+		} else if entry.checksum == "" {
+			entry.checksum = checksum
+			err := ioutil.WriteFile(filename+checksumSuffix, []byte(checksum+"\n"), 0644)
+			if err != nil {
+				logging.Errorf("failed to record checksum of cached archive %s: %s", filename, err)
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.lastVerified = time.Now()
+	c.mu.Unlock()
+	return checked, corrupt
+}
+
+func (c *cachingArchiver) CacheStatus() ArchiveCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := ArchiveCacheStatus{
+		Archives:        len(c.entries),
+		Size:            c.size,
+		CorruptArchives: c.corrupt,
+	}
+	if !c.lastVerified.IsZero() {
+		t := c.lastVerified.UTC()
+		ret.LastVerified = &t
+	}
+	return ret
+}
+
+// verifyArchive checks that the archive in the given file has the given
+// hex-encoded SHA-256 checksum, returning an error if it doesn't. If the
+// given checksum is empty then the archive is instead checked for being a
+// complete and valid gzipped tar archive.
+//
+// The result is the checksum of the file as it was read.
+func verifyArchive(filename, checksum string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := io.TeeReader(f, hash)
+	if checksum == "" {
+		// Reading the whole stream checks the gzip CRC, along with the
+		// structure of the archive.
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		tr := tar.NewReader(zr)
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", err
+	}
+
+	got := hex.EncodeToString(hash.Sum(nil))
+	if checksum != "" && got != checksum {
+		return "", fmt.Errorf("checksum is %s, but %s was recorded", got, checksum)
+	}
+	return got, nil
+}
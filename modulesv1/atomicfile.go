@@ -0,0 +1,34 @@
+package modulesv1
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic creates or replaces the given file, calling the given
+// function to write its contents. The contents are written to a temporary
+// file in the same directory, which is renamed into place only once it is
+// complete, so that a failure part way through can't leave a truncated file
+// behind.
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+"-")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+package modulesv1
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// Actions recorded in the audit trail.
+const (
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPin     = "pin"
+	AuditUnpin   = "unpin"
+	AuditPublish = "publish"
+	AuditRelease = "release"
+
+	// AuditRegister and AuditUnregister record changes to the module blocks
+	// in the modules file made through the admin API.
+	AuditRegister   = "register"
+	AuditUnregister = "unregister"
+)
+
+var (
+	// ErrModuleNotFound is returned when deleting or restoring a module
+	// that does not exist.
+	ErrModuleNotFound = errors.New("no such module")
+
+	// ErrAlreadyDeleted is returned when deleting a module that is already
+	// deleted.
+	ErrAlreadyDeleted = errors.New("module is already deleted")
+
+	// ErrNotDeleted is returned when restoring a module that is not deleted.
+	ErrNotDeleted = errors.New("module is not deleted")
+
+	// ErrNotPinned is returned when unpinning a module that is not pinned.
+	ErrNotPinned = errors.New("module is not pinned")
+)
+
+// AuditEntry is a single record in the audit trail of administrative
+// changes to the set of modules being served.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Provider   string    `json:"provider"`
+	Actor      string    `json:"actor,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+
+	// Version is set only for pin, publish and release entries, and
+	// ExpiresAt only for pin entries.
+	Version   string     `json:"version,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (e *AuditEntry) key() moduleKey {
+	return newModuleKey(e.Namespace, e.Name, e.Provider)
+}
+
+// LoadAuditLog sets the file to which the audit trail is appended, first
+// replaying any entries already in it so that modules deleted by an earlier
+// run of the server remain deleted.
+//
+// If this is never called, the audit trail and the deletions it records
+// are kept only in memory.
+func (s *ModuleSet) LoadAuditLog(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var entries []*AuditEntry
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		line := 0
+		for sc.Scan() {
+			line++
+			if len(sc.Bytes()) == 0 {
+				continue
+			}
+			entry := &AuditEntry{}
+			if err := json.Unmarshal(sc.Bytes(), entry); err != nil {
+				return fmt.Errorf("invalid entry at %s:%d: %s", filename, line, err)
+			}
+			entries = append(entries, entry)
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auditFile = filename
+	for _, entry := range entries {
+		s.applyAudit(entry)
+	}
+	return nil
+}
+
+// Delete soft-deletes the given module, so that it is no longer listed and
+// requests for it are answered with 410 Gone, until it is restored. The
+// given identifiers need not be normalized.
+//
+// The given entry describes who is making the change and why; its Time,
+// Action and module identifiers are populated by this method.
+func (s *ModuleSet) Delete(namespace, name, provider string, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleted[newModuleKey(namespace, name, provider)] != nil {
+		return nil, ErrAlreadyDeleted
+	}
+	mod := s.get(namespace, name, provider)
+	if mod == nil {
+		return nil, ErrModuleNotFound
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Action = AuditDelete
+	entry.Namespace, entry.Name, entry.Provider = mod.Namespace, mod.Name, mod.Provider
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Restore reverses an earlier Delete of the given module. The given
+// identifiers need not be normalized.
+//
+// The given entry describes who is making the change and why; its Time,
+// Action and module identifiers are populated by this method.
+func (s *ModuleSet) Restore(namespace, name, provider string, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deletion := s.deleted[newModuleKey(namespace, name, provider)]
+	if deletion == nil {
+		if s.get(namespace, name, provider) != nil {
+			return nil, ErrNotDeleted
+		}
+		return nil, ErrModuleNotFound
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Action = AuditRestore
+	entry.Namespace, entry.Name, entry.Provider = deletion.Namespace, deletion.Name, deletion.Provider
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RecordPublish records in the audit trail that the given version of the
+// given module has been published, or released from an existing commit.
+//
+// The given entry describes who made the change and has an Action of either
+// AuditPublish or AuditRelease; its Time, module identifiers and Version are
+// populated by this method.
+func (s *ModuleSet) RecordPublish(cfg *config.Module, v *version.Version, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.Time = time.Now().UTC()
+	entry.Namespace, entry.Name, entry.Provider = cfg.Namespace, cfg.Name, cfg.Provider
+	entry.Version = v.String()
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RecordConfigChange records in the audit trail that the module block with
+// the given identifiers has been added to, changed in or removed from the
+// modules file.
+//
+// The given entry describes who made the change and has an Action of either
+// AuditRegister or AuditUnregister; its Time and module identifiers are
+// populated by this method.
+func (s *ModuleSet) RecordConfigChange(namespace, name, provider string, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.Time = time.Now().UTC()
+	entry.Namespace, entry.Name, entry.Provider = namespace, name, provider
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Deletions returns the audit entries for all of the modules that are
+// currently deleted.
+func (s *ModuleSet) Deletions() []*AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]*AuditEntry, 0, len(s.deleted))
+	for _, entry := range s.deleted {
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// AuditTrail returns all of the entries in the audit trail, oldest first.
+func (s *ModuleSet) AuditTrail() []*AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]*AuditEntry, len(s.audit))
+	copy(ret, s.audit)
+	return ret
+}
+
+// recordAudit appends the given entry to the audit log file, if any, and
+// then applies it. The caller must hold s.mu for writing.
+//
+// The entry is not applied if it cannot be written, so that the file
+// remains a complete record of the deletions in effect.
+func (s *ModuleSet) recordAudit(entry *AuditEntry) error {
+	if s.auditFile != "" {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(buf, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.applyAudit(entry)
+	return nil
+}
+
+// applyAudit updates the set of deleted and pinned modules to reflect the
+// given entry.
+// The caller must hold s.mu for writing.
+func (s *ModuleSet) applyAudit(entry *AuditEntry) {
+	s.audit = append(s.audit, entry)
+	switch entry.Action {
+	case AuditDelete:
+		s.deleted[entry.key()] = entry
+	case AuditRestore:
+		delete(s.deleted, entry.key())
+	case AuditPin:
+		s.pins[entry.key()] = entry
+	case AuditUnpin:
+		delete(s.pins, entry.key())
+	}
+}
@@ -0,0 +1,221 @@
+package modulesv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// downloadsFormat is the version of the downloads file format, which is
+// increased whenever a change would cause older servers to misread the file.
+const downloadsFormat = 1
+
+// downloadDays is the number of days for which daily download counts are
+// retained, which is enough to give the count for the past year.
+const downloadDays = 366
+
+// downloadDayLayout is the layout of the dates that daily download counts
+// are keyed by, which are always in UTC.
+const downloadDayLayout = "2006-01-02"
+
+// downloadStats counts the downloads of each module, in total, by version
+// and by day.
+type downloadStats struct {
+	mu      sync.Mutex
+	modules map[moduleKey]*moduleDownloads
+}
+
+type moduleDownloads struct {
+	Total    int64            `json:"total"`
+	Versions map[string]int64 `json:"versions"`
+	Days     map[string]int64 `json:"days"`
+}
+
+type downloadsFile struct {
+	Format  int                         `json:"format"`
+	SavedAt time.Time                   `json:"saved_at"`
+	Modules map[string]*moduleDownloads `json:"modules"`
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{
+		modules: make(map[moduleKey]*moduleDownloads),
+	}
+}
+
+// record counts a download of the given version of the given module at the
+// given time.
+func (d *downloadStats) record(mod *config.Module, v *version.Version, t time.Time) {
+	key := newModuleKey(mod.Namespace, mod.Name, mod.Provider)
+	day := t.UTC().Format(downloadDayLayout)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	md, ok := d.modules[key]
+	if !ok {
+		md = &moduleDownloads{
+			Versions: make(map[string]int64),
+			Days:     make(map[string]int64),
+		}
+		d.modules[key] = md
+	}
+	md.Total++
+	md.Versions[v.String()]++
+	if _, ok := md.Days[day]; !ok {
+		// A new day is the only time that an old one can fall out of the
+		// retained range.
+		oldest := t.UTC().AddDate(0, 0, -downloadDays).Format(downloadDayLayout)
+		for old := range md.Days {
+			if old <= oldest {
+				delete(md.Days, old)
+			}
+		}
+	}
+	md.Days[day]++
+}
+
+// DownloadSummary is the number of downloads of a module over various
+// periods ending at the time it was produced, and in total.
+type DownloadSummary struct {
+	Week  int64 `json:"week"`
+	Month int64 `json:"month"`
+	Year  int64 `json:"year"`
+	Total int64 `json:"total"`
+
+	// Versions gives the total downloads of each version, keyed by version
+	// string, including only versions that have been downloaded.
+	Versions map[string]int64 `json:"versions"`
+}
+
+// summary returns the download summary of the given module as of the given
+// time. The week, month and year are the last 7, 30 and 365 days, including
+// the current one.
+func (d *downloadStats) summary(mod *config.Module, now time.Time) *DownloadSummary {
+	key := newModuleKey(mod.Namespace, mod.Name, mod.Provider)
+	now = now.UTC()
+	ret := &DownloadSummary{
+		Versions: make(map[string]int64),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	md, ok := d.modules[key]
+	if !ok {
+		return ret
+	}
+	ret.Total = md.Total
+	for v, n := range md.Versions {
+		ret.Versions[v] = n
+	}
+	for _, period := range []struct {
+		days int
+		dst  *int64
+	}{
+		{7, &ret.Week},
+		{30, &ret.Month},
+		{365, &ret.Year},
+	} {
+		after := now.AddDate(0, 0, -period.days).Format(downloadDayLayout)
+		for day, n := range md.Days {
+			if day > after {
+				*period.dst += n
+			}
+		}
+	}
+	return ret
+}
+
+// recordDownload counts a download of the given version of the given
+// module.
+func (s *ModuleSet) recordDownload(mod *config.Module, v *version.Version) {
+	s.downloads.record(mod, v, time.Now())
+}
+
+// DownloadSummary returns the number of downloads of the given module.
+func (s *ModuleSet) DownloadSummary(mod *config.Module) *DownloadSummary {
+	return s.downloads.summary(mod, time.Now())
+}
+
+// LoadDownloads loads the download counts that were previously written by
+// SaveDownloads, replacing any that have been counted since the server
+// started.
+//
+// It is not an error if the file doesn't exist, since it won't until the
+// counts have been saved for the first time.
+func (s *ModuleSet) LoadDownloads(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var raw downloadsFile
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return fmt.Errorf("invalid downloads file %s: %s", filename, err)
+	}
+	if raw.Format != downloadsFormat {
+		return fmt.Errorf("downloads file %s has unsupported format %d", filename, raw.Format)
+	}
+
+	// Unlike the index, counts are kept even for modules that are no
+	// longer configured, so that they aren't lost if a module is removed
+	// and then added again.
+	modules := make(map[moduleKey]*moduleDownloads, len(raw.Modules))
+	for addr, md := range raw.Modules {
+		parts := strings.Split(addr, "/")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid module %q in downloads file %s", addr, filename)
+		}
+		if md.Versions == nil {
+			md.Versions = make(map[string]int64)
+		}
+		if md.Days == nil {
+			md.Days = make(map[string]int64)
+		}
+		modules[newModuleKey(parts[0], parts[1], parts[2])] = md
+	}
+
+	s.downloads.mu.Lock()
+	s.downloads.modules = modules
+	s.downloads.mu.Unlock()
+	return nil
+}
+
+// SaveDownloads writes the download counts of every module to the given
+// file, to be loaded by LoadDownloads after a restart.
+func (s *ModuleSet) SaveDownloads(filename string) error {
+	raw := downloadsFile{
+		Format:  downloadsFormat,
+		SavedAt: time.Now().UTC(),
+		Modules: make(map[string]*moduleDownloads),
+	}
+
+	s.downloads.mu.Lock()
+	for key, md := range s.downloads.modules {
+		addr := key.namespace + "/" + key.name + "/" + key.provider
+		raw.Modules[addr] = md
+	}
+	buf, err := json.MarshalIndent(&raw, "", "  ")
+	s.downloads.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	})
+}
@@ -0,0 +1,218 @@
+package modulesv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// The types of Event.
+const (
+	EventModuleAdded       = "module_added"
+	EventModuleRemoved     = "module_removed"
+	EventVersionAdded      = "version_added"
+	EventDownloadCompleted = "download_completed"
+)
+
+// eventTypes are the valid types of Event.
+var eventTypes = map[string]bool{
+	EventModuleAdded:       true,
+	EventModuleRemoved:     true,
+	EventVersionAdded:      true,
+	EventDownloadCompleted: true,
+}
+
+// Event describes a change to the set of modules being served, or a
+// download of one of them.
+type Event struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+
+	// Version is set only for EventVersionAdded and EventDownloadCompleted.
+	Version string `json:"version,omitempty"`
+}
+
+const (
+	// eventHistory is the number of recent events that are retained so that
+	// clients that reconnect can catch up on the events they missed.
+	eventHistory = 256
+
+	// eventBuffer is the number of events that can be queued for a client
+	// that isn't keeping up, beyond which it is disconnected. It can then
+	// catch up by reconnecting, from the history if it isn't too far behind.
+	eventBuffer = 64
+
+	// eventKeepalive is how often a comment is sent to idle clients, so
+	// that proxies don't time out their connections.
+	eventKeepalive = 30 * time.Second
+)
+
+// events distributes events to the clients of the event stream.
+type events struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []*Event
+	subscribers map[chan *Event]struct{}
+}
+
+func newEvents() *events {
+	return &events{
+		nextID:      1,
+		subscribers: make(map[chan *Event]struct{}),
+	}
+}
+
+// publish sends an event of the given type about the given module to all of
+// the subscribers, and adds it to the history.
+func (e *events) publish(typ string, mod *config.Module, v *version.Version) {
+	ev := &Event{
+		Type:      typ,
+		Time:      time.Now().UTC(),
+		Namespace: mod.Namespace,
+		Name:      mod.Name,
+		Provider:  mod.Provider,
+	}
+	if v != nil {
+		ev.Version = v.String()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ev.ID = e.nextID
+	e.nextID++
+	e.history = append(e.history, ev)
+	if len(e.history) > eventHistory {
+		e.history = e.history[len(e.history)-eventHistory:]
+	}
+	for ch := range e.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events in the history after the given id, and a
+// channel that will receive subsequent events until the returned function
+// is called. The channel is closed if the subscriber falls too far behind.
+func (e *events) subscribe(afterID uint64) ([]*Event, <-chan *Event, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var past []*Event
+	if afterID != 0 {
+		for _, ev := range e.history {
+			if ev.ID > afterID {
+				past = append(past, ev)
+			}
+		}
+	}
+
+	ch := make(chan *Event, eventBuffer)
+	e.subscribers[ch] = struct{}{}
+	return past, ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subscribers[ch]; ok {
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// serveEvents serves the event stream as Server-Sent Events. A client that
+// reconnects with a Last-Event-ID header first receives any events it
+// missed that are still in the history.
+//
+// The stream can be limited to events of particular types, and to those
+// about modules in a particular namespace, with "type" and "namespace" query
+// arguments. The former may be given more than once.
+func (s *ModuleSet) serveEvents(wr http.ResponseWriter, req *http.Request) {
+	flusher, ok := wr.(http.Flusher)
+	if !ok {
+		// Should never happen, since both of our listener types support it.
+		apierror.Write(wr, req, apierror.NotImplemented("streaming is not supported"))
+		return
+	}
+
+	query := req.URL.Query()
+	types := make(map[string]bool)
+	for _, typ := range query["type"] {
+		if !eventTypes[typ] {
+			apierror.Write(wr, req, apierror.BadRequest(fmt.Sprintf("invalid event type %q", typ)))
+			return
+		}
+		types[typ] = true
+	}
+	namespace := query.Get("namespace")
+	wanted := func(ev *Event) bool {
+		return (len(types) == 0 || types[ev.Type]) && (namespace == "" || strings.EqualFold(ev.Namespace, namespace))
+	}
+
+	lastID, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+	past, ch, cancel := s.events.subscribe(lastID)
+	defer cancel()
+
+	wr.Header().Set("Content-Type", "text/event-stream")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.WriteHeader(200)
+	for _, ev := range past {
+		if !wanted(ev) {
+			continue
+		}
+		if err := writeEvent(wr, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !wanted(ev) {
+				continue
+			}
+			if err := writeEvent(wr, ev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(wr, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, ev *Event) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, buf)
+	return err
+}
@@ -0,0 +1,931 @@
+// Package modulesv1 implements the modules.v1 service of the Terraform
+// registry protocol, serving modules from local git repositories.
+package modulesv1
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// NewHandler returns a handler implementing the modules.v1 service for the
+// given modules, with paths relative to the base URL of the service. Module
+// archives are produced by the given archiver.
+//
+// The given function wraps the handlers for all of the routes that require
+// authentication, which is all of them except for the download of module
+// source archives.
+func NewHandler(hostname svchost.Hostname, modules *ModuleSet, archiver Archiver, authed func(http.HandlerFunc) http.HandlerFunc) http.Handler {
+	ret := mux.NewRouter()
+	ret.NotFoundHandler = apierror.NotFoundHandler
+
+	ret.HandleFunc("/events", authed(modules.serveEvents))
+
+	ret.HandleFunc("/", authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		return writeModuleList(wr, req, modules, modules.List(""))
+	})))
+
+	ret.HandleFunc("/{namespace}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		list := modules.List(mux.Vars(req)["namespace"])
+		if len(list) == 0 {
+			return apierror.NotFound()
+		}
+		return writeModuleList(wr, req, modules, list)
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+
+		byName := modules.ByName(namespace, name)
+		if byName == nil {
+			return apierror.NotFound()
+		}
+
+		list := make([]apiModule, 0)
+		for _, cfg := range byName {
+			span := startModuleSpan(req, "module.versions", cfg, nil)
+			latest, err := modules.LatestVersion(cfg, wantPrereleases(req))
+			span.Finish(err)
+			if err != nil {
+				apierror.Report(req, apierror.BackendUnavailable(err, "failed to get latest version for %s", cfg.DeclRange))
+				continue
+			}
+			if latest == nil {
+				continue
+			}
+
+			list = append(list, apiModule{
+				ID:         fmt.Sprintf("%s/%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider, latest),
+				Namespace:  cfg.Namespace,
+				Name:       cfg.Name,
+				Provider:   cfg.Provider,
+				Version:    latest.String(),
+				Links:      cfg.Links,
+				Deprecated: cfg.Deprecation(latest),
+			})
+		}
+
+		ret := apiModuleListResponse{
+			Modules: list,
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		span := startModuleSpan(req, "module.versions", cfg, nil)
+		latest, err := modules.LatestVersion(cfg, wantPrereleases(req))
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get latest version for %s", cfg.DeclRange)
+		}
+		if latest == nil {
+			return apierror.NotFound()
+		}
+		writeDeprecationHeaders(wr, cfg, latest)
+
+		ret := &apiModule{
+			ID:         fmt.Sprintf("%s/%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider, latest),
+			Namespace:  cfg.Namespace,
+			Name:       cfg.Name,
+			Provider:   cfg.Provider,
+			Version:    latest.String(),
+			Links:      cfg.Links,
+			Deprecated: cfg.Deprecation(latest),
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/versions", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		span := startModuleSpan(req, "module.versions", cfg, nil)
+		versions, err := modules.AllVersions(cfg, wantPrereleases(req))
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get all versions for %s", cfg.DeclRange)
+		}
+
+		writeDeprecationHeaders(wr, cfg, nil)
+		ret := VersionsResponse(config.AdvertisedHostname(req, hostname), cfg, versions)
+
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Write(buf)
+		return nil
+	}))))
+
+	// This must also be registered before the route for a specific version.
+	// As on the public registry, it redirects to the download of the latest
+	// version.
+	ret.HandleFunc("/{namespace}/{name}/{provider}/download", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		span := startModuleSpan(req, "module.versions", cfg, nil)
+		latest, err := modules.LatestVersion(cfg, wantPrereleases(req))
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get latest version for %s", cfg.DeclRange)
+		}
+		if latest == nil {
+			return apierror.NotFound()
+		}
+		writeDeprecationHeaders(wr, cfg, latest)
+
+		// The location is relative to this URL, so it doesn't depend on
+		// where the service is mounted.
+		wr.Header().Set("Location", fmt.Sprintf("./%s/download", latest))
+		wr.WriteHeader(302)
+		return nil
+	}))))
+
+	// This must be registered before the route for a specific version,
+	// since otherwise "resolve" would be interpreted as a version.
+	ret.HandleFunc("/{namespace}/{name}/{provider}/resolve", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+		constraintStr := req.URL.Query().Get("constraint")
+
+		constraints, err := version.NewConstraint(constraintStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version constraint")
+		}
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		span := startModuleSpan(req, "module.versions", cfg, nil)
+		versions, err := modules.AllVersions(cfg, wantPrereleases(req))
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get all versions for %s", cfg.DeclRange)
+		}
+
+		v := module.SelectVersion(versions, constraints)
+		if v == nil {
+			return apierror.NotFound()
+		}
+
+		ret := &apiResolveResponse{
+			Constraint: constraintStr,
+			Version:    v.String(),
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))
+
+	// The summary has the same form as on the public registry, with the
+	// addition of the downloads of each version.
+	ret.HandleFunc("/{namespace}/{name}/{provider}/downloads/summary", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		ret := &apiDownloadSummary{}
+		ret.Data.Type = "module-downloads-summary"
+		ret.Data.ID = fmt.Sprintf("%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider)
+		ret.Data.Attributes = modules.DownloadSummary(cfg)
+
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/diff/{from}/{to}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		from, err := version.NewVersion(vars["from"])
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+		to, err := version.NewVersion(vars["to"])
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange)
+		}
+		defer release()
+
+		for _, v := range []*version.Version{from, to} {
+			span := startModuleSpan(req, "module.has_version", cfg, v)
+			exists, err := src.HasVersion(v)
+			span.Finish(err)
+			if err != nil {
+				return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange)
+			}
+			if !exists {
+				return apierror.NotFound()
+			}
+			if cfg.Yanked(v) {
+				return apierror.Gone()
+			}
+		}
+
+		differ, ok := src.(module.Differ)
+		if !ok {
+			return apierror.NotImplemented("this module's source cannot compare versions")
+		}
+		diff, err := differ.DiffVersions(from, to)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to compare versions %s and %s of %s", from, to, cfg.DeclRange)
+		}
+
+		ret := &apiDiff{
+			From:  from.String(),
+			To:    to.String(),
+			Files: []apiDiffFile{},
+			Variables: apiDiffNames{
+				Added:   diff.Variables.Added,
+				Removed: diff.Variables.Removed,
+			},
+			Outputs: apiDiffNames{
+				Added:   diff.Outputs.Added,
+				Removed: diff.Outputs.Removed,
+			},
+		}
+		for _, f := range diff.Files {
+			ret.Files = append(ret.Files, apiDiffFile{
+				Path:   f.Path,
+				Status: f.Status,
+			})
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/download", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+		versionStr := vars["version"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		v, err := version.NewVersion(versionStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange)
+		}
+		defer release()
+
+		span := startModuleSpan(req, "module.has_version", cfg, v)
+		exists, err := src.HasVersion(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange)
+		}
+
+		if !exists {
+			return apierror.NotFound()
+		}
+		if cfg.Yanked(v) {
+			return apierror.Gone()
+		}
+		writeDeprecationHeaders(wr, cfg, v)
+
+		if locator, ok := src.(module.ArchiveLocator); ok {
+			url, err := locator.ArchiveURL(v)
+			if err != nil {
+				return apierror.BackendUnavailable(err, "failed to get archive URL for version %s of %s", v, cfg.DeclRange)
+			}
+			if url != "" {
+				// The client downloads the archive directly from the
+				// source, bypassing the archiver entirely.
+				wr.Header().Set("Content-Type", "text/plain")
+				wr.Header().Set("X-Terraform-Get", url)
+				modules.recordDownload(cfg, v)
+				return nil
+			}
+		}
+
+		span = startModuleSpan(req, "module.content_id", cfg, v)
+		treeId, err := src.ContentId(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.New(apierror.KindNotFound, err, "failed to get content id for version %s of %s", v, cfg.DeclRange)
+		}
+
+		if notModified(wr, req, treeId) {
+			return nil
+		}
+		wr.Header().Set("Content-Type", "text/plain")
+		wr.Header().Set("X-Terraform-Get", "./download/"+treeId+".tgz")
+		modules.recordDownload(cfg, v)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/download/{treeId}", validateVars(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+		versionStr := vars["version"]
+		givenTreeId := vars["treeId"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		v, err := version.NewVersion(versionStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange)
+		}
+		defer release()
+
+		span := startModuleSpan(req, "module.has_version", cfg, v)
+		exists, err := src.HasVersion(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange)
+		}
+
+		if !exists {
+			return apierror.NotFound()
+		}
+		if cfg.Yanked(v) {
+			return apierror.Gone()
+		}
+		writeDeprecationHeaders(wr, cfg, v)
+
+		span = startModuleSpan(req, "module.content_id", cfg, v)
+		treeId, err := src.ContentId(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.New(apierror.KindNotFound, err, "failed to get content id for version %s of %s", v, cfg.DeclRange)
+		}
+
+		if strings.HasSuffix(givenTreeId, ".tgz") {
+			// ignore the suffix; just there to placate go-getter
+			givenTreeId = givenTreeId[:len(givenTreeId)-4]
+		}
+
+		if givenTreeId != treeId {
+			return apierror.New(apierror.KindNotFound, nil, "wrong tree id given for version %s of %s", v, cfg.DeclRange)
+		}
+
+		// The archive is determined entirely by the tree, so a client that
+		// already has an archive of this tree needn't download it again.
+		if notModified(wr, req, treeId) {
+			return nil
+		}
+
+		// Terraform's "go-getter" client is pretty picky about both URLs and
+		// response headers. In order to process the response as a gzip tar
+		// the URL _must_ end with either .tgz or .tar.gz _and_ its content-type
+		// must be application/x-gzip rather than the tar MIME type and a gzip
+		// Content-Encoding.
+		//
+		// We set Content-Disposition here just for good measure, in case
+		// someone wants to hit this endpoint directly in a browser.
+		//
+		// Both can be overridden per module for the benefit of proxies that
+		// treat archives differently based on these headers.
+		contentType := "application/x-gzip"
+		if cfg.ContentType != "" {
+			contentType = cfg.ContentType
+		}
+		disposition := "attachment"
+		if cfg.ContentDisposition != "" {
+			disposition = cfg.ContentDisposition
+		}
+		wr.Header().Set("Content-Type", contentType)
+		wr.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, archiveFilename(cfg, v)))
+		// The archive is produced in full before we respond, so that the
+		// response can give its length.
+		span = startModuleSpan(req, "module.archive", cfg, v)
+		archive, err := openArchive(req.Context(), archiver, src, v, treeId)
+		span.Finish(err)
+		if err != nil {
+			wr.Header().Del("Content-Disposition")
+			wr.Header().Del("ETag")
+			return archiveError(wr, err, v, cfg)
+		}
+		defer archive.Close()
+
+		wr.Header().Set("Content-Length", strconv.FormatInt(archive.Size, 10))
+		wr.Header().Set("X-Checksum-SHA256", archive.SHA256)
+		cw := &countingWriter{w: wr, ctx: req.Context()}
+		_, err = io.Copy(cw, archive)
+		if err != nil {
+			// It's too late for an error response, so the client will see a
+			// truncated archive.
+			logging.Warnf("failed to send archive for version %s of %s: %s request_id=%s", v, cfg.DeclRange, err, requestid.Get(req))
+			return nil
+		}
+		modules.events.publish(EventDownloadCompleted, cfg, v)
+		return nil
+	})))
+
+	// The checksum is given in the format of the sha256sum utility, so that
+	// a downloaded archive can be checked with "sha256sum -c".
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/sha256", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+		versionStr := vars["version"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		v, err := version.NewVersion(versionStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange)
+		}
+		defer release()
+
+		span := startModuleSpan(req, "module.has_version", cfg, v)
+		exists, err := src.HasVersion(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange)
+		}
+
+		if !exists {
+			return apierror.NotFound()
+		}
+		if cfg.Yanked(v) {
+			return apierror.Gone()
+		}
+		writeDeprecationHeaders(wr, cfg, v)
+
+		span = startModuleSpan(req, "module.content_id", cfg, v)
+		treeId, err := src.ContentId(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.New(apierror.KindNotFound, err, "failed to get content id for version %s of %s", v, cfg.DeclRange)
+		}
+		if notModified(wr, req, treeId) {
+			return nil
+		}
+
+		span = startModuleSpan(req, "module.archive", cfg, v)
+		archive, err := openArchive(req.Context(), archiver, src, v, treeId)
+		span.Finish(err)
+		if err != nil {
+			wr.Header().Del("ETag")
+			return archiveError(wr, err, v, cfg)
+		}
+		archive.Close()
+
+		wr.Header().Set("Content-Type", "text/plain")
+		wr.Header().Set("X-Checksum-SHA256", archive.SHA256)
+		fmt.Fprintf(wr, "%s  %s\n", archive.SHA256, archiveFilename(cfg, v))
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		name := vars["name"]
+		provider := vars["provider"]
+		versionStr := vars["version"]
+
+		cfg := modules.Get(namespace, name, provider)
+		if cfg == nil {
+			return modules.missingError(namespace, name, provider)
+		}
+		modules.writeOrphanHeaders(wr, cfg)
+
+		v, err := version.NewVersion(versionStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		src, release, err := modules.Source(cfg)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", cfg.DeclRange)
+		}
+		defer release()
+
+		span := startModuleSpan(req, "module.has_version", cfg, v)
+		exists, err := src.HasVersion(v)
+		span.Finish(err)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, cfg.DeclRange)
+		}
+
+		if !exists {
+			return apierror.NotFound()
+		}
+		if cfg.Yanked(v) {
+			return apierror.Gone()
+		}
+
+		writeDeprecationHeaders(wr, cfg, v)
+
+		ret := &apiModule{
+			ID:         fmt.Sprintf("%s/%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider, v.String()),
+			Namespace:  cfg.Namespace,
+			Name:       cfg.Name,
+			Provider:   cfg.Provider,
+			Version:    v.String(),
+			Links:      cfg.Links,
+			Deprecated: cfg.Deprecation(v),
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		// The response also depends on the configuration of the module, so
+		// its tag is derived from the response itself rather than the tree.
+		if notModified(wr, req, fmt.Sprintf("%x", sha256.Sum256(buf))) {
+			return nil
+		}
+		wr.Write(buf)
+		return nil
+	}))))
+
+	return ret
+}
+
+// notModified sets the ETag header of the response to the given tag, which
+// must consist only of characters allowed in an entity tag, and responds
+// with 304 Not Modified if the request's If-None-Match header matches it.
+// It returns true if it did so, in which case the caller must not write
+// anything else.
+func notModified(wr http.ResponseWriter, req *http.Request, tag string) bool {
+	etag := `"` + tag + `"`
+	wr.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-None-Match uses the weak comparison, ignoring any W/ prefix.
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			wr.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// archiveFilename returns the name under which the archive of the given
+// version of the given module is downloaded.
+func archiveFilename(cfg *config.Module, v *version.Version) string {
+	return fmt.Sprintf("%s_%s_%s_%s.tgz", cfg.Namespace, cfg.Name, cfg.Provider, v)
+}
+
+// archiveError returns the error for a failure to produce the archive of
+// the given version of the given module, asking the client to retry later
+// if it failed only because too many archives were being generated.
+func archiveError(wr http.ResponseWriter, err error, v *version.Version, cfg *config.Module) error {
+	if err == errArchiversBusy {
+		wr.Header().Set("Retry-After", strconv.Itoa(int(archiveRetryAfter.Seconds())))
+	}
+	return apierror.BackendUnavailable(err, "failed to write archive for version %s of %s", v, cfg.DeclRange)
+}
+
+// wantPrereleases returns true if the given request asks for prerelease
+// versions to be offered even if the module normally hides them, using the
+// query string argument "prereleases=true".
+func wantPrereleases(req *http.Request) bool {
+	return req.URL.Query().Get("prereleases") == "true"
+}
+
+// The number of modules in each page of a module list when the request
+// doesn't specify a limit, and the largest limit it may specify. These are
+// the same as those of the public registry.
+const (
+	defaultListLimit = 15
+	maxListLimit     = 100
+)
+
+// writeModuleList writes the page of the given modules selected by the
+// "offset" and "limit" query arguments of the given request, along with
+// the "meta" object describing the neighboring pages. The list can also be
+// filtered by the "provider" argument. Modules without any versions are
+// omitted.
+func writeModuleList(wr http.ResponseWriter, req *http.Request, modules *ModuleSet, mods []*config.Module) error {
+	query := req.URL.Query()
+	offset, limit := 0, defaultListLimit
+	if s := query.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return apierror.BadRequest("invalid offset")
+		}
+		offset = n
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return apierror.BadRequest("invalid limit")
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		limit = n
+	}
+	provider := config.NormalizeIdentifier(query.Get("provider"))
+
+	list := make([]apiModule, 0)
+	for _, cfg := range mods {
+		if provider != "" && config.NormalizeIdentifier(cfg.Provider) != provider {
+			continue
+		}
+		span := startModuleSpan(req, "module.versions", cfg, nil)
+		latest, err := modules.LatestVersion(cfg, wantPrereleases(req))
+		span.Finish(err)
+		if err != nil {
+			apierror.Report(req, apierror.BackendUnavailable(err, "failed to get latest version for %s", cfg.DeclRange))
+			continue
+		}
+		if latest == nil {
+			continue
+		}
+
+		list = append(list, apiModule{
+			ID:         fmt.Sprintf("%s/%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider, latest),
+			Namespace:  cfg.Namespace,
+			Name:       cfg.Name,
+			Provider:   cfg.Provider,
+			Version:    latest.String(),
+			Links:      cfg.Links,
+			Deprecated: cfg.Deprecation(latest),
+		})
+	}
+
+	meta := &apiMeta{
+		Limit:         limit,
+		CurrentOffset: offset,
+	}
+	if offset+limit < len(list) {
+		next := offset + limit
+		meta.NextOffset = &next
+		meta.NextURL = pageURL(req, next, limit)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		meta.PrevOffset = &prev
+		meta.PrevURL = pageURL(req, prev, limit)
+	}
+	if offset > len(list) {
+		offset = len(list)
+	}
+	end := offset + limit
+	if end > len(list) {
+		end = len(list)
+	}
+
+	ret := apiModuleListResponse{
+		Modules: list[offset:end],
+		Meta:    meta,
+	}
+	buf, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return apierror.Internal(err, "failed to encode response as JSON")
+	}
+	wr.Write(buf)
+	return nil
+}
+
+// pageURL returns the URL of the page of a module list at the given offset,
+// keeping the other query arguments of the given request. The URL is an
+// absolute path, taken from the original request so that it includes the
+// base path of the service.
+func pageURL(req *http.Request, offset, limit int) string {
+	path := req.URL.Path
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		path = u.Path
+	}
+	query := req.URL.Query()
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	return (&url.URL{Path: path, RawQuery: query.Encode()}).String()
+}
+
+// VersionsResponse produces the response body for the "versions" endpoint
+// of the given module, which can be serialized as JSON.
+func VersionsResponse(hostname svchost.Hostname, cfg *config.Module, versions []*version.Version) interface{} {
+	ret := &apiVersionsResponse{
+		Modules: []apiVersionsModule{
+			{
+				Source:   fmt.Sprintf("%s/%s/%s/%s", hostname.ForDisplay(), cfg.Namespace, cfg.Name, cfg.Provider),
+				Versions: []apiVersionsModuleVersion{},
+			},
+		},
+	}
+	for _, v := range versions {
+		ret.Modules[0].Versions = append(ret.Modules[0].Versions, apiVersionsModuleVersion{
+			Version: v.String(),
+		})
+	}
+	return ret
+}
+
+type apiVersionsResponse struct {
+	Modules []apiVersionsModule `json:"modules"`
+}
+
+type apiVersionsModule struct {
+	Source   string                     `json:"source"`
+	Versions []apiVersionsModuleVersion `json:"versions"`
+}
+
+type apiVersionsModuleVersion struct {
+	Version string `json:"version"`
+}
+
+type apiModuleListResponse struct {
+	Modules []apiModule `json:"modules"`
+	Meta    *apiMeta    `json:"meta,omitempty"`
+}
+
+type apiMeta struct {
+	Limit         int `json:"limit"`
+	CurrentOffset int `json:"current_offset"`
+
+	// NextOffset and NextURL are set only if there is a next page, and
+	// PrevOffset and PrevURL only if there is a previous page.
+	NextOffset *int   `json:"next_offset,omitempty"`
+	NextURL    string `json:"next_url,omitempty"`
+	PrevOffset *int   `json:"prev_offset,omitempty"`
+	PrevURL    string `json:"prev_url,omitempty"`
+}
+
+type apiModule struct {
+	ID        string            `json:"id"`
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Provider  string            `json:"provider"`
+	Version   string            `json:"version"`
+	Links     map[string]string `json:"links,omitempty"`
+
+	// Deprecated is the message explaining why the module version is
+	// deprecated, if it is.
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+type apiResolveResponse struct {
+	Constraint string `json:"constraint"`
+	Version    string `json:"version"`
+}
+
+type apiDiff struct {
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Files     []apiDiffFile `json:"files"`
+	Variables apiDiffNames  `json:"variables"`
+	Outputs   apiDiffNames  `json:"outputs"`
+}
+
+type apiDiffFile struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+type apiDiffNames struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+type apiDownloadSummary struct {
+	Data struct {
+		Type       string           `json:"type"`
+		ID         string           `json:"id"`
+		Attributes *DownloadSummary `json:"attributes"`
+	} `json:"data"`
+}
+
+// countingWriter is an io.Writer that counts the bytes written through it.
+//
+// It also fails once the given context is done, so that writing an archive
+// for a client that has gone away stops even if writing to the client
+// itself doesn't fail, as with FastCGI where the web server discards the
+// rest of an aborted response.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	ctx context.Context
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,50 @@
+package modulesv1
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// apiHealth is the response of the admin API's /healthz and /readyz. Errors
+// gives the reasons that the server isn't ready, if it isn't.
+type apiHealth struct {
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// serveHealthz responds to a liveness probe, which succeeds whenever the
+// server is able to respond at all.
+func serveHealthz(wr http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(wr, http.StatusOK, &apiHealth{Status: "ok"})
+}
+
+// readyzHandler returns the handler for readiness probes, which succeed
+// only once at least one of the listeners in the given group is listening,
+// and, if cfg asks for it, the source of every module in the given set can
+// be opened.
+func readyzHandler(modules *ModuleSet, cfg *config.Admin, listeners *config.ListenerGroup) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		var errs []string
+		if listeners.Bound() == 0 {
+			errs = append(errs, "not yet listening for registry requests")
+		}
+		if cfg != nil && cfg.ReadyChecksSources {
+			for _, mod := range modules.allModules() {
+				_, release, err := modules.Source(mod)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("failed to open source for module %s/%s/%s: %s", mod.Namespace, mod.Name, mod.Provider, err))
+					continue
+				}
+				release()
+			}
+		}
+
+		if len(errs) != 0 {
+			writeAdminJSON(wr, http.StatusServiceUnavailable, &apiHealth{Status: "not ready", Errors: errs})
+			return
+		}
+		writeAdminJSON(wr, http.StatusOK, &apiHealth{Status: "ready"})
+	}
+}
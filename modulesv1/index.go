@@ -0,0 +1,146 @@
+package modulesv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// indexFormat is the version of the index file format, which is increased
+// whenever a change would cause older servers to misread the file.
+const indexFormat = 1
+
+type indexFile struct {
+	Format  int                 `json:"format"`
+	SavedAt time.Time           `json:"saved_at"`
+	Sources map[string][]string `json:"sources"`
+}
+
+// LoadIndex loads an index of the available versions of each module that
+// was previously written by SaveIndex. The loaded versions are served until
+// they are replaced by Revalidate, or are reloaded for some other reason.
+//
+// It is not an error if the file doesn't exist, since it won't until the
+// server has been shut down for the first time.
+func (s *ModuleSet) LoadIndex(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var raw indexFile
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return fmt.Errorf("invalid index file %s: %s", filename, err)
+	}
+	if raw.Format != indexFormat {
+		logging.Warnf("ignoring index file %s with unsupported format %d", filename, raw.Format)
+		return nil
+	}
+
+	// We only load entries for modules that are still configured, so that
+	// the index can't resurrect any that have since been removed.
+	current := make(map[string]bool)
+	for _, cfg := range s.allModules() {
+		current[versionCacheKey(cfg)] = true
+	}
+
+	known := make(map[string][]*version.Version)
+	for key, versionStrs := range raw.Sources {
+		if !current[key] {
+			continue
+		}
+		versions := make([]*version.Version, 0, len(versionStrs))
+		for _, str := range versionStrs {
+			v, err := version.NewVersion(str)
+			if err != nil {
+				return fmt.Errorf("invalid version %q for %s in index file %s", str, key, filename)
+			}
+			versions = append(versions, v)
+		}
+		known[key] = versions
+	}
+	s.versions.SetStale(known)
+
+	logging.Infof("loaded index of %d modules saved at %s", len(known), raw.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// SaveIndex writes the most recently loaded versions of each module to
+// the given file, to be loaded by LoadIndex after a restart.
+func (s *ModuleSet) SaveIndex(filename string) error {
+	var keys []string
+	for _, cfg := range s.allModules() {
+		keys = append(keys, versionCacheKey(cfg))
+	}
+
+	raw := indexFile{
+		Format:  indexFormat,
+		SavedAt: time.Now().UTC(),
+		Sources: make(map[string][]string),
+	}
+	for key, versions := range s.versions.Known(keys) {
+		strs := make([]string, len(versions))
+		for i, v := range versions {
+			strs[i] = v.String()
+		}
+		raw.Sources[key] = strs
+	}
+
+	buf, err := json.MarshalIndent(&raw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	})
+}
+
+// Revalidate reloads the versions of every module from its source,
+// replacing any that were loaded by LoadIndex. Errors are logged, and cause
+// the affected modules to be reloaded on their next request.
+func (s *ModuleSet) Revalidate() {
+	start := time.Now()
+	modules := s.allModules()
+	for _, cfg := range modules {
+		err := s.versions.Revalidate(cfg)
+		if err != nil {
+			logging.Warnf("failed to revalidate versions for %s: %s", cfg.DeclRange, err)
+		}
+	}
+	logging.Infof("revalidated versions of %d modules in %s", len(modules), time.Since(start))
+}
+
+// allModules returns all of the configured and orphaned modules.
+func (s *ModuleSet) allModules() []*config.Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ret []*config.Module
+	for _, byNamespace := range s.modules {
+		for _, byName := range byNamespace {
+			for _, mod := range byName {
+				ret = append(ret, mod)
+			}
+		}
+	}
+	now := time.Now()
+	for _, o := range s.orphans {
+		if now.Before(o.ExpiresAt) {
+			ret = append(ret, o.Module)
+		}
+	}
+	return ret
+}
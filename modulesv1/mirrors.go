@@ -0,0 +1,65 @@
+package modulesv1
+
+import (
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// UpdateMirrors clones or fetches the mirror of the repository of every
+// module that sets a git URL, and then reloads the versions of each of them.
+// Errors are logged, and leave the affected mirror as it was.
+//
+// Only one update runs at a time, so calls made while another is in
+// progress wait for it to finish first.
+func (s *ModuleSet) UpdateMirrors() {
+	var mirrored []*config.Module
+	for _, cfg := range s.allModules() {
+		if cfg.GitURL != "" {
+			mirrored = append(mirrored, cfg)
+		}
+	}
+
+	start := time.Now()
+	if updated := s.Refresh(mirrored); updated != 0 {
+		logging.Debugf("updated %d git mirrors in %s", updated, time.Since(start))
+	}
+}
+
+// Refresh fetches the mirror of the repository of each of the given modules
+// that sets a git URL, and then reloads the versions of all of them,
+// returning the number of mirrors that were updated. Errors are logged, and
+// leave the affected mirror and versions as they were.
+//
+// Refreshes, including those made by UpdateMirrors, run one at a time.
+func (s *ModuleSet) Refresh(mods []*config.Module) int {
+	s.mirrorMu.Lock()
+	defer s.mirrorMu.Unlock()
+
+	updated := make(map[string]bool)
+	for _, cfg := range mods {
+		if cfg.GitURL != "" && !updated[cfg.GitDir] {
+			// Modules that share a repository also share its mirror, which
+			// therefore need only be updated once.
+			tlsConfig, err := cfg.OutboundTLS.TLSConfig()
+			if err == nil {
+				var mod *module.Module
+				mod, err = module.Mirror(cfg.GitURL, cfg.GitDir, tlsConfig)
+				if mod != nil {
+					mod.Close()
+				}
+			}
+			if err != nil {
+				logging.Warnf("failed to update mirror of %s for %s: %s", cfg.GitURL, cfg.DeclRange, err)
+				continue
+			}
+			updated[cfg.GitDir] = true
+		}
+		if err := s.versions.Revalidate(cfg); err != nil {
+			logging.Warnf("failed to revalidate versions for %s: %s", cfg.DeclRange, err)
+		}
+	}
+	return len(updated)
+}
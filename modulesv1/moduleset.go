@@ -0,0 +1,413 @@
+package modulesv1
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// ModuleSet is the set of modules being served, which is replaced whenever
+// the configuration is reloaded.
+//
+// Modules that are removed by a reload can optionally remain available for
+// a grace period, during which they are "orphaned": still served, but with
+// response headers warning that they will soon be removed.
+type ModuleSet struct {
+	mu       sync.RWMutex
+	modules  config.Modules
+	orphans  map[moduleKey]*Orphan
+	versions *versionCache
+
+	// deleted records the modules that have been soft-deleted using the
+	// admin API, each of which is excluded from the set until restored.
+	deleted   map[moduleKey]*AuditEntry
+	audit     []*AuditEntry
+	auditFile string
+
+	// pins records the modules whose latest version has been pinned using
+	// the admin API, until each pin expires.
+	pins map[moduleKey]*AuditEntry
+
+	// mirrorMu is held while the git mirrors are being updated.
+	mirrorMu sync.Mutex
+
+	events    *events
+	downloads *downloadStats
+}
+
+type moduleKey struct {
+	namespace, name, provider string
+}
+
+func newModuleKey(namespace, name, provider string) moduleKey {
+	return moduleKey{
+		config.NormalizeIdentifier(namespace),
+		config.NormalizeIdentifier(name),
+		config.NormalizeIdentifier(provider),
+	}
+}
+
+// Orphan describes a module that has been removed from the configuration
+// but is still being served during its grace period.
+type Orphan struct {
+	Module    *config.Module
+	RemovedAt time.Time
+	ExpiresAt time.Time
+}
+
+// NewModuleSet creates a module set initially serving the given modules,
+// caching the versions of each module for the given time.
+func NewModuleSet(modules config.Modules, versionCacheTTL time.Duration) *ModuleSet {
+	s := &ModuleSet{
+		modules:   modules,
+		orphans:   make(map[moduleKey]*Orphan),
+		deleted:   make(map[moduleKey]*AuditEntry),
+		pins:      make(map[moduleKey]*AuditEntry),
+		events:    newEvents(),
+		downloads: newDownloadStats(),
+	}
+	s.versions = newVersionCache(versionCacheTTL, s.Source)
+	s.versions.added = func(cfg *config.Module, v *version.Version) {
+		s.events.publish(EventVersionAdded, cfg, v)
+	}
+	return s
+}
+
+// AllVersions returns all of the available versions of the given module,
+// with the latest version first. The result may be cached.
+//
+// Yanked versions are excluded, and if the module is pinned, versions newer
+// than the pinned version are excluded too. Prerelease versions are excluded if the module hides them,
+// unless prereleases is true to indicate that the client asked for them.
+func (s *ModuleSet) AllVersions(mod *config.Module, prereleases bool) ([]*version.Version, error) {
+	versions, err := s.versions.AllVersions(mod)
+	if err != nil {
+		return nil, err
+	}
+	if len(mod.YankedVersions) != 0 {
+		unyanked := make([]*version.Version, 0, len(versions))
+		for _, v := range versions {
+			if !mod.Yanked(v) {
+				unyanked = append(unyanked, v)
+			}
+		}
+		versions = unyanked
+	}
+	if pin := s.Pinned(mod); pin != nil {
+		versions = pinVersions(versions, pin)
+	}
+	if mod.Prereleases == config.PrereleasesHidden && !prereleases {
+		versions = releaseVersions(versions)
+	}
+	return versions, nil
+}
+
+// LatestVersion returns the latest available version of the given module,
+// or nil if it has no versions. The result may be cached.
+//
+// The latest version is never a prerelease unless the module allows it, or
+// prereleases is true to indicate that the client asked for them.
+func (s *ModuleSet) LatestVersion(mod *config.Module, prereleases bool) (*version.Version, error) {
+	versions, err := s.AllVersions(mod, prereleases)
+	if err != nil {
+		return nil, err
+	}
+	if mod.Prereleases != "" && mod.Prereleases != config.PrereleasesLatest && !prereleases {
+		versions = releaseVersions(versions)
+	}
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	return versions[0], nil
+}
+
+// releaseVersions returns the given versions without the prereleases.
+func releaseVersions(versions []*version.Version) []*version.Version {
+	ret := make([]*version.Version, 0, len(versions))
+	for _, v := range versions {
+		if v.Prerelease() == "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Get returns the configuration for the given module, or nil if it is
+// neither configured nor orphaned, or if it has been deleted. The given
+// identifiers need not be normalized.
+func (s *ModuleSet) Get(namespace, name, provider string) *config.Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.deleted[newModuleKey(namespace, name, provider)] != nil {
+		return nil
+	}
+	return s.get(namespace, name, provider)
+}
+
+// get is like Get but includes deleted modules. The caller must hold s.mu.
+func (s *ModuleSet) get(namespace, name, provider string) *config.Module {
+	if mod := s.modules.Get(namespace, name, provider); mod != nil {
+		return mod
+	}
+	key := newModuleKey(namespace, name, provider)
+	if o := s.orphans[key]; o != nil && time.Now().Before(o.ExpiresAt) {
+		return o.Module
+	}
+	return nil
+}
+
+// missingError returns the error for a response about the given module when
+// Get has returned nil for it: 410 Gone if it has been deleted, or 404 Not
+// Found otherwise.
+func (s *ModuleSet) missingError(namespace, name, provider string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.deleted[newModuleKey(namespace, name, provider)] != nil {
+		return apierror.Gone()
+	}
+	return apierror.NotFound()
+}
+
+// ByName returns the configurations for all of the configured and orphaned
+// modules with the given namespace and name, keyed by normalized provider,
+// excluding any that have been deleted. The result is nil if there are no
+// such modules.
+func (s *ModuleSet) ByName(namespace, name string) map[string]*config.Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ret map[string]*config.Module
+	for provider, mod := range s.modules.ByName(namespace, name) {
+		if s.deleted[newModuleKey(namespace, name, provider)] != nil {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[string]*config.Module)
+		}
+		ret[provider] = mod
+	}
+	now := time.Now()
+	nsKey, nameKey := config.NormalizeIdentifier(namespace), config.NormalizeIdentifier(name)
+	for key, o := range s.orphans {
+		if key.namespace != nsKey || key.name != nameKey || !now.Before(o.ExpiresAt) || s.deleted[key] != nil {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[string]*config.Module)
+		}
+		ret[key.provider] = o.Module
+	}
+	return ret
+}
+
+// List returns the configurations for all of the configured and orphaned
+// modules in the given namespace, or in all namespaces if namespace is
+// empty, excluding any that have been deleted. The result is ordered by
+// namespace, name and then provider.
+func (s *ModuleSet) List(namespace string) []*config.Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nsKey := config.NormalizeIdentifier(namespace)
+	byKey := make(map[moduleKey]*config.Module)
+	for ns, byNamespace := range s.modules {
+		if namespace != "" && ns != nsKey {
+			continue
+		}
+		for name, byName := range byNamespace {
+			for provider, mod := range byName {
+				byKey[moduleKey{ns, name, provider}] = mod
+			}
+		}
+	}
+	now := time.Now()
+	for key, o := range s.orphans {
+		if (namespace != "" && key.namespace != nsKey) || !now.Before(o.ExpiresAt) {
+			continue
+		}
+		byKey[key] = o.Module
+	}
+
+	keys := make([]moduleKey, 0, len(byKey))
+	for key := range byKey {
+		if s.deleted[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].provider < keys[j].provider
+	})
+	ret := make([]*config.Module, len(keys))
+	for i, key := range keys {
+		ret[i] = byKey[key]
+	}
+	return ret
+}
+
+// HasNamespace returns whether any module in the given namespace is
+// configured, orphaned or deleted. The given namespace need not be
+// normalized.
+func (s *ModuleSet) HasNamespace(namespace string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nsKey := config.NormalizeIdentifier(namespace)
+	if len(s.modules[nsKey]) != 0 {
+		return true
+	}
+	now := time.Now()
+	for key, o := range s.orphans {
+		if key.namespace == nsKey && now.Before(o.ExpiresAt) {
+			return true
+		}
+	}
+	for key := range s.deleted {
+		if key.namespace == nsKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Update replaces the configured modules with the given modules. Any
+// previously-configured modules that are not present in the new set are
+// orphaned for the given grace period, if it is non-zero.
+func (s *ModuleSet) Update(modules config.Modules, grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if grace > 0 {
+		for nsKey, byNamespace := range s.modules {
+			for nameKey, byName := range byNamespace {
+				for providerKey, mod := range byName {
+					if modules[nsKey][nameKey][providerKey] != nil {
+						continue
+					}
+					s.orphans[moduleKey{nsKey, nameKey, providerKey}] = &Orphan{
+						Module:    mod,
+						RemovedAt: now,
+						ExpiresAt: now.Add(grace),
+					}
+				}
+			}
+		}
+	}
+	for key, o := range s.orphans {
+		// Orphans that have expired or that have been restored to the
+		// configuration are no longer of interest.
+		if !now.Before(o.ExpiresAt) || modules[key.namespace][key.name][key.provider] != nil {
+			delete(s.orphans, key)
+		}
+	}
+
+	for _, mod := range modulesMissingFrom(modules, s.modules) {
+		s.events.publish(EventModuleAdded, mod, nil)
+	}
+	for _, mod := range modulesMissingFrom(s.modules, modules) {
+		s.events.publish(EventModuleRemoved, mod, nil)
+	}
+	s.modules = modules
+}
+
+// modulesMissingFrom returns the modules in a that are not in b.
+func modulesMissingFrom(a, b config.Modules) []*config.Module {
+	var ret []*config.Module
+	for nsKey, byNamespace := range a {
+		for nameKey, byName := range byNamespace {
+			for providerKey, mod := range byName {
+				if b[nsKey][nameKey][providerKey] == nil {
+					ret = append(ret, mod)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// Orphaned returns the orphan record for the given module configuration if
+// it is currently orphaned, or nil otherwise.
+func (s *ModuleSet) Orphaned(mod *config.Module) *Orphan {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, o := range s.orphans {
+		if o.Module == mod && time.Now().Before(o.ExpiresAt) {
+			return o
+		}
+	}
+	return nil
+}
+
+// Orphans returns all of the currently-orphaned modules.
+func (s *ModuleSet) Orphans() []*Orphan {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]*Orphan, 0, len(s.orphans))
+	now := time.Now()
+	for _, o := range s.orphans {
+		if now.Before(o.ExpiresAt) {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// Count returns the number of configured modules, excluding orphans.
+func (s *ModuleSet) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := 0
+	for _, byNamespace := range s.modules {
+		for _, byName := range byNamespace {
+			ret += len(byName)
+		}
+	}
+	return ret
+}
+
+// writeOrphanHeaders adds headers to the given response warning the client
+// that the given module has been removed from the configuration, if it is
+// orphaned.
+func (s *ModuleSet) writeOrphanHeaders(wr http.ResponseWriter, mod *config.Module) {
+	o := s.Orphaned(mod)
+	if o == nil {
+		return
+	}
+	wr.Header().Set("Deprecation", o.RemovedAt.UTC().Format(http.TimeFormat))
+	wr.Header().Set("Sunset", o.ExpiresAt.UTC().Format(http.TimeFormat))
+	wr.Header().Set("Warning", `299 - "This module has been removed from the registry and will soon be unavailable"`)
+}
+
+// writeDeprecationHeaders adds headers to the given response warning the
+// client that the given version of the given module is deprecated, if it is.
+// If v is nil, only the deprecation of the module as a whole is considered.
+func writeDeprecationHeaders(wr http.ResponseWriter, mod *config.Module, v *version.Version) {
+	message := mod.Deprecation(v)
+	if message == "" {
+		return
+	}
+	if wr.Header().Get("Deprecation") == "" {
+		// An orphaned module already has a more specific value.
+		wr.Header().Set("Deprecation", "true")
+	}
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(message)
+	wr.Header().Add("Warning", `299 - "`+quoted+`"`)
+}
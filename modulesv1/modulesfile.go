@@ -0,0 +1,315 @@
+package modulesv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/auth"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// maxModuleBlockSize is the largest module block that may be given to the
+// admin API.
+const maxModuleBlockSize = 64 * 1024
+
+// ModulesFile is the file of module blocks that is changed through the
+// admin API, as named by an Admin's ModulesFile.
+type ModulesFile struct {
+	// Filename is the path of the file, which is written in the JSON
+	// variant of the configuration syntax.
+	Filename string
+
+	// Load loads the whole configuration as it would be if the file had
+	// the given contents, returning the modules and settings of the main
+	// hostname, or an error describing why the result would be invalid.
+	Load func(contents []byte) (config.Modules, *config.ModuleSettings, error)
+
+	mu sync.Mutex
+}
+
+// modulesFileContents is the structure of a modules file, which declares
+// module blocks by their labels in the same way as any other configuration
+// file in the JSON syntax. Each block's body is kept as it was given.
+type modulesFileContents struct {
+	Module map[string]map[string]map[string]json.RawMessage `json:"module,omitempty"`
+}
+
+// read returns the current contents of the file, which are empty if it
+// doesn't exist yet.
+func (f *ModulesFile) read() (*modulesFileContents, error) {
+	ret := &modulesFileContents{}
+	buf, err := ioutil.ReadFile(f.Filename)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, ret); err != nil {
+		return nil, fmt.Errorf("%s must contain only module blocks, each given as a single object: %s", f.Filename, err)
+	}
+	return ret, nil
+}
+
+// find returns the labels under which the given module is declared in the
+// contents, which need not match the given identifiers exactly since those
+// are case-insensitive, and whether it is declared at all.
+func (c *modulesFileContents) find(namespace, name, provider string) (string, string, string, bool) {
+	key := newModuleKey(namespace, name, provider)
+	for ns, byNamespace := range c.Module {
+		for n, byName := range byNamespace {
+			for p := range byName {
+				if newModuleKey(ns, n, p) == key {
+					return ns, n, p, true
+				}
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// set replaces any existing declaration of the given module with the given
+// body, or removes it if body is nil.
+func (c *modulesFileContents) set(namespace, name, provider string, body json.RawMessage) {
+	if ns, n, p, ok := c.find(namespace, name, provider); ok {
+		delete(c.Module[ns][n], p)
+		if len(c.Module[ns][n]) == 0 {
+			delete(c.Module[ns], n)
+		}
+		if len(c.Module[ns]) == 0 {
+			delete(c.Module, ns)
+		}
+	}
+	if body == nil {
+		return
+	}
+
+	if c.Module == nil {
+		c.Module = make(map[string]map[string]map[string]json.RawMessage)
+	}
+	if c.Module[namespace] == nil {
+		c.Module[namespace] = make(map[string]map[string]json.RawMessage)
+	}
+	if c.Module[namespace][name] == nil {
+		c.Module[namespace][name] = make(map[string]json.RawMessage)
+	}
+	c.Module[namespace][name][provider] = body
+}
+
+// change applies the given change to the contents of the file, and then
+// checks the resulting configuration, writes the file and updates the given
+// module set to match it. The file is left as it was if the change would
+// make the configuration invalid.
+func (f *ModulesFile) change(modules *ModuleSet, fn func(*modulesFileContents) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	contents, err := f.read()
+	if err != nil {
+		return apierror.Internal(err, "failed to read modules file")
+	}
+	if err := fn(contents); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return apierror.Internal(err, "failed to encode modules file")
+	}
+	buf = append(buf, '\n')
+
+	mods, settings, err := f.Load(buf)
+	if err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+
+	// A truncated file would prevent the server from starting, so the file
+	// is replaced only once the new contents are complete.
+	err = writeFileAtomic(f.Filename, func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return apierror.Internal(err, "failed to write modules file")
+	}
+
+	modules.Update(mods, settings.OrphanGracePeriod)
+	go modules.UpdateMirrors()
+	return nil
+}
+
+// registerModulesFileRoutes adds the routes of the admin API that change
+// the given file to the given router.
+func registerModulesFileRoutes(r *mux.Router, modules *ModuleSet, f *ModulesFile) {
+	r.HandleFunc("/config/modules", func(wr http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		contents, err := f.read()
+		f.mu.Unlock()
+		if err != nil {
+			writeAdminError(wr, req, apierror.Internal(err, "failed to read modules file"))
+			return
+		}
+
+		ret := &apiModuleBlocks{
+			Modules: []*apiModuleBlock{},
+		}
+		for ns, byNamespace := range contents.Module {
+			for n, byName := range byNamespace {
+				for p, body := range byName {
+					ret.Modules = append(ret.Modules, &apiModuleBlock{
+						Namespace: ns,
+						Name:      n,
+						Provider:  p,
+						Config:    body,
+					})
+				}
+			}
+		}
+		sort.Slice(ret.Modules, func(i, j int) bool {
+			return ret.Modules[i].id() < ret.Modules[j].id()
+		})
+		writeAdminJSON(wr, 200, ret)
+	}).Methods("GET")
+
+	r.HandleFunc("/config/modules/{namespace}/{name}/{provider}", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		f.mu.Lock()
+		contents, err := f.read()
+		f.mu.Unlock()
+		if err != nil {
+			writeAdminError(wr, req, apierror.Internal(err, "failed to read modules file"))
+			return
+		}
+
+		ns, n, p, ok := contents.find(vars["namespace"], vars["name"], vars["provider"])
+		if !ok {
+			writeAdminJSON(wr, 404, &apiError{Error: ErrModuleNotFound.Error()})
+			return
+		}
+		writeAdminJSON(wr, 200, &apiModuleBlock{
+			Namespace: ns,
+			Name:      n,
+			Provider:  p,
+			Config:    contents.Module[ns][n][p],
+		})
+	})).Methods("GET")
+
+	r.HandleFunc("/config/modules/{namespace}/{name}/{provider}", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxModuleBlockSize+1))
+		if err != nil {
+			writeAdminJSON(wr, 400, &apiError{Error: fmt.Sprintf("failed to read request body: %s", err)})
+			return
+		}
+		if len(buf) > maxModuleBlockSize {
+			writeAdminJSON(wr, 400, &apiError{Error: "module block is too large"})
+			return
+		}
+
+		// The body is the module block's body in the JSON syntax, so it is
+		// checked here only for being an object; the attributes themselves
+		// are checked by loading the resulting configuration.
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &attrs); err != nil || attrs == nil {
+			writeAdminJSON(wr, 400, &apiError{Error: "request body must be a JSON object giving the module block's arguments"})
+			return
+		}
+		var body bytes.Buffer
+		json.Compact(&body, buf)
+
+		created := false
+		err = f.change(modules, func(contents *modulesFileContents) error {
+			_, _, _, exists := contents.find(vars["namespace"], vars["name"], vars["provider"])
+			created = !exists
+			contents.set(vars["namespace"], vars["name"], vars["provider"], body.Bytes())
+			return nil
+		})
+		if err != nil {
+			writeAdminError(wr, req, err)
+			return
+		}
+
+		status := 200
+		if created {
+			status = 201
+		}
+		writeModulesFileResult(wr, req, modules, status, vars, body.Bytes())
+	})).Methods("PUT")
+
+	r.HandleFunc("/config/modules/{namespace}/{name}/{provider}", validateVars(func(wr http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		err := f.change(modules, func(contents *modulesFileContents) error {
+			if _, _, _, ok := contents.find(vars["namespace"], vars["name"], vars["provider"]); !ok {
+				return apierror.NotFound()
+			}
+			contents.set(vars["namespace"], vars["name"], vars["provider"], nil)
+			return nil
+		})
+		if err != nil {
+			writeAdminError(wr, req, err)
+			return
+		}
+		writeModulesFileResult(wr, req, modules, 200, vars, nil)
+	})).Methods("DELETE")
+}
+
+// writeModulesFileResult records and logs a change to the module block
+// with the identifiers in the given route variables, which now has the
+// given body, or has been removed if body is nil, and writes the response.
+func writeModulesFileResult(wr http.ResponseWriter, req *http.Request, modules *ModuleSet, status int, vars map[string]string, body json.RawMessage) {
+	action := AuditRegister
+	if body == nil {
+		action = AuditUnregister
+	}
+	entry, err := modules.RecordConfigChange(vars["namespace"], vars["name"], vars["provider"], AuditEntry{
+		Action:     action,
+		Actor:      auth.Identity(req),
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		// The change has already been made, so this is only logged.
+		logging.Errorf("failed to record audit entry: %s", err)
+	}
+
+	logging.Infof("admin: %s of %s/%s/%s by %q from %s request_id=%s", action, vars["namespace"], vars["name"], vars["provider"], auth.Identity(req), req.RemoteAddr, requestid.Get(req))
+	writeAdminJSON(wr, status, &apiModuleBlock{
+		Namespace: vars["namespace"],
+		Name:      vars["name"],
+		Provider:  vars["provider"],
+		Config:    body,
+		Audit:     entry,
+	})
+}
+
+type apiModuleBlocks struct {
+	Modules []*apiModuleBlock `json:"modules"`
+}
+
+type apiModuleBlock struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+
+	// Config is the body of the module block, in the JSON syntax. It is
+	// omitted when the block has been removed.
+	Config json.RawMessage `json:"config,omitempty"`
+
+	// Audit is the audit entry for a change to the block.
+	Audit *AuditEntry `json:"audit,omitempty"`
+}
+
+func (b *apiModuleBlock) id() string {
+	return strings.ToLower(b.Namespace + "/" + b.Name + "/" + b.Provider)
+}
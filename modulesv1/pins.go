@@ -0,0 +1,115 @@
+package modulesv1
+
+import (
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// Pin pins the latest version of the given module to the given version
+// until the given time, so that any newer versions are hidden from the
+// version list and from the results of LatestVersion. The given identifiers
+// need not be normalized. Any existing pin for the module is replaced.
+//
+// This is intended as an emergency brake for a bad release. The newer
+// versions can still be downloaded by clients that request them directly.
+//
+// The given entry describes who is making the change and why; its Time,
+// Action, Version, ExpiresAt and module identifiers are populated by this
+// method.
+func (s *ModuleSet) Pin(namespace, name, provider string, v *version.Version, expires time.Time, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mod := s.get(namespace, name, provider)
+	if mod == nil || s.deleted[newModuleKey(namespace, name, provider)] != nil {
+		return nil, ErrModuleNotFound
+	}
+
+	expires = expires.UTC()
+	entry.Time = time.Now().UTC()
+	entry.Action = AuditPin
+	entry.Namespace, entry.Name, entry.Provider = mod.Namespace, mod.Name, mod.Provider
+	entry.Version = v.String()
+	entry.ExpiresAt = &expires
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Unpin removes the pin from the given module. The given identifiers need
+// not be normalized.
+//
+// The given entry describes who is making the change and why; its Time,
+// Action and module identifiers are populated by this method.
+func (s *ModuleSet) Unpin(namespace, name, provider string, entry AuditEntry) (*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pin := s.pins[newModuleKey(namespace, name, provider)]
+	if pin == nil || !pinActive(pin, time.Now()) {
+		if s.get(namespace, name, provider) == nil {
+			return nil, ErrModuleNotFound
+		}
+		return nil, ErrNotPinned
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Action = AuditUnpin
+	entry.Namespace, entry.Name, entry.Provider = pin.Namespace, pin.Name, pin.Provider
+	if err := s.recordAudit(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Pinned returns the audit entry that pinned the given module if it is
+// currently pinned, or nil otherwise.
+func (s *ModuleSet) Pinned(mod *config.Module) *AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pin := s.pins[newModuleKey(mod.Namespace, mod.Name, mod.Provider)]
+	if pin == nil || !pinActive(pin, time.Now()) {
+		return nil
+	}
+	return pin
+}
+
+// Pins returns the audit entries for all of the currently-pinned modules.
+func (s *ModuleSet) Pins() []*AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	ret := make([]*AuditEntry, 0, len(s.pins))
+	for _, pin := range s.pins {
+		if pinActive(pin, now) {
+			ret = append(ret, pin)
+		}
+	}
+	return ret
+}
+
+func pinActive(pin *AuditEntry, now time.Time) bool {
+	return pin.ExpiresAt != nil && now.Before(*pin.ExpiresAt)
+}
+
+// pinVersions returns the given versions, which must be latest first,
+// without any that are newer than the version of the given pin.
+func pinVersions(versions []*version.Version, pin *AuditEntry) []*version.Version {
+	pinned, err := version.NewVersion(pin.Version)
+	if err != nil {
+		// Should never happen, since pins are created from valid versions.
+		return versions
+	}
+	for i, v := range versions {
+		if !v.GreaterThan(pinned) {
+			return versions[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package modulesv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+	"github.com/apparentlymart/terraform-simple-registry/upstream"
+)
+
+// NewProxyHandler returns a handler that answers requests for the versions
+// and downloads of modules in namespaces that have no modules in the given
+// set by passing them on to the upstream registry described by the given
+// configuration, using the given client, and passes all other requests to
+// the given handler. If cfg is nil, nothing is proxied and the given handler
+// is returned unchanged.
+//
+// The upstream registry's version lists and archives are cached in the
+// configured directory, so that modules that have been downloaded once
+// remain available while the upstream registry is unreachable. The given
+// function wraps the handlers that require authentication, in the same way
+// as for NewHandler.
+func NewProxyHandler(hostname svchost.Hostname, modules *ModuleSet, cfg *config.Proxy, client *upstream.Client, authed func(http.HandlerFunc) http.HandlerFunc, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	p := &proxyCache{
+		cfg:    cfg,
+		client: client,
+	}
+	ret := mux.NewRouter()
+	ret.NotFoundHandler = next
+	ret.MethodNotAllowedHandler = next
+
+	// Namespaces that have local modules are never proxied, so that a
+	// private module can't be shadowed by one upstream or vice-versa.
+	proxied := func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(wr http.ResponseWriter, req *http.Request) {
+			if modules.HasNamespace(mux.Vars(req)["namespace"]) {
+				next.ServeHTTP(wr, req)
+				return
+			}
+			fn(wr, req)
+		}
+	}
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/versions", validateVars(proxied(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace, name, provider := vars["namespace"], vars["name"], vars["provider"]
+
+		versions, err := p.versions(req, namespace, name, provider)
+		if err != nil {
+			return err
+		}
+
+		ret := &apiVersionsResponse{
+			Modules: []apiVersionsModule{
+				{
+					Source:   fmt.Sprintf("%s/%s/%s/%s", config.AdvertisedHostname(req, hostname), namespace, name, provider),
+					Versions: make([]apiVersionsModuleVersion, len(versions)),
+				},
+			},
+		}
+		for i, v := range versions {
+			ret.Modules[0].Versions[i].Version = v.String()
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))).Methods("GET")
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/download", validateVars(proxied(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace, name, provider := vars["namespace"], vars["name"], vars["provider"]
+		v, err := version.NewVersion(vars["version"])
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		if _, err := os.Stat(p.archivePath(namespace, name, provider, v)); err != nil {
+			versions, err := p.versions(req, namespace, name, provider)
+			if err != nil {
+				return err
+			}
+			if !hasVersion(versions, v) {
+				return apierror.NotFound()
+			}
+		}
+
+		// The archive is always served from the cache, rather than by
+		// sending the client to wherever the upstream registry keeps it,
+		// so that the client needn't be able to reach the upstream
+		// registry at all.
+		wr.Header().Set("Content-Type", "text/plain")
+		wr.Header().Set("X-Terraform-Get", "./archive.tgz")
+		return nil
+	}))))).Methods("GET")
+
+	// As for local modules, the archive itself doesn't require
+	// authentication, since Terraform doesn't send credentials when
+	// downloading it.
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/archive.tgz", validateVars(proxied(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace, name, provider := vars["namespace"], vars["name"], vars["provider"]
+		v, err := version.NewVersion(vars["version"])
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		f, err := p.archive(req, namespace, name, provider, v)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return apierror.Internal(err, "failed to read cached archive")
+		}
+
+		wr.Header().Set("Content-Type", "application/x-gzip")
+		wr.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s-%s-%s.tar.gz", namespace, name, provider, v))
+		http.ServeContent(wr, req, "", info.ModTime(), f)
+		return nil
+	})))).Methods("GET")
+
+	return ret
+}
+
+// proxyCache fetches version lists and archives from an upstream registry,
+// caching them on disk.
+type proxyCache struct {
+	cfg    *config.Proxy
+	client *upstream.Client
+
+	// fetchMu is held while an archive is being fetched, so that
+	// concurrent requests for a version that isn't cached yet fetch it
+	// only once.
+	fetchMu sync.Mutex
+}
+
+// cachedVersions is the format of the files in which version lists are
+// cached.
+type cachedVersions struct {
+	Versions []string `json:"versions"`
+}
+
+func (p *proxyCache) moduleDir(namespace, name, provider string) string {
+	return filepath.Join(
+		p.cfg.CacheDir,
+		config.NormalizeIdentifier(namespace),
+		config.NormalizeIdentifier(name),
+		config.NormalizeIdentifier(provider),
+	)
+}
+
+func (p *proxyCache) archivePath(namespace, name, provider string, v *version.Version) string {
+	return filepath.Join(p.moduleDir(namespace, name, provider), v.String()+".tgz")
+}
+
+// versions returns the versions of the given module, which are fetched
+// from the upstream registry unless they were cached within the TTL. If
+// the upstream registry can't be reached, the cached versions are used
+// regardless of their age.
+func (p *proxyCache) versions(req *http.Request, namespace, name, provider string) ([]*version.Version, error) {
+	filename := filepath.Join(p.moduleDir(namespace, name, provider), "versions.json")
+
+	var cached []*version.Version
+	haveCached := false
+	info, statErr := os.Stat(filename)
+	if statErr == nil {
+		buf, err := ioutil.ReadFile(filename)
+		var raw cachedVersions
+		if err == nil {
+			err = json.Unmarshal(buf, &raw)
+		}
+		for _, s := range raw.Versions {
+			v, vErr := version.NewVersion(s)
+			if vErr != nil {
+				err = vErr
+				break
+			}
+			cached = append(cached, v)
+		}
+		if err != nil {
+			logging.Warnf("ignoring invalid cached versions in %s: %s", filename, err)
+		} else if time.Since(info.ModTime()) < p.cfg.CacheTTL {
+			return cached, nil
+		} else {
+			haveCached = true
+		}
+	}
+
+	versions, err := p.client.ModuleVersions(p.cfg.Upstream, namespace, name, provider)
+	if err != nil {
+		if upstream.IsNotFound(err) {
+			return nil, apierror.NotFound()
+		}
+		if haveCached {
+			logging.Warnf("proxy: using cached versions of %s/%s/%s, since %s is unavailable: %s request_id=%s", namespace, name, provider, p.cfg.Upstream.ForDisplay(), err, requestid.Get(req))
+			return cached, nil
+		}
+		return nil, apierror.BackendUnavailable(err, "failed to get versions of %s/%s/%s from %s", namespace, name, provider, p.cfg.Upstream.ForDisplay())
+	}
+
+	raw := cachedVersions{
+		Versions: make([]string, len(versions)),
+	}
+	for i, v := range versions {
+		raw.Versions[i] = v.String()
+	}
+	buf, err := json.Marshal(&raw)
+	if err == nil {
+		err = writeCacheFile(filename, func(w io.Writer) error {
+			_, err := w.Write(buf)
+			return err
+		})
+	}
+	if err != nil {
+		// The versions can still be served, but will be fetched again on
+		// the next request.
+		logging.Warnf("failed to cache versions of %s/%s/%s: %s", namespace, name, provider, err)
+	}
+	return versions, nil
+}
+
+// archive returns the cached archive of the given module version, first
+// fetching it from the upstream registry if it isn't cached yet.
+func (p *proxyCache) archive(req *http.Request, namespace, name, provider string, v *version.Version) (*os.File, error) {
+	filename := p.archivePath(namespace, name, provider, v)
+	if f, err := os.Open(filename); err == nil {
+		return f, nil
+	}
+
+	p.fetchMu.Lock()
+	defer p.fetchMu.Unlock()
+
+	// Another request may have fetched it while we were waiting.
+	if f, err := os.Open(filename); err == nil {
+		return f, nil
+	}
+
+	upstreamHost := p.cfg.Upstream.ForDisplay()
+	location, err := p.client.ModuleLocation(p.cfg.Upstream, namespace, name, provider, v)
+	if err != nil {
+		if upstream.IsNotFound(err) {
+			return nil, apierror.NotFound()
+		}
+		return nil, apierror.BackendUnavailable(err, "failed to get location of %s/%s/%s %s from %s", namespace, name, provider, v, upstreamHost)
+	}
+	files, err := p.client.FetchModuleFiles(location)
+	if err != nil {
+		return nil, apierror.BackendUnavailable(err, "failed to fetch %s/%s/%s %s from %s", namespace, name, provider, v, location)
+	}
+
+	err = writeCacheFile(filename, func(w io.Writer) error {
+		return module.WriteArchive(files, time.Now(), w)
+	})
+	if err != nil {
+		return nil, apierror.Internal(err, "failed to cache archive of %s/%s/%s %s", namespace, name, provider, v)
+	}
+	logging.Infof("proxy: cached %s/%s/%s %s from %s request_id=%s", namespace, name, provider, v, upstreamHost, requestid.Get(req))
+
+	return os.Open(filename)
+}
+
+// writeCacheFile creates or replaces the given file in the proxy's cache,
+// calling the given function to write its contents. The file appears only
+// once it is complete, so that a failure part way through can't leave a
+// truncated file behind to be served later.
+func writeCacheFile(filename string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, write)
+}
+
+func hasVersion(versions []*version.Version, v *version.Version) bool {
+	for _, candidate := range versions {
+		if candidate.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,329 @@
+package modulesv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/auth"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// NewPublishHandler returns a handler that answers requests to publish new
+// versions of the given modules, as described by the given configuration,
+// and passes all other requests to the given handler. If cfg is nil,
+// publishing is disabled and the given handler is returned unchanged.
+//
+// A version is published by a POST request for its URL, with a body that is
+// either a gzipped tar archive of its files or, with the content type
+// "application/json", an object giving the git repository and ref to take
+// them from. The version is written into the module's git repository or
+// archive directory, in the same way as the import command does.
+//
+// A version of a module with a git repository can instead be released by a
+// POST request for its URL followed by "/release", giving the id of a commit
+// already in the repository for the new version's tag to point at.
+func NewPublishHandler(modules *ModuleSet, cfg *config.Publish, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	authed := auth.Wrap(auth.NewTokens(cfg.Tokens, cfg.TokenFile))
+	ret := mux.NewRouter()
+	ret.NotFoundHandler = next
+	ret.MethodNotAllowedHandler = next
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		mod, v, err := publishTarget(req, modules, publishable)
+		if err != nil {
+			return err
+		}
+
+		files, archive, location, err := readPublishBody(req, mod, cfg.MaxSize)
+		if err != nil {
+			return err
+		}
+
+		src, release, err := modules.Source(mod)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", mod.DeclRange)
+		}
+		defer release()
+
+		// Versions are published one at a time, so that two requests for the
+		// same version can't both find that it doesn't exist yet.
+		publishMu.Lock()
+		defer publishMu.Unlock()
+
+		if err := checkNewVersion(src, mod, v); err != nil {
+			return err
+		}
+
+		switch src := src.(type) {
+		case *module.ArchiveDir:
+			if archive == nil {
+				var buf bytes.Buffer
+				if err := module.WriteArchive(files, time.Now(), &buf); err != nil {
+					return apierror.Internal(err, "failed to write archive for version %s of %s", v, mod.DeclRange)
+				}
+				archive = buf.Bytes()
+			}
+			err = src.AddVersion(v, bytes.NewReader(archive))
+		case *module.Module:
+			message := fmt.Sprintf(
+				"Publish %s/%s/%s version %s\n\nSource-Location: %s\nPublished-At: %s\n",
+				mod.Namespace, mod.Name, mod.Provider, v,
+				location, time.Now().UTC().Format(time.RFC3339),
+			)
+			err = src.ImportVersion(v, files, message)
+		default:
+			return apierror.NotImplemented("versions cannot be published to this module's source")
+		}
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to publish version %s of %s", v, mod.DeclRange)
+		}
+
+		return writePublished(wr, req, modules, mod, v, AuditPublish, location)
+	})))).Methods("POST")
+
+	ret.HandleFunc("/{namespace}/{name}/{provider}/{version}/release", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		mod, v, err := publishTarget(req, modules, taggable)
+		if err != nil {
+			return err
+		}
+
+		var body apiReleaseRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&body); err != nil {
+			return apierror.BadRequest(fmt.Sprintf("invalid request body: %s", err))
+		}
+		if !module.ValidCommitId(body.Commit) {
+			return apierror.BadRequest("\"commit\" must be a full commit id")
+		}
+
+		src, release, err := modules.Source(mod)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to open source for module configured at %s", mod.DeclRange)
+		}
+		defer release()
+		repo, ok := src.(*module.Module)
+		if !ok {
+			return apierror.NotImplemented("this module has no git repository to create tags in")
+		}
+
+		publishMu.Lock()
+		defer publishMu.Unlock()
+
+		if err := checkNewVersion(src, mod, v); err != nil {
+			return err
+		}
+		message := fmt.Sprintf(
+			"Release %s/%s/%s version %s\n\nReleased-At: %s\n",
+			mod.Namespace, mod.Name, mod.Provider, v,
+			time.Now().UTC().Format(time.RFC3339),
+		)
+		err = repo.TagVersion(v, body.Commit, message)
+		if err == module.ErrCommitNotFound {
+			return apierror.BadRequest(fmt.Sprintf("the repository has no commit %s", body.Commit))
+		}
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to tag version %s of %s", v, mod.DeclRange)
+		}
+
+		return writePublished(wr, req, modules, mod, v, AuditRelease, "commit "+strings.ToLower(body.Commit))
+	})))).Methods("POST")
+
+	return ret
+}
+
+// publishMu is held while each version is published.
+var publishMu sync.Mutex
+
+// publishTarget returns the module and version that the given request is
+// to publish, or an error if there is no such module, the version is
+// invalid, or the given check finds that the module can't be published to.
+func publishTarget(req *http.Request, modules *ModuleSet, check func(*config.Module) error) (*config.Module, *version.Version, error) {
+	vars := mux.Vars(req)
+	namespace := vars["namespace"]
+	name := vars["name"]
+	provider := vars["provider"]
+
+	mod := modules.Get(namespace, name, provider)
+	if mod == nil {
+		return nil, nil, modules.missingError(namespace, name, provider)
+	}
+	v, err := versionscheme.Scheme(mod.VersionScheme).ParseVersion(vars["version"])
+	if err != nil {
+		return nil, nil, apierror.InvalidVersion("invalid version")
+	}
+	if err := check(mod); err != nil {
+		return nil, nil, err
+	}
+	return mod, v, nil
+}
+
+// checkNewVersion returns a conflict error if the given version of the
+// given module already exists. The caller must hold publishMu.
+func checkNewVersion(src module.Source, mod *config.Module, v *version.Version) error {
+	exists, err := src.HasVersion(v)
+	if err != nil {
+		return apierror.BackendUnavailable(err, "failed to check version %s for %s", v, mod.DeclRange)
+	}
+	if exists {
+		return apierror.Conflict(fmt.Sprintf("version %s already exists", v))
+	}
+	return nil
+}
+
+// writePublished records the publication of the given version with the
+// given audit action, makes it visible at once, and then writes the
+// response describing it.
+func writePublished(wr http.ResponseWriter, req *http.Request, modules *ModuleSet, mod *config.Module, v *version.Version, action, location string) error {
+	entry, err := modules.RecordPublish(mod, v, AuditEntry{
+		Action:     action,
+		Actor:      auth.Identity(req),
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		apierror.Report(req, apierror.Internal(err, "failed to record audit entry"))
+	}
+	logging.Infof("%s: %s/%s/%s version %s from %s by %q from %s request_id=%s", action, mod.Namespace, mod.Name, mod.Provider, v, location, auth.Identity(req), req.RemoteAddr, requestid.Get(req))
+
+	// The new version is served at once, rather than once the cached
+	// versions expire, and is announced to the event stream.
+	if err := modules.versions.Revalidate(mod); err != nil {
+		apierror.Report(req, apierror.BackendUnavailable(err, "failed to revalidate versions for %s", mod.DeclRange))
+	}
+
+	ret := &apiPublishResponse{
+		ID:        fmt.Sprintf("%s/%s/%s/%s", mod.Namespace, mod.Name, mod.Provider, v),
+		Namespace: mod.Namespace,
+		Name:      mod.Name,
+		Provider:  mod.Provider,
+		Version:   v.String(),
+	}
+	if entry != nil {
+		ret.PublishedAt = entry.Time.Format(time.RFC3339)
+	}
+	buf, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return apierror.Internal(err, "failed to encode response as JSON")
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusCreated)
+	wr.Write(buf)
+	return nil
+}
+
+// publishable returns an error explaining why versions can't be published
+// to the given module, or nil if they can.
+func publishable(cfg *config.Module) error {
+	switch {
+	case cfg.S3 != nil:
+		return apierror.NotImplemented("versions cannot be published to modules served from S3")
+	case cfg.ArchiveDir != "":
+		return nil
+	}
+	return taggable(cfg)
+}
+
+// taggable returns an error explaining why the server can't create version
+// tags in the git repository of the given module, or nil if it can. The
+// restrictions are the same as for the import command.
+func taggable(cfg *config.Module) error {
+	switch {
+	case cfg.S3 != nil, cfg.ArchiveDir != "":
+		return apierror.NotImplemented("this module has no git repository to create tags in")
+	case cfg.GitURL != "":
+		// Anything we added to the mirror would be pruned by the next fetch
+		// from the remote repository.
+		return apierror.NotImplemented("this module is mirrored from another repository, so versions must be published there instead")
+	case cfg.Path != "":
+		return apierror.NotImplemented("this module is in a subdirectory of its repository, which publishing does not support")
+	case cfg.TagPattern != nil:
+		return apierror.NotImplemented("this module has custom tag names, which publishing does not support")
+	case cfg.TrustedKeys != nil:
+		// The created tags aren't signed, so they would be hidden.
+		return apierror.NotImplemented("this module serves only signed tags, which publishing cannot create")
+	}
+	return nil
+}
+
+// readPublishBody returns the files of the version being published by the
+// given request, along with a description of where they came from. If the
+// body is an archive, it is also returned as it was given, so that it can
+// be stored unchanged in an archive directory.
+func readPublishBody(req *http.Request, cfg *config.Module, maxSize int64) ([]module.ImportFile, []byte, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body apiPublishRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&body); err != nil {
+			return nil, nil, "", apierror.BadRequest(fmt.Sprintf("invalid request body: %s", err))
+		}
+
+		// Other schemes, and plain paths, would allow reading any
+		// repository on the registry's own host.
+		u, err := url.Parse(body.GitURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "ssh") {
+			return nil, nil, "", apierror.BadRequest("\"git_url\" must be an https or ssh URL")
+		}
+		tlsConfig, err := cfg.OutboundTLS.TLSConfig()
+		if err != nil {
+			return nil, nil, "", apierror.Internal(err, "invalid outbound TLS configuration for %s", cfg.DeclRange)
+		}
+		files, err := module.FetchRemoteFiles(body.GitURL, body.Ref, tlsConfig)
+		if err != nil {
+			return nil, nil, "", apierror.BadRequest(fmt.Sprintf("failed to fetch %q from %s: %s", body.Ref, body.GitURL, err))
+		}
+		if len(files) == 0 {
+			return nil, nil, "", apierror.BadRequest(fmt.Sprintf("%q in %s contains no files", body.Ref, body.GitURL))
+		}
+		return files, nil, fmt.Sprintf("%s?ref=%s", body.GitURL, url.QueryEscape(body.Ref)), nil
+	}
+
+	archive, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, nil, "", apierror.BadRequest(fmt.Sprintf("failed to read request body: %s", err))
+	}
+	if int64(len(archive)) > maxSize {
+		return nil, nil, "", apierror.BadRequest(fmt.Sprintf("archive is larger than the limit of %d bytes", maxSize))
+	}
+	files, err := module.ReadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, "", apierror.BadRequest(fmt.Sprintf("invalid archive: %s", err))
+	}
+	return files, archive, "upload", nil
+}
+
+type apiPublishRequest struct {
+	GitURL string `json:"git_url"`
+	Ref    string `json:"ref"`
+}
+
+type apiReleaseRequest struct {
+	Commit string `json:"commit"`
+}
+
+type apiPublishResponse struct {
+	ID          string `json:"id"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Provider    string `json:"provider"`
+	Version     string `json:"version"`
+	PublishedAt string `json:"published_at,omitempty"`
+}
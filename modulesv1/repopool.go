@@ -0,0 +1,150 @@
+package modulesv1
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// repoIdleTimeout is how long a git repository stays open in the pool after
+// it was last used.
+const repoIdleTimeout = 5 * time.Minute
+
+// repoPool holds the git repositories of modules open between requests, so
+// that they don't each open the repository again. Under load, the handles
+// opened for every request would otherwise accumulate faster than the
+// garbage collector frees them.
+//
+// Each caller of Load must release the module once it has finished with it.
+// A repository that no caller is using and that hasn't been used for
+// repoIdleTimeout is dropped from the pool and closed.
+//
+// The callers that share a repository may use it at the same time, since
+// the module package serializes the use of each repository itself.
+type repoPool struct {
+	mu    sync.Mutex
+	repos map[string]*pooledRepo
+	sweep sync.Once
+}
+
+type pooledRepo struct {
+	mod *module.Module
+
+	// users is the number of callers of Load that have not yet released
+	// the module.
+	users   int
+	lastUse time.Time
+}
+
+// repos is the pool shared by all of the sources opened by OpenSource.
+var repos = &repoPool{
+	repos: make(map[string]*pooledRepo),
+}
+
+// Load returns the module for the git repository in the given directory,
+// opening it with module.Load if it isn't already open, along with a
+// function that releases the module once the caller has finished with it.
+// Like module.Load, it returns nil if the directory can't be opened as a
+// git repository, in which case nothing is added to the pool so that the
+// next call tries again.
+func (p *repoPool) Load(gitDir string) (*module.Module, func()) {
+	if mod, release := p.acquire(gitDir); mod != nil {
+		return mod, release
+	}
+
+	// The repository is opened without the pool locked, so that opening one
+	// repository doesn't hold up the requests for the others.
+	mod := module.Load(gitDir)
+	if mod == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	repo, ok := p.repos[gitDir]
+	if ok {
+		// Another caller opened the same repository in the meantime, so
+		// theirs is shared and ours is closed.
+		repo.users++
+		repo.lastUse = time.Now()
+	} else {
+		repo = &pooledRepo{
+			mod:     mod,
+			users:   1,
+			lastUse: time.Now(),
+		}
+		p.repos[gitDir] = repo
+		p.sweep.Do(func() {
+			go p.dropIdleLoop()
+		})
+	}
+	p.mu.Unlock()
+
+	if repo.mod != mod {
+		mod.Close()
+	}
+	return repo.mod, p.releaser(repo)
+}
+
+// acquire returns the module for the git repository in the given directory
+// and the function that releases it, as for Load, if the repository is
+// already open, or nil otherwise.
+func (p *repoPool) acquire(gitDir string) (*module.Module, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	repo, ok := p.repos[gitDir]
+	if !ok {
+		return nil, nil
+	}
+	repo.users++
+	repo.lastUse = time.Now()
+	return repo.mod, p.releaser(repo)
+}
+
+// releaser returns the function that releases the given repository for one
+// of its users, which does nothing if it is called again.
+func (p *repoPool) releaser(repo *pooledRepo) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			repo.users--
+			repo.lastUse = time.Now()
+		})
+	}
+}
+
+// Len returns the number of repositories currently in the pool.
+func (p *repoPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.repos)
+}
+
+// dropIdleLoop periodically drops the repositories that have been idle for
+// repoIdleTimeout, for the lifetime of the process.
+func (p *repoPool) dropIdleLoop() {
+	for range time.Tick(repoIdleTimeout / 5) {
+		p.dropIdle(time.Now().Add(-repoIdleTimeout))
+	}
+}
+
+// dropIdle drops and closes the repositories that no caller is using and
+// that were last used before the given time.
+func (p *repoPool) dropIdle(before time.Time) {
+	var idle []*module.Module
+	p.mu.Lock()
+	for gitDir, repo := range p.repos {
+		if repo.users == 0 && repo.lastUse.Before(before) {
+			delete(p.repos, gitDir)
+			idle = append(idle, repo.mod)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, mod := range idle {
+		mod.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package modulesv1
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// OpenSource returns the source of the versions of the given module, along
+// with a function that the caller must call once it has finished with the
+// source, so that the git repository it reads can eventually be closed.
+func OpenSource(cfg *config.Module) (module.Source, func(), error) {
+	if loc := cfg.S3; loc != nil {
+		client, err := OutboundClient(cfg.OutboundTLS, cfg.OutboundProxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		src, err := module.LoadS3Archives(module.S3Options{
+			Bucket:          loc.Bucket,
+			Prefix:          loc.Prefix,
+			Region:          loc.Region,
+			Endpoint:        loc.Endpoint,
+			AccessKeyID:     loc.AccessKeyID,
+			SecretAccessKey: loc.SecretAccessKey,
+			RedirectExpiry:  loc.RedirectExpiry,
+			Client:          client,
+			VersionScheme:   versionscheme.Scheme(cfg.VersionScheme),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return src, noRelease, nil
+	}
+	if cfg.ArchiveDir != "" {
+		dir := module.LoadArchiveDir(cfg.ArchiveDir)
+		if cfg.VersionScheme != "" {
+			dir = dir.WithVersionScheme(versionscheme.Scheme(cfg.VersionScheme))
+		}
+		return dir, noRelease, nil
+	}
+
+	mod, release := repos.Load(cfg.GitDir)
+	if mod == nil {
+		return nil, nil, fmt.Errorf("failed to open git repository at %s", cfg.GitDir)
+	}
+	if cfg.Path != "" {
+		mod = mod.InPath(cfg.Path)
+	}
+	if cfg.TagPattern != nil {
+		mod = mod.WithTagPattern(cfg.TagPattern)
+	}
+	if cfg.VersionScheme != "" {
+		mod = mod.WithVersionScheme(versionscheme.Scheme(cfg.VersionScheme))
+	}
+	if cfg.TrustedKeys != nil {
+		mod = mod.WithTrustedKeys(cfg.TrustedKeys)
+	}
+	if len(cfg.Exclude) != 0 {
+		mod = mod.WithExclude(cfg.Exclude)
+	}
+	if len(cfg.Submodules) != 0 {
+		mod = mod.WithSubmodules(cfg.Submodules)
+	}
+	if cfg.LFSDir != "" {
+		mod = mod.WithLFSDir(cfg.LFSDir)
+	}
+	return mod, release, nil
+}
+
+// noRelease is the function returned by OpenSource for sources that have
+// nothing to release.
+func noRelease() {}
+
+// outboundClientKey identifies the configuration of an outbound HTTP client.
+type outboundClientKey struct {
+	tls   *config.OutboundTLS
+	proxy *config.OutboundProxy
+}
+
+// outboundClients holds the HTTP client for each outbound configuration, so
+// that connections are reused even though sources are opened often.
+var outboundClients = struct {
+	sync.Mutex
+	clients map[outboundClientKey]*http.Client
+}{
+	clients: make(map[outboundClientKey]*http.Client),
+}
+
+// OutboundClient returns the HTTP client for connections made with the
+// given outbound configuration, either of which may be nil to use the
+// default.
+func OutboundClient(tlsCfg *config.OutboundTLS, proxyCfg *config.OutboundProxy) (*http.Client, error) {
+	if tlsCfg == nil && proxyCfg == nil {
+		return http.DefaultClient, nil
+	}
+
+	key := outboundClientKey{tlsCfg, proxyCfg}
+	outboundClients.Lock()
+	defer outboundClients.Unlock()
+	if client, ok := outboundClients.clients[key]; ok {
+		return client, nil
+	}
+
+	tlsConfig, err := tlsCfg.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound TLS configuration at %s: %s", tlsCfg.DeclRange, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxyCfg.Proxy
+	client := &http.Client{Transport: transport}
+	outboundClients.clients[key] = client
+	return client, nil
+}
+
+// Source returns the source of the versions of the given module, which
+// must have been returned by the receiver, along with a function that the
+// caller must call once it has finished with the source, as for OpenSource.
+func (s *ModuleSet) Source(cfg *config.Module) (module.Source, func(), error) {
+	return OpenSource(cfg)
+}
@@ -0,0 +1,103 @@
+package modulesv1
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/hashicorp/hcl2/hcl"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+)
+
+// CheckSources returns error diagnostics for each of the given modules
+// whose git repository or archive directory is missing or can't be opened,
+// for servers that refuse to start with such modules.
+//
+// Modules that set "git_url" aren't checked, since their repositories are
+// mirrors that the server itself creates, and nor are modules in S3, which
+// can't be checked without listing their buckets.
+func CheckSources(modules config.Modules) hcl.Diagnostics {
+	var mods []*config.Module
+	for _, byNamespace := range modules {
+		for _, byName := range byNamespace {
+			for _, mod := range byName {
+				mods = append(mods, mod)
+			}
+		}
+	}
+	// We report the problems in the order of the configuration, since
+	// that's where the fixes must be made.
+	sort.Slice(mods, func(i, j int) bool {
+		a, b := mods[i].DeclRange, mods[j].DeclRange
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Start.Byte < b.Start.Byte
+	})
+
+	var diags hcl.Diagnostics
+	for _, mod := range mods {
+		declRange := mod.DeclRange
+		switch {
+		case mod.GitURL != "" || mod.S3 != nil:
+			continue
+		case mod.ArchiveDir != "":
+			info, err := os.Stat(mod.ArchiveDir)
+			if err == nil && !info.IsDir() {
+				err = fmt.Errorf("not a directory")
+			}
+			if err == nil {
+				var f *os.File
+				if f, err = os.Open(mod.ArchiveDir); err == nil {
+					f.Close()
+				}
+			}
+			if err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unreadable module archive directory",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"archive_dir\" to %s, which cannot be read: %s.", mod.Namespace, mod.Name, mod.Provider, mod.ArchiveDir, sourceErrorDetail(err)),
+					Subject:  &declRange,
+				})
+			}
+		default:
+			if _, err := os.Stat(mod.GitDir); err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unreadable module git repository",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"git_dir\" to %s, which cannot be read: %s.", mod.Namespace, mod.Name, mod.Provider, mod.GitDir, sourceErrorDetail(err)),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			repo, release := repos.Load(mod.GitDir)
+			if repo == nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unreadable module git repository",
+					Detail:   fmt.Sprintf("Module %q %q %q sets \"git_dir\" to %s, which cannot be opened as a git repository.", mod.Namespace, mod.Name, mod.Provider, mod.GitDir),
+					Subject:  &declRange,
+				})
+				continue
+			}
+			release()
+		}
+	}
+	return diags
+}
+
+// sourceErrorDetail describes the given error from opening a module's
+// source, without repeating the path that the diagnostic already gives.
+func sourceErrorDetail(err error) string {
+	switch {
+	case os.IsNotExist(err):
+		return "it does not exist"
+	case os.IsPermission(err):
+		return "permission denied"
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,38 @@
+package modulesv1
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/tracing"
+)
+
+// nameRequestSpan renames the span of the given request for the route that
+// it matched, so that requests for different modules along the same route
+// are grouped together.
+func nameRequestSpan(req *http.Request) {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return
+	}
+	if tmpl, err := route.GetPathTemplate(); err == nil {
+		tracing.FromContext(req.Context()).SetName(req.Method + " " + tmpl)
+	}
+}
+
+// startModuleSpan starts a span, as a child of the span of the given
+// request, for an operation on the source of the given module, and of the
+// given version unless it is nil. The caller must finish the span.
+func startModuleSpan(req *http.Request, name string, cfg *config.Module, v *version.Version) *tracing.Span {
+	attrs := []tracing.Attribute{
+		tracing.String("module.address", cfg.Namespace+"/"+cfg.Name+"/"+cfg.Provider),
+	}
+	if v != nil {
+		attrs = append(attrs, tracing.String("module.version", v.String()))
+	}
+	_, span := tracing.Start(req.Context(), name, attrs...)
+	return span
+}
@@ -0,0 +1,34 @@
+package modulesv1
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/pathvars"
+)
+
+var treeIdPattern = regexp.MustCompile(`^[0-9a-f]{40}(?:\.tgz)?$`)
+
+// routeVarValidators gives a validator for each of the variables used in
+// the route patterns in NewHandler.
+var routeVarValidators = pathvars.Validators{
+	"namespace": pathvars.Valid(config.ValidIdentifier),
+	"name":      pathvars.Valid(config.ValidIdentifier),
+	"provider":  pathvars.Valid(config.ValidIdentifier),
+	"version":   pathvars.Version,
+	"from":      pathvars.Version,
+	"to":        pathvars.Version,
+	"treeId":    pathvars.Valid(treeIdPattern.MatchString),
+}
+
+// validateVars wraps the given handler function so that it names the
+// request's tracing span and then responds with 400 Bad Request if any of
+// the route variables are invalid.
+func validateVars(fn http.HandlerFunc) http.HandlerFunc {
+	fn = routeVarValidators.Wrap(fn)
+	return func(wr http.ResponseWriter, req *http.Request) {
+		nameRequestSpan(req)
+		fn(wr, req)
+	}
+}
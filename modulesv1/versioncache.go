@@ -0,0 +1,203 @@
+package modulesv1
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// versionCache caches the available versions of each module for a fixed
+// time, so that busy registries need not iterate over all of the refs in a
+// module's repository for every request.
+//
+// The cache also remembers the versions most recently loaded for each
+// module regardless of the TTL, so that they can be saved as an index and
+// served from that index after a restart until they are revalidated.
+type versionCache struct {
+	ttl  time.Duration
+	open func(*config.Module) (module.Source, func(), error)
+
+	mu      sync.Mutex
+	entries map[string]*versionCacheEntry
+	known   map[string][]*version.Version
+
+	// stale records the keys whose known versions were loaded from an
+	// index and have not yet been revalidated. These are served as if
+	// they were cached.
+	stale map[string]bool
+
+	// added, if set, is called for each version that appears when the
+	// versions of a module are reloaded. It is not called when a module's
+	// versions are first loaded.
+	added func(*config.Module, *version.Version)
+}
+
+type versionCacheEntry struct {
+	versions []*version.Version
+	expires  time.Time
+}
+
+func newVersionCache(ttl time.Duration, open func(*config.Module) (module.Source, func(), error)) *versionCache {
+	return &versionCache{
+		ttl:     ttl,
+		open:    open,
+		entries: make(map[string]*versionCacheEntry),
+		known:   make(map[string][]*version.Version),
+		stale:   make(map[string]bool),
+	}
+}
+
+// versionCacheKey returns the key under which the versions of the given
+// module are cached. Modules that share a source share a cache entry.
+func versionCacheKey(cfg *config.Module) string {
+	key := cfg.GitDir
+	if loc := cfg.S3; loc != nil {
+		if loc.Endpoint != "" {
+			key = loc.Endpoint + "/" + loc.Bucket + "/" + loc.Prefix
+		} else {
+			key = "s3://" + loc.Bucket + "/" + loc.Prefix
+		}
+	} else if cfg.ArchiveDir != "" {
+		key = cfg.ArchiveDir
+	} else if cfg.TagPattern != nil {
+		// The same repository gives different versions for each pattern.
+		key += "\x00" + cfg.TagPattern.String()
+	}
+	if len(cfg.TrustedKeyFiles) != 0 {
+		// Only some of the tags may be signed by the trusted keys.
+		key += "\x00" + strings.Join(cfg.TrustedKeyFiles, "\x00")
+	}
+	if cfg.VersionScheme != "" {
+		// Each version scheme also gives different versions of the source.
+		key += "\x00" + string(cfg.VersionScheme)
+	}
+	return key
+}
+
+// AllVersions returns the available versions of the given module, with the
+// latest version first, from the cache if possible.
+func (c *versionCache) AllVersions(cfg *config.Module) ([]*version.Version, error) {
+	key := versionCacheKey(cfg)
+	now := time.Now()
+
+	c.mu.Lock()
+	if c.stale[key] {
+		versions := c.known[key]
+		c.mu.Unlock()
+		return versions, nil
+	}
+	entry := c.entries[key]
+	c.mu.Unlock()
+	if entry != nil && now.Before(entry.expires) {
+		return entry.versions, nil
+	}
+
+	return c.refresh(cfg, now)
+}
+
+// Revalidate reloads the versions of the given module, replacing any that
+// were cached or loaded from an index.
+func (c *versionCache) Revalidate(cfg *config.Module) error {
+	_, err := c.refresh(cfg, time.Now())
+	if err != nil {
+		// We'd rather return an error to the next request for the module
+		// than continue serving versions that may no longer exist.
+		key := versionCacheKey(cfg)
+		c.mu.Lock()
+		delete(c.stale, key)
+		delete(c.known, key)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *versionCache) refresh(cfg *config.Module, now time.Time) ([]*version.Version, error) {
+	key := versionCacheKey(cfg)
+	versions, err := c.loadVersions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.known[key]; ok && c.added != nil {
+		for _, v := range newVersions(old, versions) {
+			c.added(cfg, v)
+		}
+	}
+	c.known[key] = versions
+	delete(c.stale, key)
+	if c.ttl <= 0 {
+		return versions, nil
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &versionCacheEntry{
+		versions: versions,
+		expires:  now.Add(c.ttl),
+	}
+	return versions, nil
+}
+
+func (c *versionCache) loadVersions(cfg *config.Module) ([]*version.Version, error) {
+	src, release, err := c.open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return src.ListVersions()
+}
+
+// Known returns the versions most recently loaded for each of the given
+// keys, omitting any for which no versions have been loaded.
+func (c *versionCache) Known(keys []string) map[string][]*version.Version {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make(map[string][]*version.Version, len(keys))
+	for _, key := range keys {
+		if versions, ok := c.known[key]; ok {
+			ret[key] = versions
+		}
+	}
+	return ret
+}
+
+// SetStale records the given versions as known for each of the given keys,
+// to be served until each is revalidated.
+func (c *versionCache) SetStale(known map[string][]*version.Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, versions := range known {
+		c.known[key] = versions
+		c.stale[key] = true
+	}
+}
+
+// newVersions returns the versions in current that are not in old.
+func newVersions(old, current []*version.Version) []*version.Version {
+	var ret []*version.Version
+	for _, v := range current {
+		found := false
+		for _, o := range old {
+			if o.Equal(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
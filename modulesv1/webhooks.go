@@ -0,0 +1,206 @@
+package modulesv1
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// maxWebhookSize is the largest webhook payload that is accepted. Push
+// payloads describe only a limited number of commits, and so are much
+// smaller than this in practice.
+const maxWebhookSize = 5 * 1024 * 1024
+
+// NewWebhookHandler returns a handler that answers push webhooks from
+// GitHub at "/webhooks/github" and from GitLab at "/webhooks/gitlab", as
+// described by the given configuration, and passes all other requests to
+// the given handler. If cfg is nil, webhooks are disabled and the given
+// handler is returned unchanged.
+//
+// Each webhook refreshes the modules whose git URL is that of the
+// repository it describes, along with any named by "module" query
+// arguments in the webhook's URL, which allows it to refresh modules whose
+// repositories aren't mirrored. The refresh happens in the background,
+// since webhook senders expect a prompt response.
+func NewWebhookHandler(modules *ModuleSet, cfg *config.Webhooks, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	ret := mux.NewRouter()
+	ret.NotFoundHandler = next
+	ret.MethodNotAllowedHandler = next
+
+	ret.HandleFunc("/webhooks/github", apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookSize))
+		if err != nil {
+			return apierror.BadRequest(fmt.Sprintf("failed to read request body: %s", err))
+		}
+
+		// GitHub signs the payload with the secret rather than sending
+		// the secret itself.
+		mac := hmac.New(sha256.New, []byte(cfg.Secret))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(req.Header.Get("X-Hub-Signature-256")), []byte(want)) {
+			return apierror.Unauthorized()
+		}
+
+		switch req.Header.Get("X-GitHub-Event") {
+		case "push", "create":
+		default:
+			// Other events, such as the "ping" sent when a webhook is
+			// created, are acknowledged but otherwise ignored.
+			return writeWebhookResult(wr, req, "github", nil)
+		}
+
+		var payload struct {
+			Repository struct {
+				CloneURL string `json:"clone_url"`
+				SSHURL   string `json:"ssh_url"`
+				HTMLURL  string `json:"html_url"`
+			} `json:"repository"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return apierror.BadRequest(fmt.Sprintf("invalid payload: %s", err))
+		}
+		repo := payload.Repository
+		return refreshWebhookModules(wr, req, modules, "github", repo.CloneURL, repo.SSHURL, repo.HTMLURL)
+	})).Methods("POST")
+
+	ret.HandleFunc("/webhooks/gitlab", apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		// GitLab sends the secret itself, so it can be checked before the
+		// body is read.
+		token := req.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Secret)) != 1 {
+			return apierror.Unauthorized()
+		}
+
+		switch req.Header.Get("X-Gitlab-Event") {
+		case "Push Hook", "Tag Push Hook":
+		default:
+			return writeWebhookResult(wr, req, "gitlab", nil)
+		}
+
+		var payload struct {
+			Project struct {
+				HTTPURL string `json:"git_http_url"`
+				SSHURL  string `json:"git_ssh_url"`
+				WebURL  string `json:"web_url"`
+			} `json:"project"`
+		}
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxWebhookSize)).Decode(&payload); err != nil {
+			return apierror.BadRequest(fmt.Sprintf("invalid payload: %s", err))
+		}
+		project := payload.Project
+		return refreshWebhookModules(wr, req, modules, "gitlab", project.HTTPURL, project.SSHURL, project.WebURL)
+	})).Methods("POST")
+
+	return ret
+}
+
+// refreshWebhookModules starts refreshing the modules affected by a
+// webhook describing a repository with the given URLs, and writes the
+// response listing them. It responds with 404 Not Found if there are none,
+// so that the mistake shows in the sender's record of its deliveries.
+func refreshWebhookModules(wr http.ResponseWriter, req *http.Request, modules *ModuleSet, sender string, urls ...string) error {
+	repos := make(map[string]bool)
+	for _, u := range urls {
+		if key := repoKey(u); key != "" {
+			repos[key] = true
+		}
+	}
+	named := make(map[moduleKey]bool)
+	for _, id := range req.URL.Query()["module"] {
+		parts := strings.Split(id, "/")
+		if len(parts) != 3 {
+			return apierror.BadRequest(fmt.Sprintf("invalid module %q, which must be given as NAMESPACE/NAME/PROVIDER", id))
+		}
+		named[newModuleKey(parts[0], parts[1], parts[2])] = true
+	}
+
+	var mods []*config.Module
+	for _, cfg := range modules.allModules() {
+		if (cfg.GitURL != "" && repos[repoKey(cfg.GitURL)]) || named[newModuleKey(cfg.Namespace, cfg.Name, cfg.Provider)] {
+			mods = append(mods, cfg)
+		}
+	}
+	if len(mods) == 0 {
+		return apierror.NotFound()
+	}
+
+	go modules.Refresh(mods)
+	return writeWebhookResult(wr, req, sender, mods)
+}
+
+// writeWebhookResult writes the response to a webhook from the given
+// sender, listing the given modules that it is refreshing.
+func writeWebhookResult(wr http.ResponseWriter, req *http.Request, sender string, mods []*config.Module) error {
+	ret := &apiWebhookResponse{
+		Modules: []string{},
+	}
+	for _, cfg := range mods {
+		ret.Modules = append(ret.Modules, fmt.Sprintf("%s/%s/%s", cfg.Namespace, cfg.Name, cfg.Provider))
+	}
+	sort.Strings(ret.Modules)
+
+	status := http.StatusOK
+	if len(mods) != 0 {
+		status = http.StatusAccepted
+		logging.Infof("webhook: %s push refreshing %s request_id=%s", sender, strings.Join(ret.Modules, ","), requestid.Get(req))
+	}
+
+	buf, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return apierror.Internal(err, "failed to encode response as JSON")
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	wr.Write(buf)
+	return nil
+}
+
+// repoKey returns a string identifying the repository at the given git URL,
+// which is the same for its HTTPS, SSH and web URLs, or an empty string if
+// the URL is invalid.
+func repoKey(raw string) string {
+	var host, path string
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(raw, ":"); i > 0 && !strings.Contains(raw[:i], "/") {
+		// An scp-like SSH URL, such as "git@github.com:org/repo.git".
+		host, path = raw[:i], raw[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	} else {
+		return ""
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return ""
+	}
+	return strings.ToLower(host + "/" + path)
+}
+
+type apiWebhookResponse struct {
+	// Modules are the modules being refreshed, as NAMESPACE/NAME/PROVIDER.
+	Modules []string `json:"modules"`
+}
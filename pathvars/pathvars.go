@@ -0,0 +1,74 @@
+// Package pathvars validates the variables in the request paths of the
+// registry's APIs, so that odd input never reaches the module and provider
+// sources or the logs.
+package pathvars
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+)
+
+// maxVersionLength is the longest version string we'll accept in a request
+// path. Real version strings are much shorter than this; the limit just
+// prevents unreasonable input from reaching the version parser.
+const maxVersionLength = 128
+
+// A Validator checks the value of the route variable with the given name,
+// returning the error to respond with if it is invalid.
+type Validator func(name, value string) error
+
+// Valid returns a validator that accepts the values for which the given
+// function returns true.
+func Valid(valid func(string) bool) Validator {
+	return func(name, value string) error {
+		if !valid(value) {
+			return apierror.BadRequest("invalid " + name)
+		}
+		return nil
+	}
+}
+
+// Version is a validator that accepts versions.
+func Version(name, value string) error {
+	if !ValidVersion(value) {
+		return apierror.InvalidVersion("invalid version")
+	}
+	return nil
+}
+
+// ValidVersion returns true if the given string is a version that may be
+// given in a request.
+func ValidVersion(s string) bool {
+	if len(s) > maxVersionLength {
+		return false
+	}
+	_, err := version.NewVersion(s)
+	return err == nil
+}
+
+// Validators gives a validator for each of the variables used in the route
+// patterns of a handler.
+type Validators map[string]Validator
+
+// Wrap wraps the given handler function so that it responds with 400 Bad
+// Request if any of the route variables are invalid, or have no validator.
+func (vs Validators) Wrap(fn http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		for k, v := range mux.Vars(req) {
+			validate := vs[k]
+			if validate == nil {
+				apierror.Write(wr, req, apierror.BadRequest("invalid "+k))
+				return
+			}
+			if err := validate(k, v); err != nil {
+				apierror.Write(wr, req, err)
+				return
+			}
+		}
+		fn(wr, req)
+	}
+}
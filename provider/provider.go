@@ -0,0 +1,247 @@
+package provider
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Provider represents a single provider whose release files are stored in
+// a local directory, using the same naming scheme as official releases:
+//
+//	terraform-provider-TYPE_VERSION_OS_ARCH.zip
+//	terraform-provider-TYPE_VERSION_SHA256SUMS
+//	terraform-provider-TYPE_VERSION_SHA256SUMS.sig
+//	terraform-provider-TYPE_VERSION_manifest.json (optional)
+type Provider struct {
+	dir      string
+	typeName string
+}
+
+// Version describes a single available version of a provider.
+type Version struct {
+	Version *version.Version
+
+	// Protocols is the list of plugin protocol versions declared in the
+	// version's manifest file, or nil if it has no manifest.
+	Protocols []string
+
+	Platforms []Platform
+}
+
+// Platform is an operating system and architecture pair.
+type Platform struct {
+	OS   string
+	Arch string
+}
+
+// Package describes the release files for one platform of one version.
+type Package struct {
+	Filename              string
+	Shasum                string
+	SHA256SumsFilename    string
+	SHA256SumsSigFilename string
+
+	// Protocols is as for Version.Protocols.
+	Protocols []string
+}
+
+// Load creates a new Provider object that reads its data from the given
+// directory, which must contain release files for the given provider type.
+//
+// This function returns nil if the given directory cannot be read.
+func Load(dir, typeName string) *Provider {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	return &Provider{
+		dir:      dir,
+		typeName: typeName,
+	}
+}
+
+// AllVersions returns all of the available versions for the receiving
+// provider, in reverse order such that the latest version is at index 0.
+//
+// Only versions that have at least one platform package are returned.
+func (p Provider) AllVersions() ([]*Version, error) {
+	entries, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[string]*Version)
+	var ret []*Version
+	for _, entry := range entries {
+		v, platform, ok := p.parsePackageFilename(entry.Name())
+		if !ok {
+			continue
+		}
+
+		key := v.String()
+		pv := byVersion[key]
+		if pv == nil {
+			protocols, err := p.readProtocols(v)
+			if err != nil {
+				return nil, err
+			}
+			pv = &Version{
+				Version:   v,
+				Protocols: protocols,
+			}
+			byVersion[key] = pv
+			ret = append(ret, pv)
+		}
+		pv.Platforms = append(pv.Platforms, platform)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		// j and i are inverted here because we want reverse order
+		return ret[j].Version.LessThan(ret[i].Version)
+	})
+
+	return ret, nil
+}
+
+// Package returns the details of the package for the given version and
+// platform, or nil if no such package exists.
+func (p Provider) Package(v *version.Version, platform Platform) (*Package, error) {
+	prefix := p.filenamePrefix(v)
+	filename := fmt.Sprintf("%s_%s_%s.zip", prefix, platform.OS, platform.Arch)
+	if _, err := os.Stat(filepath.Join(p.dir, filename)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sumsFilename := prefix + "_SHA256SUMS"
+	shasum, err := p.readShasum(sumsFilename, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	protocols, err := p.readProtocols(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Package{
+		Filename:              filename,
+		Shasum:                shasum,
+		SHA256SumsFilename:    sumsFilename,
+		SHA256SumsSigFilename: sumsFilename + ".sig",
+		Protocols:             protocols,
+	}, nil
+}
+
+// OpenFile opens one of the release files belonging to the receiving
+// provider, returning an error if the given name is not such a file.
+func (p Provider) OpenFile(filename string) (*os.File, error) {
+	if filename != filepath.Base(filename) || !strings.HasPrefix(filename, "terraform-provider-"+p.typeName+"_") {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(filepath.Join(p.dir, filename))
+}
+
+func (p Provider) filenamePrefix(v *version.Version) string {
+	return fmt.Sprintf("terraform-provider-%s_%s", p.typeName, v)
+}
+
+func (p Provider) parsePackageFilename(filename string) (*version.Version, Platform, bool) {
+	prefix := "terraform-provider-" + p.typeName + "_"
+	if !strings.HasPrefix(filename, prefix) || !strings.HasSuffix(filename, ".zip") {
+		return nil, Platform{}, false
+	}
+
+	parts := strings.Split(filename[len(prefix):len(filename)-4], "_")
+	if len(parts) != 3 {
+		return nil, Platform{}, false
+	}
+
+	v, err := version.NewVersion(parts[0])
+	if err != nil {
+		return nil, Platform{}, false
+	}
+
+	return v, Platform{OS: parts[1], Arch: parts[2]}, true
+}
+
+func (p Provider) readShasum(sumsFilename, filename string) (string, error) {
+	f, err := os.Open(filepath.Join(p.dir, sumsFilename))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && fields[1] == filename {
+			return fields[0], nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s has no checksum for %s", sumsFilename, filename)
+}
+
+func (p Provider) readProtocols(v *version.Version) ([]string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(p.dir, p.filenamePrefix(v)+"_manifest.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var manifest struct {
+		Metadata struct {
+			ProtocolVersions []string `json:"protocol_versions"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for version %s: %s", v, err)
+	}
+
+	return manifest.Metadata.ProtocolVersions, nil
+}
+
+// SigningKey is a GPG public key that was used to sign provider releases.
+type SigningKey struct {
+	KeyID      string
+	ASCIIArmor string
+}
+
+// ReadSigningKey reads an ASCII-armored GPG public key from the given file.
+func ReadSigningKey(filename string) (*SigningKey, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GPG public key in %s: %s", filename, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no GPG public key in %s", filename)
+	}
+
+	return &SigningKey{
+		KeyID:      entities[0].PrimaryKey.KeyIdString(),
+		ASCIIArmor: string(buf),
+	}, nil
+}
@@ -0,0 +1,219 @@
+// Package providersv1 implements the providers.v1 service of the Terraform
+// registry protocol, serving provider releases from local directories.
+package providersv1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/provider"
+)
+
+// NewHandler returns a handler implementing the providers.v1 service for
+// the given providers, with paths relative to the base URL of the service.
+//
+// The given function wraps the handlers for all of the routes that require
+// authentication, which is all of them except for the download of the
+// release files themselves.
+func NewHandler(hostname svchost.Hostname, providers config.Providers, authed func(http.HandlerFunc) http.HandlerFunc) http.Handler {
+	ret := mux.NewRouter()
+	ret.NotFoundHandler = apierror.NotFoundHandler
+
+	ret.HandleFunc("/{namespace}/{type}/versions", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		typeName := vars["type"]
+
+		cfg := providers.Get(namespace, typeName)
+		if cfg == nil {
+			return apierror.NotFound()
+		}
+
+		prov := provider.Load(cfg.Dir, cfg.Type)
+		if prov == nil {
+			return apierror.BackendUnavailable(nil, "failed to open directory %s for provider configured at %s", cfg.Dir, cfg.DeclRange)
+		}
+
+		versions, err := prov.AllVersions()
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get all versions for %s", cfg.DeclRange)
+		}
+
+		ret := apiVersionsResponse{
+			Versions: []apiVersion{},
+		}
+		for _, pv := range versions {
+			protocols := pv.Protocols
+			if protocols == nil {
+				protocols = cfg.Protocols
+			}
+			av := apiVersion{
+				Version:   pv.Version.String(),
+				Protocols: protocols,
+				Platforms: []apiPlatform{},
+			}
+			for _, platform := range pv.Platforms {
+				av.Platforms = append(av.Platforms, apiPlatform{
+					OS:   platform.OS,
+					Arch: platform.Arch,
+				})
+			}
+			ret.Versions = append(ret.Versions, av)
+		}
+
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{type}/{version}/download/{os}/{arch}", validateVars(authed(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		typeName := vars["type"]
+		versionStr := vars["version"]
+		platform := provider.Platform{
+			OS:   vars["os"],
+			Arch: vars["arch"],
+		}
+
+		cfg := providers.Get(namespace, typeName)
+		if cfg == nil {
+			return apierror.NotFound()
+		}
+
+		v, err := version.NewVersion(versionStr)
+		if err != nil {
+			return apierror.InvalidVersion("invalid version")
+		}
+
+		prov := provider.Load(cfg.Dir, cfg.Type)
+		if prov == nil {
+			return apierror.BackendUnavailable(nil, "failed to open directory %s for provider configured at %s", cfg.Dir, cfg.DeclRange)
+		}
+
+		pkg, err := prov.Package(v, platform)
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to get package for version %s of %s", v, cfg.DeclRange)
+		}
+		if pkg == nil {
+			return apierror.NotFound()
+		}
+
+		key, err := provider.ReadSigningKey(cfg.GPGKeyFile)
+		if err != nil {
+			return apierror.Internal(err, "failed to read signing key for %s", cfg.DeclRange)
+		}
+
+		protocols := pkg.Protocols
+		if protocols == nil {
+			protocols = cfg.Protocols
+		}
+
+		// The URLs here are relative to this endpoint, and so resolve to
+		// the "files" endpoint below.
+		ret := &apiPackage{
+			Protocols:           protocols,
+			OS:                  platform.OS,
+			Arch:                platform.Arch,
+			Filename:            pkg.Filename,
+			DownloadURL:         "../../files/" + pkg.Filename,
+			SHASumsURL:          "../../files/" + pkg.SHA256SumsFilename,
+			SHASumsSignatureURL: "../../files/" + pkg.SHA256SumsSigFilename,
+			SHASum:              pkg.Shasum,
+			SigningKeys: apiSigningKeys{
+				GPGPublicKeys: []apiGPGPublicKey{
+					{
+						KeyID:      key.KeyID,
+						ASCIIArmor: key.ASCIIArmor,
+					},
+				},
+			},
+		}
+		buf, err := json.MarshalIndent(ret, "", "  ")
+		if err != nil {
+			return apierror.Internal(err, "failed to encode response as JSON")
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(buf)
+		return nil
+	}))))
+
+	ret.HandleFunc("/{namespace}/{type}/{version}/files/{filename}", validateVars(apierror.Handler(func(wr http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		namespace := vars["namespace"]
+		typeName := vars["type"]
+		filename := vars["filename"]
+
+		cfg := providers.Get(namespace, typeName)
+		if cfg == nil {
+			return apierror.NotFound()
+		}
+
+		prov := provider.Load(cfg.Dir, cfg.Type)
+		if prov == nil {
+			return apierror.BackendUnavailable(nil, "failed to open directory %s for provider configured at %s", cfg.Dir, cfg.DeclRange)
+		}
+
+		f, err := prov.OpenFile(filename)
+		if err != nil {
+			return apierror.NotFound()
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return apierror.BackendUnavailable(err, "failed to stat %s for %s", filename, cfg.DeclRange)
+		}
+
+		http.ServeContent(wr, req, filename, info.ModTime(), f)
+		return nil
+	})))
+
+	return ret
+}
+
+type apiVersionsResponse struct {
+	Versions []apiVersion `json:"versions"`
+}
+
+type apiVersion struct {
+	Version   string        `json:"version"`
+	Protocols []string      `json:"protocols"`
+	Platforms []apiPlatform `json:"platforms"`
+}
+
+type apiPlatform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+type apiPackage struct {
+	Protocols           []string       `json:"protocols"`
+	OS                  string         `json:"os"`
+	Arch                string         `json:"arch"`
+	Filename            string         `json:"filename"`
+	DownloadURL         string         `json:"download_url"`
+	SHASumsURL          string         `json:"shasums_url"`
+	SHASumsSignatureURL string         `json:"shasums_signature_url"`
+	SHASum              string         `json:"shasum"`
+	SigningKeys         apiSigningKeys `json:"signing_keys"`
+}
+
+type apiSigningKeys struct {
+	GPGPublicKeys []apiGPGPublicKey `json:"gpg_public_keys"`
+}
+
+type apiGPGPublicKey struct {
+	KeyID      string `json:"key_id"`
+	ASCIIArmor string `json:"ascii_armor"`
+}
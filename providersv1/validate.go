@@ -0,0 +1,31 @@
+package providersv1
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/pathvars"
+)
+
+var (
+	platformPattern = regexp.MustCompile(`^[0-9a-z_]{1,32}$`)
+	filenamePattern = regexp.MustCompile(`^[0-9A-Za-z_][0-9A-Za-z._+-]{0,254}$`)
+)
+
+// routeVarValidators gives a validator for each of the variables used in
+// the route patterns in NewHandler.
+var routeVarValidators = pathvars.Validators{
+	"namespace": pathvars.Valid(config.ValidIdentifier),
+	"type":      pathvars.Valid(config.ValidIdentifier),
+	"version":   pathvars.Version,
+	"os":        pathvars.Valid(platformPattern.MatchString),
+	"arch":      pathvars.Valid(platformPattern.MatchString),
+	"filename":  pathvars.Valid(filenamePattern.MatchString),
+}
+
+// validateVars wraps the given handler function so that it responds with
+// 400 Bad Request if any of the route variables are invalid.
+func validateVars(fn http.HandlerFunc) http.HandlerFunc {
+	return routeVarValidators.Wrap(fn)
+}
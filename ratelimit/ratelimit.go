@@ -0,0 +1,85 @@
+// Package ratelimit limits the rate at which each client can make requests,
+// using a token bucket for each, so that one misbehaving client can't
+// degrade the registry's servers for everyone else.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled are discarded,
+// since a full bucket is the same as one that doesn't exist yet.
+const sweepInterval = time.Minute
+
+// Limiter allows each key up to Burst requests at once, refilled at Rate
+// requests per second.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter that allows the given number of requests per second
+// for each key, with bursts of up to the given size.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow returns true if a request for the given key is allowed at the given
+// time, counting it if so. Otherwise, it returns false and how long the
+// client should wait before a request would be allowed.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.rate, l.burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+	return false, wait
+}
+
+// sweep discards the buckets that would be full at the given time. The
+// caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now, l.rate, l.burst)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
@@ -0,0 +1,71 @@
+// Package requestid gives each request that the registry's servers handle
+// an ID, which is returned to the client and included in the server's logs
+// so that the two can be correlated.
+//
+// A request that already has an ID, such as one assigned by a reverse proxy
+// in front of the server, keeps it, so that the proxy's logs can be
+// correlated too.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header is the name of the request and response header that carries the
+// request ID.
+const Header = "X-Request-ID"
+
+// maxLength is the length of the longest request ID that is accepted from a
+// client. Longer ones are replaced, as are any containing characters other
+// than printable ASCII, so that they can't disrupt the logs.
+const maxLength = 200
+
+// Handler returns a handler that assigns an ID to each request, sets it in
+// the response header, and then passes the request to the given handler,
+// which can retrieve the ID with Get.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(Header)
+		if !valid(id) {
+			id = generate()
+		}
+		wr.Header().Set(Header, id)
+		req = req.WithContext(context.WithValue(req.Context(), idKey{}, id))
+		next.ServeHTTP(wr, req)
+	})
+}
+
+type idKey struct{}
+
+// Get returns the ID of the given request, or an empty string if it wasn't
+// served through Handler.
+func Get(req *http.Request) string {
+	id, _ := req.Context().Value(idKey{}).(string)
+	return id
+}
+
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// generate returns a new random request ID.
+func generate() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// Should never happen, but an ID is only for correlating logs, so
+		// it's no reason to fail a request.
+		return "unknown"
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"os"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+	"github.com/apparentlymart/terraform-simple-registry/worker"
+)
+
+// WorkerCommand is the subcommand that a server program must dispatch to
+// worker.Main in order to support the "archive_workers" setting.
+const WorkerCommand = "archive-worker"
+
+// NewArchiver returns the module archiver selected by the given settings.
+// If archive workers are enabled, the workers are started by re-running the
+// current program with WorkerCommand.
+func NewArchiver(settings *config.ModuleSettings) (modulesv1.Archiver, error) {
+	archiver := modulesv1.LocalArchiver()
+	if settings.ArchiveWorkers != 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		archiver, err = worker.NewPool(settings.ArchiveWorkers, exe, WorkerCommand)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.ArchiveConcurrency != 0 {
+		// The limit applies only to generating archives, so archives in
+		// the cache can always be served.
+		archiver = modulesv1.LimitArchiver(archiver, settings.ArchiveConcurrency, settings.ArchiveQueueTimeout)
+	}
+
+	if cache := settings.ArchiveCache; cache != nil {
+		return modulesv1.NewCachingArchiver(archiver, cache.Dir, cache.MaxSize)
+	}
+	return archiver, nil
+}
+
+// VerifyArchives checks the given archiver's cached archives for corruption
+// in the background after each interval given in the settings, if there is
+// an archive cache and it sets "verify_interval".
+func VerifyArchives(archiver modulesv1.Archiver, settings *config.ModuleSettings) {
+	cache, ok := archiver.(modulesv1.ArchiveCache)
+	if !ok || settings.ArchiveCache == nil || settings.ArchiveCache.VerifyInterval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(settings.ArchiveCache.VerifyInterval)
+		for range ticker.C {
+			start := time.Now()
+			checked, corrupt := cache.VerifyArchives()
+			logging.Infof("verified %d cached archives in %s; %d were corrupt", checked, time.Since(start), corrupt)
+		}
+	}()
+}
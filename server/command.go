@@ -0,0 +1,104 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/apparentlymart/terraform-simple-registry/buildinfo"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+)
+
+// Main is the main function of the server program with the given name. If
+// the first command line argument names one of the given subcommands, which
+// may be nil, the subcommand is run with the remaining arguments. Otherwise,
+// the flags are parsed and run is called with the remaining arguments, which
+// are the configuration paths. Main exits with the status that either
+// returns.
+func Main(name string, commands map[string]func(args []string) int, run func(args []string) int) {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	showVersion := flag.Bool("version", false, "print the version of the server and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("%s %s\n", name, buildinfo.Get())
+		os.Exit(0)
+	}
+
+	os.Exit(run(flag.Args()))
+}
+
+// LoadConfig parses the configuration files and directories at the given
+// paths and passes the result to decode, as for DecodeConfig, writing any
+// diagnostics to stderr. It returns false if there were any errors.
+func LoadConfig(args []string, decode func(parser *hclparse.Parser, body hcl.Body) hcl.Diagnostics) bool {
+	parser := hclparse.NewParser()
+	diagW := NewDiagWriter(parser.Files())
+
+	diags := DecodeConfig(parser, args, decode)
+	diagW.WriteDiagnostics(diags)
+	return !diags.HasErrors()
+}
+
+// DecodeConfig parses the configuration files and directories at the given
+// paths with the given parser, and then passes the resulting body to decode
+// unless there were parse errors. It returns the diagnostics of both.
+func DecodeConfig(parser *hclparse.Parser, args []string, decode func(parser *hclparse.Parser, body hcl.Body) hcl.Diagnostics) hcl.Diagnostics {
+	body, diags := config.ParseFiles(parser, args)
+
+	// Abort early if we had parse errors, since that means the bodies we loaded
+	// are probably incomplete and may produce further errors on decoding.
+	if diags.HasErrors() {
+		return diags
+	}
+
+	return append(diags, decode(parser, body)...)
+}
+
+// NewDiagWriter returns a writer that writes diagnostics about the given
+// files to stderr, wrapped to the width of the terminal if stderr is one.
+func NewDiagWriter(files map[string]*hcl.File) hcl.DiagnosticWriter {
+	if !terminal.IsTerminal(2) {
+		return hcl.NewDiagnosticTextWriter(os.Stderr, files, 80, false)
+	}
+
+	wid, _, err := terminal.GetSize(2)
+	if err != nil {
+		wid = 80
+	}
+
+	return hcl.NewDiagnosticTextWriter(os.Stderr, files, uint(wid), true)
+}
+
+// ReloadOnSignal waits for SIGHUP and then calls reload, which should load
+// the configuration again and apply it, returning false if the new
+// configuration is invalid and so the previous one remains in effect.
+//
+// The listeners' TLS certificates are read again before reload is called,
+// even if the configuration turns out to be invalid, and systemd is told
+// that the server is ready again once the given listener groups, which
+// reload may update, have tried to listen on all of their listeners.
+func ReloadOnSignal(reload func() bool, groups ...*config.ListenerGroup) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logging.Infof("reloading configuration")
+		NotifyReloading()
+		config.ReloadCertificates()
+		if !reload() {
+			logging.Errorf("invalid configuration; continuing to use the previous configuration")
+		}
+		NotifyReady(groups...)
+	}
+}
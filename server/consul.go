@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// consulRetryInterval is how long to wait before retrying a failed
+// registration with the Consul agent.
+const consulRetryInterval = 10 * time.Second
+
+// RegisterConsul registers the server as a service with the Consul agent
+// described by the given configuration, and deregisters it again when the
+// server exits. It does nothing if cfg is nil.
+//
+// Registration happens in the background, retrying until it succeeds, so
+// that the server can start before the agent is available. The service's
+// health check is run by the agent, which therefore only offers the server
+// to other services once the check passes.
+func RegisterConsul(cfg *config.Consul, settings *config.ModuleSettings) {
+	if cfg == nil {
+		return
+	}
+
+	client, err := modulesv1.OutboundClient(settings.OutboundTLS, settings.OutboundProxy)
+	if err != nil {
+		logging.Errorf("failed to register with Consul: %s", err)
+		return
+	}
+
+	// The agent expects durations as Go duration strings.
+	body, err := json.Marshal(map[string]interface{}{
+		"ID":      cfg.ServiceID,
+		"Name":    cfg.ServiceName,
+		"Tags":    cfg.Tags,
+		"Address": cfg.ServiceAddress,
+		"Port":    cfg.ServicePort,
+		"Check": map[string]interface{}{
+			"HTTP":                           cfg.CheckURL,
+			"Interval":                       cfg.CheckInterval.String(),
+			"Timeout":                        cfg.CheckTimeout.String(),
+			"DeregisterCriticalServiceAfter": cfg.DeregisterAfter.String(),
+		},
+	})
+	if err != nil {
+		logging.Errorf("failed to register with Consul: %s", err)
+		return
+	}
+
+	go func() {
+		for {
+			err := consulRequest(client, cfg, "/v1/agent/service/register", body)
+			if err == nil {
+				break
+			}
+			logging.Warnf("failed to register with Consul: %s; retrying in %s", err, consulRetryInterval)
+			time.Sleep(consulRetryInterval)
+		}
+		logging.Infof("registered with Consul: service=%s id=%s", cfg.ServiceName, cfg.ServiceID)
+	}()
+
+	AtExit(func() {
+		err := consulRequest(client, cfg, "/v1/agent/service/deregister/"+cfg.ServiceID, nil)
+		if err != nil {
+			logging.Errorf("failed to deregister from Consul: %s", err)
+			return
+		}
+		logging.Infof("deregistered from Consul: id=%s", cfg.ServiceID)
+	})
+}
+
+// consulRequest makes a PUT request to the given path of the agent's API.
+func consulRequest(client *http.Client, cfg *config.Consul, path string, body []byte) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(cfg.Address, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", cfg.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// CORS returns a handler that allows scripts on the origins described by the
+// given configuration to call the given handler, answering preflight
+// requests itself. If cfg is nil, it returns the given handler unchanged.
+//
+// Requests from other origins are passed on without any CORS headers, and so
+// browsers won't let their scripts read the responses.
+func CORS(cfg *config.CORS, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	logging.Infof("cors: allowed_origins=%s allow_credentials=%t", strings.Join(cfg.AllowedOrigins, ","), cfg.AllowCredentials)
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(wr, req)
+			return
+		}
+
+		// The response depends on the origin whether or not it is allowed,
+		// so caches must not serve it for requests from other origins.
+		h := wr.Header()
+		h.Add("Vary", "Origin")
+		if !corsOriginAllowed(cfg.AllowedOrigins, origin) {
+			next.ServeHTTP(wr, req)
+			return
+		}
+
+		if allowAll(cfg.AllowedOrigins) && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", methods)
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if cfg.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			wr.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if exposed != "" {
+			h.Set("Access-Control-Expose-Headers", exposed)
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+// corsOriginAllowed returns true if the given origin matches one of the
+// allowed origins, as validated by the config package.
+func corsOriginAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*", pattern == origin:
+			return true
+		case strings.Contains(pattern, "://*."):
+			// A wildcard matches any subdomain, but not the domain itself.
+			prefix := pattern[:strings.Index(pattern, "*")]
+			suffix := pattern[len(prefix)+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) && len(origin) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func allowAll(allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
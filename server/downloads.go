@@ -0,0 +1,43 @@
+package server
+
+import (
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// downloadsSaveInterval is how often the download counts are saved, so that
+// few are lost if the process exits without being asked to.
+const downloadsSaveInterval = time.Minute
+
+// PersistDownloads loads the download counts of the modules from the given
+// file, if it exists, and then saves them to it periodically and when the
+// process is asked to exit with SIGINT or SIGTERM.
+//
+// Unlike the index, the counts can't be rebuilt, so an error loading them is
+// returned rather than allowing them to be overwritten.
+func PersistDownloads(modules *modulesv1.ModuleSet, filename string) error {
+	if err := modules.LoadDownloads(filename); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(downloadsSaveInterval) {
+			saveDownloads(modules, filename)
+		}
+	}()
+
+	AtExit(func() {
+		logging.Infof("saving download counts before exiting")
+		saveDownloads(modules, filename)
+	})
+	return nil
+}
+
+func saveDownloads(modules *modulesv1.ModuleSet, filename string) {
+	err := modules.SaveDownloads(filename)
+	if err != nil {
+		logging.Errorf("failed to save download counts: %s", err)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+var exitHooks struct {
+	sync.Mutex
+	fns     []func()
+	started bool
+}
+
+// AtExit arranges for the given function to be called when the process is
+// asked to exit with SIGINT or SIGTERM, before it exits. The functions are
+// called in the reverse of the order in which they were registered.
+func AtExit(fn func()) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+
+	exitHooks.fns = append(exitHooks.fns, fn)
+	if exitHooks.started {
+		return
+	}
+	exitHooks.started = true
+
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-ch
+		logging.Infof("received %s; exiting", sig)
+		go func() {
+			// A second signal means that whoever sent it doesn't want to
+			// wait for the exit hooks, such as listeners draining.
+			sig := <-ch
+			logging.Infof("received %s again; exiting immediately", sig)
+			os.Exit(1)
+		}()
+
+		exitHooks.Lock()
+		fns := exitHooks.fns
+		exitHooks.Unlock()
+		for i := len(fns) - 1; i >= 0; i-- {
+			fns[i]()
+		}
+		os.Exit(0)
+	}()
+}
+
+// ShutdownListeners arranges for the given listener groups to stop
+// listening when the process is asked to exit, waiting for the requests in
+// progress on them to complete, up to their drain timeout, before the exit
+// hooks registered before it are called.
+func ShutdownListeners(groups ...*config.ListenerGroup) {
+	AtExit(func() {
+		logging.Infof("waiting for requests in progress to complete")
+		var wg sync.WaitGroup
+		for _, g := range groups {
+			wg.Add(1)
+			go func(g *config.ListenerGroup) {
+				defer wg.Done()
+				g.Shutdown()
+			}(g)
+		}
+		wg.Wait()
+	})
+}
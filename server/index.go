@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// PersistIndex loads the index of module versions from the given file, if
+// it exists, and then revalidates it in the background. The index is saved
+// again once revalidation is complete, and when the process is asked to
+// exit with SIGINT or SIGTERM, after which it exits.
+func PersistIndex(modules *modulesv1.ModuleSet, filename string) {
+	err := modules.LoadIndex(filename)
+	if err != nil {
+		// The index is only an optimization, so we can continue without it.
+		logging.Warnf("failed to load index: %s", err)
+	}
+
+	go func() {
+		modules.Revalidate()
+		saveIndex(modules, filename)
+	}()
+
+	AtExit(func() {
+		logging.Infof("saving index before exiting")
+		saveIndex(modules, filename)
+	})
+}
+
+func saveIndex(modules *modulesv1.ModuleSet, filename string) {
+	err := modules.SaveIndex(filename)
+	if err != nil {
+		logging.Errorf("failed to save index: %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// ConfigureLog sets the level and destination of the server's log from the
+// given configuration, which may be nil to keep logging at the info level
+// to stderr.
+func ConfigureLog(cfg *config.Log) error {
+	SetLogLevel(cfg)
+	if cfg == nil {
+		return nil
+	}
+
+	switch {
+	case cfg.Syslog != nil:
+		s, err := logging.NewSyslogSink(cfg.Syslog.Network, cfg.Syslog.Address, cfg.Syslog.Facility, logTag(cfg.Syslog.Tag))
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %s", err)
+		}
+		logging.SetSink(s)
+		return nil
+	case cfg.Journald != nil:
+		s, err := logging.NewJournaldSink(logTag(cfg.Journald.Tag))
+		if err != nil {
+			return fmt.Errorf("failed to connect to the systemd journal: %s", err)
+		}
+		logging.SetSink(s)
+		return nil
+	case cfg.File == "":
+		return nil
+	}
+
+	f, err := logging.OpenRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %s", err)
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+// SetLogLevel sets the level of the server's log from the given
+// configuration, or to the info level if it is nil. Unlike its destination,
+// the level of the log can be changed when the configuration is reloaded.
+func SetLogLevel(cfg *config.Log) {
+	if cfg == nil {
+		logging.SetLevel(logging.Info)
+		return
+	}
+	logging.SetLevel(cfg.Level)
+}
+
+// logTag returns the given syslog tag, or the name of the program if it is
+// empty.
+func logTag(tag string) string {
+	if tag == "" {
+		return filepath.Base(os.Args[0])
+	}
+	return tag
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+)
+
+// UpdateMirrors updates the git mirrors of the given modules in the
+// background, and then again after each given interval if it is not zero.
+func UpdateMirrors(modules *modulesv1.ModuleSet, interval time.Duration) {
+	go func() {
+		modules.UpdateMirrors()
+		if interval == 0 {
+			return
+		}
+
+		// If an update takes longer than the interval then the ticker
+		// drops the ticks it misses, so updates never pile up.
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			modules.UpdateMirrors()
+		}
+	}()
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/buildinfo"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+	"github.com/hashicorp/hcl2/hcl"
+	"github.com/hashicorp/hcl2/hclparse"
+	"github.com/hashicorp/terraform/svchost"
+)
+
+// ModulesServer starts and reloads a server that serves modules, either
+// alone, as for the modules server, or alongside other services, as for the
+// combined registry server. Create one with NewModulesServer.
+type ModulesServer struct {
+	// Strict is whether to refuse to load a configuration with modules
+	// whose sources are missing, as if the configuration set "strict". It
+	// is set by the -strict flag.
+	Strict bool
+
+	decode   func(body hcl.Body) (*config.RegistryConfig, hcl.Diagnostics)
+	services func(cfg *config.RegistryConfig, modules http.Handler) http.Handler
+}
+
+// NewModulesServer returns a modules server whose configuration is decoded
+// by the given function, and registers its -strict flag.
+//
+// The given services function returns the handler for the requests under
+// the base path, given the handler for the modules of every hostname. If it
+// is nil, the modules are served directly under the base path.
+func NewModulesServer(decode func(body hcl.Body) (*config.RegistryConfig, hcl.Diagnostics), services func(cfg *config.RegistryConfig, modules http.Handler) http.Handler) *ModulesServer {
+	s := &ModulesServer{
+		decode:   decode,
+		services: services,
+	}
+	flag.BoolVar(&s.Strict, "strict", false, "refuse to start if the git repository or archive directory of any module is missing or unreadable")
+	return s
+}
+
+// LoadConfig parses and decodes the configuration files and directories at
+// the given paths, along with the modules file that they name, if any,
+// writing any diagnostics to stderr. It returns nil if there were any
+// errors.
+func (s *ModulesServer) LoadConfig(args []string) *config.RegistryConfig {
+	var cfg *config.RegistryConfig
+	ok := LoadConfig(args, func(parser *hclparse.Parser, body hcl.Body) hcl.Diagnostics {
+		var diags hcl.Diagnostics
+		cfg, diags = s.decodeConfig(parser, body, nil)
+		return diags
+	})
+	if !ok {
+		return nil
+	}
+
+	return cfg
+}
+
+// decodeConfig decodes the given configuration body, along with the modules
+// file that it names, if any. If modulesFile isn't nil then it is used in
+// place of the contents of the modules file.
+func (s *ModulesServer) decodeConfig(parser *hclparse.Parser, body hcl.Body, modulesFile []byte) (*config.RegistryConfig, hcl.Diagnostics) {
+	cfg, diags := s.decode(body)
+	if !diags.HasErrors() && cfg.Admin != nil && cfg.Admin.ModulesFile != "" {
+		diags = append(diags, config.LoadModulesFile(parser, cfg.Admin.ModulesFile, modulesFile, cfg.Modules, cfg.ModuleSettings)...)
+	}
+	if !diags.HasErrors() && (cfg.Strict || s.Strict) {
+		diags = append(diags, modulesv1.CheckSources(cfg.Modules)...)
+		for _, vhost := range cfg.VirtualHosts {
+			diags = append(diags, modulesv1.CheckSources(vhost.Modules)...)
+		}
+	}
+
+	return cfg, diags
+}
+
+// Run runs the server with the configuration at the given paths until the
+// process exits, returning the exit status if the server fails to start.
+func (s *ModulesServer) Run(args []string) int {
+	cfg := s.LoadConfig(args)
+	if cfg == nil {
+		return 1
+	}
+	if err := ConfigureLog(cfg.Log); err != nil {
+		logging.Errorf("%s", err)
+		return 1
+	}
+
+	logging.Infof("build: %s", buildinfo.Get().LogFields())
+	LogSummary(cfg.Hostname, cfg.Modules, cfg.Providers, &cfg.ModuleSettings)
+	for hostname, vhost := range cfg.VirtualHosts {
+		LogSummary(hostname, vhost.Modules, nil, nil)
+	}
+
+	archiver, err := NewArchiver(&cfg.ModuleSettings)
+	if err != nil {
+		logging.Errorf("failed to start archive workers: %s", err)
+		return 1
+	}
+
+	modules := modulesv1.NewModuleSet(cfg.Modules, cfg.VersionCacheTTL)
+	if cfg.Admin != nil && cfg.Admin.AuditLog != "" {
+		err := modules.LoadAuditLog(cfg.Admin.AuditLog)
+		if err != nil {
+			logging.Errorf("failed to load audit log: %s", err)
+			return 1
+		}
+	}
+	if err := persistModules(modules, &cfg.ModulesConfig, ""); err != nil {
+		logging.Errorf("%s", err)
+		return 1
+	}
+
+	// Each virtual host has a module set of its own, but its index and
+	// download counts are kept in files named after those of the main
+	// hostname.
+	vhosts := make(map[svchost.Hostname]*modulesv1.ModuleSet)
+	vhostHandlers := make(map[svchost.Hostname]http.Handler)
+	for hostname, vhost := range cfg.VirtualHosts {
+		vhostModules := modulesv1.NewModuleSet(vhost.Modules, cfg.VersionCacheTTL)
+		if err := persistModules(vhostModules, &cfg.ModulesConfig, "."+hostname.String()); err != nil {
+			logging.Errorf("%s", err)
+			return 1
+		}
+		vhosts[hostname] = vhostModules
+		vhostHandlers[hostname] = modulesv1.NewWebhookHandler(vhostModules, cfg.Webhooks, modulesv1.NewPublishHandler(vhostModules, cfg.Publish, modulesv1.NewHandler(hostname, vhostModules, archiver, AuthWrapper(cfg.Auth))))
+	}
+	VerifyArchives(archiver, &cfg.ModuleSettings)
+	StartTracing(cfg.Tracing, &cfg.ModuleSettings)
+	upstreamClient, err := NewUpstreamClient(&cfg.ModuleSettings)
+	if err != nil {
+		logging.Errorf("%s", err)
+		return 1
+	}
+
+	// Only the main hostname proxies to the upstream registry, since
+	// virtual hosts exist to serve their own modules.
+	authed := AuthWrapper(cfg.Auth)
+	services := VirtualHosts(vhostHandlers, modulesv1.NewWebhookHandler(modules, cfg.Webhooks, modulesv1.NewPublishHandler(modules, cfg.Publish, modulesv1.NewProxyHandler(cfg.Hostname, modules, cfg.Proxy, upstreamClient, authed, modulesv1.NewHandler(cfg.Hostname, modules, archiver, authed)))))
+	if s.services != nil {
+		services = s.services(cfg, services)
+	}
+	handler := SecurityHeaders(cfg.SecurityHeaders, CORS(cfg.CORS, RateLimit(cfg.RateLimit, NewHandler(cfg.BasePath, cfg.Discovery, cfg.Login, services))))
+	listeners := config.NewListenerGroup(handler, cfg.DrainTimeout)
+	adminHandler := SecurityHeaders(cfg.SecurityHeaders, modulesv1.NewAdminHandler(modules, archiver, cfg.Admin, listeners, s.newModulesFile(args, cfg)))
+	adminListeners := config.NewListenerGroup(adminHandler, cfg.DrainTimeout)
+	if cfg.Admin != nil {
+		adminListeners.Update(cfg.Admin.Listeners)
+	}
+	go ReloadOnSignal(func() bool {
+		return s.reload(args, modules, vhosts, listeners, adminListeners)
+	}, listeners, adminListeners)
+	ShutdownListeners(listeners, adminListeners)
+
+	RegisterConsul(cfg.Consul, &cfg.ModuleSettings)
+	listeners.Update(cfg.Listeners)
+	NotifySystemd(listeners, adminListeners)
+
+	// The listeners serve in the background until the process exits.
+	select {}
+}
+
+// persistModules loads the index and download counts of the given module
+// set from the files named in the given configuration, with the given
+// suffix, and keeps them up to date, and starts updating the mirrors of its
+// modules.
+func persistModules(modules *modulesv1.ModuleSet, cfg *config.ModulesConfig, suffix string) error {
+	if cfg.IndexFile != "" {
+		PersistIndex(modules, cfg.IndexFile+suffix)
+	}
+	if cfg.DownloadsFile != "" {
+		if err := PersistDownloads(modules, cfg.DownloadsFile+suffix); err != nil {
+			return fmt.Errorf("failed to load download counts: %s", err)
+		}
+	}
+	UpdateMirrors(modules, cfg.GitFetchInterval)
+	return nil
+}
+
+// reload loads the configuration from the given paths again, updating the
+// given module sets and listener groups accordingly, and returns false if
+// the new configuration is invalid.
+//
+// Only the module declarations, the listeners and the log level are
+// reloaded, so other changes to the configuration, including adding registry
+// blocks, require a restart.
+func (s *ModulesServer) reload(args []string, modules *modulesv1.ModuleSet, vhosts map[svchost.Hostname]*modulesv1.ModuleSet, listeners, adminListeners *config.ListenerGroup) bool {
+	cfg := s.LoadConfig(args)
+	if cfg == nil {
+		return false
+	}
+	SetLogLevel(cfg.Log)
+	modules.Update(cfg.Modules, cfg.OrphanGracePeriod)
+	go modules.UpdateMirrors()
+	for hostname, vhostModules := range vhosts {
+		vhostModulesCfg := make(config.Modules)
+		if vhost := cfg.VirtualHosts[hostname]; vhost != nil {
+			vhostModulesCfg = vhost.Modules
+		} else {
+			logging.Warnf("registry block for %s was removed; its modules are no longer served", hostname.ForDisplay())
+		}
+		vhostModules.Update(vhostModulesCfg, cfg.OrphanGracePeriod)
+		go vhostModules.UpdateMirrors()
+	}
+	for hostname := range cfg.VirtualHosts {
+		if vhosts[hostname] == nil {
+			logging.Warnf("registry block for %s was added; restart the server to serve it", hostname.ForDisplay())
+		}
+	}
+
+	listeners.Update(cfg.Listeners)
+	if cfg.Admin != nil {
+		adminListeners.Update(cfg.Admin.Listeners)
+	} else {
+		adminListeners.Update(nil)
+	}
+	return true
+}
+
+// newModulesFile returns the modules file named by the given configuration,
+// which was loaded from the given paths, or nil if it names none. Changes to
+// the file are checked by loading the whole configuration again.
+func (s *ModulesServer) newModulesFile(args []string, cfg *config.RegistryConfig) *modulesv1.ModulesFile {
+	if cfg.Admin == nil || cfg.Admin.ModulesFile == "" {
+		return nil
+	}
+
+	return &modulesv1.ModulesFile{
+		Filename: cfg.Admin.ModulesFile,
+		Load: func(contents []byte) (config.Modules, *config.ModuleSettings, error) {
+			var cfg *config.RegistryConfig
+			parser := hclparse.NewParser()
+			diags := DecodeConfig(parser, args, func(parser *hclparse.Parser, body hcl.Body) hcl.Diagnostics {
+				var diags hcl.Diagnostics
+				cfg, diags = s.decodeConfig(parser, body, contents)
+				return diags
+			})
+			if diags.HasErrors() {
+				var buf bytes.Buffer
+				hcl.NewDiagnosticTextWriter(&buf, parser.Files(), 0, false).WriteDiagnostics(diags)
+				return nil, nil, errors.New(strings.TrimSpace(buf.String()))
+			}
+			return cfg.Modules, &cfg.ModuleSettings, nil
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/auth"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/ratelimit"
+)
+
+// RateLimit returns a handler that passes requests to the given handler
+// until their client exceeds the rate limit described by the given
+// configuration, after which it responds with 429 Too Many Requests. If cfg
+// is nil, it returns the given handler unchanged.
+func RateLimit(cfg *config.RateLimit, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	limiter := ratelimit.New(cfg.RequestsPerSecond, cfg.Burst)
+	logging.Infof("rate limiting: requests_per_second=%g burst=%d key=%s", cfg.RequestsPerSecond, cfg.Burst, cfg.Key)
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		ok, wait := limiter.Allow(rateLimitKey(cfg.Key, req), time.Now())
+		if !ok {
+			wr.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apierror.Write(wr, req, apierror.TooManyRequests())
+			return
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+// rateLimitKey returns the key of the bucket that the given request counts
+// against. Requests without a token are limited by client IP address even
+// when limiting by token, so that anonymous clients don't share a bucket.
+func rateLimitKey(key string, req *http.Request) string {
+	if key == config.RateLimitByToken {
+		if token := auth.BearerToken(req); token != "" {
+			// Only a hash of the token is kept, as for the configured
+			// tokens themselves.
+			hash := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(hash[:])
+		}
+	}
+
+	// The address is already the client's rather than a proxy's if the
+	// listener trusts the proxy that the request came through.
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/forwarded"
+)
+
+// SecurityHeaders returns a handler that adds the headers described by the
+// given configuration to every response of the given handler. If cfg is nil,
+// it returns the given handler unchanged.
+func SecurityHeaders(cfg *config.SecurityHeaders, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+
+	hsts := fmt.Sprintf("max-age=%d", int64(cfg.HSTSMaxAge.Seconds()))
+	if cfg.HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	if cfg.HSTSPreload {
+		hsts += "; preload"
+	}
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		h := wr.Header()
+		for name, value := range cfg.Headers {
+			h.Set(name, value)
+		}
+
+		// Browsers ignore the header on plain HTTP responses, since an
+		// attacker could have added it, so it's sent only over HTTPS. The
+		// scheme is the client's if the request came through a trusted
+		// proxy.
+		if forwarded.Scheme(req) == "https" {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
@@ -0,0 +1,108 @@
+// Package server contains the parts of the registry servers that are not
+// specific to any one registry service, such as the service discovery
+// document and the login.v1 service, along with helpers for composing them
+// with the handlers for the individual services.
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/apparentlymart/terraform-simple-registry/apierror"
+	"github.com/apparentlymart/terraform-simple-registry/auth"
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/login"
+)
+
+// NewHandler returns a handler that serves the discovery document and the
+// login.v1 service if configured (either may be nil), passing all other
+// requests to the given handler.
+//
+// If basePath isn't empty, the login.v1 service and the given handler are
+// served under it, with it stripped from the request paths that the given
+// handler sees. The discovery document is always at the root, since that is
+// where Terraform looks for it. A listener may serve them under a base path
+// of its own instead, as given by config.AdvertisedBasePath.
+func NewHandler(basePath string, discovery *config.Discovery, loginCfg *config.Login, next http.Handler) http.Handler {
+	services := mux.NewRouter()
+
+	// The login routes must be registered before the others, since
+	// otherwise their paths may be interpreted by the next handler as
+	// module or provider namespaces.
+	var loginServer *login.Server
+	if loginCfg != nil {
+		loginServer = login.NewServer(loginCfg.Users, loginCfg.TokenFile, loginCfg.Ports)
+		services.HandleFunc(login.AuthorizationPath, loginServer.ServeAuthorization)
+		services.HandleFunc(login.TokenPath, loginServer.ServeToken)
+	}
+	services.PathPrefix("/").Handler(next)
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		reqBasePath := config.AdvertisedBasePath(req, basePath)
+
+		// Likewise, the discovery document must be matched first.
+		if discovery != nil && req.URL.Path == "/.well-known/terraform.json" {
+			doc := make(map[string]interface{})
+			for id, loc := range discovery.Services {
+				doc[id] = rebase(loc, basePath, reqBasePath)
+			}
+			if loginServer != nil {
+				doc["login.v1"] = loginServer.DiscoveryDoc(reqBasePath)
+			}
+
+			buf, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				apierror.Write(wr, req, apierror.Internal(err, "failed to encode discovery document as JSON"))
+				return
+			}
+			wr.Header().Set("Content-Type", "application/json")
+			wr.Write(buf)
+			return
+		}
+
+		if reqBasePath == "" {
+			services.ServeHTTP(wr, req)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, reqBasePath+"/") {
+			// Requests for any other paths are for whatever else shares
+			// the host.
+			http.NotFound(wr, req)
+			return
+		}
+		http.StripPrefix(reqBasePath, services).ServeHTTP(wr, req)
+	})
+}
+
+// rebase returns the given service URL moved from under one base path to
+// another, if it is a path under the first. Other URLs, such as those of
+// services hosted elsewhere, are returned unchanged.
+func rebase(loc, from, to string) string {
+	if from == to || !strings.HasPrefix(loc, from+"/") || strings.HasPrefix(loc, "//") {
+		return loc
+	}
+	return to + strings.TrimPrefix(loc, from)
+}
+
+// AuthWrapper returns a function that wraps the handlers for any routes that
+// require authentication according to the given configuration. If the
+// configuration is nil, the returned function returns handlers unchanged.
+func AuthWrapper(cfg *config.Auth) func(http.HandlerFunc) http.HandlerFunc {
+	if cfg == nil {
+		return func(fn http.HandlerFunc) http.HandlerFunc {
+			return fn
+		}
+	}
+
+	var authn auth.Any
+	if len(cfg.Tokens) != 0 || cfg.TokenFile != "" {
+		authn = append(authn, auth.NewTokens(cfg.Tokens, cfg.TokenFile))
+	}
+	if plugin := cfg.Plugin; plugin != nil {
+		authn = append(authn, auth.NewPlugin(plugin.Command, plugin.Timeout, plugin.CacheTTL))
+	}
+	return auth.Wrap(authn)
+}
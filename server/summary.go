@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// LogSummary logs a summary of the effective configuration at startup, so
+// that operators can confirm what was actually loaded. Each line consists
+// of key=value fields so that it can be parsed by log processors.
+//
+// Any of modules, providers and settings may be nil if the server does not
+// serve the corresponding service. The listeners log their own resolved
+// addresses once they are listening.
+func LogSummary(hostname svchost.Hostname, modules config.Modules, providers config.Providers, settings *config.ModuleSettings) {
+	logging.Infof("config: hostname=%s", hostname.ForDisplay())
+
+	if modules != nil {
+		namespaces := make([]string, 0, len(modules))
+		for ns := range modules {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			count := 0
+			for _, byName := range modules[ns] {
+				count += len(byName)
+			}
+			logging.Infof("config: service=modules.v1 namespace=%s modules=%d", ns, count)
+		}
+	}
+
+	if providers != nil {
+		namespaces := make([]string, 0, len(providers))
+		for ns := range providers {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			logging.Infof("config: service=providers.v1 namespace=%s providers=%d", ns, len(providers[ns]))
+		}
+	}
+
+	if settings != nil {
+		logging.Infof("config: version_cache_ttl=%s orphan_grace_period=%s", settings.VersionCacheTTL, settings.OrphanGracePeriod)
+		if settings.GitMirrorDir != "" {
+			logging.Infof("config: git_mirror_dir=%s git_fetch_interval=%s", settings.GitMirrorDir, settings.GitFetchInterval)
+		}
+		if settings.IndexFile != "" {
+			logging.Infof("config: index_file=%s", settings.IndexFile)
+		}
+		if settings.DownloadsFile != "" {
+			logging.Infof("config: downloads_file=%s", settings.DownloadsFile)
+		}
+		if cache := settings.ArchiveCache; cache != nil {
+			logging.Infof("config: archive_cache_dir=%s archive_cache_max_size=%d archive_cache_verify_interval=%s", cache.Dir, cache.MaxSize, cache.VerifyInterval)
+		}
+	}
+}
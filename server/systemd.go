@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// NotifySystemd tells systemd that the server has started, once the given
+// listener groups have each tried to listen on all of their listeners, and
+// then sends the watchdog pings that the service's WatchdogSec asks for.
+// When the server exits, systemd is told that it is stopping before the
+// exit hooks registered before this call are run, so the listeners' drain
+// timeout should be registered first.
+//
+// This is for services with Type=notify, and does nothing if the server
+// wasn't started by systemd.
+func NotifySystemd(groups ...*config.ListenerGroup) {
+	NotifyReady(groups...)
+
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logging.Warnf("failed to start systemd watchdog: %s", err)
+	} else if interval > 0 {
+		go func() {
+			// systemd recommends pinging at half of the interval, so that
+			// a late ping doesn't cause a restart.
+			for range time.Tick(interval / 2) {
+				sdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+
+	AtExit(func() {
+		sdNotify("STOPPING=1")
+	})
+}
+
+// NotifyReady tells systemd that the server is ready, once the given
+// listener groups have each tried to listen on all of their listeners,
+// either at startup or after NotifyReloading.
+func NotifyReady(groups ...*config.ListenerGroup) {
+	bound := 0
+	for _, g := range groups {
+		g.WaitListening()
+		bound += g.Bound()
+	}
+	sdNotify(fmt.Sprintf("READY=1\nSTATUS=listening on %d addresses", bound))
+}
+
+// NotifyReloading tells systemd that the server is reloading its
+// configuration, which should be followed by NotifyReady once it has.
+func NotifyReloading() {
+	sdNotify("RELOADING=1")
+}
+
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		logging.Warnf("failed to notify systemd: %s", err)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/modulesv1"
+	"github.com/apparentlymart/terraform-simple-registry/tracing"
+)
+
+// StartTracing begins exporting traces of the requests that the server
+// handles to the collector described by the given configuration, exporting
+// any that remain when the server exits. It does nothing if cfg is nil.
+func StartTracing(cfg *config.Tracing, settings *config.ModuleSettings) {
+	if cfg == nil {
+		return
+	}
+
+	client, err := modulesv1.OutboundClient(settings.OutboundTLS, settings.OutboundProxy)
+	if err != nil {
+		logging.Errorf("failed to start tracing: %s", err)
+		return
+	}
+
+	tracing.Export(tracing.Exporter{
+		Endpoint:    cfg.Endpoint,
+		Headers:     cfg.Headers,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: cfg.SampleRatio,
+		Client:      client,
+	})
+	logging.Infof("exporting traces: endpoint=%s service=%s sample_ratio=%g", cfg.Endpoint, cfg.ServiceName, cfg.SampleRatio)
+
+	AtExit(tracing.Flush)
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/apparentlymart/terraform-simple-registry/config"
+	"github.com/apparentlymart/terraform-simple-registry/upstream"
+)
+
+// NewUpstreamClient returns a client for other registries that makes its
+// connections as described by the given settings.
+func NewUpstreamClient(settings *config.ModuleSettings) (*upstream.Client, error) {
+	tlsConfig, err := settings.OutboundTLS.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound TLS configuration at %s: %s", settings.OutboundTLS.DeclRange, err)
+	}
+	return upstream.NewClient(tlsConfig, settings.OutboundProxy.Proxy), nil
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/hashicorp/terraform/svchost"
+)
+
+// VirtualHosts returns a handler that passes each request to the handler for
+// the hostname given in its Host header, or to the given default handler if
+// there isn't one for that hostname. If there are no hosts, it returns the
+// default handler unchanged.
+func VirtualHosts(hosts map[svchost.Hostname]http.Handler, def http.Handler) http.Handler {
+	if len(hosts) == 0 {
+		return def
+	}
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		// The Host header is normalized as for the hostnames in the
+		// configuration, so that it matches regardless of case or of the
+		// default HTTPS port being given.
+		if hostname, err := svchost.ForComparison(req.Host); err == nil {
+			if next, ok := hosts[hostname]; ok {
+				next.ServeHTTP(wr, req)
+				return
+			}
+		}
+		def.ServeHTTP(wr, req)
+	})
+}
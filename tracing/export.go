@@ -0,0 +1,277 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+)
+
+// The limits on how spans are batched for export. A batch is sent once it
+// reaches exportBatchSize spans, or exportInterval after its first span.
+// Spans that end while exportQueueSize are already waiting are dropped
+// rather than slowing down the requests they describe.
+const (
+	exportBatchSize = 512
+	exportQueueSize = 4096
+	exportInterval  = 5 * time.Second
+	exportTimeout   = 10 * time.Second
+)
+
+// instrumentationName identifies the spans recorded by this package to the
+// collector.
+const instrumentationName = "github.com/apparentlymart/terraform-simple-registry/tracing"
+
+// Exporter describes where spans are exported to.
+type Exporter struct {
+	// Endpoint is the base URL of the collector's OTLP/HTTP receiver, to
+	// which "/v1/traces" is appended.
+	Endpoint string
+	Headers  map[string]string
+
+	// ServiceName is the service.name resource attribute of every span.
+	ServiceName string
+
+	// SampleRatio is the fraction of traces beginning at this server that
+	// are recorded. Traces continued from a client's traceparent header
+	// follow the client's decision instead.
+	SampleRatio float64
+
+	// Client makes the requests to the collector.
+	Client *http.Client
+}
+
+type tracer struct {
+	exp   Exporter
+	bound uint64
+	queue chan *exportedSpan
+	flush chan chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+}
+
+var current struct {
+	sync.Mutex
+	t *tracer
+}
+
+func currentTracer() *tracer {
+	current.Lock()
+	defer current.Unlock()
+	return current.t
+}
+
+// Export begins recording spans and exporting them as described by the
+// given exporter. It must be called at most once.
+func Export(exp Exporter) {
+	t := &tracer{
+		exp:   exp,
+		bound: sampleBound(exp.SampleRatio),
+		queue: make(chan *exportedSpan, exportQueueSize),
+		flush: make(chan chan struct{}),
+	}
+	go t.run()
+
+	current.Lock()
+	current.t = t
+	current.Unlock()
+}
+
+// Flush exports any spans that have ended but not yet been exported,
+// returning once they have been sent or have failed to be. It does nothing
+// if Export hasn't been called.
+func Flush() {
+	t := currentTracer()
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	t.flush <- done
+	<-done
+}
+
+func (t *tracer) sample(id traceID) bool {
+	return id.sampleValue() < t.bound
+}
+
+// export queues the given span, which has just ended at the given time.
+func (t *tracer) export(s *Span, end time.Time) {
+	s.mu.Lock()
+	span := &exportedSpan{
+		TraceID:    s.sc.trace.String(),
+		SpanID:     s.sc.span.String(),
+		Name:       s.name,
+		Kind:       s.kind,
+		StartTime:  strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:    strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: s.attrs,
+	}
+	if s.parent != (spanID{}) {
+		span.ParentSpanID = s.parent.String()
+	}
+	if s.errMsg != "" {
+		span.Status = &exportedStatus{Code: statusError, Message: s.errMsg}
+	}
+	s.mu.Unlock()
+
+	select {
+	case t.queue <- span:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// run sends the queued spans to the collector in batches, for the lifetime
+// of the process.
+func (t *tracer) run() {
+	var batch []*exportedSpan
+	timer := time.NewTimer(exportInterval)
+	timer.Stop()
+
+	send := func() {
+		if len(batch) != 0 {
+			if err := t.send(batch); err != nil {
+				logging.Warnf("failed to export %d spans: %s", len(batch), err)
+			}
+			batch = nil
+		}
+		t.mu.Lock()
+		if t.dropped != 0 {
+			logging.Warnf("dropped %d spans because the export queue was full", t.dropped)
+			t.dropped = 0
+		}
+		t.mu.Unlock()
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			if len(batch) == 0 {
+				timer.Reset(exportInterval)
+			}
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				timer.Stop()
+				send()
+			}
+		case <-timer.C:
+			send()
+		case done := <-t.flush:
+			timer.Stop()
+			for len(t.queue) != 0 {
+				batch = append(batch, <-t.queue)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// send makes a single export request for the given spans.
+func (t *tracer) send(spans []*exportedSpan) error {
+	body, err := json.Marshal(&exportRequest{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{
+					Attributes: []Attribute{String("service.name", t.exp.ServiceName)},
+				},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: scope{Name: instrumentationName},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(t.exp.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.exp.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := *t.exp.Client
+	client.Timeout = exportTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// statusError is the OTLP status code of a failed span. Other spans are
+// left with the default status, as the specification recommends.
+const statusError = 2
+
+// The remaining types are the parts of an OTLP export request, in its JSON
+// encoding, that we use.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []Attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope           `json:"scope"`
+	Spans []*exportedSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type exportedSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []Attribute     `json:"attributes,omitempty"`
+	Status       *exportedStatus `json:"status,omitempty"`
+}
+
+type exportedStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// MarshalJSON encodes the attribute as an OTLP KeyValue.
+func (a Attribute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key   string         `json:"key"`
+		Value attributeValue `json:"value"`
+	}{a.Key, a.value})
+}
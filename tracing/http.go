@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apparentlymart/terraform-simple-registry/forwarded"
+	"github.com/apparentlymart/terraform-simple-registry/requestid"
+)
+
+// traceparentHeader is the W3C Trace Context header that carries the span
+// of the client, or of a reverse proxy, that made a request.
+const traceparentHeader = "traceparent"
+
+// Handler returns a handler that records a span for each request that it
+// passes to the given handler, as a child of the span given by the
+// request's traceparent header, if any. The span is initially named for
+// the request method, and handlers that know the route that matched can
+// rename it using FromContext.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if currentTracer() == nil {
+			next.ServeHTTP(wr, req)
+			return
+		}
+
+		ctx := req.Context()
+		if sc, ok := parseTraceparent(req.Header.Get(traceparentHeader)); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, sc)
+		}
+		ctx, span := start(ctx, req.Method, kindServer, []Attribute{
+			String("http.method", req.Method),
+			String("http.scheme", forwarded.Scheme(req)),
+			String("http.target", req.URL.RequestURI()),
+			String("http.host", req.Host),
+			String("http.user_agent", req.UserAgent()),
+			String("net.peer.addr", req.RemoteAddr),
+		})
+		if span == nil {
+			next.ServeHTTP(wr, req.WithContext(ctx))
+			return
+		}
+		if id := requestid.Get(req); id != "" {
+			span.SetAttributes(String("request_id", id))
+		}
+		ctx = context.WithValue(ctx, serverSpanKey{}, span)
+
+		rec := &statusRecorder{ResponseWriter: wr, status: http.StatusOK}
+		if flusher, ok := wr.(http.Flusher); ok {
+			next.ServeHTTP(&flushingStatusRecorder{rec, flusher}, req.WithContext(ctx))
+		} else {
+			next.ServeHTTP(rec, req.WithContext(ctx))
+		}
+
+		span.SetAttributes(Int("http.status_code", int64(rec.status)))
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+		}
+		span.Finish(err)
+	})
+}
+
+// parseTraceparent parses a traceparent header value of the form
+// "00-<trace id>-<span id>-<flags>", accepting later versions as long as
+// they begin with the same fields, as the specification requires.
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	trace, err := hex.DecodeString(parts[1])
+	if err != nil || len(trace) != len(sc.trace) {
+		return sc, false
+	}
+	span, err := hex.DecodeString(parts[2])
+	if err != nil || len(span) != len(sc.span) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.trace[:], trace)
+	copy(sc.span[:], span)
+	if sc.trace == (traceID{}) || sc.span == (spanID{}) {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 != 0
+	return sc, true
+}
+
+// statusRecorder is a ResponseWriter that records the status of the
+// response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(buf []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(buf)
+}
+
+// flushingStatusRecorder is a statusRecorder for a ResponseWriter that can
+// be flushed, which the event stream relies on.
+type flushingStatusRecorder struct {
+	*statusRecorder
+	flusher http.Flusher
+}
+
+func (r *flushingStatusRecorder) Flush() {
+	r.flusher.Flush()
+}
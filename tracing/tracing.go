@@ -0,0 +1,223 @@
+// Package tracing records spans describing the work that the registry's
+// servers do for each request, and exports them to an OpenTelemetry
+// collector using the JSON encoding of OTLP over HTTP, so that slow
+// requests can be traced through the registry.
+//
+// Spans are only recorded once Export has been called. Until then, and for
+// requests that aren't sampled, Start returns a nil *Span, whose methods do
+// nothing, so that instrumented code needn't check.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span is an operation within a trace. It is exported once it ends.
+type Span struct {
+	tracer *tracer
+	sc     spanContext
+	parent spanID
+	kind   int
+	start  time.Time
+
+	mu     sync.Mutex
+	name   string
+	attrs  []Attribute
+	errMsg string
+	ended  bool
+}
+
+// The OTLP span kinds that we use.
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext identifies a span and carries the sampling decision of its
+// trace, which its children inherit.
+type spanContext struct {
+	trace   traceID
+	span    spanID
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+// Attribute is a key and value describing a span.
+type Attribute struct {
+	Key   string
+	value attributeValue
+}
+
+// attributeValue is an attribute value in the JSON encoding of OTLP, which
+// encodes 64-bit integers as strings.
+type attributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// String returns an attribute with a string value.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, value: attributeValue{StringValue: &value}}
+}
+
+// Int returns an attribute with an integer value.
+func Int(key string, value int64) Attribute {
+	s := strconv.FormatInt(value, 10)
+	return Attribute{Key: key, value: attributeValue{IntValue: &s}}
+}
+
+// Bool returns an attribute with a boolean value.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, value: attributeValue{BoolValue: &value}}
+}
+
+// Start begins a span with the given name and attributes, as a child of the
+// span in the given context if there is one, and returns a context
+// containing the new span for starting its own children.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return start(ctx, name, kindInternal, attrs)
+}
+
+func start(ctx context.Context, name string, kind int, attrs []Attribute) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent, hasParent := ctx.Value(spanContextKey{}).(spanContext)
+	if hasParent && !parent.sampled {
+		return ctx, nil
+	}
+
+	sc := spanContext{
+		trace:   parent.trace,
+		span:    newSpanID(),
+		sampled: true,
+	}
+	if !hasParent {
+		sc.trace = newTraceID()
+		if !t.sample(sc.trace) {
+			// The decision is kept in the context so that the rest of
+			// the trace isn't sampled either.
+			sc.sampled = false
+			return context.WithValue(ctx, spanContextKey{}, sc), nil
+		}
+	}
+
+	span := &Span{
+		tracer: t,
+		sc:     sc,
+		kind:   kind,
+		start:  time.Now(),
+		name:   name,
+		attrs:  append([]Attribute(nil), attrs...),
+	}
+	if hasParent {
+		span.parent = parent.span
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc), span
+}
+
+// FromContext returns the span in the given context, or nil if there is
+// none or it isn't being recorded. Only spans started by Handler can be
+// retrieved this way.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(serverSpanKey{}).(*Span)
+	return span
+}
+
+type serverSpanKey struct{}
+
+// SetName replaces the name given to the span when it started.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttributes adds the given attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// Finish ends the span, marking it as failed with the given error if it
+// isn't nil. Only the first call to Finish or End has any effect.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if err != nil {
+		s.errMsg = err.Error()
+	}
+	s.mu.Unlock()
+
+	s.tracer.export(s, time.Now())
+}
+
+// End ends the span without marking it as failed.
+func (s *Span) End() {
+	s.Finish(nil)
+}
+
+func newTraceID() traceID {
+	var ret traceID
+	rand.Read(ret[:])
+	return ret
+}
+
+func newSpanID() spanID {
+	var ret spanID
+	rand.Read(ret[:])
+	return ret
+}
+
+// sampleBound returns the value that the low 63 bits of a trace ID must be
+// below for the trace to be sampled at the given ratio. Deciding by the
+// trace ID, rather than at random, gives every server that shares the
+// ratio the same decision.
+func sampleBound(ratio float64) uint64 {
+	if ratio >= 1 {
+		return 1 << 63
+	}
+	if ratio <= 0 {
+		return 0
+	}
+	return uint64(ratio * (1 << 63))
+}
+
+func (id traceID) sampleValue() uint64 {
+	return binary.BigEndian.Uint64(id[8:]) >> 1
+}
+
+func (id traceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id spanID) String() string {
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,164 @@
+// Package upstream is a client for the protocols of other Terraform
+// registries, such as the public registry at registry.terraform.io.
+package upstream
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/svchost"
+)
+
+const (
+	discoPath        = "/.well-known/terraform.json"
+	maxDiscoDocBytes = 1 * 1024 * 1024
+	maxJSONBytes     = 16 * 1024 * 1024
+	userAgent        = "terraform-simple-registry"
+)
+
+// Client is a client for upstream registries, which caches the results of
+// service discovery for each host it interacts with.
+type Client struct {
+	http      *http.Client
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	services map[svchost.Hostname]map[string]interface{}
+}
+
+// NewClient creates a new client with a default HTTP configuration, except
+// that if tlsConfig is not nil then it is used for HTTPS connections,
+// including those made when cloning git repositories, and if proxy is not
+// nil then it selects the proxy for each HTTP request, as for the Proxy of an
+// http.Transport.
+func NewClient(tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) *Client {
+	client := &http.Client{
+		Timeout: 5 * time.Minute,
+	}
+	if tlsConfig != nil || proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		if proxy != nil {
+			transport.Proxy = proxy
+		}
+		client.Transport = transport
+	}
+
+	return &Client{
+		http:      client,
+		tlsConfig: tlsConfig,
+		services:  make(map[svchost.Hostname]map[string]interface{}),
+	}
+}
+
+// ServiceURL runs Terraform's service discovery protocol against the given
+// host and returns the absolute base URL of the given service, such as
+// "modules.v1".
+//
+// An error is returned if discovery fails or if the host does not provide
+// the requested service.
+func (c *Client) ServiceURL(host svchost.Hostname, serviceID string) (*url.URL, error) {
+	discoURL := &url.URL{
+		Scheme: "https",
+		Host:   string(host),
+		Path:   discoPath,
+	}
+
+	c.mu.Lock()
+	services, cached := c.services[host]
+	c.mu.Unlock()
+
+	if !cached {
+		err := c.getJSON(discoURL.String(), maxDiscoDocBytes, &services)
+		if err != nil {
+			return nil, fmt.Errorf("service discovery failed for %s: %s", host.ForDisplay(), err)
+		}
+		c.mu.Lock()
+		c.services[host] = services
+		c.mu.Unlock()
+	}
+
+	urlStr, ok := services[serviceID].(string)
+	if !ok {
+		return nil, fmt.Errorf("host %s does not provide %s", host.ForDisplay(), serviceID)
+	}
+	ret, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("host %s has invalid URL for %s: %s", host.ForDisplay(), serviceID, err)
+	}
+	ret = discoURL.ResolveReference(ret)
+	if ret.Scheme != "https" && ret.Scheme != "http" {
+		return nil, fmt.Errorf("host %s has invalid URL for %s: must use http or https", host.ForDisplay(), serviceID)
+	}
+	return ret, nil
+}
+
+// get makes a GET request to the given URL and returns the response if
+// it has a successful status code. The caller must close the body.
+func (c *Client) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// do makes the given request and returns the response if it has a
+// successful status code. The caller must close the body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{
+			URL:        req.URL.String(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return resp, nil
+}
+
+// StatusError is the error returned when an upstream registry responds to
+// a request with an unsuccessful status code.
+type StatusError struct {
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request to %s failed: %s", e.URL, e.Status)
+}
+
+// IsNotFound returns whether the given error is from an upstream registry
+// responding that the requested module or version doesn't exist.
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) getJSON(u string, limit int64, into interface{}) error {
+	resp, err := c.get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, into)
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultGitHubAPIURL is the base URL of the API of github.com. GitHub
+// Enterprise servers instead have theirs at "/api/v3" on their own host.
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// gitHubPageSize is the number of repositories requested in each page,
+// which is the most that GitHub allows.
+const gitHubPageSize = 100
+
+// GitHubRepo is a repository returned by GitHubRepos.
+type GitHubRepo struct {
+	Name     string `json:"name"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	Archived bool   `json:"archived"`
+}
+
+// GitHubRepos returns all of the repositories of the given GitHub
+// organization, using the API at the given base URL. If token is not empty
+// then it authenticates the requests, which allows private repositories to
+// be listed.
+//
+// If there is no organization with the given name then the repositories of
+// the user with that name are returned instead, since the two are otherwise
+// indistinguishable in repository URLs.
+func (c *Client) GitHubRepos(apiURL, owner, token string) ([]GitHubRepo, error) {
+	base := strings.TrimRight(apiURL, "/")
+	ret, err := c.gitHubRepos(fmt.Sprintf("%s/orgs/%s/repos", base, url.PathEscape(owner)), token)
+	if IsNotFound(err) {
+		ret, err = c.gitHubRepos(fmt.Sprintf("%s/users/%s/repos", base, url.PathEscape(owner)), token)
+	}
+	return ret, err
+}
+
+func (c *Client) gitHubRepos(u, token string) ([]GitHubRepo, error) {
+	var ret []GitHubRepo
+	for page := 1; ; page++ {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s?type=all&per_page=%d&page=%d", u, gitHubPageSize, page), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		if token != "" {
+			req.Header.Set("Authorization", "token "+token)
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var repos []GitHubRepo
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxJSONBytes)).Decode(&repos)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid response from %s: %s", u, err)
+		}
+
+		ret = append(ret, repos...)
+		if len(repos) < gitHubPageSize {
+			return ret, nil
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/svchost"
+
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+// ModuleVersions returns all of the versions of the given module that are
+// available from the module registry at the given host, in the order the
+// registry returned them.
+func (c *Client) ModuleVersions(host svchost.Hostname, namespace, name, provider string) ([]*version.Version, error) {
+	base, err := c.ServiceURL(host, "modules.v1")
+	if err != nil {
+		return nil, err
+	}
+
+	type respModuleVersion struct {
+		Version string `json:"version"`
+	}
+	type respModule struct {
+		Versions []respModuleVersion `json:"versions"`
+	}
+	type respContent struct {
+		Modules []respModule `json:"modules"`
+	}
+
+	u := base.ResolveReference(&url.URL{
+		Path: path.Join(namespace, name, provider, "versions"),
+	})
+	var resp respContent
+	if err := c.getJSON(u.String(), maxJSONBytes, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Modules) == 0 {
+		return nil, fmt.Errorf("registry returned no module for %s/%s/%s", namespace, name, provider)
+	}
+
+	ret := make([]*version.Version, 0, len(resp.Modules[0].Versions))
+	for _, rv := range resp.Modules[0].Versions {
+		v, err := version.NewVersion(rv.Version)
+		if err != nil {
+			return nil, fmt.Errorf("registry returned invalid version %q: %s", rv.Version, err)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// ModuleLocation asks the module registry at the given host where to find
+// the source code for the given module version, returning the location in
+// the go-getter address syntax used by Terraform.
+//
+// If the registry returns a relative URL, it is resolved against the URL
+// of the download endpoint.
+func (c *Client) ModuleLocation(host svchost.Hostname, namespace, name, provider string, v *version.Version) (string, error) {
+	base, err := c.ServiceURL(host, "modules.v1")
+	if err != nil {
+		return "", err
+	}
+
+	u := base.ResolveReference(&url.URL{
+		Path: path.Join(namespace, name, provider, v.String(), "download"),
+	})
+	resp, err := c.get(u.String())
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("X-Terraform-Get")
+	if location == "" {
+		return "", fmt.Errorf("registry did not return a location for %s/%s/%s %s", namespace, name, provider, v)
+	}
+
+	if strings.HasPrefix(location, "./") || strings.HasPrefix(location, "../") || strings.HasPrefix(location, "/") {
+		rel, err := url.Parse(location)
+		if err != nil {
+			return "", fmt.Errorf("registry returned invalid location %q: %s", location, err)
+		}
+		location = u.ResolveReference(rel).String()
+	}
+
+	return location, nil
+}
+
+// FetchModuleFiles retrieves the module source code at the given location,
+// which is given in the go-getter address syntax returned by ModuleLocation.
+//
+// Only a subset of the go-getter syntax is supported: gzipped tar archives
+// over HTTP or HTTPS, and git repositories (including the github.com
+// shorthand), each optionally with a "//" subdirectory suffix.
+func (c *Client) FetchModuleFiles(location string) ([]module.ImportFile, error) {
+	getter := ""
+	if idx := strings.Index(location, "::"); idx != -1 {
+		getter, location = location[:idx], location[idx+2:]
+	}
+	if strings.HasPrefix(location, "github.com/") {
+		getter = "git"
+		location = "https://" + location
+	}
+
+	src, subdir := splitSubdir(location)
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source location %q: %s", location, err)
+	}
+	q := u.Query()
+
+	var files []module.ImportFile
+	switch getter {
+	case "git":
+		ref := q.Get("ref")
+		q.Del("ref")
+		u.RawQuery = q.Encode()
+		files, err = module.FetchRemoteFiles(u.String(), ref, c.tlsConfig)
+	case "", "http", "https":
+		archive := q.Get("archive")
+		q.Del("archive")
+		u.RawQuery = q.Encode()
+		if archive == "" {
+			switch {
+			case strings.HasSuffix(u.Path, ".tar.gz"):
+				archive = "tar.gz"
+			case strings.HasSuffix(u.Path, ".tgz"):
+				archive = "tgz"
+			}
+		}
+		if archive != "tar.gz" && archive != "tgz" {
+			return nil, fmt.Errorf("unsupported source location %q: only gzipped tar archives are supported over HTTP", location)
+		}
+		files, err = c.fetchTarGz(u.String())
+	default:
+		return nil, fmt.Errorf("unsupported source location %q: getter %q is not supported", location, getter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subdir == "" {
+		return files, nil
+	}
+	prefix := strings.Trim(subdir, "/") + "/"
+	ret := make([]module.ImportFile, 0, len(files))
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, prefix) {
+			f.Path = f.Path[len(prefix):]
+			ret = append(ret, f)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("source location %q has no files in subdirectory %q", location, subdir)
+	}
+	return ret, nil
+}
+
+func (c *Client) fetchTarGz(u string) ([]module.ImportFile, error) {
+	resp, err := c.get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return module.ReadArchive(resp.Body)
+}
+
+// splitSubdir separates a go-getter-style "//" subdirectory suffix from
+// the given source address, in the same way as go-getter itself does.
+func splitSubdir(src string) (string, string) {
+	offset := 0
+	if idx := strings.Index(src, "://"); idx != -1 {
+		offset = idx + 3
+	}
+
+	idx := strings.Index(src[offset:], "//")
+	if idx == -1 {
+		return src, ""
+	}
+	idx += offset
+	subdir := src[idx+2:]
+	src = src[:idx]
+
+	// A query string belongs to the source, not the subdirectory.
+	if qIdx := strings.Index(subdir, "?"); qIdx != -1 {
+		src += subdir[qIdx:]
+		subdir = subdir[:qIdx]
+	}
+	return src, subdir
+}
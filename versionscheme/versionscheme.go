@@ -0,0 +1,73 @@
+// Package versionscheme implements the schemes by which the tag names or
+// archive file names of a module give its versions. It is separate from the
+// module package so that the configuration can parse versions without
+// depending on a git implementation.
+package versionscheme
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// Scheme decides which tag names, or archive file names, give the
+// versions of a module, and how those versions are ordered. The versions
+// themselves are always represented as go-version values, since that is
+// what clients expect, so each scheme maps the names it accepts into
+// version numbers that order as the scheme requires.
+type Scheme string
+
+const (
+	// Loose accepts any version number that go-version does, such
+	// as "1.2" or "1.2.3.4". This is the default.
+	Loose Scheme = "loose"
+
+	// Semver accepts only version numbers that are valid semantic
+	// versions, with exactly three parts and no leading zeros.
+	Semver Scheme = "semver"
+
+	// CalVer accepts dates and other numbers made of parts
+	// separated by dots, hyphens or underscores, such as "2023.04.01" or
+	// "2023-04-01-2", each part of which is compared numerically in turn.
+	// Parts beyond the date, such as that "2", are therefore later releases
+	// of the same date rather than prereleases. A letter following a hyphen
+	// instead starts a prerelease, as in "2023.04.01-rc1".
+	//
+	// The resulting versions use dots as separators, so "2023-04-01" is
+	// served as version 2023.4.1.
+	CalVer Scheme = "calver"
+)
+
+var (
+	semverRegexp = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+		`(-(0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*)(\.(0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*))*)?` +
+		`(\+[0-9a-zA-Z-]+(\.[0-9a-zA-Z-]+)*)?$`)
+	calverRegexp          = regexp.MustCompile(`^([0-9]+(?:[._-][0-9]+)*)(-[a-zA-Z][0-9a-zA-Z.-]*)?$`)
+	calverSeparatorRegexp = regexp.MustCompile(`[._-]`)
+)
+
+// ParseVersion returns the version that the given string represents under
+// the receiving scheme, or an error if it isn't a version number in that
+// scheme. The empty scheme is the same as Loose.
+func (s Scheme) ParseVersion(raw string) (*version.Version, error) {
+	switch s {
+	case "", Loose:
+		return version.NewVersion(raw)
+	case Semver:
+		if !semverRegexp.MatchString(raw) {
+			return nil, fmt.Errorf("%q is not a semantic version", raw)
+		}
+		return version.NewVersion(raw)
+	case CalVer:
+		match := calverRegexp.FindStringSubmatch(raw)
+		if match == nil {
+			return nil, fmt.Errorf("%q is not a calendar version", raw)
+		}
+		parts := calverSeparatorRegexp.Split(match[1], -1)
+		return version.NewVersion(strings.Join(parts, ".") + match[2])
+	default:
+		return nil, fmt.Errorf("unsupported version scheme %q", s)
+	}
+}
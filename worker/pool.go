@@ -0,0 +1,232 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	requestTimeout = 5 * time.Minute
+)
+
+// Pool is a fixed-size pool of worker processes.
+type Pool struct {
+	command string
+	args    []string
+
+	dir      string
+	listener *net.UnixListener
+
+	// spawnMu serializes the starting of workers, so that each accepted
+	// connection can be associated with the process that was just started.
+	spawnMu sync.Mutex
+	idle    chan *conn
+}
+
+type conn struct {
+	cmd  *exec.Cmd
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewPool starts the given number of worker processes by running the given
+// command with the given arguments, followed by the path of the socket the
+// worker should connect to.
+//
+// The command should eventually call Main with the socket path argument.
+func NewPool(size int, command string, args ...string) (*Pool, error) {
+	dir, err := ioutil.TempDir("", "terraform-registry-workers")
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "workers.sock"), Net: "unix"}
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	p := &Pool{
+		command:  command,
+		args:     args,
+		dir:      dir,
+		listener: l,
+		idle:     make(chan *conn, size),
+	}
+	for i := 0; i < size; i++ {
+		c, err := p.spawn()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle <- c
+	}
+	return p, nil
+}
+
+// WriteArchive implements modulesv1.Archiver by asking the next available
+// worker to produce the archive. Nothing is written to w unless the worker
+// produced the archive successfully.
+//
+// Workers can only read git repositories, so archives from any other kind
+// of source are produced directly within the calling process.
+func (p *Pool) WriteArchive(src module.Source, v *version.Version, contentId string, w io.Writer) error {
+	mod, ok := src.(*module.Module)
+	if !ok {
+		r, err := src.OpenArchive(v)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	c := <-p.idle
+
+	req := request{
+		GitDir:     mod.GitDir(),
+		Path:       mod.Path(),
+		Version:    v.String(),
+		Exclude:    mod.Exclude(),
+		Submodules: mod.Submodules(),
+		LFSDir:     mod.LFSDir(),
+	}
+	if pattern := mod.TagPattern(); pattern != nil {
+		req.TagPattern = pattern.String()
+	}
+	req.VersionScheme = string(mod.VersionScheme())
+	resp, err := c.roundTrip(req, w)
+	if err != nil {
+		// The worker is in an unknown state, so we'll replace it.
+		logging.Errorf("archive worker (pid %d) failed: %s", c.cmd.Process.Pid, err)
+		c.kill()
+		go p.replace()
+		return fmt.Errorf("archive worker failed: %s", err)
+	}
+
+	p.idle <- c
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Close stops all of the idle workers and removes the pool's socket.
+func (p *Pool) Close() error {
+	for {
+		select {
+		case c := <-p.idle:
+			c.kill()
+		default:
+			err := p.listener.Close()
+			os.RemoveAll(p.dir)
+			return err
+		}
+	}
+}
+
+func (p *Pool) spawn() (*conn, error) {
+	p.spawnMu.Lock()
+	defer p.spawnMu.Unlock()
+
+	args := append(append([]string(nil), p.args...), p.listener.Addr().String())
+	cmd := exec.Command(p.command, args...)
+	// The workers log to stderr, so their lines are passed on to wherever
+	// the server's own log goes.
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = log.Writer()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p.listener.SetDeadline(time.Now().Add(connectTimeout))
+	nc, err := p.listener.Accept()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("worker did not connect: %s", err)
+	}
+
+	return &conn{
+		cmd:  cmd,
+		conn: nc,
+		r:    bufio.NewReader(nc),
+	}, nil
+}
+
+// replace starts a new worker to replace one that failed, retrying until
+// it succeeds.
+func (p *Pool) replace() {
+	for {
+		c, err := p.spawn()
+		if err == nil {
+			p.idle <- c
+			return
+		}
+		logging.Errorf("failed to start archive worker: %s", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *conn) roundTrip(req request, w io.Writer) (*response, error) {
+	c.conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(append(buf, '\n')); err != nil {
+		return nil, err
+	}
+
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, nil
+	}
+
+	// If w fails then we'll still need to consume the rest of the archive
+	// to keep the connection usable.
+	n, err := io.Copy(w, io.LimitReader(c.r, resp.Size))
+	if err != nil {
+		if _, discardErr := io.CopyN(ioutil.Discard, c.r, resp.Size-n); discardErr != nil {
+			return nil, discardErr
+		}
+		resp.Error = err.Error()
+		return &resp, nil
+	}
+	if n != resp.Size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &resp, nil
+}
+
+func (c *conn) kill() {
+	c.conn.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
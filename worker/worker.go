@@ -0,0 +1,149 @@
+// Package worker implements a pool of subprocesses that generate module
+// archives on behalf of a registry server, isolating any crashes or memory
+// growth in libgit2 from the process that is serving HTTP requests.
+//
+// Each worker is a re-execution of the server program that connects to a
+// unix socket created by the server, then processes one request at a time
+// from that connection.
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+
+	version "github.com/hashicorp/go-version"
+
+	"github.com/apparentlymart/terraform-simple-registry/logging"
+	"github.com/apparentlymart/terraform-simple-registry/module"
+	"github.com/apparentlymart/terraform-simple-registry/versionscheme"
+)
+
+// request is sent from the server to a worker as a single line of JSON.
+type request struct {
+	GitDir  string `json:"git_dir"`
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version"`
+
+	// TagPattern is the source of the module's tag pattern, if it has one.
+	TagPattern string `json:"tag_pattern,omitempty"`
+
+	// VersionScheme is the module's version scheme, if it has one.
+	VersionScheme string `json:"version_scheme,omitempty"`
+
+	// Exclude are the module's exclude patterns, if it has any.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Submodules are the module's included submodules, if it has any.
+	Submodules map[string]string `json:"submodules,omitempty"`
+
+	// LFSDir is the module's git-lfs directory, if it has one.
+	LFSDir string `json:"lfs_dir,omitempty"`
+}
+
+// response is sent from a worker to the server as a single line of JSON,
+// followed by Size bytes of archive if Error is empty.
+type response struct {
+	Error string `json:"error,omitempty"`
+	Size  int64  `json:"size"`
+}
+
+// Main is the entry point of a worker process, which expects to be given
+// the path of the socket to connect to as its only argument.
+func Main(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s archive-worker SOCKET-PATH\n\nThis command is used internally and should not be run directly.\n", os.Args[0])
+		return 1
+	}
+
+	conn, err := net.Dial("unix", args[0])
+	if err != nil {
+		logging.Errorf("worker failed to connect to %s: %s", args[0], err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err := serve(conn); err != nil {
+		logging.Errorf("worker failed: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// serve processes requests from the given connection until it is closed.
+func serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	dec := json.NewDecoder(r)
+	for {
+		var req request
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		var resp response
+		if err := writeArchive(req, &buf); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Size = int64(buf.Len())
+		}
+
+		header, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(header, '\n')); err != nil {
+			return err
+		}
+		if resp.Error == "" {
+			if _, err := buf.WriteTo(conn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeArchive(req request, w io.Writer) error {
+	v, err := version.NewVersion(req.Version)
+	if err != nil {
+		return err
+	}
+
+	mod := module.Load(req.GitDir)
+	if mod == nil {
+		return fmt.Errorf("failed to open git repository at %s", req.GitDir)
+	}
+	defer mod.Close()
+
+	mod = mod.InPath(req.Path)
+	if req.TagPattern != "" {
+		pattern, err := regexp.Compile(req.TagPattern)
+		if err != nil {
+			return err
+		}
+		mod = mod.WithTagPattern(pattern)
+	}
+	if req.VersionScheme != "" {
+		mod = mod.WithVersionScheme(versionscheme.Scheme(req.VersionScheme))
+	}
+	if len(req.Exclude) != 0 {
+		mod = mod.WithExclude(req.Exclude)
+	}
+	if len(req.Submodules) != 0 {
+		mod = mod.WithSubmodules(req.Submodules)
+	}
+	if req.LFSDir != "" {
+		mod = mod.WithLFSDir(req.LFSDir)
+	}
+
+	return mod.WriteVersionArchive(v, w)
+}